@@ -0,0 +1,148 @@
+// Package aggregate reduces floods of repetitive events.
+//
+// Deduplicator collapses events with the same key within a window into a
+// single Collapsed record with a count, first and last timestamps and samples
+// of properties which differ between the events:
+//
+//	d, err := aggregate.NewDeduplicator(aggregate.DedupOptions{
+//		Key:      aggregate.GroupBy("provider", "id", "pid", "KeyName"),
+//		Window:   time.Second,
+//		OnRecord: func(c *aggregate.Collapsed) { log.Printf("%s x%d", c.Key, c.Count) },
+//	})
+//	d.Add(record.Schema())
+//
+// Windower computes count, sum, min, max and distinct count of property
+// values over tumbling or sliding windows per key.
+//
+// Time is measured by event timestamps, so results don't depend on the
+// processing speed and replays of saved events give the same results.
+// Windows are closed once events past their end arrive; Advance closes them
+// by the clock if events stop and Flush closes all of them.
+package aggregate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// OtherKey is the key of events exceeding WindowOptions.MaxGroups.
+const OtherKey = "other"
+
+// Default limits.
+const (
+	defaultMaxGroups = 10000
+)
+
+// keySeparator separates parts of keys made by GroupBy.
+const keySeparator = "/"
+
+// KeyFunc returns the key events are grouped by.
+type KeyFunc func(e *schema.Event) string
+
+// GroupBy returns a KeyFunc joining values of @fields. Fields are header
+// fields:
+//   - provider is the provider name or the provider GUID if the name is not
+//     known; provider_id is always the GUID;
+//   - id, version, level, opcode, task, keywords, pid and tid.
+//
+// Other names refer top level properties, missing ones have empty values.
+func GroupBy(fields ...string) KeyFunc {
+	return func(e *schema.Event) string {
+		var b strings.Builder
+		for i, field := range fields {
+			if i != 0 {
+				b.WriteString(keySeparator)
+			}
+			b.WriteString(fieldValue(e, field))
+		}
+		return b.String()
+	}
+}
+
+// fieldValue returns a value of @field formatted for keys.
+func fieldValue(e *schema.Event, field string) string {
+	h := &e.Header
+	switch field {
+	case "provider":
+		if e.ProviderName != "" {
+			return e.ProviderName
+		}
+		return h.ProviderID.String()
+	case "provider_id":
+		return h.ProviderID.String()
+	case "id":
+		return strconv.FormatUint(uint64(h.ID), 10)
+	case "version":
+		return strconv.FormatUint(uint64(h.Version), 10)
+	case "level":
+		return strconv.FormatUint(uint64(h.Level), 10)
+	case "opcode":
+		return strconv.FormatUint(uint64(h.OpCode), 10)
+	case "task":
+		return strconv.FormatUint(uint64(h.Task), 10)
+	case "keywords":
+		return "0x" + strconv.FormatUint(h.Keyword, 16)
+	case "pid":
+		return strconv.FormatUint(uint64(h.ProcessID), 10)
+	case "tid":
+		return strconv.FormatUint(uint64(h.ThreadID), 10)
+	}
+	if v, ok := e.Property(field); ok {
+		return text(v)
+	}
+	return ""
+}
+
+// text formats a property value for comparisons.
+func text(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// number converts a property value to a number. TDH renders most values to
+// strings, so decimal and 0x hexadecimal strings are parsed.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		s := strings.TrimSpace(v)
+		if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+			return float64(u), true
+		}
+		if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return float64(i), true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,246 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestAggregate(t *testing.T) {
+	suite.Run(t, new(aggregateSuite))
+}
+
+type aggregateSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var (
+	registryGUID = schema.GUID{Data1: 0x70EB4F03, Data2: 0xC1DE, Data3: 0x4F73, Data4: [8]byte{0xA0, 0x51, 0x33, 0xD1, 0x3D, 0x54, 0x13, 0xBD}}
+	epoch        = time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+)
+
+func registryEvent(offset time.Duration, pid uint32, props ...schema.Property) *schema.Event {
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{ID: 1, Keyword: 0x8000},
+			ProcessID:  pid,
+			TimeStamp:  epoch.Add(offset),
+			ProviderID: registryGUID,
+		},
+		Properties: props,
+	}
+}
+
+func prop(name string, value interface{}) schema.Property {
+	return schema.Property{Name: name, Value: value}
+}
+
+func (s *aggregateSuite) TestGroupBy() {
+	e := registryEvent(0, 4, prop("KeyName", `\REGISTRY\MACHINE`), prop("Status", uint32(0)))
+	key := GroupBy("provider", "id", "pid", "tid", "keywords", "KeyName", "Status", "Missing")
+	s.Equal(registryGUID.String()+`/1/4/0/0x8000/\REGISTRY\MACHINE/0/`, key(e))
+
+	e.ProviderName = "Microsoft-Windows-Kernel-Registry"
+	s.Equal("Microsoft-Windows-Kernel-Registry/"+registryGUID.String(), GroupBy("provider", "provider_id")(e))
+}
+
+func (s *aggregateSuite) TestDedup() {
+	var records []*Collapsed
+	d, err := NewDeduplicator(DedupOptions{
+		Key:        GroupBy("provider", "id", "pid"),
+		MaxSamples: 2,
+		OnRecord:   func(c *Collapsed) { records = append(records, c) },
+	})
+	s.Require().NoError(err)
+
+	first := registryEvent(100*time.Millisecond, 10, prop("KeyName", "A"), prop("Status", "0"))
+	d.Add(first)
+	d.Add(registryEvent(200*time.Millisecond, 10, prop("KeyName", "B"), prop("Status", "0")))
+	d.Add(registryEvent(0, 10, prop("KeyName", "C"), prop("Status", "0"), prop("Extra", "x")))
+	d.Add(registryEvent(300*time.Millisecond, 10, prop("KeyName", "A")))
+	d.Add(registryEvent(500*time.Millisecond, 20, prop("KeyName", "A")))
+	s.Empty(records)
+
+	d.Add(registryEvent(1200*time.Millisecond, 10, prop("KeyName", "D")))
+	s.Require().Len(records, 1)
+	r := records[0]
+	s.Equal(registryGUID.String()+"/1/10", r.Key)
+	s.Same(first, r.Event)
+	s.Equal(uint64(4), r.Count)
+	s.Equal(epoch, r.First)
+	s.Equal(epoch.Add(300*time.Millisecond), r.Last)
+	s.Equal([]VaryingProperty{
+		{Name: "KeyName", Values: []interface{}{"A", "B"}, Truncated: true},
+		{Name: "Status", Values: []interface{}{"0", nil}},
+		{Name: "Extra", Values: []interface{}{nil, "x"}},
+	}, r.Varying)
+
+	d.Advance(epoch.Add(1600 * time.Millisecond))
+	s.Require().Len(records, 2)
+	s.Equal(registryGUID.String()+"/1/20", records[1].Key)
+	s.Equal(uint64(1), records[1].Count)
+	s.Nil(records[1].Varying)
+
+	d.Flush()
+	s.Require().Len(records, 3)
+	s.Equal(registryGUID.String()+"/1/10", records[2].Key)
+	s.Equal(epoch.Add(1200*time.Millisecond), records[2].First)
+	d.Flush()
+	s.Len(records, 3)
+}
+
+func (s *aggregateSuite) TestDedupMaxGroups() {
+	var records []*Collapsed
+	d, err := NewDeduplicator(DedupOptions{
+		MaxGroups: 1,
+		OnRecord:  func(c *Collapsed) { records = append(records, c) },
+	})
+	s.Require().NoError(err)
+
+	d.Add(registryEvent(0, 10))
+	d.Add(registryEvent(0, 20))
+	d.Add(registryEvent(0, 10))
+	s.Require().Len(records, 1, "Events of new keys are reported as is")
+	s.Equal(uint32(20), records[0].Event.Header.ProcessID)
+
+	d.Flush()
+	s.Require().Len(records, 2)
+	s.Equal(uint64(2), records[1].Count)
+}
+
+func (s *aggregateSuite) TestTumbling() {
+	var results []WindowResult
+	w, err := NewWindower(WindowOptions{
+		Size: 10 * time.Second,
+		Key:  GroupBy("pid"),
+		Aggregations: []Aggregation{
+			{Op: Count},
+			{Op: Sum, Property: "Size"},
+			{Op: Min, Property: "Size"},
+			{Op: Max, Property: "Size"},
+			{Op: DistinctCount, Property: "Path"},
+			{Op: Count, Property: "Path"},
+			{Op: Min, Property: "Path"},
+		},
+		OnResult: func(r WindowResult) { results = append(results, r) },
+	})
+	s.Require().NoError(err)
+
+	w.Add(registryEvent(1*time.Second, 10, prop("Size", "0x10"), prop("Path", "a")))
+	w.Add(registryEvent(5*time.Second, 10, prop("Size", uint32(20)), prop("Path", "b")))
+	w.Add(registryEvent(9*time.Second, 10, prop("Size", "n/a"), prop("Path", "a")))
+	w.Add(registryEvent(2*time.Second, 20, prop("Size", int64(-5))))
+	s.Empty(results)
+
+	w.Add(registryEvent(12*time.Second, 10, prop("Size", 1.5)))
+	s.Require().Len(results, 2)
+	s.Equal(WindowResult{Key: "10", Start: epoch, End: epoch.Add(10 * time.Second), Events: 3}, withoutValues(results[0]))
+	s.Equal([]float64{3, 36, 16, 20, 2, 3}, results[0].Values[:6])
+	s.True(math.IsNaN(results[0].Values[6]), "No numeric values")
+	s.Equal("20", results[1].Key)
+	s.Equal([]float64{1, -5, -5, -5, 0, 0}, results[1].Values[:6])
+
+	w.Add(registryEvent(3*time.Second, 10, prop("Size", 100)))
+	w.Add(registryEvent(3*time.Second, 30, prop("Size", 100)))
+	s.Equal(uint64(2), w.Late(), "Windows are closed for all keys")
+
+	w.Advance(epoch.Add(25 * time.Second))
+	s.Require().Len(results, 3)
+	s.Equal(WindowResult{Key: "10", Start: epoch.Add(10 * time.Second), End: epoch.Add(20 * time.Second), Events: 1}, withoutValues(results[2]))
+	s.Equal(1.5, results[2].Values[1])
+
+	w.Flush()
+	s.Len(results, 3, "No windows with events left")
+}
+
+func (s *aggregateSuite) TestSliding() {
+	var results []WindowResult
+	w, err := NewWindower(WindowOptions{
+		Size:         10 * time.Second,
+		Slide:        5 * time.Second,
+		Aggregations: []Aggregation{{Op: Max, Property: "Size"}, {Op: DistinctCount, Property: "Size"}},
+		OnResult:     func(r WindowResult) { results = append(results, r) },
+	})
+	s.Require().NoError(err)
+
+	w.Add(registryEvent(1*time.Second, 1, prop("Size", 1)))
+	w.Add(registryEvent(6*time.Second, 1, prop("Size", 3)))
+	s.Require().Len(results, 1)
+	s.Equal(WindowResult{Start: epoch.Add(-5 * time.Second), End: epoch.Add(5 * time.Second), Events: 1, Values: []float64{1, 1}}, results[0])
+
+	w.Add(registryEvent(11*time.Second, 1, prop("Size", 2)))
+	w.Add(registryEvent(12*time.Second, 1, prop("Size", 2)))
+	s.Require().Len(results, 2)
+	s.Equal(WindowResult{Start: epoch, End: epoch.Add(10 * time.Second), Events: 2, Values: []float64{3, 2}}, results[1])
+
+	w.Flush()
+	s.Require().Len(results, 4)
+	s.Equal(WindowResult{Start: epoch.Add(5 * time.Second), End: epoch.Add(15 * time.Second), Events: 3, Values: []float64{3, 2}}, results[2])
+	s.Equal(WindowResult{Start: epoch.Add(10 * time.Second), End: epoch.Add(20 * time.Second), Events: 2, Values: []float64{2, 1}}, results[3])
+
+	// Gaps between events produce no empty windows.
+	w.Add(registryEvent(time.Hour, 1, prop("Size", 7)))
+	w.Add(registryEvent(2*time.Hour, 1, prop("Size", 8)))
+	s.Require().Len(results, 6)
+	s.Equal(epoch.Add(time.Hour-5*time.Second), results[4].Start)
+	s.Equal(epoch.Add(time.Hour), results[5].Start)
+}
+
+func (s *aggregateSuite) TestWindowMaxGroups() {
+	var results []WindowResult
+	w, err := NewWindower(WindowOptions{
+		Size:      time.Second,
+		Key:       GroupBy("pid"),
+		MaxGroups: 1,
+		OnResult:  func(r WindowResult) { results = append(results, r) },
+	})
+	s.Require().NoError(err)
+
+	w.Add(registryEvent(0, 10))
+	w.Add(registryEvent(0, 20))
+	w.Add(registryEvent(0, 30))
+	w.Flush()
+	s.Require().Len(results, 2)
+	s.Equal("10", results[0].Key)
+	s.Equal(OtherKey, results[1].Key)
+	s.Equal(uint64(2), results[1].Events)
+}
+
+func (s *aggregateSuite) TestOptions() {
+	noop := func(WindowResult) {}
+	for _, options := range []WindowOptions{
+		{Size: time.Second},
+		{Size: 0, OnResult: noop},
+		{Size: time.Second, Slide: 300 * time.Millisecond, OnResult: noop},
+		{Size: time.Second, Slide: 2 * time.Second, OnResult: noop},
+		{Size: time.Second, Aggregations: []Aggregation{{Op: Sum}}, OnResult: noop},
+		{Size: time.Second, Aggregations: []Aggregation{{Op: Op(42), Property: "X"}}, OnResult: noop},
+		{Size: time.Second, MaxGroups: -1, OnResult: noop},
+	} {
+		_, err := NewWindower(options)
+		s.Error(err, "%+v", options)
+	}
+
+	_, err := NewDeduplicator(DedupOptions{})
+	s.Error(err)
+	_, err = NewDeduplicator(DedupOptions{Window: -time.Second, OnRecord: func(*Collapsed) {}})
+	s.Error(err)
+
+	d, err := NewDeduplicator(DedupOptions{OnRecord: func(*Collapsed) {}})
+	s.Require().NoError(err)
+	s.Equal(defaultDedupWindow, d.options.Window)
+	s.Equal(defaultMaxSamples, d.options.MaxSamples)
+	s.Equal(defaultMaxGroups, d.options.MaxGroups)
+
+	s.Equal("distinct_count", DistinctCount.String())
+}
+
+func withoutValues(r WindowResult) WindowResult {
+	r.Values = nil
+	return r
+}
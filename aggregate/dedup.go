@@ -0,0 +1,270 @@
+package aggregate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Default DedupOptions.
+const (
+	defaultDedupWindow = time.Second
+	defaultMaxSamples  = 5
+)
+
+// DedupOptions configure Deduplicator. Zero values stand for defaults.
+type DedupOptions struct {
+	// Key tells which events are the same. Defaults to
+	// GroupBy("provider_id", "id", "pid").
+	Key KeyFunc
+
+	// Window is the time events are collapsed for since the first event of
+	// the key. Defaults to 1s.
+	Window time.Duration
+
+	// MaxSamples is the number of distinct values kept for every varying
+	// property. Defaults to 5.
+	MaxSamples int
+
+	// MaxGroups is the number of keys collapsed at once. Events of new keys
+	// are reported as is once the limit is reached. Defaults to 10000.
+	MaxGroups int
+
+	// OnRecord receives collapsed events. It's called synchronously from
+	// Add, Advance and Flush.
+	OnRecord func(c *Collapsed)
+}
+
+// Collapsed is a group of events with the same key.
+type Collapsed struct {
+	Key string
+
+	// Event is the first event of the group.
+	Event *schema.Event
+
+	Count uint64
+	First time.Time
+	Last  time.Time
+
+	// Varying are properties which values differ between events in the
+	// order of their appearance.
+	Varying []VaryingProperty
+}
+
+// VaryingProperty holds samples of property values.
+type VaryingProperty struct {
+	Name string
+
+	// Values are distinct values in the order of appearance, nil stands for
+	// events without the property.
+	Values []interface{}
+
+	// Truncated is set if there were more than MaxSamples distinct values.
+	Truncated bool
+}
+
+// Deduplicator collapses events with the same key within a window. It's safe
+// for concurrent use.
+type Deduplicator struct {
+	mu sync.Mutex
+
+	options DedupOptions
+	groups  map[string]*dedupGroup
+	order   []*dedupGroup // By the first event, as windows close in this order.
+	latest  time.Time
+}
+
+// dedupGroup is an open window of a key.
+type dedupGroup struct {
+	record *Collapsed
+	names  []string // Properties in the order of appearance.
+	fields map[string]*dedupField
+}
+
+// dedupField tracks distinct values of a property.
+type dedupField struct {
+	values  []interface{}
+	texts   map[string]bool
+	missing bool
+	more    bool
+}
+
+// NewDeduplicator creates a Deduplicator by @options.
+func NewDeduplicator(options DedupOptions) (*Deduplicator, error) {
+	if options.OnRecord == nil {
+		return nil, fmt.Errorf("record callback is not set")
+	}
+	if options.Window < 0 {
+		return nil, fmt.Errorf("invalid Window %v", options.Window)
+	}
+	if options.MaxSamples < 0 {
+		return nil, fmt.Errorf("invalid MaxSamples %d", options.MaxSamples)
+	}
+	if options.MaxGroups < 0 {
+		return nil, fmt.Errorf("invalid MaxGroups %d", options.MaxGroups)
+	}
+	if options.Key == nil {
+		options.Key = GroupBy("provider_id", "id", "pid")
+	}
+	if options.Window == 0 {
+		options.Window = defaultDedupWindow
+	}
+	if options.MaxSamples == 0 {
+		options.MaxSamples = defaultMaxSamples
+	}
+	if options.MaxGroups == 0 {
+		options.MaxGroups = defaultMaxGroups
+	}
+	return &Deduplicator{
+		options: options,
+		groups:  make(map[string]*dedupGroup),
+	}, nil
+}
+
+// Add collapses @e into the group of its key. @e should not be modified
+// afterwards as the first event of a group is reported as is.
+func (d *Deduplicator) Add(e *schema.Event) {
+	key := d.options.Key(e)
+	ts := e.Header.TimeStamp
+
+	d.mu.Lock()
+	if ts.After(d.latest) {
+		d.latest = ts
+	}
+	records := d.expire(d.latest)
+
+	g, ok := d.groups[key]
+	switch {
+	case ok:
+		g.add(e, d.options.MaxSamples)
+	case len(d.groups) >= d.options.MaxGroups:
+		records = append(records, &Collapsed{Key: key, Event: e, Count: 1, First: ts, Last: ts})
+	default:
+		g = &dedupGroup{
+			record: &Collapsed{Key: key, Event: e, Count: 1, First: ts, Last: ts},
+			fields: make(map[string]*dedupField, len(e.Properties)),
+		}
+		for _, p := range e.Properties {
+			g.names = append(g.names, p.Name)
+			g.fields[p.Name] = &dedupField{values: []interface{}{p.Value}, texts: map[string]bool{text(p.Value): true}}
+		}
+		d.groups[key] = g
+		d.order = append(d.order, g)
+	}
+	d.mu.Unlock()
+
+	d.report(records)
+}
+
+// Advance closes windows ended by @now, e.g. by the clock if events stop.
+func (d *Deduplicator) Advance(now time.Time) {
+	d.mu.Lock()
+	if now.After(d.latest) {
+		d.latest = now
+	}
+	records := d.expire(d.latest)
+	d.mu.Unlock()
+
+	d.report(records)
+}
+
+// Flush closes all windows.
+func (d *Deduplicator) Flush() {
+	d.mu.Lock()
+	records := make([]*Collapsed, 0, len(d.order))
+	for _, g := range d.order {
+		records = append(records, g.close())
+	}
+	d.groups = make(map[string]*dedupGroup)
+	d.order = nil
+	d.mu.Unlock()
+
+	d.report(records)
+}
+
+// expire closes windows ended by @now. Should be called with mu held.
+func (d *Deduplicator) expire(now time.Time) []*Collapsed {
+	var records []*Collapsed
+	n := 0
+	for _, g := range d.order {
+		if now.Sub(g.record.First) < d.options.Window {
+			break
+		}
+		records = append(records, g.close())
+		delete(d.groups, g.record.Key)
+		n++
+	}
+	d.order = d.order[n:]
+	return records
+}
+
+func (d *Deduplicator) report(records []*Collapsed) {
+	for _, r := range records {
+		d.options.OnRecord(r)
+	}
+}
+
+// add counts @e and samples its properties.
+func (g *dedupGroup) add(e *schema.Event, maxSamples int) {
+	r := g.record
+	r.Count++
+	if ts := e.Header.TimeStamp; ts.Before(r.First) {
+		r.First = ts
+	} else if ts.After(r.Last) {
+		r.Last = ts
+	}
+
+	seen := make(map[string]bool, len(e.Properties))
+	for _, p := range e.Properties {
+		seen[p.Name] = true
+		f, ok := g.fields[p.Name]
+		if !ok {
+			// Earlier events had no such property.
+			g.names = append(g.names, p.Name)
+			f = &dedupField{texts: make(map[string]bool), missing: true, values: []interface{}{nil}}
+			g.fields[p.Name] = f
+		}
+		f.sample(p.Value, maxSamples)
+	}
+	for name, f := range g.fields {
+		if !seen[name] && !f.missing {
+			f.missing = true
+			f.sample(nil, maxSamples)
+		}
+	}
+}
+
+// sample adds @v to the values if it's new. nil stands for a missing value
+// and is added by the caller once. Values are not tracked past maxSamples to
+// keep the memory bounded.
+func (f *dedupField) sample(v interface{}, maxSamples int) {
+	if f.more {
+		return
+	}
+	if v != nil {
+		t := text(v)
+		if f.texts[t] {
+			return
+		}
+		f.texts[t] = true
+	}
+	if len(f.values) >= maxSamples {
+		f.more = true
+		return
+	}
+	f.values = append(f.values, v)
+}
+
+// close returns the record with varying properties filled.
+func (g *dedupGroup) close() *Collapsed {
+	r := g.record
+	for _, name := range g.names {
+		f := g.fields[name]
+		if len(f.values) > 1 || f.more {
+			r.Varying = append(r.Varying, VaryingProperty{Name: name, Values: f.values, Truncated: f.more})
+		}
+	}
+	return r
+}
@@ -0,0 +1,434 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Op is an aggregation of property values.
+type Op int
+
+// Aggregations.
+const (
+	// Count counts events with the property or all events if the property
+	// is not set.
+	Count Op = iota
+	// Sum, Min and Max aggregate numeric values. Values which are not
+	// numbers are skipped.
+	Sum
+	Min
+	Max
+	// DistinctCount counts distinct values.
+	DistinctCount
+)
+
+func (op Op) String() string {
+	switch op {
+	case Count:
+		return "count"
+	case Sum:
+		return "sum"
+	case Min:
+		return "min"
+	case Max:
+		return "max"
+	case DistinctCount:
+		return "distinct_count"
+	default:
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+}
+
+// Aggregation computes @Op over values of the top level property @Property.
+type Aggregation struct {
+	Op       Op
+	Property string
+}
+
+// WindowOptions configure Windower.
+type WindowOptions struct {
+	// Size is the length of windows.
+	Size time.Duration
+
+	// Slide is the period windows start with. Windows are tumbling if it's
+	// zero or equal to Size and sliding (overlapping) if it's less. Size
+	// should be a multiple of Slide.
+	Slide time.Duration
+
+	// Key splits events into groups aggregated independently. All events
+	// share a single group if nil.
+	Key KeyFunc
+
+	// Aggregations are computed for every window.
+	Aggregations []Aggregation
+
+	// MaxGroups is the number of keys aggregated at once. Events of new keys
+	// are aggregated under OtherKey once the limit is reached. Defaults to
+	// 10000.
+	MaxGroups int
+
+	// OnResult receives results of windows with events. It's called
+	// synchronously from Add, Advance and Flush.
+	OnResult func(WindowResult)
+}
+
+// WindowResult holds aggregations of a window of a key.
+type WindowResult struct {
+	Key   string
+	Start time.Time
+	End   time.Time
+
+	// Events is the number of events in the window.
+	Events uint64
+
+	// Values are results of WindowOptions.Aggregations in the same order.
+	// Min and Max are NaN if there were no numeric values.
+	Values []float64
+}
+
+// Windower aggregates events over tumbling or sliding windows. It's safe for
+// concurrent use.
+//
+// Windows are aligned to multiples of Slide. Every event is added to a pane
+// of Slide length and windows are combined from Size/Slide panes once event
+// timestamps pass their end. Events which are late for all their windows are
+// dropped and counted by Late.
+type Windower struct {
+	mu sync.Mutex
+
+	options WindowOptions
+	panes   int64 // Panes per window.
+	groups  map[string]*windowGroup
+	latest  int64 // Pane of the latest timestamp.
+	late    uint64
+}
+
+// windowGroup is the state of a key: panes by index and the first window
+// not reported yet.
+type windowGroup struct {
+	panes map[int64]*pane
+	next  int64
+}
+
+// pane holds aggregations of a Slide long part of windows.
+type pane struct {
+	events uint64
+	acc    []accumulator
+}
+
+// accumulator is a partial result of an aggregation.
+type accumulator struct {
+	count    uint64
+	numbers  uint64
+	sum      float64
+	min      float64
+	max      float64
+	distinct map[string]bool
+}
+
+// NewWindower creates a Windower by @options.
+func NewWindower(options WindowOptions) (*Windower, error) {
+	if options.OnResult == nil {
+		return nil, fmt.Errorf("result callback is not set")
+	}
+	if options.Size <= 0 {
+		return nil, fmt.Errorf("invalid Size %v", options.Size)
+	}
+	if options.Slide == 0 {
+		options.Slide = options.Size
+	}
+	if options.Slide < 0 || options.Slide > options.Size || options.Size%options.Slide != 0 {
+		return nil, fmt.Errorf("invalid Slide %v of Size %v", options.Slide, options.Size)
+	}
+	for i, a := range options.Aggregations {
+		switch {
+		case a.Op < Count || a.Op > DistinctCount:
+			return nil, fmt.Errorf("aggregation %d: unknown %v", i, a.Op)
+		case a.Op != Count && a.Property == "":
+			return nil, fmt.Errorf("aggregation %d: %v requires a property", i, a.Op)
+		}
+	}
+	if options.MaxGroups < 0 {
+		return nil, fmt.Errorf("invalid MaxGroups %d", options.MaxGroups)
+	}
+	if options.Key == nil {
+		options.Key = func(*schema.Event) string { return "" }
+	}
+	if options.MaxGroups == 0 {
+		options.MaxGroups = defaultMaxGroups
+	}
+	options.Aggregations = append([]Aggregation(nil), options.Aggregations...)
+	return &Windower{
+		options: options,
+		panes:   int64(options.Size / options.Slide),
+		groups:  make(map[string]*windowGroup),
+		latest:  math.MinInt64,
+	}, nil
+}
+
+// Add aggregates @e into windows of its key.
+func (w *Windower) Add(e *schema.Event) {
+	key := w.options.Key(e)
+	index := w.paneIndex(e.Header.TimeStamp)
+
+	w.mu.Lock()
+	var results []WindowResult
+	if index > w.latest {
+		// Windows end on pane boundaries, so they could close only here.
+		w.latest = index
+		results = w.closeWindows(w.latest)
+	}
+
+	if index+w.panes <= w.latest {
+		// All windows including the pane are closed.
+		w.late++
+	} else {
+		w.addToGroup(key, index, e)
+	}
+	w.mu.Unlock()
+
+	w.report(results)
+}
+
+// addToGroup adds @e to the pane @index of the @key group. Should be called
+// with mu held.
+func (w *Windower) addToGroup(key string, index int64, e *schema.Event) {
+	g, ok := w.groups[key]
+	if !ok {
+		if len(w.groups) >= w.options.MaxGroups {
+			key = OtherKey
+			g = w.groups[key]
+		}
+		if g == nil {
+			// The first window including the pane unless it's closed.
+			next := index - w.panes + 1
+			if closed := w.latest - w.panes + 1; next < closed {
+				next = closed
+			}
+			g = &windowGroup{panes: make(map[int64]*pane), next: next}
+			w.groups[key] = g
+		}
+	}
+	if index < g.next {
+		// Windows of the group were flushed.
+		w.late++
+		return
+	}
+	p, ok := g.panes[index]
+	if !ok {
+		p = &pane{acc: make([]accumulator, len(w.options.Aggregations))}
+		g.panes[index] = p
+	}
+	p.add(e, w.options.Aggregations)
+}
+
+// Advance closes windows ended by @now, e.g. by the clock if events stop.
+func (w *Windower) Advance(now time.Time) {
+	index := w.paneIndex(now)
+
+	w.mu.Lock()
+	var results []WindowResult
+	if index > w.latest {
+		w.latest = index
+		results = w.closeWindows(w.latest)
+	}
+	w.mu.Unlock()
+
+	w.report(results)
+}
+
+// Flush closes all windows with events.
+func (w *Windower) Flush() {
+	w.mu.Lock()
+	results := w.closeWindows(math.MaxInt64)
+	w.mu.Unlock()
+
+	w.report(results)
+}
+
+// Late returns the number of events dropped as their windows were closed.
+func (w *Windower) Late() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.late
+}
+
+// paneIndex returns the index of the pane @t belongs to.
+func (w *Windower) paneIndex(t time.Time) int64 {
+	ns, slide := t.UnixNano(), int64(w.options.Slide)
+	index := ns / slide
+	if ns%slide < 0 {
+		index--
+	}
+	return index
+}
+
+// closeWindows reports windows ending at or before the start of the pane
+// @current and forgets keys without events. Should be called with mu held.
+func (w *Windower) closeWindows(current int64) []WindowResult {
+	var results []WindowResult
+	for key, g := range w.groups {
+		results = append(results, w.closeGroup(key, g, current)...)
+		if len(g.panes) == 0 {
+			delete(w.groups, key)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].End.Equal(results[j].End) {
+			return results[i].End.Before(results[j].End)
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results
+}
+
+// closeGroup reports windows of the key ending before the pane @current.
+func (w *Windower) closeGroup(key string, g *windowGroup, current int64) []WindowResult {
+	indexes := make([]int64, 0, len(g.panes))
+	for index := range g.panes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var results []WindowResult
+	for len(indexes) != 0 {
+		// Skip windows without panes.
+		if first := indexes[0] - w.panes + 1; g.next < first {
+			g.next = first
+		}
+		end := g.next + w.panes
+		if current != math.MaxInt64 && end > current {
+			break
+		}
+
+		var panes []*pane
+		for _, index := range indexes {
+			if index >= end {
+				break
+			}
+			panes = append(panes, g.panes[index])
+		}
+		results = append(results, w.result(key, g.next, panes))
+
+		g.next++
+		if indexes[0] < g.next {
+			delete(g.panes, indexes[0])
+			indexes = indexes[1:]
+		}
+	}
+	return results
+}
+
+// result combines @panes of the window starting at the pane @start.
+func (w *Windower) result(key string, start int64, panes []*pane) WindowResult {
+	slide := int64(w.options.Slide)
+	r := WindowResult{
+		Key:    key,
+		Start:  time.Unix(0, start*slide).UTC(),
+		End:    time.Unix(0, (start+w.panes)*slide).UTC(),
+		Values: make([]float64, len(w.options.Aggregations)),
+	}
+	for _, p := range panes {
+		r.Events += p.events
+	}
+	for i, a := range w.options.Aggregations {
+		var total accumulator
+		for _, p := range panes {
+			total.merge(&p.acc[i])
+		}
+		r.Values[i] = total.value(a.Op)
+	}
+	return r
+}
+
+func (w *Windower) report(results []WindowResult) {
+	for _, r := range results {
+		w.options.OnResult(r)
+	}
+}
+
+// add aggregates @e into the pane.
+func (p *pane) add(e *schema.Event, aggregations []Aggregation) {
+	p.events++
+	for i, a := range aggregations {
+		acc := &p.acc[i]
+		if a.Property == "" {
+			acc.count++
+			continue
+		}
+		v, ok := e.Property(a.Property)
+		if !ok {
+			continue
+		}
+		acc.count++
+		switch a.Op {
+		case Sum, Min, Max:
+			if x, ok := number(v); ok {
+				acc.addNumber(x)
+			}
+		case DistinctCount:
+			if acc.distinct == nil {
+				acc.distinct = make(map[string]bool)
+			}
+			acc.distinct[text(v)] = true
+		}
+	}
+}
+
+func (a *accumulator) addNumber(x float64) {
+	if a.numbers == 0 || x < a.min {
+		a.min = x
+	}
+	if a.numbers == 0 || x > a.max {
+		a.max = x
+	}
+	a.numbers++
+	a.sum += x
+}
+
+// merge adds a partial result of the same aggregation.
+func (a *accumulator) merge(b *accumulator) {
+	a.count += b.count
+	if b.numbers != 0 {
+		if a.numbers == 0 || b.min < a.min {
+			a.min = b.min
+		}
+		if a.numbers == 0 || b.max > a.max {
+			a.max = b.max
+		}
+		a.numbers += b.numbers
+		a.sum += b.sum
+	}
+	if len(b.distinct) != 0 && a.distinct == nil {
+		a.distinct = make(map[string]bool, len(b.distinct))
+	}
+	for v := range b.distinct {
+		a.distinct[v] = true
+	}
+}
+
+func (a *accumulator) value(op Op) float64 {
+	switch op {
+	case Sum:
+		return a.sum
+	case Min:
+		if a.numbers == 0 {
+			return math.NaN()
+		}
+		return a.min
+	case Max:
+		if a.numbers == 0 {
+			return math.NaN()
+		}
+		return a.max
+	case DistinctCount:
+		return float64(len(a.distinct))
+	default:
+		return float64(a.count)
+	}
+}
@@ -0,0 +1,148 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// CollisionPolicy defines what Trace.Open does if a session with the same
+// name is already running, e.g. left by a crashed process.
+type CollisionPolicy int
+
+const (
+	// CollisionFail returns ExistsError. It's the default policy.
+	CollisionFail CollisionPolicy = iota
+
+	// CollisionKill stops the existing session and starts a new one. Check
+	// Trace.Kill for the caveats.
+	CollisionKill
+
+	// CollisionAttach consumes events of the existing session without
+	// controlling it: providers are not enabled and Trace.Stop leaves the
+	// session running.
+	CollisionAttach
+
+	// CollisionRename starts a session with a suffixed name: "name-1",
+	// "name-2" and so on. Check Trace.Name for the name taken.
+	CollisionRename
+)
+
+// defaultCollisionAttempts limits CollisionKill and CollisionRename attempts
+// if CollisionOptions.MaxAttempts is not set.
+const defaultCollisionAttempts = 3
+
+func (p CollisionPolicy) String() string {
+	switch p {
+	case CollisionFail:
+		return "fail"
+	case CollisionKill:
+		return "kill"
+	case CollisionAttach:
+		return "attach"
+	case CollisionRename:
+		return "rename"
+	default:
+		return fmt.Sprintf("CollisionPolicy(%d)", int(p))
+	}
+}
+
+// CollisionOptions tells how to handle session name collisions.
+type CollisionOptions struct {
+	Policy CollisionPolicy
+
+	// MaxAttempts limits how many times CollisionKill or CollisionRename is
+	// applied before giving up with ExistsError. Defaults to 3.
+	MaxAttempts int
+
+	// OnDecision is an optional hook called on every collision with the
+	// action taken.
+	OnDecision func(CollisionDecision)
+}
+
+// CollisionDecision describes the action taken on a session name collision.
+type CollisionDecision struct {
+	// Name is the name of the existing session.
+	Name string
+
+	// Attempt is the 1-based number of the collision during a single Open.
+	Attempt int
+
+	// Action is the policy applied or CollisionFail if attempts are over.
+	Action CollisionPolicy
+
+	// NewName is the name to try next for CollisionRename.
+	NewName string
+
+	// Err is an error of stopping the existing session for CollisionKill.
+	Err error
+}
+
+// Validate checks the policy is known and the limit is not negative.
+func (o CollisionOptions) Validate() error {
+	if o.Policy < CollisionFail || o.Policy > CollisionRename {
+		return fmt.Errorf("unknown collision policy %s", o.Policy)
+	}
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts can't be negative; got %d", o.MaxAttempts)
+	}
+	return nil
+}
+
+// startSession calls @start with the session @name applying the policy on
+// collisions. It returns the name of the started session and whether the
+// existing session should be attached to instead. @kill stops a session by
+// name for CollisionKill.
+func (o CollisionOptions) startSession(
+	name string,
+	start func(name string) error,
+	kill func(name string) error,
+) (string, bool, error) {
+	maxAttempts := o.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultCollisionAttempts
+	}
+
+	current := name
+	for attempt := 1; ; attempt++ {
+		err := start(current)
+		var exists ExistsError
+		if !errors.As(err, &exists) {
+			return current, false, err
+		}
+
+		d := CollisionDecision{Name: current, Attempt: attempt, Action: o.Policy}
+		if attempt > maxAttempts && (o.Policy == CollisionKill || o.Policy == CollisionRename) {
+			d.Action = CollisionFail
+		}
+		switch d.Action {
+		case CollisionKill:
+			// The session could be stopped by someone else meanwhile.
+			if killErr := kill(current); killErr != nil && killErr != windows.ERROR_WMI_INSTANCE_NOT_FOUND {
+				d.Err = killErr
+			}
+		case CollisionRename:
+			d.NewName = fmt.Sprintf("%s-%d", name, attempt)
+		}
+		if o.OnDecision != nil {
+			o.OnDecision(d)
+		}
+
+		switch d.Action {
+		case CollisionKill:
+			if d.Err != nil {
+				return current, false, fmt.Errorf("failed to stop existing session %q; %w", current, d.Err)
+			}
+		case CollisionRename:
+			current = d.NewName
+		case CollisionAttach:
+			return current, true, nil
+		default:
+			return current, false, err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestCollision(t *testing.T) {
+	suite.Run(t, new(collisionSuite))
+}
+
+type collisionSuite struct {
+	suite.Suite
+
+	running   map[string]bool // Sessions taken by someone else.
+	started   []string
+	killed    []string
+	killErr   error
+	decisions []CollisionDecision
+}
+
+func (s *collisionSuite) SetupTest() {
+	s.running = map[string]bool{"go-etw": true}
+	s.started, s.killed, s.killErr, s.decisions = nil, nil, nil, nil
+}
+
+func (s *collisionSuite) start(name string) error {
+	if s.running[name] {
+		return ExistsError{}
+	}
+	s.started = append(s.started, name)
+	return nil
+}
+
+func (s *collisionSuite) kill(name string) error {
+	s.killed = append(s.killed, name)
+	if s.killErr != nil {
+		return s.killErr
+	}
+	delete(s.running, name)
+	return nil
+}
+
+func (s *collisionSuite) startSession(options CollisionOptions) (string, bool, error) {
+	options.OnDecision = func(d CollisionDecision) {
+		s.decisions = append(s.decisions, d)
+	}
+	return options.startSession("go-etw", s.start, s.kill)
+}
+
+// TestFail ensures ExistsError is returned by default.
+func (s *collisionSuite) TestFail() {
+	_, _, err := s.startSession(CollisionOptions{})
+	s.True(errors.As(err, new(ExistsError)))
+	s.Equal([]CollisionDecision{{Name: "go-etw", Attempt: 1, Action: CollisionFail}}, s.decisions)
+
+	// No collision, no decisions.
+	s.SetupTest()
+	delete(s.running, "go-etw")
+	name, attached, err := s.startSession(CollisionOptions{})
+	s.Require().NoError(err)
+	s.Equal("go-etw", name)
+	s.False(attached)
+	s.Empty(s.decisions)
+}
+
+// TestKill ensures the existing session is stopped and a failing stop is
+// reported.
+func (s *collisionSuite) TestKill() {
+	name, attached, err := s.startSession(CollisionOptions{Policy: CollisionKill})
+	s.Require().NoError(err)
+	s.Equal("go-etw", name)
+	s.False(attached)
+	s.Equal([]string{"go-etw"}, s.killed)
+	s.Equal([]string{"go-etw"}, s.started)
+
+	// Session vanished meanwhile, but it's still there on retry.
+	s.SetupTest()
+	s.killErr = windows.ERROR_WMI_INSTANCE_NOT_FOUND
+	_, _, err = s.startSession(CollisionOptions{Policy: CollisionKill, MaxAttempts: 2})
+	s.True(errors.As(err, new(ExistsError)))
+	s.Len(s.killed, 2)
+	s.Require().Len(s.decisions, 3)
+	s.NoError(s.decisions[0].Err)
+	s.Equal(CollisionFail, s.decisions[2].Action)
+
+	s.SetupTest()
+	s.killErr = windows.ERROR_ACCESS_DENIED
+	_, _, err = s.startSession(CollisionOptions{Policy: CollisionKill})
+	s.True(errors.Is(err, windows.ERROR_ACCESS_DENIED))
+	s.Require().Len(s.decisions, 1)
+	s.Equal(windows.ERROR_ACCESS_DENIED, s.decisions[0].Err)
+}
+
+// TestAttach ensures the existing session is reused.
+func (s *collisionSuite) TestAttach() {
+	name, attached, err := s.startSession(CollisionOptions{Policy: CollisionAttach})
+	s.Require().NoError(err)
+	s.Equal("go-etw", name)
+	s.True(attached)
+	s.Empty(s.started)
+	s.Empty(s.killed)
+}
+
+// TestRename ensures names are suffixed until a free one is found.
+func (s *collisionSuite) TestRename() {
+	s.running["go-etw-1"] = true
+	name, attached, err := s.startSession(CollisionOptions{Policy: CollisionRename})
+	s.Require().NoError(err)
+	s.Equal("go-etw-2", name)
+	s.False(attached)
+	s.Equal([]CollisionDecision{
+		{Name: "go-etw", Attempt: 1, Action: CollisionRename, NewName: "go-etw-1"},
+		{Name: "go-etw-1", Attempt: 2, Action: CollisionRename, NewName: "go-etw-2"},
+	}, s.decisions)
+
+	_, _, err = s.startSession(CollisionOptions{Policy: CollisionRename, MaxAttempts: 1})
+	s.True(errors.As(err, new(ExistsError)), "Attempts are bounded")
+}
@@ -0,0 +1,275 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default DispatcherOptions.
+const defaultDispatcherQueueSize = 1024
+
+// PartitionKey maps an event to a partition. Events with the same key are
+// handled by the same worker in the order they are received.
+type PartitionKey func(header *EventHeader) uint64
+
+// ByProcessID keeps the order of events of every process.
+func ByProcessID(header *EventHeader) uint64 {
+	return uint64(header.ProcessID)
+}
+
+// ByThreadID keeps the order of events of every thread.
+func ByThreadID(header *EventHeader) uint64 {
+	return uint64(header.ThreadID)
+}
+
+// ByProviderID keeps the order of events of every provider.
+func ByProviderID(header *EventHeader) uint64 {
+	var buf [16]byte
+	binary.LittleEndian.PutUint32(buf[0:], header.ProviderID.Data1)
+	binary.LittleEndian.PutUint16(buf[4:], header.ProviderID.Data2)
+	binary.LittleEndian.PutUint16(buf[6:], header.ProviderID.Data3)
+	copy(buf[8:], header.ProviderID.Data4[:])
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// DispatcherOptions configure Dispatcher. Zero values stand for defaults.
+type DispatcherOptions struct {
+	// Workers is a number of worker goroutines. Defaults to the number of
+	// CPUs.
+	Workers int
+
+	// QueueSize is a capacity of every worker queue. Defaults to 1024.
+	QueueSize int
+
+	// Key partitions events between workers. Defaults to ByThreadID.
+	Key PartitionKey
+
+	// DropOnFull drops events if the worker queue is full instead of
+	// blocking the trace. Blocked trace makes the OS buffer events and lose
+	// them once session buffers are full, so dropping is only about who
+	// loses events. Dropped events are counted in WorkerStats.
+	DropOnFull bool
+
+	// Panics tells how to handle panics in the handler. With PanicStop the
+	// rest of events is dropped and Stop returns PanicError; the trace is
+	// not stopped, do it from OnPanic if needed.
+	Panics PanicOptions
+}
+
+// WorkerStats are counters of a single Dispatcher worker.
+type WorkerStats struct {
+	Enqueued  uint64
+	Processed uint64
+	Dropped   uint64
+
+	// Panics is a number of panics recovered from the handler.
+	Panics uint64
+
+	// Queued is a number of events waiting in the queue.
+	Queued int
+
+	// Busy is the total time spent in the handler.
+	Busy time.Duration
+}
+
+// ErrDispatcherStopped is returned by Dispatcher.Stop if called twice.
+//
+//nolint:gochecknoglobals
+var ErrDispatcherStopped = errors.New("dispatcher is stopped")
+
+// Dispatcher processes events concurrently. Events are copied to Records and
+// handed to a pool of workers, so a slow handler doesn't block ProcessTrace
+// as long as queues are not full.
+//
+// Use Dispatcher.Handle as an EventCallback and call Dispatcher.Stop after
+// Trace.Stop to process queued events.
+type Dispatcher struct {
+	// mu guards queues from being closed while events are sent.
+	mu      sync.RWMutex
+	stopped bool
+
+	options DispatcherOptions
+	handler func(*Record)
+	workers []*dispatcherWorker
+	wg      sync.WaitGroup
+	panics  panicState
+}
+
+type dispatcherWorker struct {
+	// Stats of the worker updated atomically. 64-bit atomics need 8-byte
+	// alignment on 32-bit platforms, which only the first fields get.
+	enqueued  uint64
+	processed uint64
+	dropped   uint64
+	panics    uint64
+	busy      int64
+
+	queue chan *Record
+}
+
+// NewDispatcher starts workers calling @handler for every event. @handler is
+// called concurrently from different workers, but sequentially for events of
+// the same partition.
+func NewDispatcher(options DispatcherOptions, handler func(*Record)) *Dispatcher {
+	if options.Workers <= 0 {
+		options.Workers = runtime.NumCPU()
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultDispatcherQueueSize
+	}
+	if options.Key == nil {
+		options.Key = ByThreadID
+	}
+
+	d := &Dispatcher{
+		options: options,
+		handler: handler,
+		workers: make([]*dispatcherWorker, options.Workers),
+	}
+	d.wg.Add(len(d.workers))
+	for i := range d.workers {
+		w := &dispatcherWorker{queue: make(chan *Record, options.QueueSize)}
+		d.workers[i] = w
+		go d.run(w)
+	}
+	return d
+}
+
+// Handle copies the event and queues it to the worker of its partition.
+func (d *Dispatcher) Handle(e *Event) {
+	// Properties errors are not fatal, deliver what we have.
+	record, _ := e.Record()
+	if record != nil {
+		d.push(record)
+	}
+}
+
+// Stop stops accepting events and waits until queued ones are processed or
+// @ctx is done. Events handled after Stop are dropped. If the handler was
+// stopped by PanicStop, Stop returns PanicError.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return ErrDispatcherStopped
+	}
+	d.stopped = true
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return d.panics.error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns counters of every worker.
+func (d *Dispatcher) Stats() []WorkerStats {
+	stats := make([]WorkerStats, len(d.workers))
+	for i, w := range d.workers {
+		stats[i] = WorkerStats{
+			Enqueued:  atomic.LoadUint64(&w.enqueued),
+			Processed: atomic.LoadUint64(&w.processed),
+			Dropped:   atomic.LoadUint64(&w.dropped),
+			Panics:    atomic.LoadUint64(&w.panics),
+			Queued:    len(w.queue),
+			Busy:      time.Duration(atomic.LoadInt64(&w.busy)),
+		}
+	}
+	return stats
+}
+
+func (d *Dispatcher) push(record *Record) {
+	w := d.workers[d.partition(&record.Header)]
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.stopped || atomic.LoadInt32(&d.panics.stopped) != 0 {
+		atomic.AddUint64(&w.dropped, 1)
+		return
+	}
+	if !d.options.DropOnFull {
+		w.queue <- record
+		atomic.AddUint64(&w.enqueued, 1)
+		return
+	}
+	select {
+	case w.queue <- record:
+		atomic.AddUint64(&w.enqueued, 1)
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// partition returns an index of the worker for @header. Keys are mixed as
+// they are often aligned, e.g. process IDs are multiples of 4.
+func (d *Dispatcher) partition(header *EventHeader) int {
+	key := d.options.Key(header) * 0x9E3779B97F4A7C15 // 2^64 / golden ratio
+	return int((key >> 32) % uint64(len(d.workers)))
+}
+
+func (d *Dispatcher) run(w *dispatcherWorker) {
+	defer d.wg.Done()
+
+	for record := range w.queue {
+		if atomic.LoadInt32(&d.panics.stopped) != 0 {
+			atomic.AddUint64(&w.dropped, 1)
+			continue
+		}
+		start := time.Now()
+		d.handle(w, record)
+		atomic.AddInt64(&w.busy, int64(time.Since(start)))
+		atomic.AddUint64(&w.processed, 1)
+	}
+}
+
+// handle passes @record to the handler recovering from panics.
+func (d *Dispatcher) handle(w *dispatcherWorker, record *Record) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&w.panics, 1)
+			d.handlePanic(&PanicError{Value: r, Header: record.Header, Stack: debug.Stack()})
+		}
+	}()
+	d.handler(record)
+}
+
+// handlePanic reports @err and applies the panic policy.
+func (d *Dispatcher) handlePanic(err *PanicError) {
+	options := d.options.Panics
+	options.report(err)
+
+	switch options.Policy {
+	case PanicContinue:
+		return
+	case PanicStop:
+		if atomic.CompareAndSwapInt32(&d.panics.stopped, 0, 1) {
+			d.panics.err.Store(err)
+		}
+	default:
+		panic(err)
+	}
+}
@@ -0,0 +1,159 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDispatcher(t *testing.T) {
+	suite.Run(t, new(dispatcherSuite))
+}
+
+type dispatcherSuite struct {
+	suite.Suite
+}
+
+func dispatcherRecord(tid uint32, seq uint16) *Record {
+	return &Record{Header: EventHeader{
+		EventDescriptor: EventDescriptor{ID: seq},
+		ThreadID:        tid,
+	}}
+}
+
+// TestOrdering ensures events of the same key are handled in order while all
+// the events are processed before Stop returns.
+func (s *dispatcherSuite) TestOrdering() {
+	const threads, perThread = 16, 100
+
+	var mu sync.Mutex
+	got := make(map[uint32][]uint16)
+	d := NewDispatcher(DispatcherOptions{Workers: 4, QueueSize: 8}, func(r *Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[r.Header.ThreadID] = append(got[r.Header.ThreadID], r.Header.ID)
+	})
+
+	for seq := uint16(0); seq < perThread; seq++ {
+		for tid := uint32(0); tid < threads; tid++ {
+			d.push(dispatcherRecord(tid*4, seq))
+		}
+	}
+	s.Require().NoError(d.Stop(context.Background()))
+
+	s.Len(got, threads)
+	for tid, seqs := range got {
+		s.Require().Len(seqs, perThread, "Thread %d", tid)
+		for i, seq := range seqs {
+			s.Equal(uint16(i), seq, "Thread %d", tid)
+		}
+	}
+
+	var processed uint64
+	busyWorkers := 0
+	for _, stats := range d.Stats() {
+		processed += stats.Processed
+		s.Equal(stats.Enqueued, stats.Processed)
+		if stats.Processed > 0 {
+			busyWorkers++
+		}
+	}
+	s.Equal(uint64(threads*perThread), processed)
+	s.Greater(busyWorkers, 1, "Aligned keys should be spread between workers")
+
+	s.Equal(ErrDispatcherStopped, d.Stop(context.Background()))
+}
+
+// TestDropOnFull ensures events are dropped if the queue is full and after
+// Stop.
+func (s *dispatcherSuite) TestDropOnFull() {
+	release := make(chan struct{})
+	d := NewDispatcher(DispatcherOptions{Workers: 1, QueueSize: 1, DropOnFull: true}, func(r *Record) {
+		<-release
+	})
+
+	// The first event is taken by the worker, the second waits in the queue.
+	d.push(dispatcherRecord(1, 0))
+	s.Eventually(func() bool { return d.Stats()[0].Queued == 0 }, time.Second, time.Millisecond)
+	d.push(dispatcherRecord(1, 1))
+	d.push(dispatcherRecord(1, 2))
+
+	stats := d.Stats()[0]
+	s.Equal(uint64(2), stats.Enqueued)
+	s.Equal(uint64(1), stats.Dropped)
+	s.Equal(1, stats.Queued)
+
+	// Stop is bounded by the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, d.Stop(ctx))
+
+	d.push(dispatcherRecord(1, 3))
+	s.Equal(uint64(2), d.Stats()[0].Dropped)
+	close(release)
+}
+
+// TestPanics ensures handler panics are recovered, counted and handled by
+// the panic policy.
+func (s *dispatcherSuite) TestPanics() {
+	var mu sync.Mutex
+	var reported []*PanicError
+	handler := func(r *Record) {
+		if r.Header.ID%2 == 0 {
+			panic("boom")
+		}
+	}
+	options := DispatcherOptions{Workers: 1, Panics: PanicOptions{
+		Policy: PanicContinue,
+		OnPanic: func(err *PanicError) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, err)
+		},
+	}}
+
+	d := NewDispatcher(options, handler)
+	for seq := uint16(0); seq < 4; seq++ {
+		d.push(dispatcherRecord(1, seq))
+	}
+	s.Require().NoError(d.Stop(context.Background()))
+	s.Equal(uint64(4), d.Stats()[0].Processed)
+	s.Equal(uint64(2), d.Stats()[0].Panics)
+	s.Require().Len(reported, 2)
+	s.Equal(uint16(2), reported[1].Header.ID)
+	s.NotEmpty(reported[1].Stack)
+
+	// The rest of events is dropped after PanicStop.
+	reported = nil
+	options.Panics.Policy = PanicStop
+	d = NewDispatcher(options, handler)
+	for seq := uint16(0); seq < 4; seq++ {
+		d.push(dispatcherRecord(1, seq))
+	}
+	err := d.Stop(context.Background())
+	var panicErr *PanicError
+	s.Require().True(errors.As(err, &panicErr), "Unexpected error %v", err)
+	s.Equal(uint16(0), panicErr.Header.ID)
+	stats := d.Stats()[0]
+	s.Equal(uint64(1), stats.Processed)
+	s.Equal(uint64(1), stats.Panics)
+	s.Equal(uint64(3), stats.Dropped)
+	s.Len(reported, 1)
+}
+
+// TestKeys ensures built-in keys differ for different events.
+func (s *dispatcherSuite) TestKeys() {
+	a := EventHeader{ProcessID: 1, ThreadID: 2, ProviderID: testProviderA}
+	b := EventHeader{ProcessID: 3, ThreadID: 4, ProviderID: testProviderB}
+	for _, key := range []PartitionKey{ByProcessID, ByThreadID, ByProviderID} {
+		s.NotEqual(key(&a), key(&b))
+		s.Equal(key(&a), key(&a))
+	}
+}
@@ -0,0 +1,504 @@
+// Package eventxml renders events as Windows Event Log XML, the schema Event
+// Viewer exports and `wevtutil qe` prints, and parses it back:
+//
+//	<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+//	  <System>
+//	    <Provider Name="Microsoft-Windows-Kernel-Process" Guid="{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}"></Provider>
+//	    <EventID>1</EventID>
+//	    <Version>3</Version>
+//	    <Level>4</Level>
+//	    <Task>1</Task>
+//	    <Opcode>1</Opcode>
+//	    <Keywords>0x8000000000000010</Keywords>
+//	    <TimeCreated SystemTime="2021-03-04T05:06:07.1234567Z"></TimeCreated>
+//	    <Correlation ActivityID="{...}"></Correlation>
+//	    <Execution ProcessID="4" ThreadID="8" SessionID="1"></Execution>
+//	    <Channel>16</Channel>
+//	    <Computer>host</Computer>
+//	    <Security UserID="S-1-5-18"></Security>
+//	  </System>
+//	  <EventData>
+//	    <Data Name="ProcessID">1234</Data>
+//	  </EventData>
+//	</Event>
+//
+// Flat properties go to EventData with array items as repeated Data elements
+// of the same name, so single item arrays are parsed back as scalars. If any
+// property is a structure, all of them go to UserData as nested elements
+// instead. Characters not allowed in element names are replaced by '_'.
+//
+// ETW doesn't know channel names, so Channel holds the channel number. XML
+// has no place for header flags, instance info and stack traces, so they are
+// lost in the round-trip. So are rundown marks unless Options.Rundown is set.
+// Parsed property values are always strings.
+package eventxml
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Namespace is the namespace of the event schema.
+const Namespace = "http://schemas.microsoft.com/win/2004/08/events/event"
+
+// userDataElement is the name of the UserData wrapper element used for
+// events without a provider specific one.
+const userDataElement = "EventXML"
+
+// timeLayout is how Windows formats SystemTime.
+const timeLayout = "2006-01-02T15:04:05.0000000Z"
+
+// Options configure rendering.
+type Options struct {
+	// Computer is the value of System/Computer. ETW events don't have it.
+	Computer string
+
+	// Indent renders every element on its own line indented by two spaces.
+	Indent bool
+
+	// Rundown marks rundown events with Rundown="true" and
+	// DuringCaptureState="true" attributes of Execution. They are not a part
+	// of the event schema, so consumers validating against it reject them.
+	Rundown bool
+}
+
+type xmlEvent struct {
+	XMLName   xml.Name      `xml:"http://schemas.microsoft.com/win/2004/08/events/event Event"`
+	System    xmlSystem     `xml:"System"`
+	EventData *xmlEventData `xml:"EventData"`
+	UserData  *xmlUserData  `xml:"UserData"`
+}
+
+type xmlSystem struct {
+	Provider    xmlProvider     `xml:"Provider"`
+	EventID     uint16          `xml:"EventID"`
+	Version     uint8           `xml:"Version"`
+	Level       uint8           `xml:"Level"`
+	Task        uint16          `xml:"Task"`
+	Opcode      uint8           `xml:"Opcode"`
+	Keywords    string          `xml:"Keywords"`
+	TimeCreated xmlTimeCreated  `xml:"TimeCreated"`
+	Correlation *xmlCorrelation `xml:"Correlation"`
+	Execution   xmlExecution    `xml:"Execution"`
+	Channel     string          `xml:"Channel"`
+	Computer    string          `xml:"Computer"`
+	Security    *xmlSecurity    `xml:"Security"`
+}
+
+type xmlProvider struct {
+	Name string `xml:"Name,attr,omitempty"`
+	GUID string `xml:"Guid,attr,omitempty"`
+}
+
+type xmlTimeCreated struct {
+	SystemTime string `xml:"SystemTime,attr"`
+}
+
+type xmlCorrelation struct {
+	ActivityID        string `xml:"ActivityID,attr,omitempty"`
+	RelatedActivityID string `xml:"RelatedActivityID,attr,omitempty"`
+}
+
+type xmlExecution struct {
+	ProcessID     uint32 `xml:"ProcessID,attr"`
+	ThreadID      uint32 `xml:"ThreadID,attr"`
+	SessionID     string `xml:"SessionID,attr,omitempty"`
+	KernelTime    uint32 `xml:"KernelTime,attr,omitempty"`
+	UserTime      uint32 `xml:"UserTime,attr,omitempty"`
+	ProcessorTime uint64 `xml:"ProcessorTime,attr,omitempty"`
+
+	Rundown            bool `xml:"Rundown,attr,omitempty"`
+	DuringCaptureState bool `xml:"DuringCaptureState,attr,omitempty"`
+}
+
+type xmlSecurity struct {
+	UserID string `xml:"UserID,attr,omitempty"`
+}
+
+type xmlEventData struct {
+	Data []xmlData `xml:"Data"`
+}
+
+type xmlData struct {
+	Name  string `xml:"Name,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// xmlUserData holds properties as nested elements of a wrapper element.
+type xmlUserData struct {
+	Properties []schema.Property
+}
+
+// Marshal renders @e as an Event element.
+func Marshal(e *schema.Event, options Options) ([]byte, error) {
+	x := xmlEvent{System: system(e, options)}
+	if structured(e.Properties) {
+		x.UserData = &xmlUserData{Properties: e.Properties}
+	} else if len(e.Properties) != 0 {
+		x.EventData = eventData(e.Properties)
+	}
+
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	if options.Indent {
+		enc.Indent("", "  ")
+	}
+	if err := enc.Encode(x); err != nil {
+		return nil, fmt.Errorf("failed to render event; %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func system(e *schema.Event, options Options) xmlSystem {
+	h := &e.Header
+	s := xmlSystem{
+		Provider: xmlProvider{Name: e.ProviderName},
+		EventID:  h.ID,
+		Version:  h.Version,
+		Level:    h.Level,
+		Task:     h.Task,
+		Opcode:   h.OpCode,
+		Keywords: fmt.Sprintf("0x%X", h.Keyword),
+		TimeCreated: xmlTimeCreated{
+			SystemTime: h.TimeStamp.UTC().Format(timeLayout),
+		},
+		Execution: xmlExecution{
+			ProcessID:     h.ProcessID,
+			ThreadID:      h.ThreadID,
+			KernelTime:    h.KernelTime,
+			UserTime:      h.UserTime,
+			ProcessorTime: h.ProcessorTime,
+		},
+		Computer: options.Computer,
+	}
+	if options.Rundown {
+		s.Execution.Rundown = h.Rundown
+		s.Execution.DuringCaptureState = h.DuringCaptureState
+	}
+	if !h.ProviderID.IsZero() {
+		s.Provider.GUID = h.ProviderID.String()
+	}
+	if h.Channel != 0 {
+		s.Channel = strconv.Itoa(int(h.Channel))
+	}
+
+	x := &e.Extended
+	if !h.ActivityID.IsZero() || x.ActivityID != nil {
+		s.Correlation = &xmlCorrelation{}
+		if !h.ActivityID.IsZero() {
+			s.Correlation.ActivityID = h.ActivityID.String()
+		}
+		if x.ActivityID != nil {
+			s.Correlation.RelatedActivityID = x.ActivityID.String()
+		}
+	}
+	if x.SessionID != nil {
+		s.Execution.SessionID = strconv.FormatUint(uint64(*x.SessionID), 10)
+	}
+	if x.UserSID != "" {
+		s.Security = &xmlSecurity{UserID: x.UserSID}
+	}
+	return s
+}
+
+// structured tells if any property is a structure, so UserData is needed.
+func structured(properties []schema.Property) bool {
+	for _, p := range properties {
+		if isStructure(p.Value) {
+			return true
+		}
+		if items, ok := p.Value.([]interface{}); ok {
+			for _, item := range items {
+				if isStructure(item) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func isStructure(v interface{}) bool {
+	switch v.(type) {
+	case []schema.Property, map[string]interface{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func eventData(properties []schema.Property) *xmlEventData {
+	data := &xmlEventData{}
+	for _, p := range properties {
+		switch v := p.Value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				data.Data = append(data.Data, xmlData{Name: p.Name, Value: valueString(item)})
+			}
+		case []string:
+			for _, item := range v {
+				data.Data = append(data.Data, xmlData{Name: p.Name, Value: item})
+			}
+		default:
+			data.Data = append(data.Data, xmlData{Name: p.Name, Value: valueString(v)})
+		}
+	}
+	return data
+}
+
+// valueString formats a scalar value the way Event Viewer shows it.
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(timeLayout)
+	case []byte:
+		return strings.ToUpper(hex.EncodeToString(v))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// MarshalXML implements xml.Marshaler.
+func (u *xmlUserData) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	wrapper := xml.StartElement{Name: xml.Name{Local: userDataElement}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(wrapper); err != nil {
+		return err
+	}
+	for _, p := range u.Properties {
+		if err := encodeElement(enc, p.Name, p.Value); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(wrapper.End()); err != nil {
+		return err
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// encodeElement writes @value as an element @name. Arrays are written as
+// repeated elements, structures as nested ones.
+func encodeElement(enc *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: elementName(name)}}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if err := encodeElement(enc, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []string:
+		for _, item := range v {
+			if err := encodeElement(enc, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []schema.Property:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, p := range v {
+			if err := encodeElement(enc, p.Name, p.Value); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]schema.Property, len(keys))
+		for i, k := range keys {
+			fields[i] = schema.Property{Name: k, Value: v[k]}
+		}
+		return encodeElement(enc, name, fields)
+	default:
+		return enc.EncodeElement(valueString(v), start)
+	}
+}
+
+// elementName makes a valid XML name of a property @name: other characters
+// than letters, digits, '_', '-' and '.' are replaced by '_', and names not
+// starting with a letter are prefixed by '_'. Colons are replaced too, as they
+// separate namespaces.
+func elementName(name string) string {
+	runes := []rune(name)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			runes[i] = '_'
+		}
+	}
+	if len(runes) == 0 || !unicode.IsLetter(runes[0]) && runes[0] != '_' {
+		return "_" + string(runes)
+	}
+	return string(runes)
+}
+
+// Unmarshal parses an Event element rendered by Marshal, Event Viewer or
+// wevtutil.
+func Unmarshal(data []byte) (*schema.Event, error) {
+	var x xmlEvent
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("failed to parse event; %w", err)
+	}
+
+	e := &schema.Event{ProviderName: x.System.Provider.Name}
+	if err := parseSystem(&x.System, e); err != nil {
+		return nil, err
+	}
+	switch {
+	case x.UserData != nil:
+		e.Properties = x.UserData.Properties
+	case x.EventData != nil:
+		e.Properties = parseEventData(x.EventData)
+	}
+	return e, nil
+}
+
+func parseSystem(s *xmlSystem, e *schema.Event) error {
+	h := &e.Header
+	var err error
+	if s.Provider.GUID != "" {
+		if h.ProviderID, err = schema.ParseGUID(s.Provider.GUID); err != nil {
+			return err
+		}
+	}
+	h.ID, h.Version, h.Level, h.Task, h.OpCode = s.EventID, s.Version, s.Level, s.Task, s.Opcode
+	if s.Keywords != "" {
+		if h.Keyword, err = strconv.ParseUint(strings.TrimPrefix(s.Keywords, "0x"), 16, 64); err != nil {
+			return fmt.Errorf("invalid Keywords %q", s.Keywords)
+		}
+	}
+	if s.TimeCreated.SystemTime != "" {
+		if h.TimeStamp, err = time.Parse(time.RFC3339Nano, s.TimeCreated.SystemTime); err != nil {
+			return fmt.Errorf("invalid SystemTime %q", s.TimeCreated.SystemTime)
+		}
+	}
+	// Channel names can't be mapped back to numbers.
+	if channel, err := strconv.ParseUint(s.Channel, 10, 8); err == nil {
+		h.Channel = uint8(channel)
+	}
+
+	if c := s.Correlation; c != nil {
+		if c.ActivityID != "" {
+			if h.ActivityID, err = schema.ParseGUID(c.ActivityID); err != nil {
+				return err
+			}
+		}
+		if c.RelatedActivityID != "" {
+			id, err := schema.ParseGUID(c.RelatedActivityID)
+			if err != nil {
+				return err
+			}
+			e.Extended.ActivityID = &id
+		}
+	}
+
+	x := &s.Execution
+	h.ProcessID, h.ThreadID = x.ProcessID, x.ThreadID
+	h.KernelTime, h.UserTime, h.ProcessorTime = x.KernelTime, x.UserTime, x.ProcessorTime
+	h.Rundown, h.DuringCaptureState = x.Rundown, x.DuringCaptureState
+	if x.SessionID != "" {
+		session, err := strconv.ParseUint(x.SessionID, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid SessionID %q", x.SessionID)
+		}
+		id := uint32(session)
+		e.Extended.SessionID = &id
+	}
+	if s.Security != nil {
+		e.Extended.UserSID = s.Security.UserID
+	}
+	return nil
+}
+
+// parseEventData merges repeated Data elements into arrays. Unnamed ones, as
+// classic event log events have, are named Param1, Param2... by position.
+func parseEventData(data *xmlEventData) []schema.Property {
+	var properties []schema.Property
+	for i, d := range data.Data {
+		name := d.Name
+		if name == "" {
+			name = fmt.Sprintf("Param%d", i+1)
+		}
+		properties = appendValue(properties, name, d.Value)
+	}
+	return properties
+}
+
+// appendValue appends a property or turns the last one into an array if it
+// has the same @name.
+func appendValue(properties []schema.Property, name string, value interface{}) []schema.Property {
+	if n := len(properties); n != 0 && properties[n-1].Name == name {
+		last := &properties[n-1]
+		if items, ok := last.Value.([]interface{}); ok {
+			last.Value = append(items, value)
+		} else {
+			last.Value = []interface{}{last.Value, value}
+		}
+		return properties
+	}
+	return append(properties, schema.Property{Name: name, Value: value})
+}
+
+// UnmarshalXML implements xml.Unmarshaler. Properties are children of the
+// first element in UserData whatever its name is.
+func (u *xmlUserData) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	value, err := decodeElement(dec)
+	if err != nil {
+		return err
+	}
+	if fields, ok := value.([]schema.Property); ok && len(fields) != 0 {
+		if wrapper, ok := fields[0].Value.([]schema.Property); ok {
+			u.Properties = wrapper
+		}
+	}
+	return nil
+}
+
+// decodeElement reads the element content up to its end. Elements with
+// children become []schema.Property, others their text.
+func decodeElement(dec *xml.Decoder) (interface{}, error) {
+	var text strings.Builder
+	var fields []schema.Property
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			value, err := decodeElement(dec)
+			if err != nil {
+				return nil, err
+			}
+			fields = appendValue(fields, t.Name.Local, value)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if fields != nil {
+				return fields, nil
+			}
+			return text.String(), nil
+		}
+	}
+}
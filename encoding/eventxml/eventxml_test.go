@@ -0,0 +1,272 @@
+package eventxml
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestEventXML(t *testing.T) {
+	suite.Run(t, new(eventXMLSuite))
+}
+
+type eventXMLSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var (
+	testProvider = schema.GUID{
+		Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+		Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+	}
+	testActivity = schema.GUID{Data1: 1, Data2: 2, Data3: 3, Data4: [8]byte{4, 5, 6, 7, 8, 9, 10, 11}}
+)
+
+func testEvent() *schema.Event {
+	session := uint32(1)
+	related := testProvider
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{
+				ID: 1, Version: 3, Channel: 16, Level: 4, OpCode: 1, Task: 1,
+				Keyword: 0x8000000000000010,
+			},
+			ThreadID:   8,
+			ProcessID:  4,
+			TimeStamp:  time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC),
+			ProviderID: testProvider,
+			ActivityID: testActivity,
+			KernelTime: 10,
+			UserTime:   20,
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+		Properties: []schema.Property{
+			{Name: "ProcessID", Value: uint32(1234)},
+			{Name: "Args", Value: []interface{}{"-v", 2}},
+			{Name: "Data", Value: []byte{0xde, 0xad}},
+		},
+		Extended: schema.Extended{
+			SessionID:  &session,
+			ActivityID: &related,
+			UserSID:    "S-1-5-18",
+		},
+	}
+}
+
+// TestRender ensures the exact System and EventData layout.
+func (s *eventXMLSuite) TestRender() {
+	data, err := Marshal(testEvent(), Options{Computer: "host"})
+	s.Require().NoError(err)
+	s.Equal(`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event"><System>`+
+		`<Provider Name="Microsoft-Windows-Kernel-Process" Guid="{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}"></Provider>`+
+		`<EventID>1</EventID><Version>3</Version><Level>4</Level><Task>1</Task><Opcode>1</Opcode>`+
+		`<Keywords>0x8000000000000010</Keywords>`+
+		`<TimeCreated SystemTime="2021-03-04T05:06:07.1234567Z"></TimeCreated>`+
+		`<Correlation ActivityID="{00000001-0002-0003-0405-060708090A0B}" RelatedActivityID="{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}"></Correlation>`+
+		`<Execution ProcessID="4" ThreadID="8" SessionID="1" KernelTime="10" UserTime="20"></Execution>`+
+		`<Channel>16</Channel><Computer>host</Computer><Security UserID="S-1-5-18"></Security>`+
+		`</System><EventData>`+
+		`<Data Name="ProcessID">1234</Data>`+
+		`<Data Name="Args">-v</Data><Data Name="Args">2</Data>`+
+		`<Data Name="Data">DEAD</Data>`+
+		`</EventData></Event>`, string(data))
+}
+
+// TestRoundTrip ensures parsed events match rendered ones but for the value
+// types.
+func (s *eventXMLSuite) TestRoundTrip() {
+	for _, indent := range []bool{false, true} {
+		e := testEvent()
+		data, err := Marshal(e, Options{Indent: indent})
+		s.Require().NoError(err)
+
+		parsed, err := Unmarshal(data)
+		s.Require().NoError(err)
+		expected := *e
+		expected.Properties = []schema.Property{
+			{Name: "ProcessID", Value: "1234"},
+			{Name: "Args", Value: []interface{}{"-v", "2"}},
+			{Name: "Data", Value: "DEAD"},
+		}
+		s.Equal(&expected, parsed, fmt.Sprintf("indent: %v", indent))
+	}
+}
+
+// TestEscaping ensures markup and characters XML can't have are escaped and
+// parsed back.
+func (s *eventXMLSuite) TestEscaping() {
+	for _, c := range []struct {
+		name       string
+		properties []schema.Property
+		rendered   string
+		parsed     []schema.Property
+	}{{
+		name:       "Markup in values",
+		properties: []schema.Property{{Name: "Path", Value: `C:\a&b <c> "d" 'e'`}},
+		rendered:   `<Data Name="Path">C:\a&amp;b &lt;c&gt; &#34;d&#34; &#39;e&#39;</Data>`,
+	}, {
+		name:       "Markup in names",
+		properties: []schema.Property{{Name: `a"<&>`, Value: "1"}},
+		rendered:   `<Data Name="a&#34;&lt;&amp;&gt;">1</Data>`,
+	}, {
+		name:       "Whitespace",
+		properties: []schema.Property{{Name: "Text", Value: "a\r\nb\tc"}},
+		rendered:   `<Data Name="Text">a&#xD;&#xA;b&#x9;c</Data>`,
+	}, {
+		name:       "Invalid characters",
+		properties: []schema.Property{{Name: "Text", Value: "a\x01b\uFFFE"}},
+		rendered:   "<Data Name=\"Text\">a\uFFFDb\uFFFD</Data>",
+		parsed:     []schema.Property{{Name: "Text", Value: "a\uFFFDb\uFFFD"}},
+	}, {
+		name: "Markup in structures",
+		properties: []schema.Property{
+			{Name: "Point", Value: []schema.Property{{Name: "X", Value: "<&>"}, {Name: "Y", Value: "]]>"}}},
+		},
+		rendered: `<Point><X>&lt;&amp;&gt;</X><Y>]]&gt;</Y></Point>`,
+	}, {
+		name: "Element names",
+		properties: []schema.Property{
+			{Name: "Process ID", Value: []schema.Property{{Name: "1st", Value: "a"}, {Name: "ns:b", Value: "b"}, {Name: "", Value: "c"}}},
+		},
+		rendered: `<Process_ID><_1st>a</_1st><ns_b>b</ns_b><_>c</_></Process_ID>`,
+		parsed: []schema.Property{
+			{Name: "Process_ID", Value: []schema.Property{{Name: "_1st", Value: "a"}, {Name: "ns_b", Value: "b"}, {Name: "_", Value: "c"}}},
+		},
+	}} {
+		data, err := Marshal(&schema.Event{Properties: c.properties}, Options{})
+		s.Require().NoError(err, c.name)
+		s.Contains(string(data), c.rendered, c.name)
+
+		parsed, err := Unmarshal(data)
+		s.Require().NoError(err, c.name)
+		expected := c.parsed
+		if expected == nil {
+			expected = c.properties
+		}
+		s.Equal(expected, parsed.Properties, c.name)
+	}
+}
+
+// TestRundown ensures rundown marks are written only on request, so the
+// default output stays valid against the event schema.
+func (s *eventXMLSuite) TestRundown() {
+	e := testEvent()
+	e.Header.Rundown, e.Header.DuringCaptureState = true, true
+	data, err := Marshal(e, Options{})
+	s.Require().NoError(err)
+	s.NotContains(string(data), "Rundown")
+
+	data, err = Marshal(e, Options{Rundown: true})
+	s.Require().NoError(err)
+	s.Contains(string(data), `<Execution ProcessID="4" ThreadID="8" SessionID="1" KernelTime="10" UserTime="20" Rundown="true" DuringCaptureState="true">`)
+
+	parsed, err := Unmarshal(data)
+	s.Require().NoError(err)
+	s.True(parsed.Header.Rundown)
+	s.True(parsed.Header.DuringCaptureState)
+}
+
+// TestUserData ensures structures are rendered as nested elements and parsed
+// back.
+func (s *eventXMLSuite) TestUserData() {
+	e := testEvent()
+	e.Properties = []schema.Property{
+		{Name: "Name", Value: "svc"},
+		{Name: "Point", Value: []schema.Property{{Name: "Y", Value: 1}, {Name: "X", Value: 2}}},
+		{Name: "Items", Value: []interface{}{
+			map[string]interface{}{"b": 2, "a": 1},
+			map[string]interface{}{"b": 4, "a": 3},
+		}},
+	}
+	data, err := Marshal(e, Options{})
+	s.Require().NoError(err)
+	s.Contains(string(data), `<UserData><EventXML><Name>svc</Name><Point><Y>1</Y><X>2</X></Point>`+
+		`<Items><a>1</a><b>2</b></Items><Items><a>3</a><b>4</b></Items></EventXML></UserData>`)
+	s.NotContains(string(data), "EventData")
+
+	for _, indent := range []bool{false, true} {
+		data, err := Marshal(e, Options{Indent: indent})
+		s.Require().NoError(err)
+		parsed, err := Unmarshal(data)
+		s.Require().NoError(err)
+		s.Equal([]schema.Property{
+			{Name: "Name", Value: "svc"},
+			{Name: "Point", Value: []schema.Property{{Name: "Y", Value: "1"}, {Name: "X", Value: "2"}}},
+			{Name: "Items", Value: []interface{}{
+				[]schema.Property{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+				[]schema.Property{{Name: "a", Value: "3"}, {Name: "b", Value: "4"}},
+			}},
+		}, parsed.Properties, fmt.Sprintf("indent: %v", indent))
+	}
+}
+
+// TestParseWevtutil ensures events exported by Windows are parsed: channel
+// names, unnamed data and unknown elements are tolerated.
+func (s *eventXMLSuite) TestParseWevtutil() {
+	data := `<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'>
+  <System>
+    <Provider Name='Service Control Manager' Guid='{555908d1-a6d7-4695-8e1e-26931d2012f4}' EventSourceName='Service Control Manager'/>
+    <EventID Qualifiers='16384'>7036</EventID>
+    <Version>0</Version>
+    <Level>4</Level>
+    <Task>0</Task>
+    <Opcode>0</Opcode>
+    <Keywords>0x8080000000000000</Keywords>
+    <TimeCreated SystemTime='2021-03-04T05:06:07.123456700Z'/>
+    <EventRecordID>1234</EventRecordID>
+    <Correlation/>
+    <Execution ProcessID='700' ThreadID='9000'/>
+    <Channel>System</Channel>
+    <Computer>host</Computer>
+    <Security/>
+  </System>
+  <EventData>
+    <Data Name='param1'>Windows Update</Data>
+    <Data Name='param2'>running</Data>
+    <Binary>770075006100750073006500720076002F0034000000</Binary>
+  </EventData>
+</Event>`
+	e, err := Unmarshal([]byte(data))
+	s.Require().NoError(err)
+	s.Equal("Service Control Manager", e.ProviderName)
+	s.Equal("{555908D1-A6D7-4695-8E1E-26931D2012F4}", e.Header.ProviderID.String())
+	s.Equal(uint16(7036), e.Header.ID)
+	s.Equal(uint64(0x8080000000000000), e.Header.Keyword)
+	s.Equal(time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC), e.Header.TimeStamp)
+	s.Equal(uint8(0), e.Header.Channel)
+	s.Equal(uint32(700), e.Header.ProcessID)
+	s.Equal(uint32(9000), e.Header.ThreadID)
+	s.True(e.Header.ActivityID.IsZero())
+	s.Nil(e.Extended.SessionID)
+	s.Empty(e.Extended.UserSID)
+	s.Equal([]schema.Property{
+		{Name: "param1", Value: "Windows Update"},
+		{Name: "param2", Value: "running"},
+	}, e.Properties)
+
+	e, err = Unmarshal([]byte(strings.Replace(data, " Name='param1'", "", 1)))
+	s.Require().NoError(err)
+	s.Equal("Param1", e.Properties[0].Name)
+}
+
+// TestParseErrors ensures malformed events are rejected.
+func (s *eventXMLSuite) TestParseErrors() {
+	for _, data := range []string{
+		``,
+		`<Event>`,
+		`<Event xmlns="urn:other"><System/></Event>`,
+		`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event"><System><Keywords>zz</Keywords></System></Event>`,
+		`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event"><System><Provider Guid="{1}"/></System></Event>`,
+		`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event"><System><TimeCreated SystemTime="now"/></System></Event>`,
+		`<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event"><System><Execution SessionID="-1"/></System></Event>`,
+	} {
+		_, err := Unmarshal([]byte(data))
+		s.Error(err, data)
+	}
+}
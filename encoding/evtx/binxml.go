@@ -0,0 +1,660 @@
+package evtx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Binary XML tokens. Tokens with tokenHasMoreData set are followed by more
+// data: attributes of an element or more attributes of the list.
+const (
+	tokenEndOfStream          = 0x00
+	tokenOpenStartElement     = 0x01
+	tokenCloseStartElement    = 0x02
+	tokenCloseEmptyElement    = 0x03
+	tokenEndElement           = 0x04
+	tokenValue                = 0x05
+	tokenAttribute            = 0x06
+	tokenCDataSection         = 0x07
+	tokenCharRef              = 0x08
+	tokenEntityRef            = 0x09
+	tokenPITarget             = 0x0a
+	tokenPIData               = 0x0b
+	tokenTemplateInstance     = 0x0c
+	tokenNormalSubstitution   = 0x0d
+	tokenOptionalSubstitution = 0x0e
+	tokenFragmentHeader       = 0x0f
+
+	tokenHasMoreData = 0x40
+)
+
+// Value types of substitutions.
+const (
+	typeNull       = 0x00
+	typeString     = 0x01
+	typeAnsiString = 0x02
+	typeInt8       = 0x03
+	typeUInt8      = 0x04
+	typeInt16      = 0x05
+	typeUInt16     = 0x06
+	typeInt32      = 0x07
+	typeUInt32     = 0x08
+	typeInt64      = 0x09
+	typeUInt64     = 0x0a
+	typeReal32     = 0x0b
+	typeReal64     = 0x0c
+	typeBool       = 0x0d
+	typeBinary     = 0x0e
+	typeGUID       = 0x0f
+	typeSizeT      = 0x10
+	typeFileTime   = 0x11
+	typeSystemTime = 0x12
+	typeSID        = 0x13
+	typeHexInt32   = 0x14
+	typeHexInt64   = 0x15
+	typeBinXML     = 0x21
+	typeArray      = 0x80
+)
+
+// maxNesting limits nesting of templates and binary XML values, so crafted
+// files can't exhaust the stack. Windows nests them a few levels deep.
+const maxNesting = 32
+
+// errNesting is returned for templates instantiating themselves and binary
+// XML nested deeper than maxNesting.
+//
+//nolint:gochecknoglobals
+var errNesting = errors.New("binary XML is nested too deep")
+
+// templateHeaderSize is the size of a template definition before its
+// fragment: next template offset, GUID and data size.
+const templateHeaderSize = 24
+
+// node is an item of element content: *element, fragment of nested binary
+// XML, substitution in template definitions or a value.
+type node interface{}
+
+// fragment is a sequence of nodes parsed from binary XML.
+type fragment []node
+
+type element struct {
+	name     string
+	attrs    []attribute
+	children []node
+}
+
+type attribute struct {
+	name  string
+	value []node
+}
+
+// substitution is a placeholder of a template instance value. Normal and
+// optional substitutions are not distinguished: null values are dropped.
+type substitution struct {
+	index uint16
+}
+
+// template is a parsed template definition.
+type template struct {
+	guid  schema.GUID
+	size  int
+	nodes fragment
+}
+
+// cursor reads little-endian data from a chunk. Errors are sticky: reads
+// past the end return zeros and set err.
+type cursor struct {
+	data []byte // The whole chunk, all offsets are relative to it.
+	pos  int
+	end  int
+	err  error
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil {
+		return nil
+	}
+	if n < 0 || c.pos+n > c.end {
+		c.err = fmt.Errorf("unexpected end of data at offset %d", c.pos)
+		return nil
+	}
+	b := c.data[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *cursor) u8() uint8 {
+	if b := c.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (c *cursor) u16() uint16 {
+	if b := c.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (c *cursor) u32() uint32 {
+	if b := c.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// peek returns the next byte without consuming it.
+func (c *cursor) peek() uint8 {
+	if c.err != nil || c.pos >= c.end {
+		return tokenEndOfStream
+	}
+	return c.data[c.pos]
+}
+
+// parser parses binary XML of a single chunk.
+type parser struct {
+	chunk *chunk
+	cur   cursor
+}
+
+// parseFragment parses binary XML from @offset up to @end.
+func (c *chunk) parseFragment(offset, end int) (fragment, error) {
+	if c.depth >= maxNesting {
+		return nil, fmt.Errorf("%w at offset %d", errNesting, offset)
+	}
+	c.depth++
+	defer func() { c.depth-- }()
+
+	p := &parser{chunk: c, cur: cursor{data: c.data, pos: offset, end: end}}
+	nodes := p.fragment()
+	if p.cur.err != nil {
+		return nil, p.cur.err
+	}
+	return nodes, nil
+}
+
+// fragment parses nodes up to the end of stream or data.
+func (p *parser) fragment() fragment {
+	var nodes fragment
+	for p.cur.err == nil && p.cur.pos < p.cur.end {
+		token := p.cur.u8()
+		switch token &^ tokenHasMoreData {
+		case tokenEndOfStream:
+			return nodes
+		case tokenFragmentHeader:
+			p.cur.take(3) // Major and minor versions, flags.
+		case tokenOpenStartElement:
+			nodes = append(nodes, p.element(token))
+		case tokenTemplateInstance:
+			nodes = append(nodes, p.templateInstance()...)
+		default:
+			p.fail("unexpected token 0x%02x in fragment", token)
+		}
+	}
+	return nodes
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	if p.cur.err == nil {
+		p.cur.err = fmt.Errorf(format+" at offset %d", append(args, p.cur.pos)...)
+	}
+}
+
+// element parses an element after its token.
+func (p *parser) element(token uint8) *element {
+	p.cur.take(2) // Dependency identifier.
+	p.cur.take(4) // Data size.
+	e := &element{name: p.name()}
+
+	if token&tokenHasMoreData != 0 {
+		p.cur.take(4) // Attribute list size.
+		for p.cur.err == nil {
+			attrToken := p.cur.u8()
+			if attrToken&^tokenHasMoreData != tokenAttribute {
+				p.fail("unexpected token 0x%02x in attributes", attrToken)
+				break
+			}
+			e.attrs = append(e.attrs, attribute{name: p.name(), value: p.attributeValue()})
+			if attrToken&tokenHasMoreData == 0 {
+				break
+			}
+		}
+	}
+
+	switch token := p.cur.u8(); token {
+	case tokenCloseEmptyElement:
+		return e
+	case tokenCloseStartElement:
+	default:
+		p.fail("unexpected token 0x%02x after attributes", token)
+		return e
+	}
+
+	for p.cur.err == nil {
+		token := p.cur.u8()
+		switch token &^ tokenHasMoreData {
+		case tokenEndElement:
+			return e
+		case tokenOpenStartElement:
+			e.children = append(e.children, p.element(token))
+		case tokenPITarget:
+			p.name()
+		case tokenPIData:
+			p.string()
+		default:
+			if n, ok := p.content(token); ok {
+				e.children = append(e.children, n)
+			} else {
+				p.fail("unexpected token 0x%02x in element %s", token, e.name)
+			}
+		}
+	}
+	return e
+}
+
+// attributeValue parses content nodes up to the next attribute or the end of
+// the start element.
+func (p *parser) attributeValue() []node {
+	var nodes []node
+	for p.cur.err == nil {
+		switch p.cur.peek() &^ tokenHasMoreData {
+		case tokenAttribute, tokenCloseStartElement, tokenCloseEmptyElement:
+			return nodes
+		}
+		token := p.cur.u8()
+		n, ok := p.content(token)
+		if !ok {
+			p.fail("unexpected token 0x%02x in attribute value", token)
+			break
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// content parses a value, substitution or reference after its @token.
+func (p *parser) content(token uint8) (node, bool) {
+	switch token &^ tokenHasMoreData {
+	case tokenValue:
+		if valueType := p.cur.u8(); valueType != typeString {
+			p.fail("unsupported value type 0x%02x", valueType)
+		}
+		return p.string(), true
+	case tokenNormalSubstitution, tokenOptionalSubstitution:
+		s := substitution{index: p.cur.u16()}
+		p.cur.u8() // Value type, the instance one is used.
+		return s, true
+	case tokenCDataSection:
+		return p.string(), true
+	case tokenCharRef:
+		return string(rune(p.cur.u16())), true
+	case tokenEntityRef:
+		return entity(p.name()), true
+	default:
+		return nil, false
+	}
+}
+
+// string parses a length prefixed UTF-16 string.
+func (p *parser) string() string {
+	length := int(p.cur.u16())
+	return decodeUTF16(p.cur.take(2 * length))
+}
+
+// name parses a name offset. The name itself is defined inline the first
+// time it's used in the chunk and referred by offset afterwards.
+func (p *parser) name() string {
+	offset := int(p.cur.u32())
+	if p.cur.err != nil {
+		return ""
+	}
+	if name, ok := p.chunk.names[offset]; ok {
+		if offset == p.cur.pos {
+			p.cur.pos += nameSize(name)
+		}
+		return name
+	}
+
+	c := cursor{data: p.chunk.data, pos: offset, end: len(p.chunk.data)}
+	c.take(4) // Next string offset.
+	c.take(2) // Hash.
+	length := int(c.u16())
+	name := decodeUTF16(c.take(2 * length))
+	c.take(2) // Terminating zero.
+	if c.err != nil {
+		p.cur.err = fmt.Errorf("invalid name at offset %d; %w", offset, c.err)
+		return ""
+	}
+	p.chunk.names[offset] = name
+	if offset == p.cur.pos {
+		p.cur.pos = c.pos
+	}
+	return name
+}
+
+// nameSize returns the size of a name definition in the chunk.
+func nameSize(name string) int {
+	return 8 + 2*len(utf16.Encode([]rune(name))) + 2
+}
+
+// templateInstance parses a template instance and resolves it with its
+// substitution values.
+func (p *parser) templateInstance() fragment {
+	p.cur.take(1) // Unknown.
+	p.cur.take(4) // Template identifier.
+	offset := int(p.cur.u32())
+	if p.cur.err != nil {
+		return nil
+	}
+
+	t, ok := p.chunk.templates[offset]
+	switch {
+	case !ok:
+		if t = p.template(offset); p.cur.err != nil {
+			return nil
+		}
+	case offset == p.cur.pos:
+		p.cur.take(templateHeaderSize + t.size)
+	}
+
+	count := int(p.cur.u32())
+	if count > (p.cur.end-p.cur.pos)/4 {
+		p.fail("invalid substitution count %d", count)
+		return nil
+	}
+	sizes := make([]int, count)
+	types := make([]uint8, count)
+	for i := range sizes {
+		sizes[i] = int(p.cur.u16())
+		types[i] = p.cur.u8()
+		p.cur.u8() // Padding.
+	}
+	values := make([]interface{}, count)
+	for i := range values {
+		offset := p.cur.pos
+		data := p.cur.take(sizes[i])
+		if p.cur.err != nil {
+			return nil
+		}
+		value, err := p.value(types[i], data, offset)
+		if err != nil {
+			p.cur.err = fmt.Errorf("substitution %d; %w", i, err)
+			return nil
+		}
+		values[i] = value
+	}
+	return resolve(t.nodes, values)
+}
+
+// template parses the template definition at @offset skipping it if it's
+// inline.
+func (p *parser) template(offset int) *template {
+	c := cursor{data: p.chunk.data, pos: offset, end: len(p.chunk.data)}
+	c.take(4) // Next template offset.
+	var guid schema.GUID
+	if b := c.take(16); b != nil {
+		guid = guidFromBytes(b)
+	}
+	size := int(c.u32())
+	if c.err != nil || offset+templateHeaderSize+size > len(p.chunk.data) {
+		p.fail("invalid template at offset %d", offset)
+		return nil
+	}
+
+	// Templates are cached once parsed, so a template instantiating itself
+	// would be parsed again and again.
+	if p.chunk.parsing[offset] {
+		p.cur.err = fmt.Errorf("%w: template %s at offset %d instantiates itself", errNesting, guid, offset)
+		return nil
+	}
+	p.chunk.parsing[offset] = true
+	defer delete(p.chunk.parsing, offset)
+
+	start := offset + templateHeaderSize
+	nodes, err := p.chunk.parseFragment(start, start+size)
+	if err != nil {
+		p.cur.err = fmt.Errorf("template %s; %w", guid, err)
+		return nil
+	}
+	t := &template{guid: guid, size: size, nodes: nodes}
+	p.chunk.templates[offset] = t
+	if offset == p.cur.pos {
+		p.cur.pos = start + size
+	}
+	return t
+}
+
+// value decodes a substitution value. @offset is the value offset in the
+// chunk, nested binary XML could refer to names and templates by offsets.
+func (p *parser) value(valueType uint8, data []byte, offset int) (interface{}, error) {
+	if valueType == typeBinXML {
+		return p.chunk.parseFragment(offset, offset+len(data))
+	}
+	if valueType&typeArray != 0 {
+		return decodeArray(valueType&^typeArray, data)
+	}
+	return decodeValue(valueType, data)
+}
+
+// resolve instantiates template @nodes with substitution @values. Null
+// values are dropped and so are attributes having only null values.
+func resolve(nodes fragment, values []interface{}) fragment {
+	var out fragment
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *element:
+			e := &element{name: n.name, children: resolve(n.children, values)}
+			for _, a := range n.attrs {
+				value := resolve(a.value, values)
+				if len(value) == 0 && len(a.value) != 0 {
+					continue
+				}
+				e.attrs = append(e.attrs, attribute{name: a.name, value: value})
+			}
+			out = append(out, e)
+		case substitution:
+			if int(n.index) >= len(values) {
+				continue
+			}
+			switch v := values[n.index].(type) {
+			case nil:
+			case fragment:
+				out = append(out, v...)
+			default:
+				out = append(out, v)
+			}
+		default:
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// decodeValue decodes a scalar value. Hex integers and sizes are decoded as
+// numbers.
+func decodeValue(valueType uint8, data []byte) (interface{}, error) {
+	if size := fixedSize(valueType); size != 0 && len(data) != size {
+		return nil, fmt.Errorf("invalid size %d of value type 0x%02x", len(data), valueType)
+	}
+
+	switch valueType {
+	case typeNull:
+		return nil, nil
+	case typeString:
+		return strings.TrimRight(decodeUTF16(data), "\x00"), nil
+	case typeAnsiString:
+		return strings.TrimRight(string(data), "\x00"), nil
+	case typeInt8:
+		return int8(data[0]), nil
+	case typeUInt8:
+		return data[0], nil
+	case typeInt16:
+		return int16(binary.LittleEndian.Uint16(data)), nil
+	case typeUInt16:
+		return binary.LittleEndian.Uint16(data), nil
+	case typeInt32:
+		return int32(binary.LittleEndian.Uint32(data)), nil
+	case typeUInt32, typeHexInt32:
+		return binary.LittleEndian.Uint32(data), nil
+	case typeInt64:
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case typeUInt64, typeHexInt64:
+		return binary.LittleEndian.Uint64(data), nil
+	case typeReal32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(data)), nil
+	case typeReal64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case typeBool:
+		for _, b := range data {
+			if b != 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case typeBinary:
+		return append([]byte(nil), data...), nil
+	case typeGUID:
+		return guidFromBytes(data), nil
+	case typeSizeT:
+		switch len(data) {
+		case 4:
+			return uint64(binary.LittleEndian.Uint32(data)), nil
+		case 8:
+			return binary.LittleEndian.Uint64(data), nil
+		}
+		return nil, fmt.Errorf("invalid size %d of SizeT", len(data))
+	case typeFileTime:
+		return schema.FromFileTime(binary.LittleEndian.Uint64(data)), nil
+	case typeSystemTime:
+		return decodeSystemTime(data), nil
+	case typeSID:
+		return decodeSID(data)
+	default:
+		return nil, fmt.Errorf("unsupported value type 0x%02x", valueType)
+	}
+}
+
+// decodeArray decodes an array of @itemType values. Strings are separated by
+// zeros, other items have fixed sizes.
+func decodeArray(itemType uint8, data []byte) (interface{}, error) {
+	switch itemType {
+	case typeString:
+		s := strings.TrimRight(decodeUTF16(data), "\x00")
+		if s == "" {
+			return []string{}, nil
+		}
+		return strings.Split(s, "\x00"), nil
+	case typeAnsiString:
+		s := strings.TrimRight(string(data), "\x00")
+		if s == "" {
+			return []string{}, nil
+		}
+		return strings.Split(s, "\x00"), nil
+	}
+
+	size := fixedSize(itemType)
+	if itemType == typeBool {
+		size = 4
+	}
+	if size == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("unsupported array of type 0x%02x and size %d", itemType, len(data))
+	}
+	items := make([]interface{}, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		item, err := decodeValue(itemType, data[i:i+size])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// fixedSize returns the size of @valueType values or 0 if it's variable.
+func fixedSize(valueType uint8) int {
+	switch valueType {
+	case typeInt8, typeUInt8:
+		return 1
+	case typeInt16, typeUInt16:
+		return 2
+	case typeInt32, typeUInt32, typeReal32, typeHexInt32:
+		return 4
+	case typeInt64, typeUInt64, typeReal64, typeFileTime, typeHexInt64:
+		return 8
+	case typeGUID, typeSystemTime:
+		return 16
+	default:
+		return 0
+	}
+}
+
+func decodeUTF16(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
+
+func guidFromBytes(b []byte) schema.GUID {
+	g := schema.GUID{
+		Data1: binary.LittleEndian.Uint32(b[0:]),
+		Data2: binary.LittleEndian.Uint16(b[4:]),
+		Data3: binary.LittleEndian.Uint16(b[6:]),
+	}
+	copy(g.Data4[:], b[8:16])
+	return g
+}
+
+// decodeSystemTime decodes SYSTEMTIME in UTC.
+func decodeSystemTime(b []byte) time.Time {
+	field := func(i int) int {
+		return int(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	// Fields are year, month, day of week, day, hour, minute, second and
+	// milliseconds.
+	return time.Date(field(0), time.Month(field(1)), field(3),
+		field(4), field(5), field(6), field(7)*int(time.Millisecond), time.UTC)
+}
+
+// decodeSID decodes a binary SID to the S-1-5-... form.
+func decodeSID(b []byte) (string, error) {
+	if len(b) < 8 || len(b) != 8+4*int(b[1]) {
+		return "", fmt.Errorf("invalid SID of size %d", len(b))
+	}
+	var authority uint64
+	for _, x := range b[2:8] {
+		authority = authority<<8 | uint64(x)
+	}
+	sid := fmt.Sprintf("S-%d-%d", b[0], authority)
+	for i := 8; i < len(b); i += 4 {
+		sid += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[i:]))
+	}
+	return sid, nil
+}
+
+// entity resolves predefined XML entities keeping unknown ones as is.
+func entity(name string) string {
+	switch name {
+	case "amp":
+		return "&"
+	case "lt":
+		return "<"
+	case "gt":
+		return ">"
+	case "quot":
+		return `"`
+	case "apos":
+		return "'"
+	default:
+		return "&" + name + ";"
+	}
+}
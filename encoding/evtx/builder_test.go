@@ -0,0 +1,340 @@
+package evtx
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// fileBuilder writes EVTX files the way Windows does, so the reader could be
+// tested on any platform: names and templates are defined inline the first
+// time they are used in a chunk and referred by offset afterwards.
+
+type xElement struct {
+	name     string
+	attrs    []xAttribute
+	children []interface{} // xElement, string, xSub, xEntity or xCharRef.
+}
+
+type xAttribute struct {
+	name  string
+	value interface{} // string or xSub.
+}
+
+type xSub struct {
+	index    uint16
+	optional bool
+}
+
+type xEntity string
+
+type xCharRef rune
+
+type xTemplate struct {
+	guid schema.GUID
+	root xElement
+}
+
+type xValue struct {
+	valueType uint8
+	data      []byte
+	nested    func(c *chunkBuilder) // Writes binary XML values in place.
+}
+
+type fileBuilder struct {
+	chunks [][]byte
+	flags  uint32
+	nextID uint64
+}
+
+type chunkBuilder struct {
+	buf       []byte
+	names     map[string]uint32
+	templates map[schema.GUID]uint32
+
+	first, last uint64
+	lastOffset  uint32
+}
+
+func newChunkBuilder() *chunkBuilder {
+	return &chunkBuilder{
+		buf:       make([]byte, chunkHeaderSize),
+		names:     make(map[string]uint32),
+		templates: make(map[schema.GUID]uint32),
+	}
+}
+
+func (c *chunkBuilder) u8(v uint8) {
+	c.buf = append(c.buf, v)
+}
+
+func (c *chunkBuilder) u16(v uint16) {
+	c.buf = append(c.buf, byte(v), byte(v>>8))
+}
+
+func (c *chunkBuilder) u32(v uint32) {
+	c.buf = append(c.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(c.buf[len(c.buf)-4:], v)
+}
+
+func (c *chunkBuilder) u64(v uint64) {
+	c.buf = append(c.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(c.buf[len(c.buf)-8:], v)
+}
+
+// patch32 writes the size of data written after @pos+4 to @pos.
+func (c *chunkBuilder) patch32(pos int) {
+	binary.LittleEndian.PutUint32(c.buf[pos:], uint32(len(c.buf)-pos-4))
+}
+
+func (c *chunkBuilder) utf16(s string) {
+	for _, ch := range utf16.Encode([]rune(s)) {
+		c.u16(ch)
+	}
+}
+
+func (c *chunkBuilder) name(name string) {
+	if offset, ok := c.names[name]; ok {
+		c.u32(offset)
+		return
+	}
+	offset := uint32(len(c.buf) + 4)
+	c.names[name] = offset
+	c.u32(offset)
+	c.u32(0) // Next string.
+	c.u16(0) // Hash, not checked.
+	c.u16(uint16(len(utf16.Encode([]rune(name)))))
+	c.utf16(name)
+	c.u16(0)
+}
+
+func (c *chunkBuilder) element(e xElement) {
+	token := uint8(tokenOpenStartElement)
+	if len(e.attrs) != 0 {
+		token |= tokenHasMoreData
+	}
+	c.u8(token)
+	c.u16(0xffff)
+	sizePos := len(c.buf)
+	c.u32(0)
+	c.name(e.name)
+
+	if len(e.attrs) != 0 {
+		listPos := len(c.buf)
+		c.u32(0)
+		for i, a := range e.attrs {
+			token := uint8(tokenAttribute)
+			if i < len(e.attrs)-1 {
+				token |= tokenHasMoreData
+			}
+			c.u8(token)
+			c.name(a.name)
+			c.content(a.value)
+		}
+		c.patch32(listPos)
+	}
+
+	if len(e.children) == 0 {
+		c.u8(tokenCloseEmptyElement)
+	} else {
+		c.u8(tokenCloseStartElement)
+		for _, child := range e.children {
+			c.content(child)
+		}
+		c.u8(tokenEndElement)
+	}
+	c.patch32(sizePos)
+}
+
+func (c *chunkBuilder) content(v interface{}) {
+	switch v := v.(type) {
+	case xElement:
+		c.element(v)
+	case string:
+		c.u8(tokenValue)
+		c.u8(typeString)
+		c.u16(uint16(len(utf16.Encode([]rune(v)))))
+		c.utf16(v)
+	case xSub:
+		if v.optional {
+			c.u8(tokenOptionalSubstitution)
+		} else {
+			c.u8(tokenNormalSubstitution)
+		}
+		c.u16(v.index)
+		c.u8(typeNull)
+	case xEntity:
+		c.u8(tokenEntityRef)
+		c.name(string(v))
+	case xCharRef:
+		c.u8(tokenCharRef)
+		c.u16(uint16(v))
+	default:
+		panic("unexpected content")
+	}
+}
+
+func (c *chunkBuilder) fragmentHeader() {
+	c.u8(tokenFragmentHeader)
+	c.u8(1)
+	c.u8(1)
+	c.u8(0)
+}
+
+func (c *chunkBuilder) templateInstance(t xTemplate, values []xValue) {
+	c.u8(tokenTemplateInstance)
+	c.u8(1)
+	c.u32(t.guid.Data1)
+	if offset, ok := c.templates[t.guid]; ok {
+		c.u32(offset)
+	} else {
+		offset := uint32(len(c.buf) + 4)
+		c.templates[t.guid] = offset
+		c.u32(offset)
+		c.u32(0) // Next template.
+		c.buf = append(c.buf, guidBytes(t.guid)...)
+		sizePos := len(c.buf)
+		c.u32(0)
+		c.fragmentHeader()
+		c.element(t.root)
+		c.u8(tokenEndOfStream)
+		c.patch32(sizePos)
+	}
+
+	c.u32(uint32(len(values)))
+	descriptors := len(c.buf)
+	for _, v := range values {
+		c.u16(uint16(len(v.data)))
+		c.u8(v.valueType)
+		c.u8(0)
+	}
+	for i, v := range values {
+		if v.nested == nil {
+			c.buf = append(c.buf, v.data...)
+			continue
+		}
+		start := len(c.buf)
+		v.nested(c)
+		binary.LittleEndian.PutUint16(c.buf[descriptors+4*i:], uint16(len(c.buf)-start))
+	}
+}
+
+// record appends a record with an instance of @t.
+func (c *chunkBuilder) record(id uint64, written time.Time, t xTemplate, values []xValue) {
+	c.rawRecord(id, written, func() { c.templateInstance(t, values) })
+}
+
+// rawRecord appends a record with binary XML written by @body after the
+// fragment header.
+func (c *chunkBuilder) rawRecord(id uint64, written time.Time, body func()) {
+	offset := len(c.buf)
+	c.buf = append(c.buf, recordSignature...)
+	sizePos := len(c.buf)
+	c.u32(0)
+	c.u64(id)
+	c.u64(schema.ToFileTime(written))
+	c.fragmentHeader()
+	body()
+	size := uint32(len(c.buf) - offset + 4)
+	c.u32(size)
+	binary.LittleEndian.PutUint32(c.buf[sizePos:], size)
+
+	if c.first == 0 {
+		c.first = id
+	}
+	c.last = id
+	c.lastOffset = uint32(offset)
+}
+
+// bytes returns the chunk with its header and checksums.
+func (c *chunkBuilder) bytes() []byte {
+	data := make([]byte, chunkSize)
+	copy(data, c.buf)
+	le := binary.LittleEndian
+	copy(data, chunkSignature)
+	le.PutUint64(data[8:], c.first)
+	le.PutUint64(data[16:], c.last)
+	le.PutUint64(data[24:], c.first)
+	le.PutUint64(data[32:], c.last)
+	le.PutUint32(data[40:], 128)
+	le.PutUint32(data[44:], c.lastOffset)
+	le.PutUint32(data[48:], uint32(len(c.buf)))
+	le.PutUint32(data[52:], crc32.ChecksumIEEE(data[chunkHeaderSize:len(c.buf)]))
+	crc := crc32.ChecksumIEEE(data[:120])
+	crc = crc32.Update(crc, crc32.IEEETable, data[128:chunkHeaderSize])
+	le.PutUint32(data[124:], crc)
+	return data
+}
+
+func (f *fileBuilder) add(c *chunkBuilder) {
+	f.chunks = append(f.chunks, c.bytes())
+	if c.last >= f.nextID {
+		f.nextID = c.last + 1
+	}
+}
+
+func (f *fileBuilder) bytes() []byte {
+	data := make([]byte, fileHeaderBlockSize)
+	le := binary.LittleEndian
+	copy(data, fileSignature)
+	le.PutUint64(data[8:], 0)
+	le.PutUint64(data[16:], uint64(len(f.chunks)-1))
+	le.PutUint64(data[24:], f.nextID)
+	le.PutUint32(data[32:], 128)
+	le.PutUint16(data[36:], 1)
+	le.PutUint16(data[38:], 3)
+	le.PutUint16(data[40:], fileHeaderBlockSize)
+	le.PutUint16(data[42:], uint16(len(f.chunks)))
+	le.PutUint32(data[120:], f.flags)
+	le.PutUint32(data[124:], crc32.ChecksumIEEE(data[:fileHeaderCRCSize]))
+	for _, c := range f.chunks {
+		data = append(data, c...)
+	}
+	return data
+}
+
+func guidBytes(g schema.GUID) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], g.Data1)
+	binary.LittleEndian.PutUint16(b[4:], g.Data2)
+	binary.LittleEndian.PutUint16(b[6:], g.Data3)
+	copy(b[8:], g.Data4[:])
+	return b
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, ch := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(ch), byte(ch>>8))
+	}
+	return b
+}
+
+func vString(s string) xValue {
+	return xValue{valueType: typeString, data: utf16Bytes(s)}
+}
+
+func vNull() xValue {
+	return xValue{valueType: typeNull}
+}
+
+func vUint(valueType uint8, v uint64, size int) xValue {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return xValue{valueType: valueType, data: b[:size]}
+}
+
+func vGUID(g schema.GUID) xValue {
+	return xValue{valueType: typeGUID, data: guidBytes(g)}
+}
+
+func vFileTime(t time.Time) xValue {
+	return vUint(typeFileTime, schema.ToFileTime(t), 8)
+}
+
+func vBinXML(nested func(c *chunkBuilder)) xValue {
+	return xValue{valueType: typeBinXML, nested: nested}
+}
@@ -0,0 +1,286 @@
+// Package evtx reads Windows Event Log files (.evtx) without Windows APIs, so
+// exported logs could be processed on any platform along with ETW events.
+//
+// A file is a header followed by 64 KiB chunks. Every chunk holds records
+// with events in binary XML which refers to names and templates defined
+// earlier in the same chunk. Records are mapped to schema.Event: the System
+// element to the header and EventData or UserData to properties keeping
+// their types and order.
+//
+// The format is described in the libevtx documentation:
+// https://github.com/libyal/libevtx/blob/main/documentation/Windows%20XML%20Event%20Log%20(EVTX).asciidoc
+package evtx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Format constants.
+const (
+	fileHeaderBlockSize = 4096
+	fileHeaderCRCSize   = 120
+	chunkSize           = 65536
+	chunkHeaderSize     = 512
+	recordHeaderSize    = 24
+)
+
+//nolint:gochecknoglobals
+var (
+	fileSignature   = []byte("ElfFile\x00")
+	chunkSignature  = []byte("ElfChnk\x00")
+	recordSignature = []byte("\x2a\x2a\x00\x00")
+)
+
+// File header flags.
+const (
+	FlagDirty = 0x1
+	FlagFull  = 0x2
+)
+
+// FileHeader is the header of an EVTX file. Windows updates it lazily, so
+// chunks and records could go past the numbers it reports.
+type FileHeader struct {
+	FirstChunk   uint64
+	LastChunk    uint64
+	NextRecordID uint64
+	MinorVersion uint16
+	MajorVersion uint16
+	ChunkCount   uint16
+	Flags        uint32
+}
+
+// Record is a single event of the log.
+type Record struct {
+	ID      uint64
+	Written time.Time
+
+	// Channel and Computer are from the System element, schema.Event has no
+	// place for them.
+	Channel  string
+	Computer string
+
+	Event *schema.Event
+}
+
+// ChunkError is returned by Reader.Next for corrupted chunks. Reading could
+// continue with the next chunk.
+type ChunkError struct {
+	Index int
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads records of an EVTX file one by one.
+type Reader struct {
+	r      io.ReaderAt
+	header FileHeader
+
+	nextChunk int
+	chunk     *chunk
+}
+
+// NewReader reads the file header from @r and checks it.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	data := make([]byte, fileHeaderBlockSize)
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("failed to read file header; %w", err)
+	}
+	if !bytes.Equal(data[:8], fileSignature) {
+		return nil, fmt.Errorf("invalid file signature")
+	}
+	le := binary.LittleEndian
+	if crc := crc32.ChecksumIEEE(data[:fileHeaderCRCSize]); crc != le.Uint32(data[124:]) {
+		return nil, fmt.Errorf("file header checksum mismatch")
+	}
+	header := FileHeader{
+		FirstChunk:   le.Uint64(data[8:]),
+		LastChunk:    le.Uint64(data[16:]),
+		NextRecordID: le.Uint64(data[24:]),
+		MinorVersion: le.Uint16(data[36:]),
+		MajorVersion: le.Uint16(data[38:]),
+		ChunkCount:   le.Uint16(data[42:]),
+		Flags:        le.Uint32(data[120:]),
+	}
+	if header.MajorVersion != 3 {
+		return nil, fmt.Errorf("unsupported format version %d.%d", header.MajorVersion, header.MinorVersion)
+	}
+	return &Reader{r: r, header: header}, nil
+}
+
+// Header returns the file header.
+func (r *Reader) Header() FileHeader {
+	return r.header
+}
+
+// Next returns the next record or io.EOF at the end of the file.
+//
+// Errors of a single record or a *ChunkError are not fatal: the next call
+// continues with the next record or chunk.
+func (r *Reader) Next() (*Record, error) {
+	for {
+		if r.chunk == nil {
+			index := r.nextChunk
+			c, err := r.readChunk(index)
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			r.nextChunk++
+			if err != nil {
+				return nil, &ChunkError{Index: index, Err: err}
+			}
+			if c == nil {
+				continue
+			}
+			r.chunk = c
+		}
+
+		record, err := r.chunk.next()
+		if errors.Is(err, io.EOF) {
+			r.chunk = nil
+			continue
+		}
+		return record, err
+	}
+}
+
+// readChunk reads and checks the chunk @index. It returns nil for unused
+// chunks and io.EOF past the end of the file.
+func (r *Reader) readChunk(index int) (*chunk, error) {
+	data := make([]byte, chunkSize)
+	n, err := r.r.ReadAt(data, fileHeaderBlockSize+int64(index)*chunkSize)
+	switch {
+	case n == 0 && errors.Is(err, io.EOF):
+		return nil, io.EOF
+	case n < chunkSize:
+		return nil, fmt.Errorf("truncated chunk of %d bytes", n)
+	}
+
+	if !bytes.Equal(data[:8], chunkSignature) {
+		if bytes.Equal(data[:8], make([]byte, 8)) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid chunk signature")
+	}
+
+	// The header checksum skips flags and itself.
+	le := binary.LittleEndian
+	crc := crc32.ChecksumIEEE(data[:120])
+	crc = crc32.Update(crc, crc32.IEEETable, data[128:chunkHeaderSize])
+	if crc != le.Uint32(data[124:]) {
+		return nil, fmt.Errorf("chunk header checksum mismatch")
+	}
+	free := int(le.Uint32(data[48:]))
+	if free < chunkHeaderSize || free > chunkSize {
+		return nil, fmt.Errorf("invalid free space offset %d", free)
+	}
+	if crc32.ChecksumIEEE(data[chunkHeaderSize:free]) != le.Uint32(data[52:]) {
+		return nil, fmt.Errorf("records checksum mismatch")
+	}
+
+	return &chunk{
+		index:     index,
+		data:      data,
+		offset:    chunkHeaderSize,
+		free:      free,
+		names:     make(map[int]string),
+		templates: make(map[int]*template),
+		parsing:   make(map[int]bool),
+	}, nil
+}
+
+// File is an EVTX file opened with Open.
+type File struct {
+	*Reader
+	f *os.File
+}
+
+// Open opens the EVTX file @name for reading.
+func Open(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &File{Reader: r, f: f}, nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// chunk is a chunk being read along with names and templates it defines.
+type chunk struct {
+	index  int
+	data   []byte
+	offset int // Of the next record.
+	free   int // Offset of the free space, records end there.
+
+	names     map[int]string
+	templates map[int]*template
+
+	// parsing are offsets of templates being parsed and depth is the
+	// nesting of fragments being parsed.
+	parsing map[int]bool
+	depth   int
+}
+
+// next parses the next record of the chunk or returns io.EOF.
+func (c *chunk) next() (*Record, error) {
+	if c.offset+recordHeaderSize > c.free {
+		return nil, io.EOF
+	}
+
+	le := binary.LittleEndian
+	data := c.data[c.offset:c.free]
+	size := int(le.Uint32(data[4:]))
+	if !bytes.Equal(data[:4], recordSignature) || size < recordHeaderSize+4 || size > len(data) ||
+		int(le.Uint32(data[size-4:])) != size {
+		err := fmt.Errorf("invalid record at offset %d", c.offset)
+		c.offset = c.free
+		return nil, &ChunkError{Index: c.index, Err: err}
+	}
+
+	record := &Record{
+		ID:      le.Uint64(data[8:]),
+		Written: schema.FromFileTime(le.Uint64(data[16:])),
+	}
+	start := c.offset + recordHeaderSize
+	c.offset += size
+
+	nodes, err := c.parseFragment(start, start+size-recordHeaderSize-4)
+	if errors.Is(err, errNesting) {
+		// Records share templates of the chunk, so the rest of it is not
+		// trusted either.
+		c.offset = c.free
+		return nil, &ChunkError{Index: c.index, Err: fmt.Errorf("record %d: %w", record.ID, err)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %w", record.ID, err)
+	}
+	if err := record.fill(nodes); err != nil {
+		return nil, fmt.Errorf("record %d: %w", record.ID, err)
+	}
+	return record, nil
+}
@@ -0,0 +1,581 @@
+package evtx
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/encoding/eventxml"
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestEVTX(t *testing.T) {
+	suite.Run(t, new(evtxSuite))
+}
+
+type evtxSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var (
+	testProvider = schema.GUID{
+		Data1: 0x555908D1, Data2: 0xA6D7, Data3: 0x4695,
+		Data4: [8]byte{0x8E, 0x1E, 0x26, 0x93, 0x1D, 0x20, 0x12, 0xF4},
+	}
+	testActivity = schema.GUID{Data1: 1, Data2: 2, Data3: 3, Data4: [8]byte{4, 5, 6, 7, 8, 9, 10, 11}}
+	testTime     = time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC)
+
+	// S-1-5-18
+	testSID = []byte{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0}
+)
+
+// eventTemplate builds an Event element with System filled by substitutions
+// 0-14 and @data after it.
+func eventTemplate(id uint32, data xElement) xTemplate {
+	sub := func(i uint16) xSub { return xSub{index: i} }
+	opt := func(i uint16) xSub { return xSub{index: i, optional: true} }
+	text := func(name string, v interface{}) xElement {
+		return xElement{name: name, children: []interface{}{v}}
+	}
+	return xTemplate{
+		guid: schema.GUID{Data1: id, Data2: 1},
+		root: xElement{
+			name:  "Event",
+			attrs: []xAttribute{{"xmlns", "http://schemas.microsoft.com/win/2004/08/events/event"}},
+			children: []interface{}{
+				xElement{name: "System", children: []interface{}{
+					xElement{name: "Provider", attrs: []xAttribute{{"Name", sub(0)}, {"Guid", sub(1)}}},
+					text("EventID", sub(2)),
+					text("Version", sub(3)),
+					text("Level", sub(4)),
+					text("Task", sub(5)),
+					text("Opcode", sub(6)),
+					text("Keywords", sub(7)),
+					xElement{name: "TimeCreated", attrs: []xAttribute{{"SystemTime", sub(8)}}},
+					text("EventRecordID", sub(9)),
+					xElement{name: "Correlation", attrs: []xAttribute{{"ActivityID", opt(10)}, {"RelatedActivityID", opt(11)}}},
+					xElement{name: "Execution", attrs: []xAttribute{{"ProcessID", sub(12)}, {"ThreadID", sub(13)}}},
+					text("Channel", "System"),
+					text("Computer", "host"),
+					xElement{name: "Security", attrs: []xAttribute{{"UserID", opt(14)}}},
+				}},
+				data,
+			},
+		},
+	}
+}
+
+// systemValues returns substitution values for eventTemplate.
+func systemValues(recordID uint64, activity bool) []xValue {
+	values := []xValue{
+		vString("Service Control Manager"),
+		vGUID(testProvider),
+		vUint(typeUInt16, 7036, 2),
+		vUint(typeUInt8, 1, 1),
+		vUint(typeUInt8, 4, 1),
+		vUint(typeUInt16, 2, 2),
+		vUint(typeUInt8, 3, 1),
+		vUint(typeHexInt64, 0x8080000000000000, 8),
+		vFileTime(testTime),
+		vUint(typeUInt64, recordID, 8),
+		vNull(),
+		vNull(),
+		vUint(typeUInt32, 700, 4),
+		vUint(typeUInt32, 9000, 4),
+		{valueType: typeSID, data: testSID},
+	}
+	if activity {
+		values[10] = vGUID(testActivity)
+		values[11] = vGUID(testProvider)
+	}
+	return values
+}
+
+// eventDataTemplate has flat EventData with substitutions 15-18.
+func eventDataTemplate() xTemplate {
+	data := func(name string, v ...interface{}) xElement {
+		e := xElement{name: "Data", children: v}
+		if name != "" {
+			e.attrs = []xAttribute{{"Name", name}}
+		}
+		return e
+	}
+	return eventTemplate(1, xElement{name: "EventData", children: []interface{}{
+		data("param1", xSub{index: 15}),
+		data("param2", xSub{index: 16}),
+		data("", xSub{index: 17}),
+		data("Tags", xSub{index: 18}),
+		data("Text", "a", xEntity("amp"), "b", xCharRef('!')),
+	}})
+}
+
+func eventDataValues(recordID uint64, activity bool) []xValue {
+	return append(systemValues(recordID, activity),
+		vString("Windows Update\x00"),
+		vUint(typeUInt32, 42, 4),
+		xValue{valueType: typeReal64, data: []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		xValue{valueType: typeString | typeArray, data: utf16Bytes("a\x00b\x00")},
+	)
+}
+
+// userDataTemplate has UserData filled by a binary XML substitution 15.
+func userDataTemplate() xTemplate {
+	return eventTemplate(2, xElement{name: "UserData", children: []interface{}{xSub{index: 15}}})
+}
+
+func userDataValues(recordID uint64) []xValue {
+	config := xTemplate{
+		guid: schema.GUID{Data1: 3},
+		root: xElement{name: "Config", attrs: []xAttribute{{"xmlns", "urn:test"}}, children: []interface{}{
+			xElement{name: "Name", children: []interface{}{xSub{index: 0}}},
+			xElement{name: "Items", children: []interface{}{"1"}},
+			xElement{name: "Items", children: []interface{}{"2"}},
+			xElement{name: "Point", children: []interface{}{
+				xElement{name: "X", children: []interface{}{xSub{index: 1}}},
+				xElement{name: "Y", children: []interface{}{xSub{index: 2}}},
+			}},
+		}},
+	}
+	return append(systemValues(recordID, false), vBinXML(func(c *chunkBuilder) {
+		c.fragmentHeader()
+		c.templateInstance(config, []xValue{
+			vString("svc"),
+			vUint(typeUInt16, 1, 2),
+			vUint(typeUInt16, 2, 2),
+		})
+	}))
+}
+
+func (s *evtxSuite) read(data []byte) ([]*Record, []error) {
+	r, err := NewReader(bytes.NewReader(data))
+	s.Require().NoError(err)
+	var records []*Record
+	var errs []error
+	for i := 0; i < 100; i++ {
+		record, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return records, errs
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	s.FailNow("Reader doesn't stop")
+	return nil, nil
+}
+
+// TestRead ensures records are mapped to events with typed values.
+func (s *evtxSuite) TestRead() {
+	var f fileBuilder
+	c := newChunkBuilder()
+	c.record(1, testTime, eventDataTemplate(), eventDataValues(1, true))
+	c.record(2, testTime.Add(time.Second), eventDataTemplate(), eventDataValues(2, false))
+	f.add(c)
+
+	records, errs := s.read(f.bytes())
+	s.Empty(errs)
+	s.Require().Len(records, 2)
+
+	r := records[0]
+	s.Equal(uint64(1), r.ID)
+	s.Equal(testTime, r.Written)
+	s.Equal("System", r.Channel)
+	s.Equal("host", r.Computer)
+
+	related := testProvider
+	s.Equal(&schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{
+				ID: 7036, Version: 1, Level: 4, Task: 2, OpCode: 3, Keyword: 0x8080000000000000,
+			},
+			ThreadID:   9000,
+			ProcessID:  700,
+			TimeStamp:  testTime,
+			ProviderID: testProvider,
+			ActivityID: testActivity,
+		},
+		ProviderName: "Service Control Manager",
+		Properties: []schema.Property{
+			{Name: "param1", Value: "Windows Update"},
+			{Name: "param2", Value: uint32(42)},
+			{Name: "Param3", Value: 1.5},
+			{Name: "Tags", Value: []string{"a", "b"}},
+			{Name: "Text", Value: "a&b!"},
+		},
+		Extended: schema.Extended{
+			ActivityID: &related,
+			UserSID:    "S-1-5-18",
+		},
+	}, r.Event)
+
+	// The second record reuses names and the template, optional values are
+	// not set.
+	r = records[1]
+	s.Equal(uint64(2), r.ID)
+	s.True(r.Event.Header.ActivityID.IsZero())
+	s.Nil(r.Event.Extended.ActivityID)
+	s.Equal(records[0].Event.Properties, r.Event.Properties)
+	s.Equal("Service Control Manager", r.Event.ProviderName)
+}
+
+// TestUserData ensures nested binary XML is parsed into structured
+// properties.
+func (s *evtxSuite) TestUserData() {
+	var f fileBuilder
+	c := newChunkBuilder()
+	c.record(1, testTime, userDataTemplate(), userDataValues(1))
+	f.add(c)
+
+	records, errs := s.read(f.bytes())
+	s.Empty(errs)
+	s.Require().Len(records, 1)
+	s.Equal([]schema.Property{
+		{Name: "Name", Value: "svc"},
+		{Name: "Items", Value: []interface{}{"1", "2"}},
+		{Name: "Point", Value: []schema.Property{{Name: "X", Value: uint16(1)}, {Name: "Y", Value: uint16(2)}}},
+	}, records[0].Event.Properties)
+}
+
+// TestChunks ensures templates are chunk local, unused chunks are skipped and
+// corrupted ones reported without stopping.
+func (s *evtxSuite) TestChunks() {
+	var f fileBuilder
+	for i := uint64(0); i < 4; i++ {
+		c := newChunkBuilder()
+		c.record(2*i+1, testTime, eventDataTemplate(), eventDataValues(2*i+1, false))
+		c.record(2*i+2, testTime, userDataTemplate(), userDataValues(2*i+2))
+		f.add(c)
+	}
+	f.chunks[1][chunkHeaderSize+100] ^= 0xff       // Records checksum.
+	f.chunks[2] = make([]byte, chunkSize)          // Unused.
+	f.chunks = append(f.chunks, make([]byte, 100)) // Truncated.
+	data := f.bytes()
+
+	r, err := NewReader(bytes.NewReader(data))
+	s.Require().NoError(err)
+	s.Equal(FileHeader{
+		LastChunk: 4, NextRecordID: 9, MinorVersion: 1, MajorVersion: 3, ChunkCount: 5,
+	}, r.Header())
+
+	records, errs := s.read(data)
+	s.Require().Len(records, 4)
+	for i, id := range []uint64{1, 2, 7, 8} {
+		s.Equal(id, records[i].ID)
+	}
+	s.Require().Len(errs, 2)
+	var chunkErr *ChunkError
+	s.Require().True(errors.As(errs[0], &chunkErr))
+	s.Equal(1, chunkErr.Index)
+	s.Contains(chunkErr.Error(), "records checksum")
+	s.Require().True(errors.As(errs[1], &chunkErr))
+	s.Equal(4, chunkErr.Index)
+}
+
+// TestBadRecord ensures a malformed record doesn't prevent reading the next
+// ones.
+func (s *evtxSuite) TestBadRecord() {
+	var f fileBuilder
+	c := newChunkBuilder()
+	c.record(1, testTime, eventDataTemplate(), eventDataValues(1, false))
+	bad := len(c.buf)
+	c.record(2, testTime, eventDataTemplate(), eventDataValues(2, false))
+	c.buf[bad+recordHeaderSize+4] = 0xff // Token of the template instance.
+	c.record(3, testTime, eventDataTemplate(), eventDataValues(3, false))
+	f.add(c)
+
+	records, errs := s.read(f.bytes())
+	s.Require().Len(records, 2)
+	s.Equal(uint64(1), records[0].ID)
+	s.Equal(uint64(3), records[1].ID)
+	s.Require().Len(errs, 1)
+	s.Contains(errs[0].Error(), "record 2")
+
+	// A broken record size makes the rest of the chunk unreadable.
+	c.buf[bad+4] = 0xff
+	f.chunks[0] = c.bytes()
+	records, errs = s.read(f.bytes())
+	s.Len(records, 1)
+	s.Len(errs, 1)
+}
+
+// TestNesting ensures crafted templates and values nested without limits are
+// reported as corrupted chunks instead of exhausting the stack.
+func (s *evtxSuite) TestNesting() {
+	var f fileBuilder
+
+	// The template body instantiates the template itself.
+	c := newChunkBuilder()
+	c.rawRecord(1, testTime, func() {
+		c.u8(tokenTemplateInstance)
+		c.u8(1)
+		c.u32(0)
+		offset := uint32(len(c.buf) + 4)
+		c.u32(offset)
+		c.u32(0) // Next template.
+		c.buf = append(c.buf, guidBytes(testProvider)...)
+		sizePos := len(c.buf)
+		c.u32(0)
+		c.fragmentHeader()
+		c.u8(tokenTemplateInstance)
+		c.u8(1)
+		c.u32(0)
+		c.u32(offset)
+		c.u32(0) // Values.
+		c.u8(tokenEndOfStream)
+		c.patch32(sizePos)
+		c.u32(0) // Values.
+	})
+	c.record(2, testTime, eventDataTemplate(), eventDataValues(2, false))
+	f.add(c)
+
+	// Binary XML values nested deeper than any real event.
+	nested := xTemplate{guid: testActivity, root: xElement{name: "N", children: []interface{}{xSub{index: 0}}}}
+	value := vString("leaf")
+	for i := 0; i < maxNesting; i++ {
+		inner := value
+		value = vBinXML(func(c *chunkBuilder) {
+			c.fragmentHeader()
+			c.templateInstance(nested, []xValue{inner})
+		})
+	}
+	c = newChunkBuilder()
+	c.record(3, testTime, nested, []xValue{value})
+	f.add(c)
+
+	c = newChunkBuilder()
+	c.record(4, testTime, eventDataTemplate(), eventDataValues(4, false))
+	f.add(c)
+
+	records, errs := s.read(f.bytes())
+	s.Require().Len(records, 1)
+	s.Equal(uint64(4), records[0].ID)
+	s.Require().Len(errs, 2)
+	for i, err := range errs {
+		var chunkErr *ChunkError
+		s.Require().True(errors.As(err, &chunkErr), err)
+		s.Equal(i, chunkErr.Index)
+		s.True(errors.Is(err, errNesting), err)
+	}
+	s.Contains(errs[0].Error(), "instantiates itself")
+}
+
+// TestHeader ensures invalid files are rejected.
+func (s *evtxSuite) TestHeader() {
+	var f fileBuilder
+	c := newChunkBuilder()
+	c.record(1, testTime, eventDataTemplate(), eventDataValues(1, false))
+	f.add(c)
+	data := f.bytes()
+
+	for name, corrupt := range map[string]func(b []byte){
+		"signature": func(b []byte) { b[0] = 'X' },
+		"checksum":  func(b []byte) { b[30] ^= 1 },
+		"truncated": nil,
+	} {
+		b := append([]byte(nil), data...)
+		if corrupt != nil {
+			corrupt(b)
+		} else {
+			b = b[:100]
+		}
+		_, err := NewReader(bytes.NewReader(b))
+		s.Error(err, name)
+	}
+}
+
+// TestOpen ensures files are read from disk.
+func (s *evtxSuite) TestOpen() {
+	var f fileBuilder
+	c := newChunkBuilder()
+	c.record(1, testTime, eventDataTemplate(), eventDataValues(1, false))
+	f.add(c)
+
+	tmp, err := ioutil.TempFile("", "*.evtx")
+	s.Require().NoError(err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(f.bytes())
+	s.Require().NoError(err)
+	s.Require().NoError(tmp.Close())
+
+	file, err := Open(tmp.Name())
+	s.Require().NoError(err)
+	defer file.Close()
+	record, err := file.Next()
+	s.Require().NoError(err)
+	s.Equal(uint64(1), record.ID)
+	_, err = file.Next()
+	s.Equal(io.EOF, err)
+
+	_, err = Open(tmp.Name() + ".missing")
+	s.Error(err)
+}
+
+// TestExported compares logs exported from Windows in testdata with their
+// rendering by wevtutil, see testdata/README.md. Synthetic files can't stand
+// for real ones, so the test fails without them.
+func (s *evtxSuite) TestExported() {
+	logs, err := filepath.Glob(filepath.Join("testdata", "*.evtx"))
+	s.Require().NoError(err)
+	s.Require().NotEmpty(logs, "No exported logs in testdata, see testdata/README.md")
+
+	multiChunk := false
+	for _, log := range logs {
+		info, err := os.Stat(log)
+		s.Require().NoError(err)
+		if info.Size() > fileHeaderBlockSize+chunkSize {
+			multiChunk = true
+		}
+
+		s.Run(filepath.Base(log), func() {
+			rendered, err := ioutil.ReadFile(strings.TrimSuffix(log, ".evtx") + ".xml")
+			s.Require().NoError(err)
+			expected := s.renderedEvents(rendered)
+
+			file, err := Open(log)
+			s.Require().NoError(err)
+			defer file.Close()
+			var events []*schema.Event
+			for {
+				record, err := file.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				s.Require().NoError(err)
+				events = append(events, record.Event)
+			}
+
+			s.Require().Len(events, len(expected))
+			for i, e := range events {
+				s.Equal(expected[i].ProviderName, e.ProviderName, "Event %d", i)
+				want, got := expected[i].Header, e.Header
+				// Channels are rendered by name.
+				want.Channel, got.Channel = 0, 0
+				s.Equal(want, got, "Event %d", i)
+				s.Equal(expected[i].Extended.UserSID, e.Extended.UserSID, "Event %d", i)
+				s.Equal(renderedProperties(expected[i].Properties), renderedProperties(e.Properties), "Event %d", i)
+			}
+		})
+	}
+	s.True(multiChunk, "No exported log spans several chunks")
+}
+
+// renderedEvents parses Event elements of wevtutil qe /f:xml output.
+func (s *evtxSuite) renderedEvents(data []byte) []*schema.Event {
+	var events []*schema.Event
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		offset := dec.InputOffset()
+		token, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		s.Require().NoError(err)
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Event" {
+			continue
+		}
+		s.Require().NoError(dec.Skip())
+		e, err := eventxml.Unmarshal(data[offset:dec.InputOffset()])
+		s.Require().NoError(err)
+		events = append(events, e)
+	}
+}
+
+// renderedProperties formats values as text, as XML renderings are not
+// typed.
+func renderedProperties(properties []schema.Property) []schema.Property {
+	rendered := make([]schema.Property, 0, len(properties))
+	for _, p := range properties {
+		rendered = append(rendered, schema.Property{Name: p.Name, Value: renderedValue(p.Value)})
+	}
+	return rendered
+}
+
+func renderedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []schema.Property:
+		return renderedProperties(v)
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, renderedValue(item))
+		}
+		return items
+	case []byte:
+		return text(v)
+	}
+	// Typed arrays are rendered as repeated elements.
+	if array := reflect.ValueOf(v); array.Kind() == reflect.Slice {
+		items := make([]interface{}, 0, array.Len())
+		for i := 0; i < array.Len(); i++ {
+			items = append(items, text(array.Index(i).Interface()))
+		}
+		return items
+	}
+	return text(v)
+}
+
+// TestValues ensures substitution values are decoded.
+func (s *evtxSuite) TestValues() {
+	for _, test := range []struct {
+		valueType uint8
+		data      []byte
+		expected  interface{}
+	}{
+		{typeNull, nil, nil},
+		{typeAnsiString, []byte("abc\x00"), "abc"},
+		{typeInt8, []byte{0xff}, int8(-1)},
+		{typeInt16, []byte{0xfe, 0xff}, int16(-2)},
+		{typeInt32, []byte{0xfd, 0xff, 0xff, 0xff}, int32(-3)},
+		{typeInt64, []byte{0xfc, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, int64(-4)},
+		{typeReal32, []byte{0, 0, 0xc0, 0x3f}, float32(1.5)},
+		{typeBool, []byte{1, 0, 0, 0}, true},
+		{typeBool, []byte{0, 0, 0, 0}, false},
+		{typeBinary, []byte{0xde, 0xad}, []byte{0xde, 0xad}},
+		{typeSizeT, []byte{1, 0, 0, 0}, uint64(1)},
+		{typeSizeT, []byte{1, 0, 0, 0, 0, 0, 0, 1}, uint64(1<<56 + 1)},
+		{typeHexInt32, []byte{0x10, 0, 0, 0}, uint32(16)},
+		{typeSID, []byte{1, 2, 0, 0, 0, 0, 0, 5, 32, 0, 0, 0, 0x20, 0x02, 0, 0}, "S-1-5-32-544"},
+		{typeSystemTime, []byte{0xe5, 0x07, 3, 0, 4, 0, 4, 0, 5, 0, 6, 0, 7, 0, 0x7b, 0}, time.Date(2021, 3, 4, 5, 6, 7, 123000000, time.UTC)},
+	} {
+		value, err := decodeValue(test.valueType, test.data)
+		s.Require().NoError(err, "type 0x%02x", test.valueType)
+		s.Equal(test.expected, value, "type 0x%02x", test.valueType)
+	}
+
+	array, err := decodeArray(typeUInt16, []byte{1, 0, 2, 0})
+	s.Require().NoError(err)
+	s.Equal([]interface{}{uint16(1), uint16(2)}, array)
+	array, err = decodeArray(typeReal64, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x7f})
+	s.Require().NoError(err)
+	s.True(math.IsInf(array.([]interface{})[0].(float64), 1))
+
+	for _, test := range []struct {
+		valueType uint8
+		data      []byte
+	}{
+		{typeUInt32, []byte{1, 2}},
+		{typeSizeT, []byte{1, 2}},
+		{typeSID, []byte{1, 2, 0, 0, 0, 0, 0, 5}},
+		{0x7f, nil},
+	} {
+		_, err := decodeValue(test.valueType, test.data)
+		s.Error(err, "type 0x%02x", test.valueType)
+	}
+	_, err = decodeArray(typeUInt32, []byte{1, 2, 3})
+	s.Error(err)
+}
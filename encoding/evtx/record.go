@@ -0,0 +1,260 @@
+package evtx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// fill maps the Event element of @nodes to the record.
+func (r *Record) fill(nodes fragment) error {
+	var event *element
+	for _, n := range nodes {
+		if e, ok := n.(*element); ok && e.name == "Event" {
+			event = e
+			break
+		}
+	}
+	if event == nil {
+		return fmt.Errorf("no Event element")
+	}
+	system := event.child("System")
+	if system == nil {
+		return fmt.Errorf("no System element")
+	}
+
+	r.Event = &schema.Event{}
+	r.fillSystem(system)
+	if data := event.child("EventData"); data != nil {
+		r.Event.Properties = eventData(data)
+	} else if data := event.child("UserData"); data != nil {
+		r.Event.Properties = userData(data)
+	}
+	return nil
+}
+
+// fillSystem maps the System element to the event header. Malformed values
+// are skipped.
+func (r *Record) fillSystem(system *element) {
+	e := r.Event
+	h := &e.Header
+	if provider := system.child("Provider"); provider != nil {
+		e.ProviderName = text(provider.attr("Name"))
+		if guid, ok := toGUID(provider.attr("Guid")); ok {
+			h.ProviderID = guid
+		}
+	}
+	h.ID = uint16(toUint(system.childValue("EventID")))
+	h.Version = uint8(toUint(system.childValue("Version")))
+	h.Level = uint8(toUint(system.childValue("Level")))
+	h.Task = uint16(toUint(system.childValue("Task")))
+	h.OpCode = uint8(toUint(system.childValue("Opcode")))
+	h.Keyword = toUint(system.childValue("Keywords"))
+	if created := system.child("TimeCreated"); created != nil {
+		h.TimeStamp = toTime(created.attr("SystemTime"))
+	}
+
+	if correlation := system.child("Correlation"); correlation != nil {
+		if guid, ok := toGUID(correlation.attr("ActivityID")); ok {
+			h.ActivityID = guid
+		}
+		if guid, ok := toGUID(correlation.attr("RelatedActivityID")); ok {
+			e.Extended.ActivityID = &guid
+		}
+	}
+	if execution := system.child("Execution"); execution != nil {
+		h.ProcessID = uint32(toUint(execution.attr("ProcessID")))
+		h.ThreadID = uint32(toUint(execution.attr("ThreadID")))
+		h.KernelTime = uint32(toUint(execution.attr("KernelTime")))
+		h.UserTime = uint32(toUint(execution.attr("UserTime")))
+		h.ProcessorTime = toUint(execution.attr("ProcessorTime"))
+		if session := execution.attr("SessionID"); session != nil {
+			id := uint32(toUint(session))
+			e.Extended.SessionID = &id
+		}
+	}
+	if security := system.child("Security"); security != nil {
+		e.Extended.UserSID = text(security.attr("UserID"))
+	}
+
+	r.Channel = text(system.childValue("Channel"))
+	r.Computer = text(system.childValue("Computer"))
+}
+
+// eventData maps Data elements to properties. Repeated names are merged into
+// arrays and unnamed ones are named Param1, Param2... by position.
+func eventData(data *element) []schema.Property {
+	var properties []schema.Property
+	index := 0
+	for _, n := range data.children {
+		e, ok := n.(*element)
+		if !ok || e.name != "Data" {
+			continue
+		}
+		index++
+		name := text(e.attr("Name"))
+		if name == "" {
+			name = fmt.Sprintf("Param%d", index)
+		}
+		properties = appendValue(properties, name, e.value())
+	}
+	return properties
+}
+
+// userData maps children of the first element in UserData to properties.
+func userData(data *element) []schema.Property {
+	for _, n := range data.children {
+		if wrapper, ok := n.(*element); ok {
+			properties, _ := wrapper.value().([]schema.Property)
+			return properties
+		}
+	}
+	return nil
+}
+
+// appendValue appends a property or turns the last one into an array if it
+// has the same @name.
+func appendValue(properties []schema.Property, name string, value interface{}) []schema.Property {
+	if n := len(properties); n != 0 && properties[n-1].Name == name {
+		last := &properties[n-1]
+		if items, ok := last.Value.([]interface{}); ok {
+			last.Value = append(items, value)
+		} else {
+			last.Value = []interface{}{last.Value, value}
+		}
+		return properties
+	}
+	return append(properties, schema.Property{Name: name, Value: value})
+}
+
+func (e *element) child(name string) *element {
+	for _, n := range e.children {
+		if child, ok := n.(*element); ok && child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func (e *element) childValue(name string) interface{} {
+	if child := e.child(name); child != nil {
+		return child.value()
+	}
+	return nil
+}
+
+func (e *element) attr(name string) interface{} {
+	for _, a := range e.attrs {
+		if a.name == name {
+			return join(a.value)
+		}
+	}
+	return nil
+}
+
+// value returns the element content: properties of child elements, the only
+// value as is or values joined into a string.
+func (e *element) value() interface{} {
+	var properties []schema.Property
+	for _, n := range e.children {
+		if child, ok := n.(*element); ok {
+			properties = appendValue(properties, child.name, child.value())
+		}
+	}
+	if properties != nil {
+		return properties
+	}
+	return join(e.children)
+}
+
+func join(nodes []node) interface{} {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	var b strings.Builder
+	for _, n := range nodes {
+		b.WriteString(text(n))
+	}
+	return b.String()
+}
+
+// text formats a value as Event Viewer does.
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return strings.ToUpper(fmt.Sprintf("%x", v))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toUint converts integers and their decimal or hex strings to uint64. It
+// returns 0 for other values.
+func toUint(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uint64:
+		return v
+	case int8:
+		return uint64(v)
+	case int16:
+		return uint64(v)
+	case int32:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	case string:
+		s := strings.TrimSpace(v)
+		var x uint64
+		var err error
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			x, err = strconv.ParseUint(s[2:], 16, 64)
+		} else {
+			x, err = strconv.ParseUint(s, 10, 64)
+		}
+		if err == nil {
+			return x
+		}
+	}
+	return 0
+}
+
+func toGUID(v interface{}) (schema.GUID, bool) {
+	switch v := v.(type) {
+	case schema.GUID:
+		return v, true
+	case string:
+		g, err := schema.ParseGUID(v)
+		return g, err == nil
+	}
+	return schema.GUID{}, false
+}
+
+func toTime(v interface{}) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,370 @@
+// Package jsonl writes events as JSON Lines: one JSON object per line.
+//
+// Every object has the same stable set of fields in the same order, so the
+// output is diffable and safe to parse by field position or name:
+//
+//	{
+//	  "timestamp": "2021-03-04T05:06:07.123456789Z",
+//	  "provider": {"guid": "{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}", "name": "Microsoft-Windows-Kernel-Process"},
+//	  "event": {"id": 1, "version": 3, "channel": 16, "level": 4, "level_name": "Information",
+//	            "opcode": 1, "task": 1, "keywords": "0x8000000000000010"},
+//	  "process_id": 4,
+//	  "thread_id": 8,
+//	  "activity_id": "{00000000-0000-0000-0000-000000000000}",
+//	  "flags": 576,
+//	  "kernel_time": 0,
+//	  "user_time": 0,
+//	  "processor_time": 0,
+//	  "properties": {"ProcessID": 1234, ...},
+//	  "extended": {"session_id": 1, ...},
+//	  "rundown": false,
+//	  "during_capture_state": false
+//	}
+//
+// "provider.name" is empty if the provider is unknown. "properties" keep the
+// event order. "extended" has only the items present in the event:
+// "session_id", "activity_id", "user_sid", "instance" with "id", "parent_id"
+// and "parent_guid", "stack" with "matched_id", "addresses" (hex strings),
+// "kernel_frames", "kernel_stack_key" and "user_stack_key".
+//
+// New fields could be appended in the future, existing ones are not renamed
+// or removed.
+package jsonl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Top level field names, they could be used in Options.Fields.
+const (
+	FieldTimestamp     = "timestamp"
+	FieldProvider      = "provider"
+	FieldEvent         = "event"
+	FieldProcessID     = "process_id"
+	FieldThreadID      = "thread_id"
+	FieldActivityID    = "activity_id"
+	FieldFlags         = "flags"
+	FieldKernelTime    = "kernel_time"
+	FieldUserTime      = "user_time"
+	FieldProcessorTime = "processor_time"
+	FieldProperties    = "properties"
+	FieldExtended      = "extended"
+
+	FieldRundown            = "rundown"
+	FieldDuringCaptureState = "during_capture_state"
+)
+
+//nolint:gochecknoglobals
+var knownFields = map[string]bool{
+	FieldTimestamp: true, FieldProvider: true, FieldEvent: true,
+	FieldProcessID: true, FieldThreadID: true, FieldActivityID: true,
+	FieldFlags: true, FieldKernelTime: true, FieldUserTime: true,
+	FieldProcessorTime: true, FieldProperties: true, FieldExtended: true,
+	FieldRundown: true, FieldDuringCaptureState: true,
+}
+
+// ValueMode tells how property values are written.
+type ValueMode int
+
+const (
+	// ValuesTyped writes numbers and booleans as JSON numbers and booleans.
+	// NaN and infinite floats are written as strings as JSON doesn't support
+	// them.
+	ValuesTyped ValueMode = iota
+
+	// ValuesString writes every scalar property value as a string, so
+	// consumers with strict schemas get the same type for a field whatever
+	// the event is.
+	ValuesString
+)
+
+// TimeFormat tells how timestamps are written.
+type TimeFormat int
+
+const (
+	// TimeRFC3339Nano writes timestamps as RFC 3339 strings in UTC with
+	// nanoseconds.
+	TimeRFC3339Nano TimeFormat = iota
+
+	// TimeRaw writes timestamps as FILETIME numbers: 100-nanosecond
+	// intervals since January 1, 1601 (UTC), as ETW reports them.
+	TimeRaw
+)
+
+// Options configure Encoder. Zero Options write all the fields with typed
+// values and RFC 3339 timestamps.
+type Options struct {
+	Values ValueMode
+	Time   TimeFormat
+
+	// Fields is an allowlist of top level fields, see Field* constants. All
+	// the fields are written if empty.
+	Fields []string
+
+	// Properties is an allowlist of top level properties. All the properties
+	// are written if empty.
+	Properties []string
+}
+
+// Validate checks modes and field names are known.
+func (o Options) Validate() error {
+	if o.Values < ValuesTyped || o.Values > ValuesString {
+		return fmt.Errorf("unknown value mode %d", o.Values)
+	}
+	if o.Time < TimeRFC3339Nano || o.Time > TimeRaw {
+		return fmt.Errorf("unknown time format %d", o.Time)
+	}
+	for _, f := range o.Fields {
+		if !knownFields[f] {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+// Encoder writes events to a stream. It's not safe for concurrent use.
+type Encoder struct {
+	w       io.Writer
+	options Options
+	fields  map[string]bool
+	props   map[string]bool
+	buf     bytes.Buffer
+}
+
+// NewEncoder creates an Encoder writing to @w.
+func NewEncoder(w io.Writer, options Options) (*Encoder, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return &Encoder{
+		w:       w,
+		options: options,
+		fields:  set(options.Fields),
+		props:   set(options.Properties),
+	}, nil
+}
+
+// Encode writes @e as a single line.
+func (enc *Encoder) Encode(e *schema.Event) error {
+	data, err := json.Marshal(enc.object(e))
+	if err != nil {
+		return fmt.Errorf("failed to encode event; %w", err)
+	}
+	enc.buf.Reset()
+	enc.buf.Write(data)
+	enc.buf.WriteByte('\n')
+	_, err = enc.w.Write(enc.buf.Bytes())
+	return err
+}
+
+// Marshal returns @e encoded with @options without the trailing newline.
+func Marshal(e *schema.Event, options Options) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(e); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// object builds the ordered JSON object of @e.
+func (enc *Encoder) object(e *schema.Event) object {
+	h := &e.Header
+	var o object
+	o.add(enc.fields, FieldTimestamp, enc.time(h.TimeStamp))
+	o.add(enc.fields, FieldProvider, object{
+		{"guid", h.ProviderID.String()},
+		{"name", e.ProviderName},
+	})
+	o.add(enc.fields, FieldEvent, object{
+		{"id", h.ID},
+		{"version", h.Version},
+		{"channel", h.Channel},
+		{"level", h.Level},
+		{"level_name", schema.LevelName(h.Level)},
+		{"opcode", h.OpCode},
+		{"task", h.Task},
+		{"keywords", fmt.Sprintf("0x%016x", h.Keyword)},
+	})
+	o.add(enc.fields, FieldProcessID, h.ProcessID)
+	o.add(enc.fields, FieldThreadID, h.ThreadID)
+	o.add(enc.fields, FieldActivityID, h.ActivityID.String())
+	o.add(enc.fields, FieldFlags, h.Flags)
+	o.add(enc.fields, FieldKernelTime, h.KernelTime)
+	o.add(enc.fields, FieldUserTime, h.UserTime)
+	o.add(enc.fields, FieldProcessorTime, h.ProcessorTime)
+	if allowed(enc.fields, FieldProperties) {
+		props := object{}
+		for _, p := range e.Properties {
+			props.add(enc.props, p.Name, enc.value(p.Value))
+		}
+		o = append(o, member{FieldProperties, props})
+	}
+	o.add(enc.fields, FieldExtended, enc.extended(&e.Extended))
+	o.add(enc.fields, FieldRundown, h.Rundown)
+	o.add(enc.fields, FieldDuringCaptureState, h.DuringCaptureState)
+	return o
+}
+
+func (enc *Encoder) extended(x *schema.Extended) object {
+	o := object{}
+	if x.SessionID != nil {
+		o = append(o, member{"session_id", *x.SessionID})
+	}
+	if x.ActivityID != nil {
+		o = append(o, member{"activity_id", x.ActivityID.String()})
+	}
+	if x.UserSID != "" {
+		o = append(o, member{"user_sid", x.UserSID})
+	}
+	if i := x.InstanceInfo; i != nil {
+		o = append(o, member{"instance", object{
+			{"id", i.InstanceID},
+			{"parent_id", i.ParentInstanceID},
+			{"parent_guid", i.ParentGUID.String()},
+		}})
+	}
+	if s := x.StackTrace; s != nil {
+		addresses := make([]string, len(s.Addresses))
+		for i, a := range s.Addresses {
+			addresses[i] = fmt.Sprintf("0x%x", a)
+		}
+		o = append(o, member{"stack", object{
+			{"matched_id", s.MatchedID},
+			{"addresses", addresses},
+			{"kernel_frames", s.KernelFrames},
+			{"kernel_stack_key", s.KernelStackKey},
+			{"user_stack_key", s.UserStackKey},
+		}})
+	}
+	return o
+}
+
+// time formats @t according to Options.Time.
+func (enc *Encoder) time(t time.Time) interface{} {
+	if enc.options.Time == TimeRaw {
+		return schema.ToFileTime(t)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// value converts a property value to what json.Marshal writes as needed.
+// Structures keep the order of their fields; byte slices are written as hex.
+func (enc *Encoder) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []schema.Property:
+		o := make(object, 0, len(v))
+		for _, p := range v {
+			o = append(o, member{p.Name, enc.value(p.Value)})
+		}
+		return o
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = enc.value(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = enc.value(item)
+		}
+		return a
+	case []string:
+		return v
+	case []byte:
+		return hex.EncodeToString(v)
+	case time.Time:
+		return enc.time(v)
+	case string:
+		return v
+	case float32:
+		return enc.float(float64(v), 32)
+	case float64:
+		return enc.float(v, 64)
+	}
+	if enc.options.Values == ValuesString {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// float writes floats as the shortest text keeping the precision of @bits.
+func (enc *Encoder) float(f float64, bits int) interface{} {
+	if enc.options.Values == ValuesString || math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, bits)
+	}
+	if bits == 32 {
+		return float32(f)
+	}
+	return f
+}
+
+// allowed tells if @name passes @allowlist. Empty allowlist passes all.
+func allowed(allowlist map[string]bool, name string) bool {
+	return len(allowlist) == 0 || allowlist[name]
+}
+
+func set(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	return m
+}
+
+// object is a JSON object keeping the order of its members.
+type object []member
+
+type member struct {
+	name  string
+	value interface{}
+}
+
+// add appends a member if it passes @allowlist.
+func (o *object) add(allowlist map[string]bool, name string, value interface{}) {
+	if allowed(allowlist, name) {
+		*o = append(*o, member{name, value})
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", m.name, err)
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
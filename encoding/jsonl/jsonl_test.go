@@ -0,0 +1,169 @@
+package jsonl
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestJSONL(t *testing.T) {
+	suite.Run(t, new(jsonlSuite))
+}
+
+type jsonlSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var testProvider = schema.GUID{
+	Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+	Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+}
+
+func testEvent() *schema.Event {
+	session := uint32(1)
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{
+				ID: 1, Version: 3, Channel: 16, Level: 4, OpCode: 1, Task: 1,
+				Keyword: 0x8000000000000010,
+			},
+			ThreadID:   8,
+			ProcessID:  4,
+			TimeStamp:  time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC),
+			ProviderID: testProvider,
+			Flags:      576,
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+		Properties: []schema.Property{
+			{Name: "ProcessID", Value: uint32(1234)},
+			{Name: "Point", Value: []schema.Property{{Name: "Y", Value: 1}, {Name: "X", Value: 2}}},
+		},
+		Extended: schema.Extended{
+			SessionID: &session,
+			UserSID:   "S-1-5-18",
+			StackTrace: &schema.StackTrace{
+				MatchedID: 7,
+				Addresses: []uint64{0xfffff80000001000, 0x7ff600001000},
+			},
+		},
+	}
+}
+
+// TestSchema ensures the exact output of the documented schema.
+func (s *jsonlSuite) TestSchema() {
+	data, err := Marshal(testEvent(), Options{})
+	s.Require().NoError(err)
+	s.Equal(`{"timestamp":"2021-03-04T05:06:07.1234567Z",`+
+		`"provider":{"guid":"{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}","name":"Microsoft-Windows-Kernel-Process"},`+
+		`"event":{"id":1,"version":3,"channel":16,"level":4,"level_name":"Information","opcode":1,"task":1,"keywords":"0x8000000000000010"},`+
+		`"process_id":4,"thread_id":8,"activity_id":"{00000000-0000-0000-0000-000000000000}",`+
+		`"flags":576,"kernel_time":0,"user_time":0,"processor_time":0,`+
+		`"properties":{"ProcessID":1234,"Point":{"Y":1,"X":2}},`+
+		`"extended":{"session_id":1,"user_sid":"S-1-5-18",`+
+		`"stack":{"matched_id":7,"addresses":["0xfffff80000001000","0x7ff600001000"],"kernel_frames":0,"kernel_stack_key":0,"user_stack_key":0}},`+
+		`"rundown":false,"during_capture_state":false}`,
+		string(data))
+}
+
+// TestRundown ensures rundown marks are written.
+func (s *jsonlSuite) TestRundown() {
+	e := testEvent()
+	e.Header.Rundown = true
+	data, err := Marshal(e, Options{Fields: []string{FieldRundown, FieldDuringCaptureState}})
+	s.Require().NoError(err)
+	s.Equal(`{"rundown":true,"during_capture_state":false}`, string(data))
+}
+
+// TestValues ensures property values in both modes, including ones JSON
+// can't represent as is.
+func (s *jsonlSuite) TestValues() {
+	for _, c := range []struct {
+		name   string
+		value  interface{}
+		typed  string
+		string string
+	}{
+		{"Bool", true, `true`, `"true"`},
+		{"Uint64 beyond float64 precision", uint64(math.MaxUint64), `18446744073709551615`, `"18446744073709551615"`},
+		{"Int64 min", int64(math.MinInt64), `-9223372036854775808`, `"-9223372036854775808"`},
+		{"Float32", float32(0.1), `0.1`, `"0.1"`},
+		{"NaN", math.NaN(), `"NaN"`, `"NaN"`},
+		{"Infinity", float32(math.Inf(1)), `"+Inf"`, `"+Inf"`},
+		{"Bytes", []byte{0xde, 0xad}, `"dead"`, `"dead"`},
+		{"Nil", nil, `null`, `null`},
+		{"HTML", "<a&b>", `"\u003ca\u0026b\u003e"`, `"\u003ca\u0026b\u003e"`},
+		{"Control characters", "a\nb\x00", `"a\nb\u0000"`, `"a\nb\u0000"`},
+		{"Invalid UTF-8", "a\xffb", "\"a\uFFFDb\"", "\"a\uFFFDb\""},
+		{"Array", []interface{}{"a", int64(-1)}, `["a",-1]`, `["a","-1"]`},
+		{"Structure", []schema.Property{{Name: "Y", Value: 1}, {Name: "X", Value: 2}}, `{"Y":1,"X":2}`, `{"Y":"1","X":"2"}`},
+		{"Map", map[string]interface{}{"b": uint8(2), "a": "1"}, `{"a":"1","b":2}`, `{"a":"1","b":"2"}`},
+	} {
+		e := &schema.Event{Properties: []schema.Property{{Name: "V", Value: c.value}}}
+		for mode, expected := range map[ValueMode]string{ValuesTyped: c.typed, ValuesString: c.string} {
+			data, err := Marshal(e, Options{Values: mode, Fields: []string{FieldProperties}})
+			s.Require().NoError(err, c.name)
+			s.Equal(`{"properties":{"V":`+expected+`}}`, string(data), "%s, mode %d", c.name, mode)
+		}
+	}
+}
+
+// TestRawTime ensures FILETIME timestamps, both in the header and properties.
+func (s *jsonlSuite) TestRawTime() {
+	e := testEvent()
+	e.Properties = []schema.Property{{Name: "Start", Value: e.Header.TimeStamp}}
+	data, err := Marshal(e, Options{Time: TimeRaw, Fields: []string{FieldTimestamp, FieldProperties}})
+	s.Require().NoError(err)
+	s.Equal(`{"timestamp":132593079671234567,"properties":{"Start":132593079671234567}}`, string(data))
+	s.Equal(e.Header.TimeStamp, schema.FromFileTime(132593079671234567))
+}
+
+// TestAllowlists ensures fields and properties are filtered keeping the order.
+func (s *jsonlSuite) TestAllowlists() {
+	data, err := Marshal(testEvent(), Options{
+		Fields:     []string{FieldProperties, FieldProcessID},
+		Properties: []string{"Point", "ProcessID", "Unknown"},
+	})
+	s.Require().NoError(err)
+	s.Equal(`{"process_id":4,"properties":{"ProcessID":1234,"Point":{"Y":1,"X":2}}}`, string(data))
+
+	_, err = NewEncoder(&bytes.Buffer{}, Options{Fields: []string{"pid"}})
+	s.Error(err, "Unknown field")
+	_, err = NewEncoder(&bytes.Buffer{}, Options{Values: ValuesString + 1})
+	s.Error(err, "Unknown value mode")
+	_, err = NewEncoder(&bytes.Buffer{}, Options{Time: TimeRaw + 1})
+	s.Error(err, "Unknown time format")
+}
+
+// TestStream ensures every event is a valid JSON on its own line.
+func (s *jsonlSuite) TestStream() {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf, Options{})
+	s.Require().NoError(err)
+
+	e := testEvent()
+	e.Properties = append(e.Properties, schema.Property{Name: "Text", Value: "line\nbreak"})
+	for i := 0; i < 3; i++ {
+		e.Header.ID = uint16(i)
+		s.Require().NoError(enc.Encode(e))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	s.Require().Len(lines, 3)
+	for i, line := range lines {
+		var decoded struct {
+			Event struct {
+				ID int `json:"id"`
+			} `json:"event"`
+		}
+		s.Require().NoError(json.Unmarshal([]byte(line), &decoded))
+		s.Equal(i, decoded.Event.ID)
+	}
+}
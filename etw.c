@@ -1,5 +1,6 @@
 #include "etw.h"
 #include <in6addr.h>
+#include <intrin.h>
 
 // handleEvent is exported from Go to CGO. Unfortunately CGO can't vary calling
 // convention of exported functions (or we don't know da way), so wrap the Go's
@@ -10,16 +11,111 @@ void WINAPI stdcallHandleEvent(PEVENT_RECORD e) {
     handleEvent(e);
 }
 
+#ifndef PROCESS_TRACE_MODE_RAW_TIMESTAMP
+#define PROCESS_TRACE_MODE_RAW_TIMESTAMP 0x00000001
+#endif
+
+// Clock types of WNODE_HEADER.ClientContext.
+#define TRACE_CLOCK_QPC 1
+#define TRACE_CLOCK_SYSTEM_TIME 2
+#define TRACE_CLOCK_CPU_CYCLES 3
+
+// getSystemTime calls GetSystemTimePreciseAsFileTime resolving it at runtime
+// as it's missing before Windows 8, the coarse time is used there.
+static LONGLONG getSystemTime() {
+    typedef VOID (WINAPI *GetSystemTimeFunc)(LPFILETIME);
+    static GetSystemTimeFunc getSystemTimePrecise = NULL;
+    static BOOL resolved = FALSE;
+    FILETIME ft;
+    ULARGE_INTEGER time;
+
+    if (!resolved) {
+        HMODULE kernel32 = GetModuleHandleW(L"kernel32.dll");
+        if (kernel32 != NULL) {
+            getSystemTimePrecise = (GetSystemTimeFunc)GetProcAddress(kernel32, "GetSystemTimePreciseAsFileTime");
+        }
+        resolved = TRUE;
+    }
+    if (getSystemTimePrecise != NULL) {
+        getSystemTimePrecise(&ft);
+    } else {
+        GetSystemTimeAsFileTime(&ft);
+    }
+    time.LowPart = ft.dwLowDateTime;
+    time.HighPart = ft.dwHighDateTime;
+    return (LONGLONG)time.QuadPart;
+}
+
 // OpenTraceHelper helps to access EVENT_TRACE_LOGFILEW union fields and pass
 // pointer to C not warning CGO checker.
-TRACEHANDLE OpenTraceHelper(LPWSTR name, PVOID ctx) {
+//
+// The trace is opened with raw timestamps: StackWalk events refer to events by
+// the timestamp in the session clock, which is lost once ETW converts header
+// timestamps to FILETIME. The clock of the session is reported in @clock
+// along with a counter value taken at the same moment as the system time, so
+// Go converts timestamps itself.
+TRACEHANDLE OpenTraceHelper(LPWSTR name, PVOID ctx, TraceClock* clock) {
     EVENT_TRACE_LOGFILEW trace = {0};
+    LARGE_INTEGER counter;
     trace.LoggerName = name;
     trace.Context = ctx;
-    trace.ProcessTraceMode = PROCESS_TRACE_MODE_REAL_TIME | PROCESS_TRACE_MODE_EVENT_RECORD;
+    trace.ProcessTraceMode = PROCESS_TRACE_MODE_REAL_TIME | PROCESS_TRACE_MODE_EVENT_RECORD |
+        PROCESS_TRACE_MODE_RAW_TIMESTAMP;
     trace.EventRecordCallback = stdcallHandleEvent;
 
-    return OpenTraceW(&trace);
+    TRACEHANDLE handle = OpenTraceW(&trace);
+    if (handle == INVALID_PROCESSTRACE_HANDLE) {
+        return handle;
+    }
+
+    // Zero stands for the default clock which is QPC.
+    clock->Type = trace.LogfileHeader.ReservedFlags;
+    if (clock->Type == 0) {
+        clock->Type = TRACE_CLOCK_QPC;
+    }
+    clock->Frequency = 0;
+    clock->SyncCounter = 0;
+    switch (clock->Type) {
+    case TRACE_CLOCK_QPC:
+        clock->Frequency = trace.LogfileHeader.PerfFreq.QuadPart;
+        if (clock->Frequency == 0 && QueryPerformanceFrequency(&counter)) {
+            clock->Frequency = counter.QuadPart;
+        }
+        QueryPerformanceCounter(&counter);
+        clock->SyncCounter = counter.QuadPart;
+        break;
+    case TRACE_CLOCK_CPU_CYCLES:
+#if defined(__x86_64__) || defined(__i386__)
+        // Cycles can't be converted on other platforms, Frequency is left 0.
+        clock->Frequency = (LONGLONG)trace.LogfileHeader.CpuSpeedInMHz * 1000000;
+        clock->SyncCounter = (LONGLONG)__rdtsc();
+#endif
+        break;
+    }
+    clock->SyncTime = getSystemTime();
+
+    return handle;
+}
+
+// TraceSetInformationHelper calls TraceSetInformation resolving it at runtime
+// as it's missing in some MinGW versions. Information class is passed as int
+// for the same reason.
+ULONG TraceSetInformationHelper(TRACEHANDLE session, int infoClass, PVOID info, ULONG length) {
+    typedef ULONG (WINAPI *TraceSetInformationFunc)(TRACEHANDLE, int, PVOID, ULONG);
+    static TraceSetInformationFunc traceSetInformation = NULL;
+
+    if (traceSetInformation == NULL) {
+        // advapi32.dll is already loaded as ETW functions are linked from it.
+        HMODULE advapi = GetModuleHandleW(L"advapi32.dll");
+        if (advapi == NULL) {
+            return ERROR_NOT_SUPPORTED;
+        }
+        traceSetInformation = (TraceSetInformationFunc)GetProcAddress(advapi, "TraceSetInformation");
+        if (traceSetInformation == NULL) {
+            return ERROR_NOT_SUPPORTED;
+        }
+    }
+    return traceSetInformation(session, infoClass, info, length);
 }
 
 int getLengthFromProperty(PEVENT_RECORD event, PROPERTY_DATA_DESCRIPTOR* dataDescriptor, UINT32* length) {
@@ -7,9 +7,24 @@
 #include <evntcons.h>
 #include <tdh.h>
 
+// TraceClock describes the clock of raw event timestamps: its type (see
+// WNODE_HEADER.ClientContext), ticks per second and a counter value taken
+// along with the system time (FILETIME) to convert timestamps.
+typedef struct _TraceClock {
+    ULONG Type;
+    LONGLONG Frequency;
+    LONGLONG SyncCounter;
+    LONGLONG SyncTime;
+} TraceClock;
+
 // OpenTraceHelper helps to access EVENT_TRACE_LOGFILEW union fields and pass
-// pointer to C not warning CGO checker.
-TRACEHANDLE OpenTraceHelper(LPWSTR name, PVOID ctx);
+// pointer to C not warning CGO checker. Events are delivered with raw
+// timestamps, @clock is filled to convert them.
+TRACEHANDLE OpenTraceHelper(LPWSTR name, PVOID ctx, TraceClock* clock);
+
+// TraceSetInformationHelper calls TraceSetInformation resolving it at runtime
+// as it's missing in some MinGW versions.
+ULONG TraceSetInformationHelper(TRACEHANDLE session, int infoClass, PVOID info, ULONG length);
 
 // GetArraySize extracts a size of array located at property @i.
 ULONG GetArraySize(PEVENT_RECORD event, PTRACE_EVENT_INFO info, int idx, UINT32* count);
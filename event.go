@@ -9,7 +9,6 @@ package etw
 import "C"
 import (
 	"fmt"
-	"math"
 	"time"
 	"unsafe"
 
@@ -25,6 +24,14 @@ import (
 type Event struct {
 	Header      EventHeader
 	eventRecord C.PEVENT_RECORD
+
+	// decodeObserver is notified of EventProperties failures (see Metrics).
+	decodeObserver decodeObserver
+}
+
+// decodeObserver is notified of event properties decoding failures.
+type decodeObserver interface {
+	decodeFailed(header *EventHeader)
 }
 
 // EventHeader contains an information that is common for every ETW event
@@ -47,6 +54,18 @@ type EventHeader struct {
 	KernelTime    uint32
 	UserTime      uint32
 	ProcessorTime uint64
+
+	// Rundown is set for events describing the provider state rather than
+	// live activity, i.e. events with DC_Start/DC_Stop opcodes. It's not a
+	// part of EVENT_HEADER.
+	Rundown bool
+
+	// DuringCaptureState is set for events written by the provider while
+	// Trace.CaptureState or Provider.CaptureState was waiting for its state.
+	// It helps with providers writing rundown events with other opcodes, but
+	// it's a guess: live events written meanwhile are marked as well. It's
+	// not a part of EVENT_HEADER.
+	DuringCaptureState bool
 }
 
 // HasCPUTime returns true if the event has separate UserTime and KernelTime
@@ -95,6 +114,14 @@ type EventDescriptor struct {
 //
 // Take a look at `TestParsing` for possible EventProperties values.
 func (e *Event) EventProperties() (map[string]interface{}, error) {
+	properties, err := e.parseProperties()
+	if err != nil && e.decodeObserver != nil {
+		e.decodeObserver.decodeFailed(&e.Header)
+	}
+	return properties, err
+}
+
+func (e *Event) parseProperties() (map[string]interface{}, error) {
 	if e.eventRecord == nil {
 		return nil, fmt.Errorf("usage of Event is invalid outside of EventCallback")
 	}
@@ -153,6 +180,14 @@ type EventInstanceInfo struct {
 type EventStackTrace struct {
 	MatchedID uint64
 	Addresses []uint64
+
+	// Fields below are set by StackCorrelator only. Addresses hold
+	// KernelFrames kernel frames followed by user frames. Stack keys are
+	// non-zero if stack caching is enabled; frames of known keys are
+	// included into Addresses.
+	KernelFrames   int
+	KernelStackKey uint64
+	UserStackKey   uint64
 }
 
 // ExtendedInfo extracts ExtendedEventInfo structure from native buffers of
@@ -498,15 +533,6 @@ func windowsGUIDToGo(guid C.GUID) windows.GUID {
 	}
 }
 
-// stampToTime translates FileTime to a golang time. Same as in standard packages.
-func stampToTime(quadPart C.LONGLONG) time.Time {
-	ft := windows.Filetime{
-		HighDateTime: uint32(quadPart >> 32),
-		LowDateTime:  uint32(quadPart & math.MaxUint32),
-	}
-	return time.Unix(0, ft.Nanoseconds())
-}
-
 // Creates UTF16 string from raw parts.
 //
 // Actually in go we have no way to make a slice from raw parts, ref:
@@ -0,0 +1,575 @@
+// Package otlp exports events to an OpenTelemetry collector as OTLP log
+// records over HTTP using the JSON encoding.
+//
+// Every event becomes a LogRecord:
+//   - timeUnixNano is the event timestamp;
+//   - severityNumber and severityText come from the event level;
+//   - attributes hold the provider, event descriptor, process and thread IDs
+//     and decoded properties prefixed with Options.PropertyPrefix;
+//   - etw.rundown and etw.during_capture_state are set for rundown events;
+//   - traceId is the activity ID if it's set.
+//
+// Records are batched and sent from a background goroutine. Failed batches
+// are retried with exponential backoff if the collector asks for it.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/internal/export"
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Default Options.
+const (
+	defaultBatchSize      = 512
+	defaultQueueSize      = 4096
+	defaultFlushInterval  = 5 * time.Second
+	defaultTimeout        = 10 * time.Second
+	defaultMaxRetries     = 5
+	defaultMinBackoff     = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultPropertyPrefix = "etw.data."
+)
+
+// scopeName is the instrumentation scope of exported records.
+const scopeName = "github.com/gaelmuller/etw"
+
+// ErrExporterStopped is returned by Exporter methods after Shutdown.
+//
+//nolint:gochecknoglobals
+var ErrExporterStopped = errors.New("exporter is stopped")
+
+// Options configure Exporter. Zero values stand for defaults.
+type Options struct {
+	// Endpoint is the full URL of the logs endpoint, e.g.
+	// http://localhost:4318/v1/logs.
+	Endpoint string
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+
+	// Resource are attributes of the resource, e.g. service.name.
+	Resource map[string]string
+
+	// BatchSize is the maximal number of records in a request. Defaults to
+	// 512.
+	BatchSize int
+
+	// QueueSize is the number of records waiting to be sent. Records
+	// exported to a full queue are dropped. Defaults to 4096.
+	QueueSize int
+
+	// FlushInterval is how often incomplete batches are sent. Defaults to 5s.
+	FlushInterval time.Duration
+
+	// Timeout limits every request. Defaults to 10s.
+	Timeout time.Duration
+
+	// MaxRetries limits retries of a batch. Defaults to 5, negative values
+	// disable retries.
+	MaxRetries int
+
+	// MinBackoff is a delay before the first retry. It's doubled with every
+	// retry up to MaxBackoff. Retry-After of the response is used instead
+	// if set. Defaults to 1s and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// PropertyPrefix is prepended to property names to make attribute keys.
+	// Defaults to "etw.data.".
+	PropertyPrefix string
+
+	// Client sends requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// OnError is called with errors of dropped batches.
+	OnError func(error)
+}
+
+// Stats are counters of an Exporter.
+type Stats struct {
+	// Exported is a number of records accepted by the collector.
+	Exported uint64
+
+	// Dropped is a number of records dropped due to the full queue.
+	Dropped uint64
+
+	// Failed is a number of records the collector failed or rejected.
+	Failed uint64
+
+	// Retries is a number of retried requests.
+	Retries uint64
+}
+
+// Exporter sends events to a collector.
+type Exporter struct {
+	options  Options
+	resource []keyValue
+	queue    *export.Queue
+}
+
+// NewExporter starts an exporter.
+func NewExporter(options Options) (*Exporter, error) {
+	if options.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is not set")
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = defaultMaxRetries
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultMinBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	if options.PropertyPrefix == "" {
+		options.PropertyPrefix = defaultPropertyPrefix
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+
+	keys := make([]string, 0, len(options.Resource))
+	for k := range options.Resource {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resource := make([]keyValue, len(keys))
+	for i, k := range keys {
+		resource[i] = keyValue{Key: k, Value: stringValue(options.Resource[k])}
+	}
+
+	e := &Exporter{options: options, resource: resource}
+	e.queue = export.NewQueue(export.Options{
+		Size:          options.QueueSize,
+		BatchSize:     options.BatchSize,
+		FlushInterval: options.FlushInterval,
+		Send:          e.send,
+		Stopped:       ErrExporterStopped,
+	})
+	return e, nil
+}
+
+// Export converts @event to a log record and queues it. @event could be
+// reused once Export returns. It returns false if the record is dropped.
+func (e *Exporter) Export(event *schema.Event) bool {
+	return e.queue.Push(e.convert(event, time.Now()))
+}
+
+// Flush sends queued records and waits until they are sent or @ctx is done.
+// It returns the error of the last failed batch.
+func (e *Exporter) Flush(ctx context.Context) error {
+	return e.queue.Flush(ctx)
+}
+
+// Shutdown stops accepting records and sends queued ones. Sending is aborted
+// once @ctx is done.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return e.queue.Shutdown(ctx)
+}
+
+// Stats returns counters of the exporter.
+func (e *Exporter) Stats() Stats {
+	stats := e.queue.Stats()
+	return Stats{
+		Exported: stats.Sent,
+		Dropped:  stats.Dropped,
+		Failed:   stats.Failed,
+		Retries:  stats.Retries,
+	}
+}
+
+// send posts @batch of log records retrying if possible. Failed records are
+// counted and reported to OnError.
+func (e *Exporter) send(batch []interface{}) error {
+	records := make([]logRecord, len(batch))
+	for i, r := range batch {
+		records[i] = *r.(*logRecord)
+	}
+	body, err := json.Marshal(exportRequest{ResourceLogs: []resourceLogs{{
+		Resource:  resource{Attributes: e.resource},
+		ScopeLogs: []scopeLogs{{Scope: scope{Name: scopeName}, LogRecords: records}},
+	}}})
+	if err == nil {
+		err = e.post(body, len(batch))
+	}
+	if err != nil {
+		e.queue.AddFailed(len(batch))
+		if e.options.OnError != nil {
+			e.options.OnError(err)
+		}
+	}
+	return err
+}
+
+// post sends @body with retries.
+func (e *Exporter) post(body []byte, count int) error {
+	ctx := e.queue.Context()
+	backoff := export.Backoff{Min: e.options.MinBackoff, Max: e.options.MaxBackoff}
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := e.postOnce(ctx, body, count)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= e.options.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := backoff.Next()
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		if !export.Wait(ctx, delay) {
+			return err
+		}
+		e.queue.AddRetry()
+	}
+}
+
+// permanentError is a response which shouldn't be retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// postOnce sends a single request. It returns Retry-After of throttling
+// responses.
+func (e *Exporter) postOnce(ctx context.Context, body []byte, count int) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.options.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.options.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.options.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var partial exportResponse
+		rejected := 0
+		if json.Unmarshal(data, &partial) == nil && partial.PartialSuccess != nil {
+			rejected, _ = strconv.Atoi(partial.PartialSuccess.RejectedLogRecords)
+		}
+		if rejected > count {
+			rejected = count
+		}
+		e.queue.AddSent(count - rejected)
+		e.queue.AddFailed(rejected)
+		if rejected != 0 && e.options.OnError != nil {
+			e.options.OnError(fmt.Errorf("collector rejected %d records: %s", rejected, partial.PartialSuccess.ErrorMessage))
+		}
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout:
+		retryAfter := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, fmt.Errorf("collector responded %s", resp.Status)
+	default:
+		return 0, &permanentError{fmt.Errorf("collector responded %s: %s", resp.Status, bytes.TrimSpace(data))}
+	}
+}
+
+// Severity numbers of the log data model.
+const (
+	severityTrace = 1
+	severityDebug = 5
+	severityInfo  = 9
+	severityWarn  = 13
+	severityError = 17
+	severityFatal = 21
+)
+
+// severity maps an event level to a severity number. LogAlways has no
+// severity and custom levels are more verbose than Verbose.
+func severity(level uint8) int {
+	switch level {
+	case schema.LevelLogAlways:
+		return 0
+	case schema.LevelCritical:
+		return severityFatal
+	case schema.LevelError:
+		return severityError
+	case schema.LevelWarning:
+		return severityWarn
+	case schema.LevelInformation:
+		return severityInfo
+	case schema.LevelVerbose:
+		return severityDebug
+	default:
+		return severityTrace
+	}
+}
+
+// convert maps @event to a log record observed at @now.
+func (e *Exporter) convert(event *schema.Event, now time.Time) *logRecord {
+	h := &event.Header
+	r := &logRecord{
+		TimeUnixNano:         strconv.FormatInt(h.TimeStamp.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(now.UnixNano(), 10),
+		SeverityNumber:       severity(h.Level),
+		SeverityText:         schema.LevelName(h.Level),
+		Body:                 stringValue(event.Title()),
+	}
+	attr := func(key string, value anyValue) {
+		r.Attributes = append(r.Attributes, keyValue{Key: key, Value: value})
+	}
+	attr("etw.provider.guid", stringValue(h.ProviderID.String()))
+	if event.ProviderName != "" {
+		attr("etw.provider.name", stringValue(event.ProviderName))
+	}
+	attr("etw.event.id", intValue(int64(h.ID)))
+	attr("etw.event.version", intValue(int64(h.Version)))
+	attr("etw.channel", intValue(int64(h.Channel)))
+	attr("etw.task", intValue(int64(h.Task)))
+	attr("etw.opcode", intValue(int64(h.OpCode)))
+	attr("etw.keywords", stringValue(fmt.Sprintf("0x%016x", h.Keyword)))
+	attr("process.pid", intValue(int64(h.ProcessID)))
+	attr("thread.id", intValue(int64(h.ThreadID)))
+	if x := event.Extended.ActivityID; x != nil {
+		attr("etw.related_activity_id", stringValue(x.String()))
+	}
+	if sid := event.Extended.UserSID; sid != "" {
+		attr("etw.user_sid", stringValue(sid))
+	}
+	if h.Rundown {
+		attr("etw.rundown", boolValue(true))
+	}
+	if h.DuringCaptureState {
+		attr("etw.during_capture_state", boolValue(true))
+	}
+	for _, p := range event.Properties {
+		attr(e.options.PropertyPrefix+p.Name, toValue(p.Value))
+	}
+
+	if !h.ActivityID.IsZero() {
+		r.TraceID = hex.EncodeToString(guidBytes(h.ActivityID))
+	}
+	return r
+}
+
+// guidBytes returns the GUID in its binary layout.
+func guidBytes(g schema.GUID) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], g.Data1)
+	binary.LittleEndian.PutUint16(b[4:], g.Data2)
+	binary.LittleEndian.PutUint16(b[6:], g.Data3)
+	copy(b[8:], g.Data4[:])
+	return b
+}
+
+// toValue converts a property value. Values which don't fit AnyValue are
+// converted to strings.
+func toValue(v interface{}) anyValue {
+	switch v := v.(type) {
+	case nil:
+		return anyValue{}
+	case string:
+		return stringValue(v)
+	case bool:
+		return boolValue(v)
+	case int8:
+		return intValue(int64(v))
+	case int16:
+		return intValue(int64(v))
+	case int32:
+		return intValue(int64(v))
+	case int64:
+		return intValue(v)
+	case int:
+		return intValue(int64(v))
+	case uint8:
+		return intValue(int64(v))
+	case uint16:
+		return intValue(int64(v))
+	case uint32:
+		return intValue(int64(v))
+	case uint64:
+		return uintValue(v)
+	case uint:
+		return uintValue(uint64(v))
+	case float32:
+		return doubleValue(float64(v))
+	case float64:
+		return doubleValue(v)
+	case []byte:
+		return anyValue{BytesValue: v}
+	case time.Time:
+		return stringValue(v.UTC().Format(time.RFC3339Nano))
+	case []string:
+		values := make([]anyValue, len(v))
+		for i, item := range v {
+			values[i] = stringValue(item)
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case []interface{}:
+		values := make([]anyValue, len(v))
+		for i, item := range v {
+			values[i] = toValue(item)
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case []schema.Property:
+		values := make([]keyValue, len(v))
+		for i, p := range v {
+			values[i] = keyValue{Key: p.Name, Value: toValue(p.Value)}
+		}
+		return anyValue{KvlistValue: &kvlistValue{Values: values}}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		values := make([]keyValue, len(keys))
+		for i, k := range keys {
+			values[i] = keyValue{Key: k, Value: toValue(v[k])}
+		}
+		return anyValue{KvlistValue: &kvlistValue{Values: values}}
+	default:
+		return stringValue(fmt.Sprint(v))
+	}
+}
+
+func stringValue(s string) anyValue {
+	return anyValue{StringValue: &s}
+}
+
+func boolValue(b bool) anyValue {
+	return anyValue{BoolValue: &b}
+}
+
+// intValue encodes int64 as a string as the protobuf JSON mapping requires.
+func intValue(i int64) anyValue {
+	s := strconv.FormatInt(i, 10)
+	return anyValue{IntValue: &s}
+}
+
+// uintValue encodes values beyond int64 as strings, AnyValue has no unsigned
+// integers.
+func uintValue(u uint64) anyValue {
+	if u > math.MaxInt64 {
+		return stringValue(strconv.FormatUint(u, 10))
+	}
+	return intValue(int64(u))
+}
+
+func doubleValue(f float64) anyValue {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return stringValue(fmt.Sprint(f))
+	}
+	return anyValue{DoubleValue: &f}
+}
+
+// The OTLP JSON encoding of ExportLogsServiceRequest, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/logs/v1/logs.proto
+
+type exportRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type exportResponse struct {
+	PartialSuccess *struct {
+		RejectedLogRecords string `json:"rejectedLogRecords"`
+		ErrorMessage       string `json:"errorMessage"`
+	} `json:"partialSuccess"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeLogs struct {
+	Scope      scope       `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type logRecord struct {
+	TimeUnixNano         string     `json:"timeUnixNano"`
+	ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+	SeverityNumber       int        `json:"severityNumber,omitempty"`
+	SeverityText         string     `json:"severityText,omitempty"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes,omitempty"`
+	TraceID              string     `json:"traceId,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string      `json:"stringValue,omitempty"`
+	BoolValue   *bool        `json:"boolValue,omitempty"`
+	IntValue    *string      `json:"intValue,omitempty"`
+	DoubleValue *float64     `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue  `json:"arrayValue,omitempty"`
+	KvlistValue *kvlistValue `json:"kvlistValue,omitempty"`
+	BytesValue  []byte       `json:"bytesValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+type kvlistValue struct {
+	Values []keyValue `json:"values"`
+}
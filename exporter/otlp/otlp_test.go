@@ -0,0 +1,325 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestOTLP(t *testing.T) {
+	suite.Run(t, new(otlpSuite))
+}
+
+type otlpSuite struct {
+	suite.Suite
+	receiver *receiver
+	server   *httptest.Server
+}
+
+// receiver is an in-process stand-in of the collector. Responses are taken
+// from statuses one by one, 200 once they are over.
+type receiver struct {
+	mu       sync.Mutex
+	requests []exportRequest
+	headers  []http.Header
+	statuses []int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := http.StatusOK
+	if len(r.statuses) != 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	if status != http.StatusOK {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	var request exportRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.requests = append(r.requests, request)
+	r.headers = append(r.headers, req.Header)
+	_, _ = w.Write([]byte("{}"))
+}
+
+// respond sets statuses of the next responses.
+func (r *receiver) respond(statuses ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = statuses
+}
+
+// records returns all received records.
+func (r *receiver) records() []logRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var records []logRecord
+	for _, req := range r.requests {
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				records = append(records, sl.LogRecords...)
+			}
+		}
+	}
+	return records
+}
+
+func (s *otlpSuite) SetupTest() {
+	s.receiver = &receiver{}
+	s.server = httptest.NewServer(s.receiver)
+}
+
+func (s *otlpSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *otlpSuite) newExporter(options Options) *Exporter {
+	options.Endpoint = s.server.URL + "/v1/logs"
+	if options.MinBackoff == 0 {
+		options.MinBackoff, options.MaxBackoff = time.Millisecond, time.Millisecond
+	}
+	e, err := NewExporter(options)
+	s.Require().NoError(err)
+	return e
+}
+
+func testEvent(id uint16) *schema.Event {
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{
+				ID: id, Version: 2, Channel: 16, Level: schema.LevelWarning, OpCode: 1, Task: 3,
+				Keyword: 0x8000000000000010,
+			},
+			ThreadID:  8,
+			ProcessID: 4,
+			TimeStamp: time.Unix(1614834367, 123456700),
+			ProviderID: schema.GUID{
+				Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+				Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+			},
+			ActivityID: schema.GUID{Data1: 0x04030201, Data2: 0x0605, Data3: 0x0807, Data4: [8]byte{9, 10, 11, 12, 13, 14, 15, 16}},
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+		Properties:   []schema.Property{{Name: "ProcessID", Value: uint32(1234)}},
+	}
+}
+
+// TestMapping ensures the log record layout.
+func (s *otlpSuite) TestMapping() {
+	e := s.newExporter(Options{
+		Resource: map[string]string{"service.name": "agent", "host.name": "host"},
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	})
+	s.True(e.Export(testEvent(1)))
+	s.Require().NoError(e.Flush(context.Background()))
+	s.Require().NoError(e.Shutdown(context.Background()))
+
+	s.Require().Len(s.receiver.requests, 1)
+	s.Equal("Bearer token", s.receiver.headers[0].Get("Authorization"))
+	s.Equal("application/json", s.receiver.headers[0].Get("Content-Type"))
+	rl := s.receiver.requests[0].ResourceLogs[0]
+	s.Equal("host.name", rl.Resource.Attributes[0].Key)
+	s.Equal("service.name", rl.Resource.Attributes[1].Key)
+	s.Equal(scopeName, rl.ScopeLogs[0].Scope.Name)
+
+	records := s.receiver.records()
+	s.Require().Len(records, 1)
+	r := records[0]
+	s.Equal("1614834367123456700", r.TimeUnixNano)
+	s.NotEmpty(r.ObservedTimeUnixNano)
+	s.Equal(severityWarn, r.SeverityNumber)
+	s.Equal("Warning", r.SeverityText)
+	s.Equal("Microsoft-Windows-Kernel-Process event 1", *r.Body.StringValue)
+	s.Equal("0102030405060708090a0b0c0d0e0f10", r.TraceID)
+
+	attributes := make(map[string]anyValue)
+	for _, kv := range r.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	s.Equal("{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}", *attributes["etw.provider.guid"].StringValue)
+	s.Equal("Microsoft-Windows-Kernel-Process", *attributes["etw.provider.name"].StringValue)
+	for key, expected := range map[string]string{
+		"etw.event.id": "1", "etw.event.version": "2", "etw.channel": "16",
+		"etw.task": "3", "etw.opcode": "1", "process.pid": "4", "thread.id": "8",
+		"etw.data.ProcessID": "1234",
+	} {
+		s.Require().NotNil(attributes[key].IntValue, key)
+		s.Equal(expected, *attributes[key].IntValue, key)
+	}
+	s.Equal("0x8000000000000010", *attributes["etw.keywords"].StringValue)
+}
+
+// TestValues ensures property values map to AnyValue, falling back to
+// strings for values it can't hold.
+func (s *otlpSuite) TestValues() {
+	for _, c := range []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"Nil", nil, `{}`},
+		{"Bool", true, `{"boolValue":true}`},
+		{"Uint32", uint32(math.MaxUint32), `{"intValue":"4294967295"}`},
+		{"Int64 min", int64(math.MinInt64), `{"intValue":"-9223372036854775808"}`},
+		{"Uint64 in int64 range", uint64(math.MaxInt64), `{"intValue":"9223372036854775807"}`},
+		{"Uint64 overflow", uint64(math.MaxInt64 + 1), `{"stringValue":"9223372036854775808"}`},
+		{"Uint64 max", uint64(math.MaxUint64), `{"stringValue":"18446744073709551615"}`},
+		{"Uint overflow", uint(math.MaxUint64), `{"stringValue":"18446744073709551615"}`},
+		{"Uint", uint(7), `{"intValue":"7"}`},
+		{"Double", 0.5, `{"doubleValue":0.5}`},
+		{"NaN", math.NaN(), `{"stringValue":"NaN"}`},
+		{"Infinity", float32(math.Inf(-1)), `{"stringValue":"-Inf"}`},
+		{"Bytes", []byte{0xCA, 0xFE}, `{"bytesValue":"yv4="}`},
+		{"Time", time.Unix(1614834367, 123456700), `{"stringValue":"2021-03-04T05:06:07.1234567Z"}`},
+		{"Strings", []string{"-a"}, `{"arrayValue":{"values":[{"stringValue":"-a"}]}}`},
+		{"Array", []interface{}{uint64(math.MaxUint64), nil}, `{"arrayValue":{"values":[{"stringValue":"18446744073709551615"},{}]}}`},
+		{"Structure", []schema.Property{{Name: "Y", Value: 1}, {Name: "X", Value: 2}},
+			`{"kvlistValue":{"values":[{"key":"Y","value":{"intValue":"1"}},{"key":"X","value":{"intValue":"2"}}]}}`},
+		{"Map", map[string]interface{}{"b": "2", "a": "1"},
+			`{"kvlistValue":{"values":[{"key":"a","value":{"stringValue":"1"}},{"key":"b","value":{"stringValue":"2"}}]}}`},
+		{"Other", testEvent(1).Header.ProviderID, `{"stringValue":"{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}"}`},
+	} {
+		data, err := json.Marshal(toValue(c.value))
+		s.Require().NoError(err, c.name)
+		s.Equal(c.expected, string(data), c.name)
+	}
+}
+
+// TestRundown ensures rundown marks are exported only if set.
+func (s *otlpSuite) TestRundown() {
+	e := s.newExporter(Options{})
+	defer e.Shutdown(context.Background())
+
+	event := testEvent(1)
+	s.NotContains(attributeKeys(e.convert(event, time.Now())), "etw.rundown")
+	event.Header.Rundown, event.Header.DuringCaptureState = true, true
+	keys := attributeKeys(e.convert(event, time.Now()))
+	s.Contains(keys, "etw.rundown")
+	s.Contains(keys, "etw.during_capture_state")
+}
+
+func attributeKeys(r *logRecord) []string {
+	keys := make([]string, len(r.Attributes))
+	for i, kv := range r.Attributes {
+		keys[i] = kv.Key
+	}
+	return keys
+}
+
+// TestSeverity ensures levels map to the log data model.
+func (s *otlpSuite) TestSeverity() {
+	for level, expected := range map[uint8]int{
+		0: 0, 1: severityFatal, 2: severityError, 3: severityWarn,
+		4: severityInfo, 5: severityDebug, 6: severityTrace,
+	} {
+		s.Equal(expected, severity(level), "level %d", level)
+	}
+}
+
+// TestBatching ensures records are split into batches and sent on Shutdown.
+func (s *otlpSuite) TestBatching() {
+	e := s.newExporter(Options{BatchSize: 2, FlushInterval: time.Hour})
+	for i := 0; i < 5; i++ {
+		s.True(e.Export(testEvent(uint16(i))))
+	}
+	s.Require().NoError(e.Shutdown(context.Background()))
+
+	records := s.receiver.records()
+	s.Require().Len(records, 5)
+	s.Len(s.receiver.requests, 3)
+	s.Equal(Stats{Exported: 5}, e.Stats())
+
+	s.False(e.Export(testEvent(0)), "Stopped")
+	s.Equal(ErrExporterStopped, e.Flush(context.Background()))
+	s.Equal(ErrExporterStopped, e.Shutdown(context.Background()))
+}
+
+// TestFlushInterval ensures incomplete batches are sent in time.
+func (s *otlpSuite) TestFlushInterval() {
+	e := s.newExporter(Options{FlushInterval: 10 * time.Millisecond})
+	defer e.Shutdown(context.Background())
+	e.Export(testEvent(1))
+	s.Eventually(func() bool { return len(s.receiver.records()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestRetry ensures throttled batches are retried and others dropped.
+func (s *otlpSuite) TestRetry() {
+	s.receiver.respond(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	var errs []error
+	e := s.newExporter(Options{OnError: func(err error) { errs = append(errs, err) }})
+	e.Export(testEvent(1))
+	s.Require().NoError(e.Flush(context.Background()))
+	s.Len(s.receiver.records(), 1)
+	s.Equal(Stats{Exported: 1, Retries: 2}, e.Stats())
+
+	s.receiver.respond(http.StatusBadRequest)
+	e.Export(testEvent(2))
+	s.Error(e.Flush(context.Background()), "Permanent error")
+	s.Equal(Stats{Exported: 1, Failed: 1, Retries: 2}, e.Stats())
+	s.Len(errs, 1)
+
+	s.Require().NoError(e.Shutdown(context.Background()))
+
+	s.receiver.respond(http.StatusBadGateway, http.StatusBadGateway)
+	e = s.newExporter(Options{MaxRetries: 1})
+	e.Export(testEvent(3))
+	s.Error(e.Flush(context.Background()), "Retries exceeded")
+	s.Equal(Stats{Failed: 1, Retries: 1}, e.Stats())
+	s.Require().NoError(e.Shutdown(context.Background()))
+}
+
+// TestQueueFull ensures records are dropped instead of blocking.
+func (s *otlpSuite) TestQueueFull() {
+	blocked := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer server.Close()
+
+	e, err := NewExporter(Options{Endpoint: server.URL, QueueSize: 2, BatchSize: 1, MaxRetries: -1})
+	s.Require().NoError(err)
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if !e.Export(testEvent(1)) {
+			dropped++
+		}
+	}
+	s.GreaterOrEqual(dropped, 7)
+	s.Equal(uint64(dropped), e.Stats().Dropped)
+
+	close(blocked)
+	s.Require().NoError(e.Shutdown(context.Background()))
+}
+
+// TestShutdownTimeout ensures Shutdown doesn't hang on a dead collector.
+func (s *otlpSuite) TestShutdownTimeout() {
+	s.receiver.respond(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	e := s.newExporter(Options{MinBackoff: time.Hour})
+	e.Export(testEvent(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, e.Shutdown(ctx))
+	s.Equal(uint64(1), e.Stats().Failed)
+
+	_, err := NewExporter(Options{})
+	s.Error(err, "No endpoint")
+}
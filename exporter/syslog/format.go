@@ -0,0 +1,423 @@
+package syslog
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Event fields which could be used in CEFField.Field. Property values are
+// referred as "data.<name>", nested ones as "data.<name>.<field>".
+const (
+	FieldProviderName = "ProviderName"
+	FieldProviderID   = "ProviderID"
+	FieldID           = "ID"
+	FieldVersion      = "Version"
+	FieldChannel      = "Channel"
+	FieldLevel        = "Level"
+	FieldOpCode       = "OpCode"
+	FieldTask         = "Task"
+	FieldKeyword      = "Keyword"
+	FieldProcessID    = "ProcessID"
+	FieldThreadID     = "ThreadID"
+	FieldTimeStamp    = "TimeStamp"
+	FieldActivityID   = "ActivityID"
+	FieldUserSID      = "UserSID"
+	FieldSessionID    = "SessionID"
+	FieldRundown      = "Rundown"
+
+	// FieldDataPrefix starts names of property fields.
+	FieldDataPrefix = "data."
+)
+
+// CEFField maps an event field to a CEF extension key.
+type CEFField struct {
+	// Key is the extension key, e.g. "dvcpid" or "suser".
+	Key string
+
+	// Field is one of Field* names or a property as "data.<name>". The key
+	// is skipped if the event has no such property.
+	Field string
+
+	// Value is a constant used if Field is empty, e.g. for "cs1Label".
+	Value string
+}
+
+// DefaultCEFMapping is used if Options.CEF.Mapping is empty.
+//
+//nolint:gochecknoglobals
+var DefaultCEFMapping = []CEFField{
+	{Key: "rt", Field: FieldTimeStamp},
+	{Key: "dvcpid", Field: FieldProcessID},
+	{Key: "cn1Label", Value: "ThreadID"},
+	{Key: "cn1", Field: FieldThreadID},
+	{Key: "cs1Label", Value: "ProviderGUID"},
+	{Key: "cs1", Field: FieldProviderID},
+	{Key: "cs2Label", Value: "ActivityID"},
+	{Key: "cs2", Field: FieldActivityID},
+	{Key: "cs3Label", Value: "Keywords"},
+	{Key: "cs3", Field: FieldKeyword},
+	{Key: "suid", Field: FieldUserSID},
+}
+
+//nolint:gochecknoglobals
+var headerFields = map[string]bool{
+	FieldProviderName: true, FieldProviderID: true, FieldID: true, FieldVersion: true,
+	FieldChannel: true, FieldLevel: true, FieldOpCode: true, FieldTask: true,
+	FieldKeyword: true, FieldProcessID: true, FieldThreadID: true, FieldTimeStamp: true,
+	FieldActivityID: true, FieldUserSID: true, FieldSessionID: true, FieldRundown: true,
+}
+
+// validate checks the key and the field name.
+func (f CEFField) validate() error {
+	if f.Key == "" {
+		return fmt.Errorf("CEF key is not set")
+	}
+	for _, ch := range f.Key {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9') {
+			return fmt.Errorf("invalid CEF key %q", f.Key)
+		}
+	}
+	if f.Field != "" && !headerFields[f.Field] && !strings.HasPrefix(f.Field, FieldDataPrefix) {
+		return fmt.Errorf("unknown field %q of CEF key %q", f.Field, f.Key)
+	}
+	return nil
+}
+
+// Syslog severities.
+const (
+	severityCritical      = 2
+	severityError         = 3
+	severityWarning       = 4
+	severityNotice        = 5
+	severityInformational = 6
+	severityDebug         = 7
+)
+
+// severity maps an event level to a syslog severity. LogAlways events are
+// notices and custom levels are debug.
+func severity(level uint8) int {
+	switch level {
+	case schema.LevelLogAlways:
+		return severityNotice
+	case schema.LevelCritical:
+		return severityCritical
+	case schema.LevelError:
+		return severityError
+	case schema.LevelWarning:
+		return severityWarning
+	case schema.LevelInformation:
+		return severityInformational
+	default:
+		return severityDebug
+	}
+}
+
+// cefSeverity maps an event level to a CEF severity from 0 to 10.
+func cefSeverity(level uint8) int {
+	switch level {
+	case schema.LevelCritical:
+		return 10
+	case schema.LevelError:
+		return 8
+	case schema.LevelWarning:
+		return 6
+	case schema.LevelLogAlways, schema.LevelInformation:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// Header field limits of RFC 5424.
+const (
+	maxHostname = 255
+	maxAppName  = 48
+	maxProcID   = 128
+	maxMsgID    = 32
+	maxSDName   = 32
+)
+
+// rfc5424Time is TIMESTAMP of RFC 5424 with the allowed precision.
+const rfc5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+// formatter formats events according to Options.
+type formatter struct {
+	options Options
+}
+
+// format returns the message of @e without framing.
+func (f *formatter) format(e *schema.Event) []byte {
+	if f.options.Format == FormatCEF {
+		return f.header(e, "-", f.cef(e))
+	}
+	return f.header(e, f.structuredData(e), e.Title())
+}
+
+// header prepends the RFC 5424 header to @sd and @msg.
+func (f *formatter) header(e *schema.Event, sd, msg string) []byte {
+	h := &e.Header
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 ", *f.options.Facility*8+severity(h.Level))
+	if h.TimeStamp.IsZero() {
+		b.WriteString("-")
+	} else {
+		b.WriteString(h.TimeStamp.UTC().Format(rfc5424Time))
+	}
+	b.WriteByte(' ')
+	b.WriteString(headerValue(f.options.Hostname, maxHostname))
+	b.WriteByte(' ')
+	b.WriteString(headerValue(f.options.AppName, maxAppName))
+	b.WriteByte(' ')
+	b.WriteString(headerValue(strconv.FormatUint(uint64(h.ProcessID), 10), maxProcID))
+	b.WriteByte(' ')
+	b.WriteString(headerValue(strconv.FormatUint(uint64(h.ID), 10), maxMsgID))
+	b.WriteByte(' ')
+	b.WriteString(sd)
+	if msg != "" {
+		b.WriteByte(' ')
+		b.WriteString(msg)
+	}
+	return []byte(b.String())
+}
+
+// structuredData returns STRUCTURED-DATA with an element of the header and an
+// element of the properties if any.
+func (f *formatter) structuredData(e *schema.Event) string {
+	h := &e.Header
+	var b strings.Builder
+	param := func(name, value string) {
+		b.WriteByte(' ')
+		b.WriteString(sdName(name))
+		b.WriteString(`="`)
+		b.WriteString(sdValueEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+
+	fmt.Fprintf(&b, "[etw@%d", f.options.EnterpriseID)
+	if e.ProviderName != "" {
+		param("provider", e.ProviderName)
+	}
+	param("providerGuid", h.ProviderID.String())
+	param("eventId", strconv.Itoa(int(h.ID)))
+	param("version", strconv.Itoa(int(h.Version)))
+	param("channel", strconv.Itoa(int(h.Channel)))
+	param("level", strconv.Itoa(int(h.Level)))
+	param("task", strconv.Itoa(int(h.Task)))
+	param("opcode", strconv.Itoa(int(h.OpCode)))
+	param("keywords", fmt.Sprintf("0x%016x", h.Keyword))
+	param("pid", strconv.FormatUint(uint64(h.ProcessID), 10))
+	param("tid", strconv.FormatUint(uint64(h.ThreadID), 10))
+	if !h.ActivityID.IsZero() {
+		param("activityId", h.ActivityID.String())
+	}
+	if x := e.Extended.ActivityID; x != nil {
+		param("relatedActivityId", x.String())
+	}
+	if x := e.Extended.SessionID; x != nil {
+		param("sessionId", strconv.FormatUint(uint64(*x), 10))
+	}
+	if sid := e.Extended.UserSID; sid != "" {
+		param("userSid", sid)
+	}
+	if h.Rundown {
+		param("rundown", "true")
+	}
+	if h.DuringCaptureState {
+		param("duringCaptureState", "true")
+	}
+	b.WriteByte(']')
+
+	if len(e.Properties) != 0 {
+		fmt.Fprintf(&b, "[etwData@%d", f.options.EnterpriseID)
+		for _, p := range e.Properties {
+			flatten(p.Name, p.Value, param)
+		}
+		b.WriteByte(']')
+	}
+	return b.String()
+}
+
+// cef returns the CEF message of @e.
+func (f *formatter) cef(e *schema.Event) string {
+	h := &e.Header
+	var b strings.Builder
+	b.WriteString("CEF:0|")
+	for _, v := range []string{
+		f.options.CEF.Vendor,
+		f.options.CEF.Product,
+		f.options.CEF.Version,
+		strconv.Itoa(int(h.ID)),
+		e.Title(),
+		strconv.Itoa(cefSeverity(h.Level)),
+	} {
+		b.WriteString(cefHeaderEscaper.Replace(v))
+		b.WriteByte('|')
+	}
+
+	first := true
+	for _, m := range f.options.CEF.Mapping {
+		value, ok := m.Value, true
+		if m.Field != "" {
+			value, ok = fieldValue(e, m.Field)
+		}
+		if !ok {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(m.Key)
+		b.WriteByte('=')
+		b.WriteString(cefValueEscaper.Replace(value))
+	}
+	return b.String()
+}
+
+// fieldValue returns a text of the event @field. It returns false if the
+// event has no such field.
+func fieldValue(e *schema.Event, field string) (string, bool) {
+	h := &e.Header
+	switch field {
+	case FieldProviderName:
+		return e.ProviderName, e.ProviderName != ""
+	case FieldProviderID:
+		return h.ProviderID.String(), true
+	case FieldID:
+		return strconv.Itoa(int(h.ID)), true
+	case FieldVersion:
+		return strconv.Itoa(int(h.Version)), true
+	case FieldChannel:
+		return strconv.Itoa(int(h.Channel)), true
+	case FieldLevel:
+		return strconv.Itoa(int(h.Level)), true
+	case FieldOpCode:
+		return strconv.Itoa(int(h.OpCode)), true
+	case FieldTask:
+		return strconv.Itoa(int(h.Task)), true
+	case FieldKeyword:
+		return fmt.Sprintf("0x%016x", h.Keyword), true
+	case FieldProcessID:
+		return strconv.FormatUint(uint64(h.ProcessID), 10), true
+	case FieldThreadID:
+		return strconv.FormatUint(uint64(h.ThreadID), 10), true
+	case FieldTimeStamp:
+		// CEF timestamps are milliseconds since the Unix epoch.
+		return strconv.FormatInt(h.TimeStamp.UnixNano()/int64(time.Millisecond), 10), !h.TimeStamp.IsZero()
+	case FieldActivityID:
+		return h.ActivityID.String(), true
+	case FieldUserSID:
+		return e.Extended.UserSID, e.Extended.UserSID != ""
+	case FieldSessionID:
+		if e.Extended.SessionID == nil {
+			return "", false
+		}
+		return strconv.FormatUint(uint64(*e.Extended.SessionID), 10), true
+	case FieldRundown:
+		return strconv.FormatBool(e.Header.Rundown), true
+	}
+
+	var values []string
+	name := strings.TrimPrefix(field, FieldDataPrefix)
+	for _, p := range e.Properties {
+		flatten(p.Name, p.Value, func(n, v string) {
+			if n == name {
+				values = append(values, v)
+			}
+		})
+	}
+	return strings.Join(values, ","), len(values) != 0
+}
+
+// flatten calls @emit with texts of @value: arrays emit every item with the
+// same @name, structures emit fields as "<name>.<field>".
+func flatten(name string, value interface{}, emit func(name, value string)) {
+	switch v := value.(type) {
+	case nil:
+		return
+	case []schema.Property:
+		for _, p := range v {
+			flatten(name+"."+p.Name, p.Value, emit)
+		}
+		return
+	case []byte:
+		emit(name, strings.ToUpper(fmt.Sprintf("%x", v)))
+		return
+	}
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		for i := 0; i < rv.Len(); i++ {
+			flatten(name, rv.Index(i).Interface(), emit)
+		}
+		return
+	}
+	emit(name, text(value))
+}
+
+// text formats scalar values.
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+//nolint:gochecknoglobals
+var (
+	// sdValueEscaper escapes PARAM-VALUE of RFC 5424.
+	sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+	// cefHeaderEscaper escapes CEF header fields, which can't have newlines.
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+
+	// cefValueEscaper escapes CEF extension values.
+	cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// headerValue replaces RFC 5424 header values which are not PRINTUSASCII and
+// truncates them to @limit. Empty values are NILVALUE.
+func headerValue(v string, limit int) string {
+	if v == "" {
+		return "-"
+	}
+	b := []byte(v)
+	for i, ch := range b {
+		if ch < 33 || ch > 126 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > limit {
+		b = b[:limit]
+	}
+	return string(b)
+}
+
+// sdName makes a valid SD-NAME of @name: PRINTUSASCII except '=', ' ', ']'
+// and '"' of at most 32 characters.
+func sdName(name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		if ch < 33 || ch > 126 || ch == '=' || ch == ']' || ch == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > maxSDName {
+		b = b[:maxSDName]
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
@@ -0,0 +1,408 @@
+// Package syslog sends events to syslog receivers and SIEMs as RFC 5424
+// messages or as ArcSight CEF over UDP, TCP or TLS.
+//
+// RFC 5424 messages hold the event header in the "etw@<EnterpriseID>"
+// structured data element and properties in "etwData@<EnterpriseID>":
+//
+//	<14>1 2021-03-04T05:06:07.123456Z host etw 4 1 [etw@32473 provider="..." eventId="1" ...][etwData@32473 ImageName="notepad.exe"] Microsoft-Windows-Kernel-Process event 1
+//
+// CEF messages are sent with the same syslog header and no structured data;
+// extension keys are set according to CEFOptions.Mapping:
+//
+//	<14>1 2021-03-04T05:06:07.123456Z host etw 4 1 - CEF:0|Microsoft|ETW|1.0|1|Microsoft-Windows-Kernel-Process event 1|3|rt=1614834367123 dvcpid=4 ...
+//
+// Messages are queued and written from a background goroutine which
+// reconnects with exponential backoff once the connection is lost.
+package syslog
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/internal/export"
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Format is a message format.
+type Format int
+
+// Supported formats.
+const (
+	FormatRFC5424 Format = iota
+	FormatCEF
+)
+
+// Framing separates messages in TCP and TLS streams (RFC 6587). It's not used
+// for UDP, where every message is a datagram.
+type Framing int
+
+// Supported framings.
+const (
+	// FramingOctetCounting prefixes messages with their length.
+	FramingOctetCounting Framing = iota
+	// FramingNewline terminates messages with LF.
+	FramingNewline
+)
+
+// Supported networks.
+const (
+	NetworkUDP = "udp"
+	NetworkTCP = "tcp"
+	NetworkTLS = "tls"
+)
+
+// Default Options.
+const (
+	defaultFacility     = 1 // user-level messages
+	defaultAppName      = "etw"
+	defaultEnterpriseID = 32473 // Reserved for documentation (RFC 5612).
+	defaultQueueSize    = 4096
+	defaultDialTimeout  = 10 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = 30 * time.Second
+
+	defaultCEFVendor  = "Microsoft"
+	defaultCEFProduct = "ETW"
+	defaultCEFVersion = "1.0"
+)
+
+// maxFacility is local7.
+const maxFacility = 23
+
+// ErrSinkStopped is returned by Sink methods after Shutdown.
+//
+//nolint:gochecknoglobals
+var ErrSinkStopped = errors.New("sink is stopped")
+
+// Options configure Sink. Zero values stand for defaults.
+type Options struct {
+	// Network is one of NetworkUDP, NetworkTCP or NetworkTLS. Defaults to
+	// UDP.
+	Network string
+
+	// Address is host:port of the receiver.
+	Address string
+
+	// TLSConfig is used with NetworkTLS.
+	TLSConfig *tls.Config
+
+	// Format is the message format. Defaults to RFC 5424.
+	Format Format
+
+	// Framing is used with TCP and TLS. Defaults to octet counting.
+	Framing Framing
+
+	// Facility of messages from 0 (kernel) to 23. Defaults to 1
+	// (user-level) if nil. Severity is taken from the event level.
+	Facility *int
+
+	// Hostname is the HOSTNAME field. Defaults to os.Hostname().
+	Hostname string
+
+	// AppName is the APP-NAME field. Defaults to "etw".
+	AppName string
+
+	// EnterpriseID is the private enterprise number in structured data IDs.
+	// Defaults to 32473 reserved for documentation, it's better to set your
+	// own number.
+	EnterpriseID int
+
+	// CEF configures FormatCEF messages.
+	CEF CEFOptions
+
+	// QueueSize is the number of messages waiting to be written. Messages
+	// sent to a full queue are dropped. Defaults to 4096.
+	QueueSize int
+
+	// DialTimeout and WriteTimeout limit connecting and every write.
+	// Default to 10s.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MinBackoff is a delay before the first reconnect. It's doubled with
+	// every failed attempt up to MaxBackoff. Default to 1s and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError is called with connection errors and errors of dropped
+	// messages.
+	OnError func(error)
+}
+
+// CEFOptions configure CEF messages. Zero values stand for defaults.
+type CEFOptions struct {
+	// Vendor, Product and Version are the device fields of the CEF header.
+	// Default to "Microsoft", "ETW" and "1.0".
+	Vendor  string
+	Product string
+	Version string
+
+	// Mapping sets extension keys in the given order. Defaults to
+	// DefaultCEFMapping.
+	Mapping []CEFField
+}
+
+// Validate checks options after defaults are applied.
+func (o Options) Validate() error {
+	switch o.Network {
+	case NetworkUDP, NetworkTCP, NetworkTLS:
+	default:
+		return fmt.Errorf("unsupported network %q", o.Network)
+	}
+	if o.Address == "" {
+		return fmt.Errorf("address is not set")
+	}
+	if o.Format != FormatRFC5424 && o.Format != FormatCEF {
+		return fmt.Errorf("unknown format %d", o.Format)
+	}
+	if o.Framing != FramingOctetCounting && o.Framing != FramingNewline {
+		return fmt.Errorf("unknown framing %d", o.Framing)
+	}
+	if o.Facility != nil && (*o.Facility < 0 || *o.Facility > maxFacility) {
+		return fmt.Errorf("invalid facility %d", *o.Facility)
+	}
+	if o.EnterpriseID < 0 {
+		return fmt.Errorf("invalid enterprise ID %d", o.EnterpriseID)
+	}
+	for _, m := range o.CEF.Mapping {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Options) setDefaults() {
+	if o.Network == "" {
+		o.Network = NetworkUDP
+	}
+	if o.Facility == nil {
+		facility := defaultFacility
+		o.Facility = &facility
+	}
+	if o.Hostname == "" {
+		o.Hostname, _ = os.Hostname()
+	}
+	if o.AppName == "" {
+		o.AppName = defaultAppName
+	}
+	if o.EnterpriseID == 0 {
+		o.EnterpriseID = defaultEnterpriseID
+	}
+	if o.CEF.Vendor == "" {
+		o.CEF.Vendor = defaultCEFVendor
+	}
+	if o.CEF.Product == "" {
+		o.CEF.Product = defaultCEFProduct
+	}
+	if o.CEF.Version == "" {
+		o.CEF.Version = defaultCEFVersion
+	}
+	if len(o.CEF.Mapping) == 0 {
+		o.CEF.Mapping = DefaultCEFMapping
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultQueueSize
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = defaultDialTimeout
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = defaultWriteTimeout
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = defaultMinBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+}
+
+// Stats are counters of a Sink.
+type Stats struct {
+	// Sent is a number of written messages.
+	Sent uint64
+
+	// Dropped is a number of messages dropped due to the full queue.
+	Dropped uint64
+
+	// Failed is a number of messages which couldn't be written.
+	Failed uint64
+
+	// Reconnects is a number of connections made after the first one.
+	Reconnects uint64
+}
+
+// Sink writes events to a syslog receiver.
+type Sink struct {
+	options   Options
+	formatter formatter
+	queue     *export.Queue
+
+	// conn and connected are used by the writing goroutine only.
+	conn      net.Conn
+	connected bool
+}
+
+// NewSink starts a sink. The connection is made in background, so receiver
+// errors are reported to OnError.
+func NewSink(options Options) (*Sink, error) {
+	options.setDefaults()
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Sink{options: options, formatter: formatter{options: options}}
+	s.queue = export.NewQueue(export.Options{
+		Size:    options.QueueSize,
+		Send:    s.send,
+		Close:   s.disconnect,
+		Stopped: ErrSinkStopped,
+	})
+	return s, nil
+}
+
+// Send formats @event and queues the message. @event could be reused once
+// Send returns. It returns false if the message is dropped.
+func (s *Sink) Send(event *schema.Event) bool {
+	return s.queue.Push(s.frame(s.formatter.format(event)))
+}
+
+// Flush waits until queued messages are written or @ctx is done. It returns
+// the error of the last failed message.
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.queue.Flush(ctx)
+}
+
+// Shutdown stops accepting events, writes queued messages and closes the
+// connection. Writing is aborted once @ctx is done.
+func (s *Sink) Shutdown(ctx context.Context) error {
+	return s.queue.Shutdown(ctx)
+}
+
+// Stats returns counters of the sink.
+func (s *Sink) Stats() Stats {
+	stats := s.queue.Stats()
+	return Stats{
+		Sent:       stats.Sent,
+		Dropped:    stats.Dropped,
+		Failed:     stats.Failed,
+		Reconnects: stats.Retries,
+	}
+}
+
+// frame adds stream framing to @msg.
+func (s *Sink) frame(msg []byte) []byte {
+	if s.options.Network == NetworkUDP {
+		return msg
+	}
+	if s.options.Framing == FramingNewline {
+		return append(msg, '\n')
+	}
+	framed := strconv.AppendInt(nil, int64(len(msg)), 10)
+	framed = append(framed, ' ')
+	return append(framed, msg...)
+}
+
+// send writes @batch of messages. It returns the error of the last failed
+// message.
+func (s *Sink) send(batch []interface{}) error {
+	var last error
+	for _, msg := range batch {
+		if err := s.write(msg.([]byte)); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+// write writes @msg reconnecting once if the connection is broken. Failed
+// messages are counted and reported to OnError.
+func (s *Sink) write(msg []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				break
+			}
+		}
+		if err = s.conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout)); err == nil {
+			_, err = s.conn.Write(msg)
+		}
+		if err == nil {
+			s.queue.AddSent(1)
+			return nil
+		}
+		s.disconnect()
+	}
+	s.queue.AddFailed(1)
+	s.report(fmt.Errorf("failed to write message; %w", err))
+	return err
+}
+
+// connect dials the receiver until it succeeds or the sink is aborted.
+func (s *Sink) connect() error {
+	ctx := s.queue.Context()
+	backoff := export.Backoff{Min: s.options.MinBackoff, Max: s.options.MaxBackoff}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conn, err := s.dial()
+		if err == nil {
+			if s.connected {
+				s.queue.AddRetry()
+			}
+			s.conn, s.connected = conn, true
+			if s.options.Network != NetworkUDP {
+				go watch(conn)
+			}
+			return nil
+		}
+		s.report(fmt.Errorf("failed to connect to %s; %w", s.options.Address, err))
+
+		if !export.Wait(ctx, backoff.Next()) {
+			return err
+		}
+	}
+}
+
+func (s *Sink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.options.DialTimeout}
+	if s.options.Network == NetworkTLS {
+		return tls.DialWithDialer(dialer, "tcp", s.options.Address, s.options.TLSConfig)
+	}
+	return dialer.Dial(s.options.Network, s.options.Address)
+}
+
+// watch closes a stream @conn once the receiver closes it, so the next write
+// fails instead of being lost. Receivers never write anything back.
+func watch(conn net.Conn) {
+	_, _ = io.Copy(ioutil.Discard, conn)
+	_ = conn.Close()
+}
+
+func (s *Sink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Sink) report(err error) {
+	if s.options.OnError != nil {
+		s.options.OnError(err)
+	}
+}
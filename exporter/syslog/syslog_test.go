@@ -0,0 +1,395 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestSyslog(t *testing.T) {
+	suite.Run(t, new(syslogSuite))
+}
+
+type syslogSuite struct {
+	suite.Suite
+}
+
+func testEvent(id uint16) *schema.Event {
+	session := uint32(1)
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{
+				ID: id, Version: 2, Channel: 16, Level: schema.LevelWarning, OpCode: 1, Task: 3,
+				Keyword: 0x8000000000000010,
+			},
+			ThreadID:  8,
+			ProcessID: 4,
+			TimeStamp: time.Unix(1614834367, 123456700),
+			ProviderID: schema.GUID{
+				Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+				Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+			},
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+		Properties:   []schema.Property{{Name: "ProcessID", Value: uint32(1234)}},
+		Extended:     schema.Extended{SessionID: &session, UserSID: "S-1-5-18"},
+	}
+}
+
+func facility(f int) *int {
+	return &f
+}
+
+func testFormatter(options Options) *formatter {
+	options.Hostname = "host"
+	options.Address = "localhost:514"
+	options.setDefaults()
+	return &formatter{options: options}
+}
+
+// TestRFC5424 ensures the message layout and escaping.
+func (s *syslogSuite) TestRFC5424() {
+	msg := string(testFormatter(Options{}).format(testEvent(1)))
+	s.Equal(`<12>1 2021-03-04T05:06:07.123456Z host etw 4 1 `+
+		`[etw@32473 provider="Microsoft-Windows-Kernel-Process" providerGuid="{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}" `+
+		`eventId="1" version="2" channel="16" level="3" task="3" opcode="1" keywords="0x8000000000000010" `+
+		`pid="4" tid="8" sessionId="1" userSid="S-1-5-18"]`+
+		`[etwData@32473 ProcessID="1234"] `+
+		`Microsoft-Windows-Kernel-Process event 1`, msg)
+
+	e := testEvent(2)
+	e.ProviderName, e.Properties = "", nil
+	e.Header.Level = schema.LevelCritical
+	msg = string(testFormatter(Options{Facility: facility(16), AppName: "my app", EnterpriseID: 1}).format(e))
+	s.True(strings.HasPrefix(msg, "<130>1 2021-03-04T05:06:07.123456Z host my_app 4 2 [etw@1 providerGuid="), msg)
+	s.True(strings.HasSuffix(msg, `"] {22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716} event 2`), msg)
+
+	e = testEvent(3)
+	e.Header.Rundown, e.Header.DuringCaptureState = true, true
+	msg = string(testFormatter(Options{}).format(e))
+	s.Contains(msg, ` userSid="S-1-5-18" rundown="true" duringCaptureState="true"]`)
+
+	msg = string(testFormatter(Options{Facility: facility(0)}).format(testEvent(1)))
+	s.True(strings.HasPrefix(msg, "<4>1 "), "Kernel facility is replaced: %s", msg)
+}
+
+// TestCEF ensures the header and the mapping of extension keys.
+func (s *syslogSuite) TestCEF() {
+	msg := string(testFormatter(Options{Format: FormatCEF}).format(testEvent(1)))
+	s.Equal(`<12>1 2021-03-04T05:06:07.123456Z host etw 4 1 - `+
+		`CEF:0|Microsoft|ETW|1.0|1|Microsoft-Windows-Kernel-Process event 1|6|`+
+		`rt=1614834367123 dvcpid=4 cn1Label=ThreadID cn1=8 cs1Label=ProviderGUID cs1={22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716} `+
+		`cs2Label=ActivityID cs2={00000000-0000-0000-0000-000000000000} cs3Label=Keywords cs3=0x8000000000000010 suid=S-1-5-18`, msg)
+
+	e := testEvent(1)
+	e.Properties = []schema.Property{
+		{Name: "ImageName", Value: `C:\a.exe`},
+		{Name: "Args", Value: []string{"-a", "-b"}},
+		{Name: "Point", Value: []schema.Property{{Name: "X", Value: 1}}},
+	}
+	f := testFormatter(Options{Format: FormatCEF, CEF: CEFOptions{
+		Mapping: []CEFField{
+			{Key: "fname", Field: "data.ImageName"},
+			{Key: "cs1", Field: "data.Args"},
+			{Key: "cn1", Field: "data.Point.X"},
+			{Key: "cs2", Field: "data.Missing"},
+			{Key: "cs3Label", Value: "Level"},
+			{Key: "cs3", Field: FieldLevel},
+		},
+	}})
+	msg = string(f.format(e))
+	s.True(strings.HasSuffix(msg, `|6|fname=C:\\a.exe cs1=-a,-b cn1=1 cs3Label=Level cs3=3`), msg)
+}
+
+// TestSDEscaping ensures property names are made valid SD-NAMEs and values
+// are escaped.
+func (s *syslogSuite) TestSDEscaping() {
+	for _, c := range []struct {
+		name     string
+		property schema.Property
+		expected string
+	}{
+		{"Escaped characters", schema.Property{Name: "Path", Value: `C:\"a]b".exe`}, `Path="C:\\\"a\]b\".exe"`},
+		{"Name characters", schema.Property{Name: `Process ID=1]"`, Value: 1}, `Process_ID_1__="1"`},
+		{"Non-ASCII", schema.Property{Name: "Größe", Value: "ü"}, `Gr____e="ü"`},
+		{"Long name", schema.Property{Name: strings.Repeat("a", 40), Value: 1}, strings.Repeat("a", 32) + `="1"`},
+		{"Empty name", schema.Property{Value: 1}, `_="1"`},
+		{"Array", schema.Property{Name: "Args", Value: []interface{}{"-a", uint8(2)}}, `Args="-a" Args="2"`},
+		{"Structure", schema.Property{Name: "Point", Value: []schema.Property{{Name: "X", Value: "]"}}}, `Point.X="\]"`},
+		{"Bytes", schema.Property{Name: "Data", Value: []byte{0xCA, 0xFE}}, `Data="CAFE"`},
+		{"Float32", schema.Property{Name: "Ratio", Value: float32(0.1)}, `Ratio="0.1"`},
+	} {
+		e := testEvent(1)
+		e.Properties = []schema.Property{c.property}
+		msg := string(testFormatter(Options{}).format(e))
+		s.Contains(msg, `[etwData@32473 `+c.expected+`] `, c.name)
+	}
+}
+
+// TestCEFEscaping ensures '|' is escaped in the header only, '=' in
+// extension values only and newlines are kept out of both.
+func (s *syslogSuite) TestCEFEscaping() {
+	for _, c := range []struct {
+		name      string
+		text      string
+		header    string
+		extension string
+	}{
+		{"Pipe", "a|b", `a\|b`, `a|b`},
+		{"Equal sign", "a=b", `a=b`, `a\=b`},
+		{"Backslash", `a\b`, `a\\b`, `a\\b`},
+		{"Newlines", "a\r\nb", `a  b`, `a\r\nb`},
+	} {
+		e := testEvent(1)
+		e.Properties = []schema.Property{{Name: "Text", Value: c.text}}
+		f := testFormatter(Options{Format: FormatCEF, CEF: CEFOptions{
+			Vendor:  c.text,
+			Mapping: []CEFField{{Key: "msg", Field: "data.Text"}},
+		}})
+		msg := string(f.format(e))
+		s.Contains(msg, ` - CEF:0|`+c.header+`|ETW|`, c.name)
+		s.True(strings.HasSuffix(msg, `|msg=`+c.extension), "%s: %s", c.name, msg)
+	}
+}
+
+// TestSeverity ensures levels map to syslog and CEF severities.
+func (s *syslogSuite) TestSeverity() {
+	for level, expected := range map[uint8][2]int{
+		0: {5, 3}, 1: {2, 10}, 2: {3, 8}, 3: {4, 6}, 4: {6, 3}, 5: {7, 1}, 6: {7, 1},
+	} {
+		s.Equal(expected[0], severity(level), "level %d", level)
+		s.Equal(expected[1], cefSeverity(level), "level %d", level)
+	}
+}
+
+// TestUDP ensures every message is a datagram.
+func (s *syslogSuite) TestUDP() {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer conn.Close()
+
+	sink, err := NewSink(Options{Address: conn.LocalAddr().String(), Hostname: "host"})
+	s.Require().NoError(err)
+	s.True(sink.Send(testEvent(1)))
+	s.True(sink.Send(testEvent(2)))
+	s.Require().NoError(sink.Shutdown(context.Background()))
+	s.Equal(Stats{Sent: 2}, sink.Stats())
+
+	buf := make([]byte, 4096)
+	for _, id := range []string{"1", "2"} {
+		s.Require().NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		s.Require().NoError(err)
+		s.Contains(string(buf[:n]), " host etw 4 "+id+" [etw@32473 ")
+	}
+}
+
+// receiver is a stream listener collecting messages of all connections.
+type receiver struct {
+	listener net.Listener
+	framing  Framing
+
+	mu       sync.Mutex
+	messages []string
+	conns    []net.Conn
+}
+
+func newReceiver(listener net.Listener, framing Framing) *receiver {
+	r := &receiver{listener: listener, framing: framing}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+			go r.read(conn)
+		}
+	}()
+	return r
+}
+
+func (r *receiver) read(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	for {
+		var msg string
+		if r.framing == FramingNewline {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			msg = strings.TrimSuffix(line, "\n")
+		} else {
+			length, err := br.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+			if err != nil {
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			msg = string(buf)
+		}
+		r.mu.Lock()
+		r.messages = append(r.messages, msg)
+		r.mu.Unlock()
+	}
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+// dropConnections closes accepted connections.
+func (r *receiver) dropConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *receiver) close() {
+	r.listener.Close()
+	r.dropConnections()
+}
+
+// TestTCP ensures stream framings.
+func (s *syslogSuite) TestTCP() {
+	for _, framing := range []Framing{FramingOctetCounting, FramingNewline} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		s.Require().NoError(err)
+		r := newReceiver(listener, framing)
+
+		sink, err := NewSink(Options{Network: NetworkTCP, Address: listener.Addr().String(), Framing: framing, Format: FormatCEF})
+		s.Require().NoError(err)
+		for i := 1; i <= 3; i++ {
+			s.True(sink.Send(testEvent(uint16(i))))
+		}
+		s.Require().NoError(sink.Flush(context.Background()))
+		s.Eventually(func() bool { return len(r.received()) == 3 }, time.Second, 5*time.Millisecond)
+		s.Contains(r.received()[2], "|3|Microsoft-Windows-Kernel-Process event 3|")
+		s.Require().NoError(sink.Shutdown(context.Background()))
+		r.close()
+	}
+}
+
+// TestTLS ensures messages are sent over TLS.
+func (s *syslogSuite) TestTLS() {
+	// Borrow a certificate and a trusting client config of a test server.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	s.Require().NoError(err)
+	r := newReceiver(listener, FramingOctetCounting)
+	defer r.close()
+
+	clientConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	clientConfig.ServerName = "example.com"
+	sink, err := NewSink(Options{Network: NetworkTLS, Address: listener.Addr().String(), TLSConfig: clientConfig})
+	s.Require().NoError(err)
+	s.True(sink.Send(testEvent(1)))
+	s.Require().NoError(sink.Shutdown(context.Background()))
+	s.Eventually(func() bool { return len(r.received()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestReconnect ensures the sink reconnects once the receiver drops the
+// connection or is temporarily down.
+func (s *syslogSuite) TestReconnect() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	address := listener.Addr().String()
+	r := newReceiver(listener, FramingOctetCounting)
+
+	var mu sync.Mutex
+	var errs []error
+	sink, err := NewSink(Options{
+		Network: NetworkTCP, Address: address,
+		MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond,
+		OnError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	s.Require().NoError(err)
+	defer sink.Shutdown(context.Background())
+
+	s.True(sink.Send(testEvent(1)))
+	s.Require().NoError(sink.Flush(context.Background()))
+	s.Eventually(func() bool { return len(r.received()) == 1 }, time.Second, 5*time.Millisecond)
+
+	// The receiver restarts at the same address.
+	r.close()
+	time.Sleep(50 * time.Millisecond)
+	listener, err = net.Listen("tcp", address)
+	s.Require().NoError(err)
+	r = newReceiver(listener, FramingOctetCounting)
+	defer r.close()
+
+	s.True(sink.Send(testEvent(2)))
+	s.Require().NoError(sink.Flush(context.Background()))
+	s.Eventually(func() bool { return len(r.received()) == 1 }, time.Second, 5*time.Millisecond)
+	s.Equal(Stats{Sent: 2, Reconnects: 1}, sink.Stats())
+}
+
+// TestUnreachable ensures messages fail once the sink is shut down while
+// the receiver is down.
+func (s *syslogSuite) TestUnreachable() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	sink, err := NewSink(Options{Network: NetworkTCP, Address: address, MinBackoff: time.Hour, QueueSize: 1})
+	s.Require().NoError(err)
+	s.True(sink.Send(testEvent(1)))
+	s.Eventually(func() bool { return sink.Send(testEvent(2)) }, time.Second, 5*time.Millisecond)
+	s.False(sink.Send(testEvent(3)), "Queue is full")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, sink.Shutdown(ctx))
+	s.Equal(Stats{Dropped: 1, Failed: 2}, sink.Stats())
+	s.Equal(ErrSinkStopped, sink.Flush(context.Background()))
+	s.False(sink.Send(testEvent(4)))
+}
+
+// TestOptions ensures invalid options are rejected.
+func (s *syslogSuite) TestOptions() {
+	for _, options := range []Options{
+		{},
+		{Address: "localhost:514", Network: "unix"},
+		{Address: "localhost:514", Facility: facility(24)},
+		{Address: "localhost:514", Facility: facility(-1)},
+		{Address: "localhost:514", Format: 2},
+		{Address: "localhost:514", Framing: 2},
+		{Address: "localhost:514", CEF: CEFOptions{Mapping: []CEFField{{Key: "bad key", Field: FieldID}}}},
+		{Address: "localhost:514", CEF: CEFOptions{Mapping: []CEFField{{Key: "cs1", Field: "Unknown"}}}},
+	} {
+		_, err := NewSink(options)
+		s.Error(err, "%+v", options)
+	}
+}
@@ -0,0 +1,116 @@
+// Package filter compiles event filter expressions into predicates:
+//
+//	provider == "Microsoft-Windows-Kernel-Process" && id in (1, 2) && props.ImageName endswith ".exe"
+//
+// Expressions compare fields with literals and combine comparisons with
+// && (and), || (or), ! (not) and parentheses.
+//
+// Fields are header fields and properties:
+//   - provider is the provider name compared with strings or the provider
+//     GUID compared with GUIDs; provider_name and provider_id are explicit;
+//   - id, version, channel, level, opcode, task, keywords, pid, tid and
+//     flags are numbers;
+//   - activity_id is a GUID and timestamp is a time compared with RFC 3339
+//     strings;
+//   - props.Name refers a property, props["Name with spaces"] refers any
+//     name and props.Name.Field refers fields of structures.
+//
+// Literals are numbers (decimal, 0x hexadecimal or floating point), strings
+// with Go escapes, true and false, GUIDs in braces, IP addresses, networks
+// in CIDR notation and regular expressions as /.../ or /.../i for
+// case-insensitive ones.
+//
+// Comparisons are:
+//   - == != < <= > >= compare numbers, strings, times, GUIDs (== and !=
+//     only), IP addresses (== and !=) and booleans (== and !=);
+//   - in (a, b, ...) is true if any of == is; "in <network>" checks an IP
+//     address, networks could be in lists too;
+//   - contains, startswith and endswith compare strings;
+//   - matches (=~) and !~ match regular expressions;
+//   - exists(props.Name) is true if the event has the property.
+//
+// Strings are compared case-insensitively. Properties are compared by the
+// literal type: strings rendered by TDH are parsed as numbers, GUIDs and
+// addresses when needed. Comparisons of missing properties and values which
+// can't be converted are false, != included. Arrays match if any item does.
+package filter
+
+import (
+	"fmt"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Filter is a compiled expression. It's safe for concurrent use.
+type Filter struct {
+	expr         string
+	predicate    predicate
+	properties   bool
+	providerName bool
+}
+
+// predicate is a compiled expression.
+type predicate func(e *schema.Event) bool
+
+// Compile parses @expr. Errors are *SyntaxError.
+func Compile(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{expr: expr, tokens: tokens}
+	f := &Filter{expr: expr}
+	p.filter = f
+	if f.predicate, err = p.or(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t.describe())
+	}
+	return f, nil
+}
+
+// MustCompile is like Compile but panics if @expr can't be parsed.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match returns true if @e matches the expression.
+func (f *Filter) Match(e *schema.Event) bool {
+	return f.predicate(e)
+}
+
+// String returns the source expression.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// NeedsProperties reports if the expression refers properties, so events
+// without decoded properties can't be matched.
+func (f *Filter) NeedsProperties() bool {
+	return f.properties
+}
+
+// NeedsProviderName reports if the expression refers the provider name.
+func (f *Filter) NeedsProviderName() bool {
+	return f.providerName
+}
+
+// SyntaxError is an error of Compile.
+type SyntaxError struct {
+	Expr   string
+	Offset int // Byte offset of the error in Expr.
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Offset+1, e.Msg)
+}
+
+func syntaxError(expr string, offset int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Expr: expr, Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
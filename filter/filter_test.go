@@ -0,0 +1,205 @@
+package filter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestFilter(t *testing.T) {
+	suite.Run(t, new(filterSuite))
+}
+
+type filterSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var kernelProcessGUID = schema.GUID{Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B, Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16}}
+
+func processStart() *schema.Event {
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{ID: 1, Version: 3, Level: schema.LevelInformation, Keyword: 0x8000000000000010},
+			ProcessID:  4,
+			ThreadID:   8,
+			TimeStamp:  time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+			ProviderID: kernelProcessGUID,
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+		Properties: []schema.Property{
+			{Name: "ProcessID", Value: "0x1A2C"},
+			{Name: "ImageName", Value: `\Device\HarddiskVolume2\Windows\System32\Notepad.EXE`},
+			{Name: "ExitCode", Value: int32(-1)},
+			{Name: "Elevated", Value: true},
+			{Name: "Address", Value: "10.1.2.3"},
+			{Name: "Session ID", Value: uint32(2)},
+			{Name: "Ratio", Value: 0.5},
+			{Name: "Parent", Value: []schema.Property{
+				{Name: "Image", Value: "explorer.exe"},
+				{Name: "Token", Value: map[string]interface{}{"Integrity": "High"}},
+			}},
+			{Name: "Modules", Value: []string{"ntdll.dll", "kernel32.dll"}},
+			{Name: "Ports", Value: []uint16{80, 443}},
+			{Name: "Correlation", Value: "{a64ae4b5-4b2d-4c2a-9d8a-2f4b1c3d5e6f}"},
+		},
+	}
+}
+
+func (s *filterSuite) TestMatch() {
+	e := processStart()
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`provider == "Microsoft-Windows-Kernel-Process" && id in (1,2) && props.ImageName endswith ".exe"`, true},
+		{`provider == "microsoft-windows-kernel-process"`, true},
+		{`provider == {22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}`, true},
+		{`provider_id != {22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}`, false},
+		{`provider_name startswith "microsoft-windows-"`, true},
+		{`provider =~ /kernel-(process|file)/i`, true},
+		{`provider =~ /kernel-process/`, false},
+		{`provider !~ /Registry/`, true},
+		{`id == 2 || id == 1`, true},
+		{`id in (2, 3)`, false},
+		{`!(id == 1)`, false},
+		{`not id == 1 or level <= 4`, true},
+		{`level > 4`, false},
+		{`version >= 3 and version < 4`, true},
+		{`keywords == 0x8000000000000010`, true},
+		{`pid == 4 && tid == 8 && opcode == 0 && task == 0 && channel == 0 && flags == 0`, true},
+		{`activity_id == {00000000-0000-0000-0000-000000000000}`, true},
+		{`timestamp >= "2021-05-01T12:00:00Z" && timestamp < "2021-05-01T13:00:00+01:00"`, false},
+		{`timestamp > "2021-05-01T11:59:59.5Z"`, true},
+
+		// Properties.
+		{`props.ProcessID == 6700`, true},
+		{`props.ProcessID > 0x1000`, true},
+		{`props.ExitCode < 0`, true},
+		{`props.ExitCode == -1.0`, true},
+		{`props.Ratio < 1`, true},
+		{`props.Elevated == true`, true},
+		{`props.Elevated == false`, false},
+		{`props.ImageName contains "\\system32\\"`, true},
+		{`props.ImageName == "\\device\\harddiskvolume2\\windows\\system32\\notepad.exe"`, true},
+		{`props.ImageName matches "(?i)notepad"`, true},
+		{`props["Session ID"] == 2`, true},
+		{`props.Parent.Image == "Explorer.exe"`, true},
+		{`props["Parent"].Token.Integrity == "high"`, true},
+		{`props.Modules contains "kernel32"`, true},
+		{`props.Ports in (443)`, true},
+		{`props.Ports == 8080`, false},
+		{`props.Address in 10.0.0.0/8`, true},
+		{`props.Address in (192.168.0.0/16, 10.1.2.3)`, true},
+		{`props.Address == 10.1.2.4`, false},
+		{`props.Correlation == {A64AE4B5-4B2D-4C2A-9D8A-2F4B1C3D5E6F}`, true},
+		{`exists(props.ImageName) && !exists(props.Missing)`, true},
+
+		// Missing values and values of other types never match.
+		{`props.Missing == 1`, false},
+		{`props.Missing != 1`, false},
+		{`props.ImageName > 1`, false},
+		{`props.Parent.Missing.Field == "x"`, false},
+	}
+	for _, test := range tests {
+		f, err := Compile(test.expr)
+		if !s.NoError(err, test.expr) {
+			continue
+		}
+		s.Equal(test.match, f.Match(e), test.expr)
+		s.Equal(test.expr, f.String())
+	}
+}
+
+func (s *filterSuite) TestErrors() {
+	tests := []struct {
+		expr   string
+		offset int
+		msg    string
+	}{
+		{``, 0, `expected a field, got end of expression`},
+		{`id = 1`, 3, `unexpected "=", did you mean "=="?`},
+		{`id == 1 &&`, 10, `expected a field, got end of expression`},
+		{`id == 1 2`, 8, `unexpected "2"`},
+		{`(id == 1`, 8, `expected ")", got end of expression`},
+		{`idx == 1`, 0, `unknown field "idx"`},
+		{`id == "1"`, 6, `id is a number, got a string`},
+		{`id contains "1"`, 3, `"contains" applies to strings, id is a number`},
+		{`provider == Kernel`, 12, `expected a value, got "Kernel" (strings should be quoted)`},
+		{`provider == "a`, 12, `unterminated string`},
+		{`provider =~ /(/`, 12, "invalid regexp: error parsing regexp: missing closing ): `(`"},
+		{`provider =~ /a`, 12, `unterminated regexp`},
+		{`provider == {1234}`, 12, `invalid GUID {1234}`},
+		{`activity_id < {22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}`, 12, `"<" doesn't apply to a GUID`},
+		{`timestamp > "yesterday"`, 12, `timestamp is a time, got a string`},
+		{`props.Address == 10.0.0.0/8`, 17, `networks apply to "in" only`},
+		{`props.Address in 10.0.0.1`, 17, `expected a list or a network after "in", got "10.0.0.1"`},
+		{`props.Address in (1,`, 20, `expected a value, got end of expression`},
+		{`props.X == /x/`, 11, `regexps apply to matches only`},
+		{`props == 1`, 0, `expected a property name after props`},
+		{`props..X == 1`, 0, `empty property name in "props..X"`},
+		{`props[X] == 1`, 6, `expected a property name, got "X"`},
+		{`exists(id)`, 7, `exists applies to properties only`},
+		{`id # 1`, 3, `unexpected character '#'`},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.expr)
+		if !s.Error(err, test.expr) {
+			continue
+		}
+		serr, ok := err.(*SyntaxError)
+		if !s.True(ok, test.expr) {
+			continue
+		}
+		s.Equal(test.expr, serr.Expr)
+		s.Equal(test.offset, serr.Offset, test.expr)
+		s.Equal(test.msg, serr.Msg, test.expr)
+	}
+
+	_, err := Compile(`id == 1 2`)
+	s.EqualError(err, `column 9: unexpected "2"`)
+	s.Panics(func() { MustCompile(`id ==`) })
+}
+
+func (s *filterSuite) TestNeeds() {
+	f := MustCompile(`id == 1`)
+	s.False(f.NeedsProperties())
+	s.False(f.NeedsProviderName())
+
+	f = MustCompile(`provider == {22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716} && props.X == 1`)
+	s.True(f.NeedsProperties())
+	s.False(f.NeedsProviderName())
+
+	f = MustCompile(`provider endswith "-Process"`)
+	s.False(f.NeedsProperties())
+	s.True(f.NeedsProviderName())
+}
+
+func (s *filterSuite) TestValueTypes() {
+	e := &schema.Event{Properties: []schema.Property{
+		{Name: "Int64", Value: int64(-9223372036854775808)},
+		{Name: "Uint64", Value: uint64(18446744073709551615)},
+		{Name: "GUID", Value: kernelProcessGUID},
+		{Name: "IP", Value: net.ParseIP("fe80::1")},
+		{Name: "Time", Value: time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{Name: "Items", Value: []interface{}{"a", uint8(7)}},
+	}}
+	for _, expr := range []string{
+		`props.Int64 == -9223372036854775808 && props.Int64 < -9223372036854775807`,
+		`props.Uint64 == 18446744073709551615 && props.Uint64 > 18446744073709551614`,
+		`props.GUID == {22fb2cd6-0e7b-422b-a0c7-2fad1fd0e716}`,
+		`props.GUID == "{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}"`,
+		`props.IP in fe80::/10 && props.IP == fe80::1`,
+		`props.Time == "2021-05-01T14:00:00+02:00"`,
+		`props.Items == 7 && props.Items == "A"`,
+	} {
+		f, err := Compile(expr)
+		if s.NoError(err, expr) {
+			s.True(f.Match(e), expr)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenKind is a kind of lexical token.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenOperator // == != < <= > >= && || ! =~ !~
+	tokenString   // "..." with Go escapes.
+	tokenRegex    // /.../ with an optional i flag.
+	tokenGUID     // {XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX}
+	tokenAtom     // Words, numbers, IP addresses and networks.
+)
+
+type token struct {
+	kind tokenKind
+	text string // Source text, unquoted for strings and regexps.
+	pos  int    // Byte offset in the expression.
+}
+
+// describe returns the token for error messages.
+func (t token) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return fmt.Sprintf("string %q", t.text)
+	case tokenRegex:
+		return fmt.Sprintf("regexp /%s/", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// isAtomChar reports characters of words, numbers, addresses and networks.
+func isAtomChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+		ch == '_' || ch == '.' || ch == ':' || ch == '/' || ch == '-' || ch == '+'
+}
+
+// lex splits @expr into tokens.
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		start := i
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			continue
+		case ch == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case ch == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case ch == '[':
+			tokens = append(tokens, token{tokenLBracket, "[", i})
+			i++
+		case ch == ']':
+			tokens = append(tokens, token{tokenRBracket, "]", i})
+			i++
+		case ch == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case strings.IndexByte("=!<>&|", ch) >= 0:
+			op := expr[i : i+1]
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||", "=~", "!~":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, syntaxError(expr, i, "unexpected %q, did you mean %q?", op, op+op)
+			}
+			tokens = append(tokens, token{tokenOperator, op, i})
+			i += len(op)
+		case ch == '"':
+			end, err := scanString(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			text, err := strconv.Unquote(expr[i:end])
+			if err != nil {
+				return nil, syntaxError(expr, i, "invalid string: %v", err)
+			}
+			tokens = append(tokens, token{tokenString, text, i})
+			i = end
+		case ch == '/':
+			i++
+			var b strings.Builder
+			for ; i < len(expr) && expr[i] != '/'; i++ {
+				if expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == '/' {
+					i++
+				}
+				b.WriteByte(expr[i])
+			}
+			if i == len(expr) {
+				return nil, syntaxError(expr, start, "unterminated regexp")
+			}
+			i++
+			text := b.String()
+			if i < len(expr) && expr[i] == 'i' {
+				text = "(?i)" + text
+				i++
+			}
+			tokens = append(tokens, token{tokenRegex, text, start})
+		case ch == '{':
+			end := strings.IndexByte(expr[i:], '}')
+			if end < 0 {
+				return nil, syntaxError(expr, i, "unterminated GUID")
+			}
+			i += end + 1
+			tokens = append(tokens, token{tokenGUID, expr[start:i], start})
+		case isAtomChar(ch):
+			for i < len(expr) && isAtomChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenAtom, expr[start:i], start})
+		default:
+			return nil, syntaxError(expr, i, "unexpected character %q", ch)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// scanString returns the end of the string literal starting at @start.
+func scanString(expr string, start int) (int, error) {
+	for i := start + 1; i < len(expr); i++ {
+		switch expr[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, syntaxError(expr, start, "unterminated string")
+}
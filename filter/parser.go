@@ -0,0 +1,418 @@
+package filter
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// parser compiles tokens into predicates:
+//
+//	or         = and { ( "||" | "or" ) and }
+//	and        = unary { ( "&&" | "and" ) unary }
+//	unary      = ( "!" | "not" ) unary | primary
+//	primary    = "(" or ")" | "exists" "(" field ")" | comparison
+//	comparison = field ( operator literal | "in" list | "in" literal | keyword literal )
+//	list       = "(" literal { "," literal } ")"
+//	field      = name | "props" { "." name | "[" string "]" }
+type parser struct {
+	expr   string
+	tokens []token
+	pos    int
+	filter *Filter
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword reports if @t is the (case-insensitive) @keyword or operator.
+func isKeyword(t token, keyword string) bool {
+	return (t.kind == tokenAtom || t.kind == tokenOperator) && strings.EqualFold(t.text, keyword)
+}
+
+// accept consumes the next token if it's any of @keywords.
+func (p *parser) accept(keywords ...string) bool {
+	for _, k := range keywords {
+		if isKeyword(p.peek(), k) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s, got %s", what, t.describe())
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return syntaxError(p.expr, t.pos, format, args...)
+}
+
+func (p *parser) or() (predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||", "or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *schema.Event) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) and() (predicate, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&", "and") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *schema.Event) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (predicate, error) {
+	if p.accept("!", "not") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *schema.Event) bool { return !x(e) }, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (predicate, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenLParen:
+		p.next()
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case isKeyword(t, "exists") && p.tokens[p.pos+1].kind == tokenLParen:
+		p.pos += 2
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		if f.header != nil {
+			return nil, p.errorf(f.token, "exists applies to properties only")
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return func(e *schema.Event) bool {
+			_, ok := lookup(e.Properties, f.path)
+			return ok
+		}, nil
+	}
+	return p.comparison()
+}
+
+// fieldRef is a field of a comparison: a header field or a property path.
+type fieldRef struct {
+	token  token
+	name   string
+	header *headerField
+	path   []string
+}
+
+func (p *parser) field() (*fieldRef, error) {
+	t := p.next()
+	if t.kind != tokenAtom {
+		return nil, p.errorf(t, "expected a field, got %s", t.describe())
+	}
+	f := &fieldRef{token: t, name: t.text}
+
+	segments := strings.Split(t.text, ".")
+	if segments[0] != "props" {
+		h, ok := headerFields[strings.ToLower(t.text)]
+		if !ok {
+			return nil, p.errorf(t, "unknown field %q", t.text)
+		}
+		f.header = &h
+		return f, nil
+	}
+
+	p.filter.properties = true
+	if err := p.appendPath(f, t, segments[1:]); err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenLBracket {
+		p.next()
+		name, err := p.expect(tokenString, "a property name")
+		if err != nil {
+			return nil, err
+		}
+		closing, err := p.expect(tokenRBracket, `"]"`)
+		if err != nil {
+			return nil, err
+		}
+		f.path = append(f.path, name.text)
+		f.name = p.expr[t.pos : closing.pos+1]
+
+		// The rest of the path right after the bracket is lexed as ".Field".
+		if next := p.peek(); next.kind == tokenAtom && next.pos == closing.pos+1 && strings.HasPrefix(next.text, ".") {
+			p.next()
+			f.name += next.text
+			if err := p.appendPath(f, next, strings.Split(next.text[1:], ".")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(f.path) == 0 {
+		return nil, p.errorf(t, "expected a property name after props")
+	}
+	return f, nil
+}
+
+func (p *parser) appendPath(f *fieldRef, t token, segments []string) error {
+	for _, s := range segments {
+		if s == "" {
+			return p.errorf(t, "empty property name in %q", t.text)
+		}
+		f.path = append(f.path, s)
+	}
+	return nil
+}
+
+func (p *parser) comparison() (predicate, error) {
+	f, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == tokenOperator && (op.text == "==" || op.text == "!=" ||
+		op.text == "<" || op.text == "<=" || op.text == ">" || op.text == ">="):
+		lit, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return p.compare(f, op, lit, false)
+
+	case isKeyword(op, "=~") || isKeyword(op, "!~") || isKeyword(op, "matches"):
+		t := p.next()
+		var re *regexp.Regexp
+		switch t.kind {
+		case tokenRegex, tokenString:
+			if re, err = regexp.Compile(t.text); err != nil {
+				return nil, p.errorf(t, "invalid regexp: %v", err)
+			}
+		default:
+			return nil, p.errorf(t, "expected a regexp after %q, got %s", op.text, t.describe())
+		}
+		x, err := p.text(f, op)
+		if err != nil {
+			return nil, err
+		}
+		match := func(e *schema.Event) bool { return x(e, re.MatchString) }
+		if op.text == "!~" {
+			return func(e *schema.Event) bool { return x(e, func(s string) bool { return !re.MatchString(s) }) }, nil
+		}
+		return match, nil
+
+	case isKeyword(op, "contains") || isKeyword(op, "startswith") || isKeyword(op, "endswith"):
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, p.errorf(t, "expected a string after %q, got %s", op.text, t.describe())
+		}
+		x, err := p.text(f, op)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(t.text)
+		var check func(string, string) bool
+		switch strings.ToLower(op.text) {
+		case "contains":
+			check = strings.Contains
+		case "startswith":
+			check = strings.HasPrefix
+		default:
+			check = strings.HasSuffix
+		}
+		return func(e *schema.Event) bool {
+			return x(e, func(v string) bool { return check(strings.ToLower(v), s) })
+		}, nil
+
+	case isKeyword(op, "in"):
+		var lits []*literal
+		if p.peek().kind == tokenLParen {
+			p.next()
+			for {
+				lit, err := p.literal()
+				if err != nil {
+					return nil, err
+				}
+				lits = append(lits, lit)
+				if p.peek().kind != tokenComma {
+					break
+				}
+				p.next()
+			}
+			if _, err := p.expect(tokenRParen, `"," or ")"`); err != nil {
+				return nil, err
+			}
+		} else {
+			lit, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			if lit.kind != literalCIDR {
+				return nil, p.errorf(lit.token, "expected a list or a network after \"in\", got %s", lit.token.describe())
+			}
+			lits = []*literal{lit}
+		}
+
+		eq := token{kind: tokenOperator, text: "==", pos: op.pos}
+		var alternatives []predicate
+		for _, lit := range lits {
+			x, err := p.compare(f, eq, lit, true)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, x)
+		}
+		return func(e *schema.Event) bool {
+			for _, x := range alternatives {
+				if x(e) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, p.errorf(op, "expected an operator after %s, got %s", f.name, op.describe())
+}
+
+// text returns a function applying a string check to texts of the field.
+func (p *parser) text(f *fieldRef, op token) (func(e *schema.Event, check func(string) bool) bool, error) {
+	if f.header != nil {
+		h := f.header
+		if h.kind != kindString {
+			return nil, p.errorf(op, "%q applies to strings, %s is %s", op.text, f.name, h.kind)
+		}
+		p.filter.providerName = true
+		get := h.str
+		return func(e *schema.Event, check func(string) bool) bool { return check(get(e)) }, nil
+	}
+	path := f.path
+	return func(e *schema.Event, check func(string) bool) bool {
+		v, ok := lookup(e.Properties, path)
+		return ok && anyItem(v, func(x interface{}) bool { return check(text(x)) })
+	}, nil
+}
+
+// literal parses a literal value.
+func (p *parser) literal() (*literal, error) {
+	t := p.next()
+	lit := &literal{token: t}
+	switch t.kind {
+	case tokenString:
+		lit.kind = literalString
+		lit.str = t.text
+		if ts, err := time.Parse(time.RFC3339Nano, t.text); err == nil {
+			lit.time, lit.isTime = ts, true
+		}
+	case tokenRegex:
+		return nil, p.errorf(t, "regexps apply to matches only")
+	case tokenGUID:
+		g, err := schema.ParseGUID(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid GUID %s", t.text)
+		}
+		lit.kind, lit.guid = literalGUID, g
+	case tokenAtom:
+		switch {
+		case strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false"):
+			lit.kind, lit.boolean = literalBool, strings.EqualFold(t.text, "true")
+		case strings.Contains(t.text, "/"):
+			_, network, err := net.ParseCIDR(t.text)
+			if err != nil {
+				return nil, p.errorf(t, "invalid network %s", t.text)
+			}
+			lit.kind, lit.network = literalCIDR, network
+		case net.ParseIP(t.text) != nil:
+			lit.kind, lit.ip = literalIP, net.ParseIP(t.text)
+		default:
+			n, ok := parseNumber(t.text)
+			if !ok {
+				return nil, p.errorf(t, "expected a value, got %s (strings should be quoted)", t.describe())
+			}
+			lit.kind, lit.number = literalNumber, n
+		}
+	default:
+		return nil, p.errorf(t, "expected a value, got %s", t.describe())
+	}
+	return lit, nil
+}
+
+// compare compiles a comparison of @f with @lit. Networks are allowed in
+// "in" comparisons only.
+func (p *parser) compare(f *fieldRef, op token, lit *literal, in bool) (predicate, error) {
+	ordering := op.text != "==" && op.text != "!="
+	switch lit.kind {
+	case literalGUID, literalBool, literalIP, literalCIDR:
+		if ordering {
+			return nil, p.errorf(op, "%q doesn't apply to %s", op.text, lit.kind)
+		}
+	}
+	if lit.kind == literalCIDR && !in {
+		return nil, p.errorf(lit.token, "networks apply to \"in\" only")
+	}
+	cmp := comparator(op.text)
+
+	if f.header == nil {
+		path := f.path
+		return func(e *schema.Event) bool {
+			v, ok := lookup(e.Properties, path)
+			return ok && anyItem(v, func(x interface{}) bool { return lit.compare(x, cmp) })
+		}, nil
+	}
+
+	h := f.header
+	if strings.EqualFold(f.name, "provider") && lit.kind == literalGUID {
+		// The provider is compared by name or by GUID.
+		h = &providerID
+	}
+	if h.kind == kindString {
+		p.filter.providerName = true
+	}
+	if !h.accepts(lit) {
+		return nil, p.errorf(lit.token, "%s is %s, got %s", f.name, h.kind, lit.kind)
+	}
+	return h.compile(lit, cmp), nil
+}
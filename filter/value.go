@@ -0,0 +1,427 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// literalKind is a type of literal.
+type literalKind int
+
+const (
+	literalNumber literalKind = iota
+	literalString
+	literalBool
+	literalGUID
+	literalIP
+	literalCIDR
+)
+
+func (k literalKind) String() string {
+	switch k {
+	case literalNumber:
+		return "a number"
+	case literalString:
+		return "a string"
+	case literalBool:
+		return "a boolean"
+	case literalGUID:
+		return "a GUID"
+	case literalIP:
+		return "an IP address"
+	default:
+		return "a network"
+	}
+}
+
+// literal is a parsed literal value.
+type literal struct {
+	kind  literalKind
+	token token
+
+	str     string
+	time    time.Time
+	isTime  bool // The string is an RFC 3339 time.
+	guid    schema.GUID
+	boolean bool
+	ip      net.IP
+	network *net.IPNet
+	number  number
+}
+
+// compare compares a property value @x with the literal. @cmp gets the result
+// of comparison of @x with the literal as strings.Compare does. Values which
+// can't be converted to the literal type don't match.
+func (lit *literal) compare(x interface{}, cmp func(int) bool) bool {
+	switch lit.kind {
+	case literalNumber:
+		n, ok := toNumber(x)
+		return ok && cmp(n.compare(lit.number))
+
+	case literalString:
+		if t, ok := x.(time.Time); ok && lit.isTime {
+			return cmp(compareTimes(t, lit.time))
+		}
+		return cmp(strings.Compare(strings.ToLower(text(x)), strings.ToLower(lit.str)))
+
+	case literalBool:
+		var b bool
+		switch x := x.(type) {
+		case bool:
+			b = x
+		case string:
+			var err error
+			if b, err = strconv.ParseBool(x); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+		return cmp(equality(b == lit.boolean))
+
+	case literalGUID:
+		var g schema.GUID
+		switch x := x.(type) {
+		case schema.GUID:
+			g = x
+		case string:
+			var err error
+			if g, err = schema.ParseGUID(x); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+		return cmp(equality(g == lit.guid))
+
+	case literalIP, literalCIDR:
+		var ip net.IP
+		switch x := x.(type) {
+		case net.IP:
+			ip = x
+		case string:
+			if ip = net.ParseIP(x); ip == nil {
+				return false
+			}
+		default:
+			return false
+		}
+		if lit.kind == literalCIDR {
+			return cmp(equality(lit.network.Contains(ip)))
+		}
+		return cmp(equality(ip.Equal(lit.ip)))
+	}
+	return false
+}
+
+// equality converts an equality check to a comparison result.
+func equality(equal bool) int {
+	if equal {
+		return 0
+	}
+	return 1
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// comparator returns a check of comparison results for the operator @op.
+func comparator(op string) func(int) bool {
+	switch op {
+	case "!=":
+		return func(c int) bool { return c != 0 }
+	case "<":
+		return func(c int) bool { return c < 0 }
+	case "<=":
+		return func(c int) bool { return c <= 0 }
+	case ">":
+		return func(c int) bool { return c > 0 }
+	case ">=":
+		return func(c int) bool { return c >= 0 }
+	default:
+		return func(c int) bool { return c == 0 }
+	}
+}
+
+// fieldKind is a type of header field.
+type fieldKind int
+
+const (
+	kindNumber fieldKind = iota
+	kindGUID
+	kindString
+	kindTime
+)
+
+func (k fieldKind) String() string {
+	switch k {
+	case kindNumber:
+		return "a number"
+	case kindGUID:
+		return "a GUID"
+	case kindString:
+		return "a string"
+	default:
+		return "a time"
+	}
+}
+
+// headerField is a field of the event header. The getter of the kind is set.
+type headerField struct {
+	kind   fieldKind
+	number func(e *schema.Event) uint64
+	guid   func(e *schema.Event) schema.GUID
+	str    func(e *schema.Event) string
+	time   func(e *schema.Event) time.Time
+}
+
+// accepts returns true if the field could be compared with @lit.
+func (h *headerField) accepts(lit *literal) bool {
+	switch h.kind {
+	case kindNumber:
+		return lit.kind == literalNumber
+	case kindGUID:
+		return lit.kind == literalGUID
+	case kindString:
+		return lit.kind == literalString
+	default:
+		return lit.kind == literalString && lit.isTime
+	}
+}
+
+// compile returns a predicate comparing the field with @lit, which the field
+// accepts.
+func (h *headerField) compile(lit *literal, cmp func(int) bool) predicate {
+	switch h.kind {
+	case kindNumber:
+		get, n := h.number, lit.number
+		return func(e *schema.Event) bool {
+			return cmp(number{u: get(e), integer: true}.compare(n))
+		}
+	case kindGUID:
+		get, g := h.guid, lit.guid
+		return func(e *schema.Event) bool { return cmp(equality(get(e) == g)) }
+	case kindString:
+		get, s := h.str, strings.ToLower(lit.str)
+		return func(e *schema.Event) bool { return cmp(strings.Compare(strings.ToLower(get(e)), s)) }
+	default:
+		get, t := h.time, lit.time
+		return func(e *schema.Event) bool { return cmp(compareTimes(get(e), t)) }
+	}
+}
+
+//nolint:gochecknoglobals
+var (
+	providerName = headerField{kind: kindString, str: func(e *schema.Event) string { return e.ProviderName }}
+	providerID   = headerField{kind: kindGUID, guid: func(e *schema.Event) schema.GUID { return e.Header.ProviderID }}
+)
+
+// headerFields are header fields by name. The provider is compared by name
+// unless the literal is a GUID.
+//
+//nolint:gochecknoglobals
+var headerFields = map[string]headerField{
+	"provider":      providerName,
+	"provider_name": providerName,
+	"provider_id":   providerID,
+	"id":            {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.ID) }},
+	"version":       {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.Version) }},
+	"channel":       {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.Channel) }},
+	"level":         {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.Level) }},
+	"opcode":        {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.OpCode) }},
+	"task":          {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.Task) }},
+	"keywords":      {kind: kindNumber, number: func(e *schema.Event) uint64 { return e.Header.Keyword }},
+	"pid":           {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.ProcessID) }},
+	"tid":           {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.ThreadID) }},
+	"flags":         {kind: kindNumber, number: func(e *schema.Event) uint64 { return uint64(e.Header.Flags) }},
+	"activity_id":   {kind: kindGUID, guid: func(e *schema.Event) schema.GUID { return e.Header.ActivityID }},
+	"timestamp":     {kind: kindTime, time: func(e *schema.Event) time.Time { return e.Header.TimeStamp }},
+}
+
+// number is an exact integer or a floating point number.
+type number struct {
+	u       uint64 // Absolute value of integers.
+	f       float64
+	neg     bool
+	integer bool
+}
+
+// parseNumber parses decimal, 0x hexadecimal and floating point numbers.
+func parseNumber(s string) (number, bool) {
+	if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return number{u: u, integer: true}, true
+	}
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return fromInt(i), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return number{}, false
+	}
+	return number{f: f}, true
+}
+
+// toNumber converts a property value to a number.
+func toNumber(x interface{}) (number, bool) {
+	switch x := x.(type) {
+	case uint8:
+		return number{u: uint64(x), integer: true}, true
+	case uint16:
+		return number{u: uint64(x), integer: true}, true
+	case uint32:
+		return number{u: uint64(x), integer: true}, true
+	case uint64:
+		return number{u: x, integer: true}, true
+	case uint:
+		return number{u: uint64(x), integer: true}, true
+	case uintptr:
+		return number{u: uint64(x), integer: true}, true
+	case int8:
+		return fromInt(int64(x)), true
+	case int16:
+		return fromInt(int64(x)), true
+	case int32:
+		return fromInt(int64(x)), true
+	case int64:
+		return fromInt(x), true
+	case int:
+		return fromInt(int64(x)), true
+	case float32:
+		return number{f: float64(x)}, true
+	case float64:
+		return number{f: x}, true
+	case string:
+		return parseNumber(strings.TrimSpace(x))
+	}
+	return number{}, false
+}
+
+func fromInt(i int64) number {
+	if i < 0 {
+		// -(i+1)+1 doesn't overflow for math.MinInt64.
+		return number{u: uint64(-(i + 1)) + 1, neg: true, integer: true}
+	}
+	return number{u: uint64(i), integer: true}
+}
+
+func (n number) float() float64 {
+	if !n.integer {
+		return n.f
+	}
+	if n.neg {
+		return -float64(n.u)
+	}
+	return float64(n.u)
+}
+
+// compare returns -1, 0 or 1 if @n is less, equal or greater than @m.
+func (n number) compare(m number) int {
+	if !n.integer || !m.integer {
+		a, b := n.float(), m.float()
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case n.neg && !m.neg:
+		return -1
+	case !n.neg && m.neg:
+		return 1
+	}
+	c := 0
+	switch {
+	case n.u < m.u:
+		c = -1
+	case n.u > m.u:
+		c = 1
+	}
+	if n.neg {
+		return -c
+	}
+	return c
+}
+
+// lookup returns the property at @path, fields of structures included.
+func lookup(properties []schema.Property, path []string) (interface{}, bool) {
+	var v interface{} = properties
+	for _, name := range path {
+		found := false
+		switch s := v.(type) {
+		case []schema.Property:
+			for _, p := range s {
+				if p.Name == name {
+					v, found = p.Value, true
+					break
+				}
+			}
+		case map[string]interface{}:
+			v, found = s[name]
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// anyItem applies @fn to items of arrays or to the scalar @v.
+func anyItem(v interface{}, fn func(x interface{}) bool) bool {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, x := range v {
+			if fn(x) {
+				return true
+			}
+		}
+		return false
+	case []string:
+		for _, x := range v {
+			if fn(x) {
+				return true
+			}
+		}
+		return false
+	case []byte, []schema.Property, net.IP:
+		return fn(v)
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		for i := 0; i < rv.Len(); i++ {
+			if fn(rv.Index(i).Interface()) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(v)
+}
+
+// text formats a property value for string comparisons.
+func text(x interface{}) string {
+	switch x := x.(type) {
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(x)
+}
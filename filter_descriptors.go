@@ -0,0 +1,197 @@
+//go:build windows
+// +build windows
+
+package etw
+
+/*
+	#include "etw.h"
+*/
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Payload filters API is missing in MinGW as well as TdhFormatProperty.
+//
+//nolint:gochecknoglobals
+var (
+	tdhCreatePayloadFilter                 = tdh.NewProc("TdhCreatePayloadFilter")
+	tdhDeletePayloadFilter                 = tdh.NewProc("TdhDeletePayloadFilter")
+	tdhAggregatePayloadFilters             = tdh.NewProc("TdhAggregatePayloadFilters")
+	tdhCleanupPayloadEventFilterDescriptor = tdh.NewProc("TdhCleanupPayloadEventFilterDescriptor")
+)
+
+// filterDescriptors is an array of EVENT_FILTER_DESCRIPTOR allocated in C
+// memory to be passed with ENABLE_TRACE_PARAMETERS.
+type filterDescriptors struct {
+	array   *C.EVENT_FILTER_DESCRIPTOR
+	count   int
+	buffers []unsafe.Pointer
+	payload *C.EVENT_FILTER_DESCRIPTOR // Allocated by TDH if any.
+}
+
+// newFilterDescriptors builds descriptors for filters of the @provider.
+// Returned descriptors should be freed with `.free()` after use.
+func newFilterDescriptors(provider *Provider) (*filterDescriptors, error) {
+	filters, payload, err := marshalFilters(provider.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filters; %w", err)
+	}
+
+	d := &filterDescriptors{count: len(filters)}
+	if payload != nil {
+		d.count++
+	}
+	if d.count == 0 {
+		return d, nil
+	}
+
+	descSize := C.size_t(unsafe.Sizeof(C.EVENT_FILTER_DESCRIPTOR{}))
+	d.array = (*C.EVENT_FILTER_DESCRIPTOR)(C.calloc(C.size_t(d.count), descSize))
+	if d.array == nil {
+		return nil, fmt.Errorf("calloc(%d, %d) failed", d.count, descSize)
+	}
+	array := (*[1 << 10]C.EVENT_FILTER_DESCRIPTOR)(unsafe.Pointer(d.array))[:d.count:d.count]
+
+	for i, f := range filters {
+		buf := C.CBytes(f.data)
+		d.buffers = append(d.buffers, buf)
+		array[i].Ptr = C.ULONGLONG(uintptr(buf))
+		array[i].Size = C.ULONG(len(f.data))
+		array[i].Type = C.ULONG(f.filterType)
+	}
+
+	if payload != nil {
+		d.payload = &array[len(filters)]
+		if err := aggregatePayloadFilter(provider.ProviderId, payload, d.payload); err != nil {
+			d.payload = nil
+			d.free()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// free releases all the memory allocated for descriptors.
+func (d *filterDescriptors) free() {
+	if d.payload != nil {
+		_, _, _ = tdhCleanupPayloadEventFilterDescriptor.Call(uintptr(unsafe.Pointer(d.payload)))
+	}
+	for _, buf := range d.buffers {
+		C.free(buf)
+	}
+	if d.array != nil {
+		C.free(unsafe.Pointer(d.array))
+	}
+}
+
+// payloadPredicate mirrors PAYLOAD_FILTER_PREDICATE.
+type payloadPredicate struct {
+	FieldName *uint16
+	CompareOp uint16
+	Value     *uint16
+}
+
+// aggregatePayloadFilter creates TDH payload filters for every event of
+// @filter and aggregates them into a descriptor @out.
+func aggregatePayloadFilter(providerID windows.GUID, filter *PayloadFilter, out *C.EVENT_FILTER_DESCRIPTOR) error {
+	handles := make([]uintptr, 0, len(filter.Events))
+	defer func() {
+		for i := range handles {
+			_, _, _ = tdhDeletePayloadFilter.Call(uintptr(unsafe.Pointer(&handles[i])))
+		}
+	}()
+
+	for _, e := range filter.Events {
+		handle, err := createPayloadFilter(providerID, e)
+		if err != nil {
+			return err
+		}
+		handles = append(handles, handle)
+	}
+
+	matchAll := make([]byte, len(handles)) // BOOLEAN array.
+	if filter.MatchAll {
+		for i := range matchAll {
+			matchAll[i] = 1
+		}
+	}
+
+	// ULONG TdhAggregatePayloadFilters(
+	//  ULONG                    PayloadFilterCount,
+	//  PVOID                    *PayloadFilterPtrs,
+	//  PBOOLEAN                 EventMatchALLFlags,
+	//  PEVENT_FILTER_DESCRIPTOR EventFilterDescriptor
+	// );
+	r0, _, _ := tdhAggregatePayloadFilters.Call(
+		uintptr(len(handles)),
+		uintptr(unsafe.Pointer(&handles[0])),
+		uintptr(unsafe.Pointer(&matchAll[0])),
+		uintptr(unsafe.Pointer(out)),
+	)
+	if status := windows.Errno(r0); status != windows.ERROR_SUCCESS {
+		return fmt.Errorf("TdhAggregatePayloadFilters failed; %w", status)
+	}
+	return nil
+}
+
+// createPayloadFilter wraps TdhCreatePayloadFilter returning a filter handle
+// which should be deleted with TdhDeletePayloadFilter.
+func createPayloadFilter(providerID windows.GUID, filter PayloadEventFilter) (uintptr, error) {
+	predicates := make([]payloadPredicate, len(filter.Predicates))
+	for i, p := range filter.Predicates {
+		field, err := windows.UTF16PtrFromString(p.Field)
+		if err != nil {
+			return 0, fmt.Errorf("invalid field name %q; %w", p.Field, err)
+		}
+		value, err := windows.UTF16PtrFromString(p.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q; %w", p.Value, err)
+		}
+		predicates[i] = payloadPredicate{FieldName: field, CompareOp: uint16(p.Op), Value: value}
+	}
+
+	descriptor := C.EVENT_DESCRIPTOR{
+		Id:      C.USHORT(filter.Event.ID),
+		Version: C.UCHAR(filter.Event.Version),
+		Channel: C.UCHAR(filter.Event.Channel),
+		Level:   C.UCHAR(filter.Event.Level),
+		Opcode:  C.UCHAR(filter.Event.OpCode),
+		Task:    C.USHORT(filter.Event.Task),
+		Keyword: C.ULONGLONG(filter.Event.Keyword),
+	}
+	var matchAny byte
+	if filter.MatchAny {
+		matchAny = 1
+	}
+
+	// ULONG TdhCreatePayloadFilter(
+	//  LPCGUID                    ProviderGuid,
+	//  PCEVENT_DESCRIPTOR         EventDescriptor,
+	//  BOOLEAN                    EventMatchANY,
+	//  ULONG                      PayloadPredicateCount,
+	//  PPAYLOAD_FILTER_PREDICATE  PayloadPredicates,
+	//  PVOID                      *PayloadFilter
+	// );
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/tdh/nf-tdh-tdhcreatepayloadfilter
+	var handle uintptr
+	r0, _, _ := tdhCreatePayloadFilter.Call(
+		uintptr(unsafe.Pointer(&providerID)),
+		uintptr(unsafe.Pointer(&descriptor)),
+		uintptr(matchAny),
+		uintptr(len(predicates)),
+		uintptr(unsafe.Pointer(&predicates[0])),
+		uintptr(unsafe.Pointer(&handle)),
+	)
+	// Strings are referenced from predicates only.
+	runtime.KeepAlive(predicates)
+	if status := windows.Errno(r0); status != windows.ERROR_SUCCESS {
+		return 0, fmt.Errorf("TdhCreatePayloadFilter failed for event %d; %w", filter.Event.ID, status)
+	}
+	return handle, nil
+}
@@ -0,0 +1,278 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Types of EVENT_FILTER_DESCRIPTOR.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntprov/ns-evntprov-event_filter_descriptor
+const (
+	eventFilterTypePID            = 0x80000004
+	eventFilterTypeExecutableName = 0x80000008
+	eventFilterTypePayload        = 0x80000100
+	eventFilterTypeEventID        = 0x80000200
+	eventFilterTypeStackWalk      = 0x80001000
+)
+
+// Limits of filters data, see evntprov.h.
+const (
+	maxEventFilterPIDCount     = 8    // MAX_EVENT_FILTER_PID_COUNT
+	maxEventFilterEventIDCount = 64   // MAX_EVENT_FILTER_EVENT_ID_COUNT
+	maxEventFilterDataSize     = 1024 // MAX_EVENT_FILTER_DATA_SIZE
+	maxPayloadPredicates       = 8    // MAX_PAYLOAD_PREDICATES
+)
+
+// EventFilter is a filter applied by the provider itself, so filtered out
+// events are never written to the session. Filters are passed to the provider
+// with EnableTraceEx2 as EVENT_FILTER_DESCRIPTOR. Only one filter of each type
+// could be set for a provider.
+//
+// Filters are available for user providers only and most of them require
+// Windows 8.1 or newer.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntprov/ns-evntprov-event_filter_descriptor
+type EventFilter interface {
+	// filterType returns EVENT_FILTER_TYPE_* of the filter.
+	filterType() uint32
+	// marshal validates the filter and returns EVENT_FILTER_DESCRIPTOR data.
+	marshal() ([]byte, error)
+}
+
+// PIDFilter passes events from processes listed in PIDs only. Up to 8 PIDs
+// could be set.
+type PIDFilter struct {
+	PIDs []uint32
+}
+
+func (f PIDFilter) filterType() uint32 {
+	return eventFilterTypePID
+}
+
+// marshal encodes PIDs as an array of ULONG.
+func (f PIDFilter) marshal() ([]byte, error) {
+	if len(f.PIDs) == 0 || len(f.PIDs) > maxEventFilterPIDCount {
+		return nil, fmt.Errorf("PID filter should have 1 to %d PIDs, got %d", maxEventFilterPIDCount, len(f.PIDs))
+	}
+	data := make([]byte, 4*len(f.PIDs))
+	for i, pid := range f.PIDs {
+		binary.LittleEndian.PutUint32(data[4*i:], pid)
+	}
+	return data, nil
+}
+
+// EventIDFilter passes (if FilterIn is set) or drops events with IDs listed.
+// Up to 64 IDs could be set.
+type EventIDFilter struct {
+	IDs      []uint16
+	FilterIn bool
+}
+
+func (f EventIDFilter) filterType() uint32 {
+	return eventFilterTypeEventID
+}
+
+func (f EventIDFilter) marshal() ([]byte, error) {
+	return marshalEventIDs(f.IDs, f.FilterIn)
+}
+
+// StackWalkFilter limits events which get a call stack with
+// EVENT_ENABLE_PROPERTY_STACK_TRACE: stacks are collected for listed event
+// IDs only (if FilterIn is set) or for all events except listed ones. Up to 64
+// IDs could be set.
+type StackWalkFilter struct {
+	IDs      []uint16
+	FilterIn bool
+}
+
+func (f StackWalkFilter) filterType() uint32 {
+	return eventFilterTypeStackWalk
+}
+
+func (f StackWalkFilter) marshal() ([]byte, error) {
+	return marshalEventIDs(f.IDs, f.FilterIn)
+}
+
+// marshalEventIDs encodes EVENT_FILTER_EVENT_ID structure:
+//
+//	typedef struct _EVENT_FILTER_EVENT_ID {
+//	  BOOLEAN FilterIn;
+//	  UCHAR   Reserved;
+//	  USHORT  Count;
+//	  USHORT  Events[ANYSIZE_ARRAY];
+//	} EVENT_FILTER_EVENT_ID;
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntprov/ns-evntprov-event_filter_event_id
+func marshalEventIDs(ids []uint16, filterIn bool) ([]byte, error) {
+	if len(ids) == 0 || len(ids) > maxEventFilterEventIDCount {
+		return nil, fmt.Errorf("event ID filter should have 1 to %d IDs, got %d", maxEventFilterEventIDCount, len(ids))
+	}
+	data := make([]byte, 4+2*len(ids))
+	if filterIn {
+		data[0] = 1
+	}
+	binary.LittleEndian.PutUint16(data[2:], uint16(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint16(data[4+2*i:], id)
+	}
+	return data, nil
+}
+
+// ExecutableNameFilter passes events from processes with executable file
+// names (like "notepad.exe") listed in Names only.
+type ExecutableNameFilter struct {
+	Names []string
+}
+
+func (f ExecutableNameFilter) filterType() uint32 {
+	return eventFilterTypeExecutableName
+}
+
+// marshal encodes names as a null-terminated UTF-16 string of names separated
+// by semicolons.
+func (f ExecutableNameFilter) marshal() ([]byte, error) {
+	if len(f.Names) == 0 {
+		return nil, errors.New("executable name filter should have at least one name")
+	}
+	for _, name := range f.Names {
+		if name == "" || strings.ContainsAny(name, ";\x00") {
+			return nil, fmt.Errorf("invalid executable name %q", name)
+		}
+	}
+
+	encoded := utf16.Encode([]rune(strings.Join(f.Names, ";")))
+	encoded = append(encoded, 0)
+	if 2*len(encoded) > maxEventFilterDataSize {
+		return nil, fmt.Errorf("executable names exceed %d bytes", maxEventFilterDataSize)
+	}
+
+	data := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(data[2*i:], c)
+	}
+	return data, nil
+}
+
+// PayloadOperator is a comparison operator of PayloadPredicate.
+type PayloadOperator uint16
+
+//nolint:golint,stylecheck // We keep original names to underline that it's an external constants.
+const (
+	PAYLOADFIELD_EQ            = PayloadOperator(0)
+	PAYLOADFIELD_NE            = PayloadOperator(1)
+	PAYLOADFIELD_LE            = PayloadOperator(2)
+	PAYLOADFIELD_GT            = PayloadOperator(3)
+	PAYLOADFIELD_LT            = PayloadOperator(4)
+	PAYLOADFIELD_GE            = PayloadOperator(5)
+	PAYLOADFIELD_BETWEEN       = PayloadOperator(6) // Value is "low,high".
+	PAYLOADFIELD_NOTBETWEEN    = PayloadOperator(7)
+	PAYLOADFIELD_MODULO        = PayloadOperator(8)
+	PAYLOADFIELD_CONTAINS      = PayloadOperator(20)
+	PAYLOADFIELD_DOESNTCONTAIN = PayloadOperator(21)
+	PAYLOADFIELD_IS            = PayloadOperator(30)
+	PAYLOADFIELD_ISNOT         = PayloadOperator(31)
+)
+
+// PayloadPredicate compares the event field named Field with Value.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/tdh/ns-tdh-payload_filter_predicate
+type PayloadPredicate struct {
+	Field string
+	Op    PayloadOperator
+	Value string
+}
+
+// PayloadEventFilter matches events of a single type described by Event (ID
+// and Version are used) by up to 8 predicates. All predicates should match
+// unless MatchAny is set.
+type PayloadEventFilter struct {
+	Event      EventDescriptor
+	MatchAny   bool
+	Predicates []PayloadPredicate
+}
+
+// PayloadFilter passes events matching payload predicates. Events of types
+// not mentioned in Events are passed as is.
+//
+// Payload filters are schematized: fields are resolved with the provider
+// manifest, so the provider should be registered in the system. Unlike other
+// filters, the data is built by TDH when the provider is enabled.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/tdh/nf-tdh-tdhaggregatepayloadfilters
+type PayloadFilter struct {
+	Events []PayloadEventFilter
+
+	// MatchAll requires events to match all filters for the same event type
+	// instead of any of them.
+	MatchAll bool
+}
+
+func (f PayloadFilter) filterType() uint32 {
+	return eventFilterTypePayload
+}
+
+// marshal only validates the filter. Its data is produced by TDH.
+func (f PayloadFilter) marshal() ([]byte, error) {
+	if len(f.Events) == 0 {
+		return nil, errors.New("payload filter should have at least one event filter")
+	}
+	for _, e := range f.Events {
+		if len(e.Predicates) == 0 || len(e.Predicates) > maxPayloadPredicates {
+			return nil, fmt.Errorf("payload filter of event %d should have 1 to %d predicates, got %d",
+				e.Event.ID, maxPayloadPredicates, len(e.Predicates))
+		}
+		for _, p := range e.Predicates {
+			if p.Field == "" {
+				return nil, fmt.Errorf("payload filter of event %d has a predicate without a field", e.Event.ID)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// filterData is a serialized EventFilter ready to be placed into
+// EVENT_FILTER_DESCRIPTOR.
+type filterData struct {
+	filterType uint32
+	data       []byte
+}
+
+// marshalFilters serializes @filters checking there are no filters of the
+// same type. Payload filter is returned separately as it requires TDH.
+func marshalFilters(filters []EventFilter) ([]filterData, *PayloadFilter, error) {
+	var (
+		result  []filterData
+		payload *PayloadFilter
+		seen    = make(map[uint32]bool)
+	)
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+		if seen[f.filterType()] {
+			return nil, nil, fmt.Errorf("duplicate filter of type %#x", f.filterType())
+		}
+		seen[f.filterType()] = true
+
+		data, err := f.marshal()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch pf := f.(type) {
+		case PayloadFilter:
+			payload = &pf
+		case *PayloadFilter:
+			payload = pf
+		default:
+			result = append(result, filterData{filterType: f.filterType(), data: data})
+		}
+	}
+	return result, payload, nil
+}
@@ -0,0 +1,118 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestFilters(t *testing.T) {
+	suite.Run(t, new(filtersSuite))
+}
+
+type filtersSuite struct {
+	suite.Suite
+}
+
+// TestPID ensures PIDs are encoded as an array of ULONG.
+func (s *filtersSuite) TestPID() {
+	data, err := PIDFilter{PIDs: []uint32{4, 0x01020304}}.marshal()
+	s.Require().NoError(err)
+	s.Equal([]byte{
+		0x04, 0x00, 0x00, 0x00,
+		0x04, 0x03, 0x02, 0x01,
+	}, data)
+
+	_, err = PIDFilter{}.marshal()
+	s.Error(err, "Empty PID list")
+	_, err = PIDFilter{PIDs: make([]uint32, maxEventFilterPIDCount+1)}.marshal()
+	s.Error(err, "Too many PIDs")
+}
+
+// TestEventID ensures EVENT_FILTER_EVENT_ID layout.
+func (s *filtersSuite) TestEventID() {
+	data, err := EventIDFilter{IDs: []uint16{1, 0x0203}, FilterIn: true}.marshal()
+	s.Require().NoError(err)
+	s.Equal([]byte{
+		0x01,       // FilterIn
+		0x00,       // Reserved
+		0x02, 0x00, // Count
+		0x01, 0x00, // Events[0]
+		0x03, 0x02, // Events[1]
+	}, data)
+
+	data, err = StackWalkFilter{IDs: []uint16{7}}.marshal()
+	s.Require().NoError(err)
+	s.Equal([]byte{0x00, 0x00, 0x01, 0x00, 0x07, 0x00}, data)
+
+	_, err = EventIDFilter{}.marshal()
+	s.Error(err, "Empty ID list")
+	_, err = StackWalkFilter{IDs: make([]uint16, maxEventFilterEventIDCount+1)}.marshal()
+	s.Error(err, "Too many IDs")
+}
+
+// TestExecutableName ensures names are joined into a null-terminated UTF-16
+// string.
+func (s *filtersSuite) TestExecutableName() {
+	data, err := ExecutableNameFilter{Names: []string{"a.exe", "я"}}.marshal()
+	s.Require().NoError(err)
+	s.Equal([]byte{
+		'a', 0, '.', 0, 'e', 0, 'x', 0, 'e', 0,
+		';', 0,
+		0x4f, 0x04, // U+044F
+		0, 0,
+	}, data)
+
+	invalid := [][]string{nil, {""}, {"a;b.exe"}, {strings.Repeat("a", maxEventFilterDataSize)}}
+	for _, names := range invalid {
+		_, err = ExecutableNameFilter{Names: names}.marshal()
+		s.Error(err, "Names %v", names)
+	}
+}
+
+// TestPayload ensures payload filters are validated and split from others.
+func (s *filtersSuite) TestPayload() {
+	payload := PayloadFilter{Events: []PayloadEventFilter{{
+		Event:      EventDescriptor{ID: 1},
+		Predicates: []PayloadPredicate{{Field: "Name", Op: PAYLOADFIELD_EQ, Value: "x"}},
+	}}}
+
+	filters, gotPayload, err := marshalFilters([]EventFilter{
+		PIDFilter{PIDs: []uint32{1}},
+		nil,
+		&payload,
+		EventIDFilter{IDs: []uint16{1}},
+	})
+	s.Require().NoError(err)
+	s.Equal(&payload, gotPayload)
+	s.Require().Len(filters, 2)
+	s.Equal(uint32(eventFilterTypePID), filters[0].filterType)
+	s.Equal(uint32(eventFilterTypeEventID), filters[1].filterType)
+
+	_, _, err = marshalFilters([]EventFilter{PayloadFilter{}})
+	s.Error(err, "Empty payload filter")
+	_, _, err = marshalFilters([]EventFilter{PayloadFilter{Events: []PayloadEventFilter{{
+		Predicates: []PayloadPredicate{{Value: "x"}},
+	}}}})
+	s.Error(err, "Predicate without a field")
+}
+
+// TestDuplicates ensures only one filter of each type is allowed.
+func (s *filtersSuite) TestDuplicates() {
+	_, _, err := marshalFilters([]EventFilter{
+		EventIDFilter{IDs: []uint16{1}},
+		EventIDFilter{IDs: []uint16{2}, FilterIn: true},
+	})
+	s.Error(err)
+
+	// Stack walk filter shares the layout but not the type.
+	_, _, err = marshalFilters([]EventFilter{
+		EventIDFilter{IDs: []uint16{1}},
+		StackWalkFilter{IDs: []uint16{1}},
+	})
+	s.NoError(err)
+}
@@ -0,0 +1,272 @@
+// Package export is the plumbing shared by exporters: a bounded queue drained
+// by a background goroutine with batching, flushes and graceful shutdown, and
+// an exponential backoff for retries.
+package export
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configure Queue. Zero values stand for no batching and no periodic
+// flushes.
+type Options struct {
+	// Size is the number of items waiting to be sent. Items pushed to a full
+	// queue are dropped.
+	Size int
+
+	// BatchSize is the maximal number of items passed to Send at once.
+	BatchSize int
+
+	// FlushInterval is how often incomplete batches are sent.
+	FlushInterval time.Duration
+
+	// Send is called from the background goroutine with batches of items. The
+	// batch is reused once Send returns.
+	Send func(batch []interface{}) error
+
+	// Close is called from the background goroutine once the queue is
+	// drained.
+	Close func()
+
+	// Stopped is returned by Flush and Shutdown once the queue is shut down.
+	Stopped error
+}
+
+// Stats are counters of a Queue. Dropped is counted by the queue, others by
+// the exporter.
+type Stats struct {
+	Sent    uint64
+	Dropped uint64
+	Failed  uint64
+	Retries uint64
+}
+
+// Queue sends pushed items from a background goroutine.
+type Queue struct {
+	// Counters are accessed atomically, keep them first for 64-bit alignment.
+	sent    uint64
+	dropped uint64
+	failed  uint64
+	retries uint64
+
+	options Options
+
+	// mu guards items from being closed while items are pushed.
+	mu      sync.RWMutex
+	stopped bool
+	items   chan interface{}
+	flushes chan chan error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewQueue starts a queue.
+func NewQueue(options Options) *Queue {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		options: options,
+		items:   make(chan interface{}, options.Size),
+		flushes: make(chan chan error),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Context is canceled once Shutdown is aborted, so Send should give up.
+func (q *Queue) Context() context.Context {
+	return q.ctx
+}
+
+// Push queues @item. It returns false if the item is dropped.
+func (q *Queue) Push(item interface{}) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.stopped {
+		select {
+		case q.items <- item:
+			return true
+		default:
+		}
+	}
+	atomic.AddUint64(&q.dropped, 1)
+	return false
+}
+
+// Flush sends queued items and waits until they are sent or @ctx is done. It
+// returns the error of the last failed batch.
+func (q *Queue) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case q.flushes <- reply:
+	case <-q.done:
+		return q.options.Stopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting items and sends queued ones. Sending is aborted
+// once @ctx is done.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return q.options.Stopped
+	}
+	q.stopped = true
+	close(q.items)
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+		return ctx.Err()
+	}
+}
+
+// AddSent counts @n items delivered.
+func (q *Queue) AddSent(n int) {
+	atomic.AddUint64(&q.sent, uint64(n))
+}
+
+// AddFailed counts @n items failed to be delivered.
+func (q *Queue) AddFailed(n int) {
+	atomic.AddUint64(&q.failed, uint64(n))
+}
+
+// AddRetry counts a retry.
+func (q *Queue) AddRetry() {
+	atomic.AddUint64(&q.retries, 1)
+}
+
+// Stats returns counters of the queue.
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&q.sent),
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Failed:  atomic.LoadUint64(&q.failed),
+		Retries: atomic.LoadUint64(&q.retries),
+	}
+}
+
+// run batches queued items until the queue is closed.
+func (q *Queue) run() {
+	defer close(q.done)
+	defer q.cancel()
+	if q.options.Close != nil {
+		defer q.options.Close()
+	}
+
+	var tick <-chan time.Time
+	if q.options.FlushInterval > 0 {
+		ticker := time.NewTicker(q.options.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([]interface{}, 0, q.options.BatchSize)
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := q.options.Send(batch)
+		for i := range batch {
+			batch[i] = nil
+		}
+		batch = batch[:0]
+		return err
+	}
+	// add appends @item sending the batch once it's full.
+	add := func(item interface{}) error {
+		batch = append(batch, item)
+		if len(batch) == q.options.BatchSize {
+			return send()
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case item, ok := <-q.items:
+			if !ok {
+				_ = send()
+				return
+			}
+			_ = add(item)
+		case <-tick:
+			_ = send()
+		case reply := <-q.flushes:
+			var last error
+			for drained := false; !drained; {
+				select {
+				case item, ok := <-q.items:
+					if !ok {
+						drained = true
+						break
+					}
+					if err := add(item); err != nil {
+						last = err
+					}
+				default:
+					drained = true
+				}
+			}
+			if err := send(); err != nil {
+				last = err
+			}
+			reply <- last
+		}
+	}
+}
+
+// Backoff is an exponential backoff: delays are doubled from Min up to Max.
+type Backoff struct {
+	Min  time.Duration
+	Max  time.Duration
+	next time.Duration
+}
+
+// Next returns the delay before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.Min
+	}
+	delay := b.next
+	b.next *= 2
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+	return delay
+}
+
+// Wait sleeps for @delay. It returns false if @ctx is done first.
+func Wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
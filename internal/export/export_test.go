@@ -0,0 +1,87 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestExport(t *testing.T) {
+	suite.Run(t, new(exportSuite))
+}
+
+type exportSuite struct {
+	suite.Suite
+}
+
+var errStopped = errors.New("stopped")
+
+// TestQueue ensures items are batched, flushed and drained on shutdown.
+func (s *exportSuite) TestQueue() {
+	var mu sync.Mutex
+	var batches [][]interface{}
+	q := NewQueue(Options{
+		Size:      10,
+		BatchSize: 2,
+		Send: func(batch []interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, append([]interface{}(nil), batch...))
+			if batch[0] == 3 {
+				return errors.New("failed")
+			}
+			return nil
+		},
+		Stopped: errStopped,
+	})
+
+	s.True(q.Push(1))
+	s.True(q.Push(2))
+	s.True(q.Push(3))
+	s.Error(q.Flush(context.Background()), "Failed batch")
+	s.True(q.Push(4))
+	s.Require().NoError(q.Shutdown(context.Background()))
+
+	s.Equal([][]interface{}{{1, 2}, {3}, {4}}, batches)
+	s.False(q.Push(5), "Stopped")
+	s.Equal(Stats{Dropped: 1}, q.Stats())
+	s.Equal(errStopped, q.Flush(context.Background()))
+	s.Equal(errStopped, q.Shutdown(context.Background()))
+}
+
+// TestShutdownTimeout ensures Shutdown cancels Send once its context is done.
+func (s *exportSuite) TestShutdownTimeout() {
+	closed := false
+	var q *Queue
+	q = NewQueue(Options{
+		Size: 1,
+		Send: func([]interface{}) error {
+			<-q.Context().Done()
+			return q.Context().Err()
+		},
+		Close: func() { closed = true },
+	})
+	s.Require().True(q.Push(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, q.Shutdown(ctx))
+	s.True(closed, "Close is not called")
+}
+
+func (s *exportSuite) TestBackoff() {
+	b := Backoff{Min: time.Second, Max: 3 * time.Second}
+	s.Equal(time.Second, b.Next())
+	s.Equal(2*time.Second, b.Next())
+	s.Equal(3*time.Second, b.Next())
+	s.Equal(3*time.Second, b.Next())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.False(Wait(ctx, time.Hour))
+	s.True(Wait(context.Background(), 0))
+}
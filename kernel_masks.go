@@ -0,0 +1,221 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"golang.org/x/sys/windows"
+)
+
+// PerfGroupMask is an extended kernel flag which EVENT_TRACE_FLAG_* can't
+// express. The top 3 bits hold an index of the mask in PERFINFO_GROUPMASK,
+// the rest are flags of that mask.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ne-evntrace-trace_query_info_class
+// (TraceSystemTraceEnableFlagsInfo)
+type PerfGroupMask uint32
+
+// Some of PERF_* values from ntwmi.h. Masks with index 0 are EVENT_TRACE_FLAG_*
+// and should be set with Provider.EnableFlags.
+//
+//nolint:golint,stylecheck // We keep original names to underline that it's an external constants.
+const (
+	PERF_MEMORY          = PerfGroupMask(0x20000001)
+	PERF_PROFILE         = PerfGroupMask(0x20000002)
+	PERF_CONTEXT_SWITCH  = PerfGroupMask(0x20000004)
+	PERF_FOOTPRINT       = PerfGroupMask(0x20000008)
+	PERF_DRIVERS         = PerfGroupMask(0x20000010)
+	PERF_REFSET          = PerfGroupMask(0x20000020)
+	PERF_POOL            = PerfGroupMask(0x20000040)
+	PERF_DPC             = PerfGroupMask(0x20000080)
+	PERF_COMPACT_CSWITCH = PerfGroupMask(0x20000100)
+	PERF_DISPATCHER      = PerfGroupMask(0x20000200)
+	PERF_PMC_PROFILE     = PerfGroupMask(0x20000400)
+	PERF_PROFILING       = PerfGroupMask(0x20000402)
+	PERF_PROCESS_INSWAP  = PerfGroupMask(0x20000800)
+	PERF_AFFINITY        = PerfGroupMask(0x20001000)
+	PERF_PRIORITY        = PerfGroupMask(0x20002000)
+	PERF_INTERRUPT       = PerfGroupMask(0x20004000)
+	PERF_VIRTUAL_ALLOC   = PerfGroupMask(0x20008000)
+	PERF_SPINLOCK        = PerfGroupMask(0x20010000)
+	PERF_SYNC_OBJECTS    = PerfGroupMask(0x20020000)
+	PERF_DPC_QUEUE       = PerfGroupMask(0x20040000)
+	PERF_MEMINFO         = PerfGroupMask(0x20080000)
+	PERF_CONTMEM_GEN     = PerfGroupMask(0x20100000)
+	PERF_SPINLOCK_CNTRS  = PerfGroupMask(0x20200000)
+	PERF_SESSION         = PerfGroupMask(0x20400000)
+	PERF_MEMINFO_WS      = PerfGroupMask(0x20800000)
+	PERF_KERNEL_QUEUE    = PerfGroupMask(0x21000000)
+	PERF_INTERRUPT_STEER = PerfGroupMask(0x22000000)
+	PERF_SHOULD_YIELD    = PerfGroupMask(0x24000000)
+	PERF_WS              = PerfGroupMask(0x28000000)
+
+	PERF_ANTI_STARVATION  = PerfGroupMask(0x40000001)
+	PERF_PROCESS_FREEZE   = PerfGroupMask(0x40000002)
+	PERF_PFN_LIST         = PerfGroupMask(0x40000004)
+	PERF_WS_DETAIL        = PerfGroupMask(0x40000008)
+	PERF_WS_ENTRY         = PerfGroupMask(0x40000010)
+	PERF_HEAP             = PerfGroupMask(0x40000020)
+	PERF_SYSCALL          = PerfGroupMask(0x40000040)
+	PERF_UMS              = PerfGroupMask(0x40000080)
+	PERF_BACKTRACE        = PerfGroupMask(0x40000100)
+	PERF_VULCAN           = PerfGroupMask(0x40000200)
+	PERF_OBJECTS          = PerfGroupMask(0x40000400)
+	PERF_EVENTS           = PerfGroupMask(0x40000800)
+	PERF_FULLTRACE        = PerfGroupMask(0x40001000)
+	PERF_DFSS             = PerfGroupMask(0x40002000)
+	PERF_PREFETCH         = PerfGroupMask(0x40004000)
+	PERF_PROCESSOR_IDLE   = PerfGroupMask(0x40008000)
+	PERF_CPU_CONFIG       = PerfGroupMask(0x40010000)
+	PERF_TIMER            = PerfGroupMask(0x40020000)
+	PERF_CLOCK_INTERRUPT  = PerfGroupMask(0x40040000)
+	PERF_LOAD_BALANCER    = PerfGroupMask(0x40080000)
+	PERF_CLOCK_TIMER      = PerfGroupMask(0x40100000)
+	PERF_IDLE_SELECTION   = PerfGroupMask(0x40200000)
+	PERF_IPI              = PerfGroupMask(0x40400000)
+	PERF_IO_TIMER         = PerfGroupMask(0x40800000)
+	PERF_REG_HIVE         = PerfGroupMask(0x41000000)
+	PERF_REG_NOTIF        = PerfGroupMask(0x42000000)
+	PERF_PPM_EXIT_LATENCY = PerfGroupMask(0x44000000)
+	PERF_WORKER_THREAD    = PerfGroupMask(0x48000000)
+
+	PERF_OPTICAL_IO      = PerfGroupMask(0x80000001)
+	PERF_OPTICAL_IO_INIT = PerfGroupMask(0x80000002)
+	PERF_DLL_INFO        = PerfGroupMask(0x80000008)
+	PERF_DLL_FLUSH_WS    = PerfGroupMask(0x80000010)
+	PERF_OB_HANDLE       = PerfGroupMask(0x80000040)
+	PERF_OB_OBJECT       = PerfGroupMask(0x80000080)
+	PERF_WAKE_DROP       = PerfGroupMask(0x80000200)
+	PERF_WAKE_EVENT      = PerfGroupMask(0x80000400)
+	PERF_DEBUGGER        = PerfGroupMask(0x80000800)
+	PERF_PROC_ATTACH     = PerfGroupMask(0x80001000)
+	PERF_WAKE_COUNTER    = PerfGroupMask(0x80002000)
+	PERF_POWER           = PerfGroupMask(0x80008000)
+	PERF_SOFT_TRIM       = PerfGroupMask(0x80010000)
+	PERF_CC              = PerfGroupMask(0x80020000)
+	PERF_FLT_IO_INIT     = PerfGroupMask(0x80080000)
+	PERF_FLT_IO          = PerfGroupMask(0x80100000)
+	PERF_FLT_FASTIO      = PerfGroupMask(0x80200000)
+	PERF_FLT_IO_FAILURE  = PerfGroupMask(0x80400000)
+	PERF_HV_PROFILE      = PerfGroupMask(0x80800000)
+	PERF_WDF_DPC         = PerfGroupMask(0x81000000)
+	PERF_WDF_INTERRUPT   = PerfGroupMask(0x82000000)
+	PERF_CACHE_FLUSH     = PerfGroupMask(0x84000000)
+
+	PERF_HIBER_RUNDOWN = PerfGroupMask(0xA0000001)
+
+	PERF_SYSCFG_SYSTEM   = PerfGroupMask(0xC0000001)
+	PERF_SYSCFG_GRAPHICS = PerfGroupMask(0xC0000002)
+	PERF_SYSCFG_STORAGE  = PerfGroupMask(0xC0000004)
+	PERF_SYSCFG_NETWORK  = PerfGroupMask(0xC0000008)
+	PERF_SYSCFG_SERVICES = PerfGroupMask(0xC0000010)
+	PERF_SYSCFG_PNP      = PerfGroupMask(0xC0000020)
+	PERF_SYSCFG_OPTICAL  = PerfGroupMask(0xC0000040)
+
+	PERF_CLUSTER_OFF    = PerfGroupMask(0xE0000001)
+	PERF_MEMORY_CONTROL = PerfGroupMask(0xE0000002)
+)
+
+const (
+	perfMaskIndexShift = 29
+	perfMaskGroup      = 1<<perfMaskIndexShift - 1
+
+	// Kernel accepts up to 256 event classes for stack tracing.
+	maxStackTracingClasses = 256
+
+	// sizeof(CLASSIC_EVENT_ID)
+	classicEventIDSize = 24
+)
+
+// perfGroupMasks mirrors PERFINFO_GROUPMASK: the first mask holds
+// EVENT_TRACE_FLAG_* and the rest are extended ones.
+type perfGroupMasks [8]uint32
+
+func (m *perfGroupMasks) set(mask PerfGroupMask) {
+	m[uint32(mask)>>perfMaskIndexShift] |= uint32(mask) & perfMaskGroup
+}
+
+// groupMasksOf returns extended masks of the @provider.
+func groupMasksOf(provider *Provider) perfGroupMasks {
+	var masks perfGroupMasks
+	for _, mask := range provider.GroupMasks {
+		masks.set(mask)
+	}
+	return masks
+}
+
+// kernelGroupMasks merges EnableFlags and GroupMasks of all providers in the
+// table. Should be called with providersMu held.
+func (trace *Trace) kernelGroupMasks() perfGroupMasks {
+	var masks perfGroupMasks
+	for _, provider := range trace.providers {
+		masks[0] |= uint32(provider.EnableFlags)
+		for _, mask := range provider.GroupMasks {
+			masks.set(mask)
+		}
+	}
+	return masks
+}
+
+// stackTracingClass is a kernel event class to collect call stacks for.
+type stackTracingClass struct {
+	id     windows.GUID
+	opcode uint8
+}
+
+// kernelStackTracing collects event classes of all providers in the table
+// and serializes them into an array of CLASSIC_EVENT_ID. Classes are sorted,
+// so the result could be compared with the applied one.
+// Should be called with providersMu held.
+func (trace *Trace) kernelStackTracing() ([]byte, error) {
+	seen := make(map[stackTracingClass]bool)
+	var classes []stackTracingClass
+	for _, provider := range trace.providers {
+		for _, opcode := range provider.StackTracing {
+			class := stackTracingClass{id: provider.ProviderId, opcode: opcode}
+			if !seen[class] {
+				seen[class] = true
+				classes = append(classes, class)
+			}
+		}
+	}
+	if len(classes) > maxStackTracingClasses {
+		return nil, fmt.Errorf("too many event classes for stack tracing: %d, max %d",
+			len(classes), maxStackTracingClasses)
+	}
+	return marshalClassicEventIDs(classes), nil
+}
+
+// marshalClassicEventIDs encodes @classes as an array of CLASSIC_EVENT_ID:
+//
+//	typedef struct _CLASSIC_EVENT_ID {
+//	  GUID  EventGuid;
+//	  UCHAR Type;
+//	  UCHAR Reserved[7];
+//	} CLASSIC_EVENT_ID;
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ns-evntrace-classic_event_id
+func marshalClassicEventIDs(classes []stackTracingClass) []byte {
+	if len(classes) == 0 {
+		return nil
+	}
+
+	items := make([][]byte, len(classes))
+	for i, class := range classes {
+		item := make([]byte, classicEventIDSize)
+		binary.LittleEndian.PutUint32(item[0:], class.id.Data1)
+		binary.LittleEndian.PutUint16(item[4:], class.id.Data2)
+		binary.LittleEndian.PutUint16(item[6:], class.id.Data3)
+		copy(item[8:16], class.id.Data4[:])
+		item[16] = class.opcode
+		items[i] = item
+	}
+	// Keep the order stable to compare arrays built from the map.
+	sort.Slice(items, func(i, j int) bool { return bytes.Compare(items[i], items[j]) < 0 })
+	return bytes.Join(items, nil)
+}
@@ -0,0 +1,88 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestKernelMasks(t *testing.T) {
+	suite.Run(t, new(kernelMasksSuite))
+}
+
+type kernelMasksSuite struct {
+	suite.Suite
+}
+
+// TestGroupMasks ensures PERF_* values are placed to the proper mask and
+// merged with EnableFlags.
+func (s *kernelMasksSuite) TestGroupMasks() {
+	trace, err := newTrace("Test-ETW", func(*Event) {}, newFakeTraceImpl(), nil)
+	s.Require().NoError(err)
+
+	memory := &Provider{ProviderId: KERNEL_PAGE_FAULT_GUID, GroupMasks: []PerfGroupMask{PERF_MEMINFO, PERF_MEMINFO_WS}}
+	s.Require().NoError(trace.Enable(KERNEL_PROCESS_PROVIDER, memory, &Provider{
+		ProviderId: KERNEL_PERF_INFO_GUID,
+		GroupMasks: []PerfGroupMask{PERF_PMC_PROFILE, PERF_SYSCALL, PERF_OB_HANDLE, PERF_MEMORY_CONTROL},
+	}))
+	s.Len(trace.providers, 3)
+
+	s.Equal(perfGroupMasks{
+		uint32(KERNEL_PROCESS_PROVIDER.EnableFlags),
+		0x00080000 | 0x00800000 | 0x00000400,
+		0x00000040,
+		0,
+		0x00000040,
+		0,
+		0,
+		0x00000002,
+	}, trace.kernelGroupMasks())
+
+	// Providers with the same GUID and flags but different masks differ.
+	s.NotEqual(keyOf(memory), keyOf(&Provider{ProviderId: KERNEL_PAGE_FAULT_GUID}))
+	s.Require().NoError(trace.Disable(memory))
+	s.Equal(uint32(0x00000400), trace.kernelGroupMasks()[1])
+}
+
+// TestStackTracing ensures CLASSIC_EVENT_ID array layout and classes merging.
+func (s *kernelMasksSuite) TestStackTracing() {
+	guid := windows.GUID{
+		Data1: 0x01020304,
+		Data2: 0x0506,
+		Data3: 0x0708,
+		Data4: [8]byte{0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+	}
+	s.Equal([]byte{
+		0x04, 0x03, 0x02, 0x01, 0x06, 0x05, 0x08, 0x07,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x01,                                     // Type
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Reserved
+		0x04, 0x03, 0x02, 0x01, 0x06, 0x05, 0x08, 0x07,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x02,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, marshalClassicEventIDs([]stackTracingClass{{guid, 2}, {guid, 1}}), "Classes should be sorted")
+	s.Nil(marshalClassicEventIDs(nil))
+
+	trace, err := newTrace("Test-ETW", func(*Event) {}, newFakeTraceImpl(), nil)
+	s.Require().NoError(err)
+	s.Require().NoError(trace.Enable(
+		&Provider{ProviderId: guid, EnableFlags: 1, StackTracing: []uint8{1, 2}},
+		&Provider{ProviderId: guid, EnableFlags: 2, StackTracing: []uint8{2}},
+	))
+	stacks, err := trace.kernelStackTracing()
+	s.Require().NoError(err)
+	s.Len(stacks, 2*classicEventIDSize, "Duplicate classes are not merged")
+
+	many := make([]uint8, 0, 256)
+	for i := 0; i < 256; i++ {
+		many = append(many, uint8(i))
+	}
+	s.Require().NoError(trace.Enable(&Provider{ProviderId: KERNEL_PROCESS_GUID, StackTracing: many}))
+	_, err = trace.kernelStackTracing()
+	s.Error(err, "Too many classes")
+}
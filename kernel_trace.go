@@ -8,30 +8,123 @@ package etw
 	#include "etw.h"
 */
 import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
 
-type KernelTrace struct{}
+	"golang.org/x/sys/windows"
+)
 
-func NewKernelTrace(name string, callback EventCallback) (*Trace, error) {
-	return newTrace(name, callback, &KernelTrace{})
+// Classes of TraceSetInformation used to configure a running kernel session.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ne-evntrace-trace_query_info_class
+const (
+	traceStackTracingInfo           = 3
+	traceSystemTraceEnableFlagsInfo = 4
+)
+
+type KernelTrace struct {
+	// Group masks and stack tracing classes currently applied to the
+	// session. Guarded by Trace.providersMu.
+	masks  perfGroupMasks
+	stacks []byte
 }
 
-func (u *KernelTrace) setTraceProperties(trace *Trace) {
-	var flags uint64
+// NewKernelTrace creates a trace session for kernel providers. Optional
+// TraceOptions tune session buffers; at most one could be passed.
+func NewKernelTrace(name string, callback EventCallback, options ...TraceOptions) (*Trace, error) {
+	return newTrace(name, callback, &KernelTrace{}, options)
+}
 
-	for _, provider := range trace.providers {
-		flags |= provider.EnableFlags
-	}
+func (u *KernelTrace) setTraceProperties(trace *Trace) {
+	// Only EnableFlags could be set on start, the rest is applied by
+	// enableProvider once the session is started.
+	masks := trace.kernelGroupMasks()
+	u.masks = perfGroupMasks{masks[0]}
+	u.stacks = nil
 
 	trace.properties.LogFileMode |= C.EVENT_TRACE_SYSTEM_LOGGER_MODE
-	trace.properties.EnableFlags = C.ulong(flags)
+	trace.properties.EnableFlags = C.ulong(masks[0])
+}
+
+// Kernel providers are just bits of the session flags, so both enabling
+// and disabling a provider means applying flags of the whole provider table.
+// On Open flags are already set via trace properties and only extended masks
+// and stack tracing are applied.
+func (u *KernelTrace) enableProvider(trace *Trace, provider *Provider) error {
+	return u.apply(trace)
+}
+
+func (u *KernelTrace) disableProvider(trace *Trace, provider *Provider) error {
+	return u.apply(trace)
+}
+
+// Kernel providers can't be asked for the state: the system logger writes
+// DC_Start rundown events for processes, threads and images on its own when
+// the session starts.
+func (u *KernelTrace) captureState(handle traceHandle, provider *Provider) error {
+	return errors.New("capture state is not supported by kernel sessions")
 }
 
-// For Kernel Trace, providers were already enabled via Trace Properties
-func (u *KernelTrace) enableProviders(trace *Trace) error {
+// apply updates group masks and stack tracing of the running session if the
+// provider table has changed.
+func (u *KernelTrace) apply(trace *Trace) error {
+	if masks := trace.kernelGroupMasks(); masks != u.masks {
+		if err := setTraceGroupMasks(trace, masks[:]); err != nil {
+			return fmt.Errorf("failed to set kernel group masks; %w", err)
+		}
+		u.masks = masks
+	}
+
+	stacks, err := trace.kernelStackTracing()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stacks, u.stacks) {
+		// An empty list disables stack tracing.
+		if err := traceSetInformationBytes(trace, traceStackTracingInfo, stacks); err != nil {
+			return fmt.Errorf("failed to set kernel stack tracing; %w", err)
+		}
+		u.stacks = stacks
+	}
 	return nil
 }
 
-// Nothing to do for kernel traces
-func (u *KernelTrace) disableProviders(trace *Trace) error {
+// setTraceGroupMasks sets PERFINFO_GROUPMASK @masks of the session.
+func setTraceGroupMasks(trace *Trace, masks []uint32) error {
+	data := make([]byte, 4*len(masks))
+	for i, mask := range masks {
+		binary.LittleEndian.PutUint32(data[4*i:], mask)
+	}
+	return traceSetInformationBytes(trace, traceSystemTraceEnableFlagsInfo, data)
+}
+
+// traceSetInformationBytes passes raw @data of @infoClass to the session.
+func traceSetInformationBytes(trace *Trace, infoClass int, data []byte) error {
+	var ptr C.PVOID
+	if len(data) > 0 {
+		ptr = C.PVOID(unsafe.Pointer(&data[0]))
+	}
+
+	// ULONG WMIAPI TraceSetInformation(
+	//  TRACEHANDLE      SessionHandle,
+	//  TRACE_INFO_CLASS InformationClass,
+	//  PVOID            TraceInformation,
+	//  ULONG            InformationLength
+	// );
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-tracesetinformation
+	ret := C.TraceSetInformationHelper(
+		trace.registrationHandle,
+		C.int(infoClass),
+		ptr,
+		C.ULONG(len(data)),
+	)
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
+		return fmt.Errorf("TraceSetInformation failed; %w", status)
+	}
 	return nil
 }
@@ -91,6 +91,105 @@ waitForEvent:
 	s.waitForSignal(done, deadline, "Failed to stop event processing")
 }
 
+// TestStackTracing ensures call stacks are delivered for selected event
+// classes.
+func (s *kernelTraceSuite) TestStackTracing() {
+	const deadline = 10 * time.Second
+
+	gotStack := make(chan struct{}, 1)
+	trace, err := NewKernelTrace("Test-ETW", func(e *Event) {
+		if e.Header.ProviderID == KERNEL_STACK_WALK_GUID {
+			trySignal(gotStack)
+		}
+	})
+	s.Require().NoError(err, "Error creating trace object")
+
+	processes := *KERNEL_PROCESS_PROVIDER
+	processes.StackTracing = []uint8{1} // Process Start
+	s.Require().NoError(trace.Enable(&processes))
+
+	done := make(chan struct{})
+	go func() {
+		s.Require().NoError(trace.Start(), "Error processing events")
+		close(done)
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				_ = exec.Command("cmd", "/c", "exit").Run()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+
+	s.waitForSignal(gotStack, deadline, "Failed to get stack walk event")
+
+	// Extended masks could be changed on the running session.
+	s.Require().NoError(trace.Enable(&Provider{
+		ProviderId: KERNEL_PAGE_FAULT_GUID,
+		GroupMasks: []PerfGroupMask{PERF_MEMINFO},
+	}), "Failed to set group masks")
+
+	s.Require().NoError(trace.Stop(), "Failed to close trace properly")
+	s.waitForSignal(done, deadline, "Failed to stop event processing")
+}
+
+// TestStackCorrelation ensures StackCorrelator pairs live events with their
+// stacks: a Process Start event of the spawned process arrives with the stack
+// attached.
+func (s *kernelTraceSuite) TestStackCorrelation() {
+	const deadline = 10 * time.Second
+
+	gotStack := make(chan struct{}, 1)
+	correlator := NewStackCorrelator(StackCorrelatorOptions{
+		Classes: []StackClass{{ProviderID: KERNEL_PROCESS_GUID, OpCode: 1}},
+	}, func(r *Record) {
+		if r.Header.ProviderID != KERNEL_PROCESS_GUID || r.Header.OpCode != 1 {
+			return
+		}
+		if r.Properties["CommandLine"] != "cmd /c exit" {
+			return
+		}
+		if r.Extended.StackTrace != nil && len(r.Extended.StackTrace.Addresses) > 0 {
+			trySignal(gotStack)
+		}
+	})
+	trace, err := NewKernelTrace("Test-ETW", correlator.Handle)
+	s.Require().NoError(err, "Error creating trace object")
+
+	processes := *KERNEL_PROCESS_PROVIDER
+	processes.StackTracing = []uint8{1} // Process Start
+	s.Require().NoError(trace.Enable(&processes))
+
+	done := make(chan struct{})
+	go func() {
+		s.Require().NoError(trace.Start(), "Error processing events")
+		close(done)
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				_ = exec.Command("cmd", "/c", "exit").Run()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+
+	s.waitForSignal(gotStack, deadline, "Failed to get process start event with its stack")
+
+	s.Require().NoError(trace.Stop(), "Failed to close trace properly")
+	s.waitForSignal(done, deadline, "Failed to stop event processing")
+	correlator.Flush()
+}
+
 // waitForSignal waits for anything on @done no longer than @deadline.
 // Fails test run if deadline exceeds.
 func (s kernelTraceSuite) waitForSignal(done <-chan struct{}, deadline time.Duration, failMsg string) {
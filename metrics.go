@@ -0,0 +1,442 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Default MetricsOptions.
+const (
+	defaultMetricsNamespace = "etw"
+	defaultMaxSeries        = 1000
+)
+
+// defaultLatencyBuckets are upper bounds of callback latency buckets in
+// seconds: from 10µs to 1s.
+var defaultLatencyBuckets = []float64{ //nolint:gochecknoglobals
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// MetricsOtherLabel is the value of provider and event_id labels of events
+// exceeding the label policy of Metrics.
+const MetricsOtherLabel = "other"
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsOptions configure Metrics. Zero values stand for defaults.
+//
+// Every provider, event ID and level combination is a separate series, so
+// the label policy keeps the number of series bounded whatever providers
+// produce.
+type MetricsOptions struct {
+	// Namespace prefixes metric names. Defaults to "etw".
+	Namespace string
+
+	// MaxSeries is the maximum number of provider, event ID and level
+	// combinations. Events of new combinations are counted with provider
+	// and event_id labels set to "other" once the limit is reached.
+	// Defaults to 1000.
+	MaxSeries int
+
+	// Providers, if set, limits the provider label to the listed providers.
+	// Events of other providers are counted as "other".
+	Providers []windows.GUID
+
+	// LatencyBuckets are upper bounds of callback latency buckets in
+	// seconds. Defaults to 16 buckets from 10µs to 1s.
+	LatencyBuckets []float64
+}
+
+// statsSource is a subset of Trace used by Metrics.
+type statsSource interface {
+	Name() string
+	Stats() (TraceStats, error)
+}
+
+// Metrics collects event processing metrics and exposes them in Prometheus
+// text format by ServeHTTP:
+//   - <namespace>_events_total{provider,event_id,level} counts events
+//     passed to the callback, so rate() gives events per second;
+//   - <namespace>_decode_failures_total{provider,event_id,level} counts
+//     failed EventProperties calls;
+//   - <namespace>_callback_duration_seconds is a histogram of the
+//     callback latency;
+//   - <namespace>_session_* are lost events and buffers of the traces
+//     added with AddTrace.
+//
+// Events are counted by a callback returned by Wrap. It's safe to wrap
+// callbacks of several traces with the same Metrics.
+type Metrics struct {
+	mu sync.Mutex
+
+	options   MetricsOptions
+	providers map[windows.GUID]struct{} // nil means any provider.
+
+	events   map[metricsSeries]uint64
+	failures map[metricsSeries]uint64
+	latency  latencyHistogram
+
+	traces []statsSource
+}
+
+// metricsSeries is a label set of per-event metrics. Provider and ID are
+// zero for the "other" series.
+type metricsSeries struct {
+	provider windows.GUID
+	id       uint16
+	level    uint8
+	other    bool
+}
+
+// latencyHistogram holds non-cumulative bucket counts; the last one is +Inf.
+type latencyHistogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics creates Metrics with @options.
+func NewMetrics(options MetricsOptions) (*Metrics, error) {
+	if options.Namespace == "" {
+		options.Namespace = defaultMetricsNamespace
+	}
+	if !validMetricName(options.Namespace) {
+		return nil, fmt.Errorf("invalid metrics namespace %q", options.Namespace)
+	}
+	if options.MaxSeries <= 0 {
+		options.MaxSeries = defaultMaxSeries
+	}
+	if len(options.LatencyBuckets) == 0 {
+		options.LatencyBuckets = defaultLatencyBuckets
+	}
+	bounds := append([]float64(nil), options.LatencyBuckets...)
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= bounds[i-1]) {
+			return nil, fmt.Errorf("latency buckets should be finite and increasing")
+		}
+	}
+
+	m := &Metrics{
+		options:  options,
+		events:   make(map[metricsSeries]uint64),
+		failures: make(map[metricsSeries]uint64),
+		latency: latencyHistogram{
+			bounds: bounds,
+			counts: make([]uint64, len(bounds)+1),
+		},
+	}
+	if len(options.Providers) != 0 {
+		m.providers = make(map[windows.GUID]struct{}, len(options.Providers))
+		for _, id := range options.Providers {
+			m.providers[id] = struct{}{}
+		}
+	}
+	return m, nil
+}
+
+// Wrap returns an EventCallback counting events and measuring @callback
+// latency. EventProperties failures inside @callback are counted as well (by
+// the innermost Metrics if callbacks are wrapped several times).
+func (m *Metrics) Wrap(callback EventCallback) EventCallback {
+	return func(e *Event) {
+		m.observe(&e.Header)
+
+		prev := e.decodeObserver
+		e.decodeObserver = m
+		start := time.Now()
+		defer func() {
+			// Panics are recovered by the Trace, so count them as usual.
+			m.observeLatency(time.Since(start))
+			e.decodeObserver = prev
+		}()
+		callback(e)
+	}
+}
+
+// AddTrace exposes lost events and buffers of @trace. Statistics are queried
+// on every scrape.
+func (m *Metrics) AddTrace(trace *Trace) {
+	m.addSource(trace)
+}
+
+func (m *Metrics) addSource(source statsSource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.traces = append(m.traces, source)
+}
+
+func (m *Metrics) observe(header *EventHeader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[m.series(header)]++
+}
+
+func (m *Metrics) decodeFailed(header *EventHeader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[m.series(header)]++
+}
+
+func (m *Metrics) observeLatency(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(m.latency.bounds, seconds)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.counts[i]++
+	m.latency.sum += seconds
+	m.latency.count++
+}
+
+// series returns labels of the event applying the label policy. Must be
+// called with mu held.
+func (m *Metrics) series(header *EventHeader) metricsSeries {
+	other := metricsSeries{level: header.Level, other: true}
+	if m.providers != nil {
+		if _, ok := m.providers[header.ProviderID]; !ok {
+			return other
+		}
+	}
+	s := metricsSeries{provider: header.ProviderID, id: header.ID, level: header.Level}
+	if _, ok := m.events[s]; ok {
+		return s
+	}
+	if len(m.events) >= m.options.MaxSeries {
+		return other
+	}
+	return s
+}
+
+// ServeHTTP writes metrics in Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := m.write(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// metricsSnapshot is a copy of collected metrics, so the output is written
+// without holding the lock.
+type metricsSnapshot struct {
+	events   map[metricsSeries]uint64
+	failures map[metricsSeries]uint64
+	latency  latencyHistogram
+	traces   []statsSource
+}
+
+func (m *Metrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := metricsSnapshot{
+		events:   make(map[metricsSeries]uint64, len(m.events)),
+		failures: make(map[metricsSeries]uint64, len(m.failures)),
+		latency:  m.latency,
+		traces:   append([]statsSource(nil), m.traces...),
+	}
+	s.latency.counts = append([]uint64(nil), m.latency.counts...)
+	for k, v := range m.events {
+		s.events[k] = v
+	}
+	for k, v := range m.failures {
+		s.failures[k] = v
+	}
+	return s
+}
+
+func (m *Metrics) write(buf *bytes.Buffer) error {
+	s := m.snapshot()
+	w := metricsWriter{w: bufio.NewWriter(buf), namespace: m.options.Namespace}
+
+	w.header("events_total", "counter", "Events passed to the callback.")
+	for _, series := range sortedSeries(s.events) {
+		w.sample("events_total", series.labels(), float64(s.events[series]))
+	}
+	w.header("decode_failures_total", "counter", "Failed event properties decoding.")
+	for _, series := range sortedSeries(s.failures) {
+		w.sample("decode_failures_total", series.labels(), float64(s.failures[series]))
+	}
+
+	w.header("callback_duration_seconds", "histogram", "Event callback latency.")
+	var cumulative uint64
+	for i, count := range s.latency.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(s.latency.bounds) {
+			le = formatMetricValue(s.latency.bounds[i])
+		}
+		w.sample("callback_duration_seconds_bucket", []string{"le", le}, float64(cumulative))
+	}
+	w.sample("callback_duration_seconds_sum", nil, s.latency.sum)
+	w.sample("callback_duration_seconds_count", nil, float64(s.latency.count))
+
+	m.writeSessions(&w, s.traces)
+	return w.w.Flush()
+}
+
+// writeSessions writes statistics of @traces. Sessions which can't be queried
+// are reported by the up metric only.
+func (m *Metrics) writeSessions(w *metricsWriter, traces []statsSource) {
+	if len(traces) == 0 {
+		return
+	}
+	type sessionStats struct {
+		name  string
+		stats TraceStats
+		err   error
+	}
+	sessions := make([]sessionStats, 0, len(traces))
+	for _, t := range traces {
+		stats, err := t.Stats()
+		sessions = append(sessions, sessionStats{name: t.Name(), stats: stats, err: err})
+	}
+
+	w.header("session_up", "gauge", "Whether session statistics could be queried.")
+	for _, s := range sessions {
+		up := 1.
+		if s.err != nil {
+			up = 0
+		}
+		w.sample("session_up", []string{"session", s.name}, up)
+	}
+	w.header("session_events_lost_total", "counter", "Events not recorded by the session.")
+	for _, s := range sessions {
+		if s.err == nil {
+			w.sample("session_events_lost_total", []string{"session", s.name}, float64(s.stats.EventsLost))
+		}
+	}
+	w.header("session_buffers_lost_total", "counter", "Buffers lost by the session.")
+	for _, s := range sessions {
+		if s.err == nil {
+			w.sample("session_buffers_lost_total", []string{"session", s.name, "kind", "log"}, float64(s.stats.LogBuffersLost))
+			w.sample("session_buffers_lost_total", []string{"session", s.name, "kind", "realtime"}, float64(s.stats.RealTimeBuffersLost))
+		}
+	}
+	w.header("session_lost_notifications_total", "counter", "Lost event notifications received in the event stream.")
+	for _, s := range sessions {
+		if s.err == nil {
+			w.sample("session_lost_notifications_total", []string{"session", s.name, "kind", "event"}, float64(s.stats.LostEventNotifications))
+			w.sample("session_lost_notifications_total", []string{"session", s.name, "kind", "buffer"}, float64(s.stats.LostBufferNotifications))
+			w.sample("session_lost_notifications_total", []string{"session", s.name, "kind", "file"}, float64(s.stats.LostFileNotifications))
+		}
+	}
+}
+
+// labels returns label name and value pairs of the series.
+func (s metricsSeries) labels() []string {
+	provider, id := MetricsOtherLabel, MetricsOtherLabel
+	if !s.other {
+		provider, id = s.provider.String(), strconv.Itoa(int(s.id))
+	}
+	return []string{"provider", provider, "event_id", id, "level", strconv.Itoa(int(s.level))}
+}
+
+// sortedSeries returns keys of @m ordered by labels with "other" series last.
+func sortedSeries(m map[metricsSeries]uint64) []metricsSeries {
+	keys := make([]metricsSeries, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.other != b.other {
+			return b.other
+		}
+		if a.provider != b.provider {
+			return a.provider.String() < b.provider.String()
+		}
+		if a.id != b.id {
+			return a.id < b.id
+		}
+		return a.level < b.level
+	})
+	return keys
+}
+
+// metricsWriter writes samples in Prometheus text exposition format.
+//
+// Ref: https://prometheus.io/docs/instrumenting/exposition_formats/
+type metricsWriter struct {
+	w         *bufio.Writer
+	namespace string
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	name = w.namespace + "_" + name
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample with @labels given as name and value pairs.
+func (w *metricsWriter) sample(name string, labels []string, value float64) {
+	w.w.WriteString(w.namespace)
+	w.w.WriteByte('_')
+	w.w.WriteString(name)
+	if len(labels) != 0 {
+		w.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(labels[i])
+			w.w.WriteString(`="`)
+			w.w.WriteString(escapeLabelValue(labels[i+1]))
+			w.w.WriteByte('"')
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatMetricValue(value))
+	w.w.WriteByte('\n')
+}
+
+//nolint:gochecknoglobals
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// validMetricName checks @name against [a-zA-Z_:][a-zA-Z0-9_:]*.
+func validMetricName(name string) bool {
+	for i, ch := range name {
+		switch {
+		case ch == '_' || ch == ':':
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+		case ch >= '0' && ch <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,176 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestMetrics(t *testing.T) {
+	suite.Run(t, new(metricsSuite))
+}
+
+type metricsSuite struct {
+	suite.Suite
+}
+
+func metricsEvent(provider windows.GUID, id uint16, level uint8) *Event {
+	e := &Event{Header: EventHeader{ProviderID: provider}}
+	e.Header.ID = id
+	e.Header.Level = level
+	return e
+}
+
+// scrape returns lines of the @m output.
+func (s *metricsSuite) scrape(m *Metrics) []string {
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Equal(metricsContentType, resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+}
+
+// TestEvents ensures events, decode failures and latency are exposed.
+func (s *metricsSuite) TestEvents() {
+	m, err := NewMetrics(MetricsOptions{LatencyBuckets: []float64{0.5, 1}})
+	s.Require().NoError(err)
+
+	cb := m.Wrap(func(e *Event) {
+		if e.Header.ID == 2 {
+			// Outside of a trace the event has no data to decode.
+			_, err := e.EventProperties()
+			s.Error(err)
+		}
+	})
+	cb(metricsEvent(testProviderA, 1, 4))
+	cb(metricsEvent(testProviderA, 1, 4))
+	cb(metricsEvent(testProviderA, 2, 2))
+	cb(metricsEvent(testProviderB, 1, 4))
+
+	e := metricsEvent(testProviderA, 2, 2)
+	_, _ = e.EventProperties()
+	s.Nil(e.decodeObserver, "Observer is reset after the callback")
+
+	a, b := testProviderA.String(), testProviderB.String()
+	lines := s.scrape(m)
+	s.Subset(lines, []string{
+		"# HELP etw_events_total Events passed to the callback.",
+		"# TYPE etw_events_total counter",
+		`etw_events_total{provider="` + a + `",event_id="1",level="4"} 2`,
+		`etw_events_total{provider="` + a + `",event_id="2",level="2"} 1`,
+		`etw_events_total{provider="` + b + `",event_id="1",level="4"} 1`,
+		"# TYPE etw_decode_failures_total counter",
+		`etw_decode_failures_total{provider="` + a + `",event_id="2",level="2"} 1`,
+		"# TYPE etw_callback_duration_seconds histogram",
+		`etw_callback_duration_seconds_bucket{le="0.5"} 4`,
+		`etw_callback_duration_seconds_bucket{le="1"} 4`,
+		`etw_callback_duration_seconds_bucket{le="+Inf"} 4`,
+		"etw_callback_duration_seconds_count 4",
+	})
+	s.NotContains(strings.Join(lines, "\n"), "session_", "No traces added")
+}
+
+// TestLabelPolicy ensures the number of series is bounded.
+func (s *metricsSuite) TestLabelPolicy() {
+	m, err := NewMetrics(MetricsOptions{Namespace: "test", MaxSeries: 2})
+	s.Require().NoError(err)
+	cb := m.Wrap(func(*Event) {})
+	for id := uint16(1); id <= 10; id++ {
+		cb(metricsEvent(testProviderA, id, 4))
+	}
+	cb(metricsEvent(testProviderA, 1, 4))
+
+	a := testProviderA.String()
+	var events []string
+	for _, line := range s.scrape(m) {
+		if strings.HasPrefix(line, "test_events_total") {
+			events = append(events, line)
+		}
+	}
+	s.Equal([]string{
+		`test_events_total{provider="` + a + `",event_id="1",level="4"} 2`,
+		`test_events_total{provider="` + a + `",event_id="2",level="4"} 1`,
+		`test_events_total{provider="other",event_id="other",level="4"} 8`,
+	}, events)
+
+	m, err = NewMetrics(MetricsOptions{Providers: []windows.GUID{testProviderB}})
+	s.Require().NoError(err)
+	cb = m.Wrap(func(*Event) {})
+	cb(metricsEvent(testProviderA, 1, 4))
+	cb(metricsEvent(testProviderB, 1, 4))
+	s.Subset(s.scrape(m), []string{
+		`etw_events_total{provider="` + testProviderB.String() + `",event_id="1",level="4"} 1`,
+		`etw_events_total{provider="other",event_id="other",level="4"} 1`,
+	})
+}
+
+// TestPanic ensures the latency of panicked callbacks is observed.
+func (s *metricsSuite) TestPanic() {
+	m, err := NewMetrics(MetricsOptions{})
+	s.Require().NoError(err)
+	cb := m.Wrap(func(*Event) { panic("test") })
+	s.Panics(func() { cb(metricsEvent(testProviderA, 1, 4)) })
+	s.Contains(s.scrape(m), "etw_callback_duration_seconds_count 1")
+}
+
+// TestSessions ensures lost events of added traces are exposed.
+func (s *metricsSuite) TestSessions() {
+	control := newFakeSessionControl(SessionInfo{
+		Name:  "Test-ETW",
+		Stats: TraceStats{EventsLost: 3, LogBuffersLost: 1, RealTimeBuffersLost: 2},
+	})
+	trace, err := NewUserTrace("Test-ETW", func(*Event) {})
+	s.Require().NoError(err)
+	trace.control = control
+	trace.lostEvents.observe(&EventHeader{
+		ProviderID:      KERNEL_LOST_EVENT_GUID,
+		EventDescriptor: EventDescriptor{OpCode: lostEventOpcodeEvent},
+	})
+	missing, err := NewUserTrace(`Test-"ETW"`, func(*Event) {})
+	s.Require().NoError(err)
+	missing.control = control
+
+	m, err := NewMetrics(MetricsOptions{})
+	s.Require().NoError(err)
+	m.AddTrace(trace)
+	m.AddTrace(missing)
+
+	lines := s.scrape(m)
+	s.Subset(lines, []string{
+		`etw_session_up{session="Test-ETW"} 1`,
+		`etw_session_up{session="Test-\"ETW\""} 0`,
+		`etw_session_events_lost_total{session="Test-ETW"} 3`,
+		`etw_session_buffers_lost_total{session="Test-ETW",kind="log"} 1`,
+		`etw_session_buffers_lost_total{session="Test-ETW",kind="realtime"} 2`,
+		`etw_session_lost_notifications_total{session="Test-ETW",kind="event"} 1`,
+		`etw_session_lost_notifications_total{session="Test-ETW",kind="buffer"} 0`,
+	})
+	s.NotContains(strings.Join(lines, "\n"), `etw_session_events_lost_total{session="Test-\"ETW\""}`)
+}
+
+// TestOptions ensures invalid options are rejected.
+func (s *metricsSuite) TestOptions() {
+	_, err := NewMetrics(MetricsOptions{Namespace: "1etw"})
+	s.Error(err)
+	_, err = NewMetrics(MetricsOptions{Namespace: "etw-trace"})
+	s.Error(err)
+	_, err = NewMetrics(MetricsOptions{LatencyBuckets: []float64{1, 0.5}})
+	s.Error(err)
+	_, err = NewMetrics(MetricsOptions{Namespace: "etw:trace_1"})
+	s.NoError(err)
+}
@@ -0,0 +1,232 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows"
+)
+
+// ErrUnknownSubscription is returned by Multiplexer.Unsubscribe for IDs which
+// are not subscribed.
+//
+//nolint:gochecknoglobals
+var ErrUnknownSubscription = errors.New("unknown subscription")
+
+// Subscription describes events of a single provider a Multiplexer subscriber
+// is interested in.
+type Subscription struct {
+	ProviderID windows.GUID
+
+	// Level, MatchAnyKeyword and MatchAllKeyword have the same meaning as
+	// Provider ones. Zero Level stands for TRACE_LEVEL_VERBOSE.
+	Level           TraceLevel
+	MatchAnyKeyword uint64
+	MatchAllKeyword uint64
+
+	// EnableProperties are enabled for the provider, so they affect other
+	// subscribers of the provider as well.
+	EnableProperties []EnableProperty
+
+	// Filter is an optional predicate events should satisfy.
+	Filter func(e *Event) bool
+
+	// Callback receives matching events. It's called synchronously from the
+	// trace callback, so the same restrictions apply.
+	Callback EventCallback
+}
+
+// SubscriptionID identifies a subscription in Multiplexer.
+type SubscriptionID uint64
+
+// providerController is a subset of Trace used by Multiplexer.
+type providerController interface {
+	Enable(providers ...*Provider) error
+	Disable(providers ...*Provider) error
+}
+
+// Multiplexer shares a single user trace between many subscribers.
+//
+// Providers are enabled once for all their subscribers with the widest level
+// and keywords, so every subscriber gets all the events it asked for. Events
+// are routed only to subscribers whose level, keywords and filters match.
+type Multiplexer struct {
+	trace   *Trace
+	control providerController
+
+	// mu serializes subscription changes along with provider control.
+	mu     sync.Mutex
+	nextID SubscriptionID
+	subs   map[SubscriptionID]*Subscription
+
+	// routes is an immutable map[windows.GUID][]*Subscription replaced on
+	// every change, so callbacks could subscribe and unsubscribe.
+	routes atomic.Value
+}
+
+// NewMultiplexer creates a Multiplexer on a new user trace with a given
+// @name. Use Multiplexer.Trace to start and stop the session.
+func NewMultiplexer(name string, options ...TraceOptions) (*Multiplexer, error) {
+	m := newMultiplexer(nil)
+	trace, err := NewUserTrace(name, m.Handle, options...)
+	if err != nil {
+		return nil, err
+	}
+	m.trace, m.control = trace, trace
+	return m, nil
+}
+
+func newMultiplexer(control providerController) *Multiplexer {
+	m := &Multiplexer{
+		control: control,
+		subs:    make(map[SubscriptionID]*Subscription),
+	}
+	m.routes.Store(map[windows.GUID][]*Subscription{})
+	return m
+}
+
+// Trace returns the underlying trace.
+func (m *Multiplexer) Trace() *Trace {
+	return m.trace
+}
+
+// Subscribe adds a subscriber and enables or updates its provider. If the
+// provider fails, the subscription is not added.
+func (m *Multiplexer) Subscribe(sub Subscription) (SubscriptionID, error) {
+	if sub.Callback == nil {
+		return 0, fmt.Errorf("subscription callback is not set")
+	}
+	if sub.Level == 0 {
+		sub.Level = TRACE_LEVEL_VERBOSE
+	}
+	sub.EnableProperties = append([]EnableProperty(nil), sub.EnableProperties...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := m.nextID
+	m.subs[id] = &sub
+	if err := m.apply(sub.ProviderID); err != nil {
+		delete(m.subs, id)
+		return 0, err
+	}
+	m.updateRoutes()
+	return id, nil
+}
+
+// Unsubscribe removes a subscriber. The provider is disabled once its last
+// subscriber is gone, otherwise its settings are narrowed to the remaining
+// subscribers. The subscription is removed even if the provider fails.
+func (m *Multiplexer) Unsubscribe(id SubscriptionID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subs[id]
+	if !ok {
+		return ErrUnknownSubscription
+	}
+	delete(m.subs, id)
+	m.updateRoutes()
+	return m.apply(sub.ProviderID)
+}
+
+// Handle routes the event to matching subscribers. It's the EventCallback of
+// the trace created by NewMultiplexer.
+func (m *Multiplexer) Handle(e *Event) {
+	routes := m.routes.Load().(map[windows.GUID][]*Subscription)
+	for _, sub := range routes[e.Header.ProviderID] {
+		if sub.matches(e) {
+			sub.Callback(e)
+		}
+	}
+}
+
+// apply enables the provider @id merged from all its subscriptions or
+// disables it if there are none. Should be called with mu held.
+func (m *Multiplexer) apply(id windows.GUID) error {
+	var subs []*Subscription
+	for _, sub := range m.subs {
+		if sub.ProviderID == id {
+			subs = append(subs, sub)
+		}
+	}
+
+	if len(subs) == 0 {
+		err := m.control.Disable(NewProvider(id))
+		var errs ProviderErrors
+		if errors.As(err, &errs) && len(errs) == 1 && errors.Is(errs[0], ErrProviderNotEnabled) {
+			return nil
+		}
+		return err
+	}
+	return m.control.Enable(mergeSubscriptions(id, subs))
+}
+
+// updateRoutes rebuilds the routing table. Should be called with mu held.
+func (m *Multiplexer) updateRoutes() {
+	routes := make(map[windows.GUID][]*Subscription)
+	for id := SubscriptionID(1); id <= m.nextID; id++ {
+		// Keep the subscription order for the same provider.
+		if sub, ok := m.subs[id]; ok {
+			routes[sub.ProviderID] = append(routes[sub.ProviderID], sub)
+		}
+	}
+	m.routes.Store(routes)
+}
+
+// mergeSubscriptions makes a provider delivering all the events @subs want:
+// the highest level, the union of MatchAnyKeyword and the intersection of
+// MatchAllKeyword. Zero MatchAnyKeyword of any subscription means all the
+// keywords.
+func mergeSubscriptions(id windows.GUID, subs []*Subscription) *Provider {
+	provider := NewProvider(id)
+	provider.Level = 0
+	anyAll := false
+	matchAll := ^uint64(0)
+	seen := make(map[EnableProperty]bool)
+
+	for _, sub := range subs {
+		if sub.Level > provider.Level {
+			provider.Level = sub.Level
+		}
+		if sub.MatchAnyKeyword == 0 {
+			anyAll = true
+		}
+		provider.MatchAnyKeyword |= sub.MatchAnyKeyword
+		matchAll &= sub.MatchAllKeyword
+
+		for _, p := range sub.EnableProperties {
+			if !seen[p] {
+				seen[p] = true
+				provider.EnableProperties = append(provider.EnableProperties, p)
+			}
+		}
+	}
+
+	if anyAll {
+		provider.MatchAnyKeyword, provider.MatchAllKeyword = 0, 0
+	} else {
+		provider.MatchAllKeyword = matchAll
+	}
+	return provider
+}
+
+// matches tells if @e passes the subscription level, keywords and filter.
+// Events with zero level or keywords match any level or keywords as ETW does.
+func (s *Subscription) matches(e *Event) bool {
+	if e.Header.Level != 0 && TraceLevel(e.Header.Level) > s.Level {
+		return false
+	}
+	if keyword := e.Header.Keyword; keyword != 0 && s.MatchAnyKeyword != 0 {
+		if keyword&s.MatchAnyKeyword == 0 || keyword&s.MatchAllKeyword != s.MatchAllKeyword {
+			return false
+		}
+	}
+	return s.Filter == nil || s.Filter(e)
+}
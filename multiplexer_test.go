@@ -0,0 +1,164 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestMultiplexer(t *testing.T) {
+	suite.Run(t, new(multiplexerSuite))
+}
+
+type multiplexerSuite struct {
+	suite.Suite
+
+	enabled map[windows.GUID]Provider
+	failing error
+}
+
+func (s *multiplexerSuite) SetupTest() {
+	s.enabled = make(map[windows.GUID]Provider)
+	s.failing = nil
+}
+
+func (s *multiplexerSuite) Enable(providers ...*Provider) error {
+	if s.failing != nil {
+		return s.failing
+	}
+	for _, p := range providers {
+		s.enabled[p.ProviderId] = *p
+	}
+	return nil
+}
+
+func (s *multiplexerSuite) Disable(providers ...*Provider) error {
+	var errs ProviderErrors
+	for _, p := range providers {
+		if _, ok := s.enabled[p.ProviderId]; !ok {
+			errs = append(errs, &ProviderError{ProviderID: p.ProviderId, Err: ErrProviderNotEnabled})
+		}
+		delete(s.enabled, p.ProviderId)
+	}
+	return errs.errorOrNil()
+}
+
+func testEvent(provider windows.GUID, level uint8, keyword uint64) *Event {
+	return &Event{Header: EventHeader{
+		EventDescriptor: EventDescriptor{Level: level, Keyword: keyword},
+		ProviderID:      provider,
+	}}
+}
+
+// TestMerge ensures providers are enabled with settings covering all the
+// subscribers and disabled with the last one.
+func (s *multiplexerSuite) TestMerge() {
+	m := newMultiplexer(s)
+	nop := func(*Event) {}
+
+	first, err := m.Subscribe(Subscription{
+		ProviderID:      testProviderA,
+		Level:           TRACE_LEVEL_WARNING,
+		MatchAnyKeyword: 0x1,
+		MatchAllKeyword: 0x3,
+		Callback:        nop,
+	})
+	s.Require().NoError(err)
+	second, err := m.Subscribe(Subscription{
+		ProviderID:       testProviderA,
+		Level:            TRACE_LEVEL_INFORMATION,
+		MatchAnyKeyword:  0x4,
+		MatchAllKeyword:  0x1,
+		EnableProperties: []EnableProperty{EVENT_ENABLE_PROPERTY_SID},
+		Callback:         nop,
+	})
+	s.Require().NoError(err)
+
+	merged := s.enabled[testProviderA]
+	s.Equal(TRACE_LEVEL_INFORMATION, merged.Level)
+	s.Equal(uint64(0x5), merged.MatchAnyKeyword)
+	s.Equal(uint64(0x1), merged.MatchAllKeyword)
+	s.Equal([]EnableProperty{EVENT_ENABLE_PROPERTY_SID}, merged.EnableProperties)
+
+	// Any subscriber without keywords wants everything.
+	third, err := m.Subscribe(Subscription{ProviderID: testProviderA, Callback: nop})
+	s.Require().NoError(err)
+	merged = s.enabled[testProviderA]
+	s.Equal(TRACE_LEVEL_VERBOSE, merged.Level)
+	s.Zero(merged.MatchAnyKeyword)
+	s.Zero(merged.MatchAllKeyword)
+
+	// Settings are narrowed back on unsubscribe.
+	s.Require().NoError(m.Unsubscribe(third))
+	s.Require().NoError(m.Unsubscribe(second))
+	merged = s.enabled[testProviderA]
+	s.Equal(TRACE_LEVEL_WARNING, merged.Level)
+	s.Equal(uint64(0x1), merged.MatchAnyKeyword)
+	s.Equal(uint64(0x3), merged.MatchAllKeyword)
+
+	s.Require().NoError(m.Unsubscribe(first))
+	s.Empty(s.enabled)
+	s.Equal(ErrUnknownSubscription, m.Unsubscribe(first))
+}
+
+// TestFailure ensures a subscription isn't added if its provider fails.
+func (s *multiplexerSuite) TestFailure() {
+	m := newMultiplexer(s)
+	s.failing = errors.New("access denied")
+
+	var called bool
+	_, err := m.Subscribe(Subscription{ProviderID: testProviderA, Callback: func(*Event) { called = true }})
+	s.Equal(s.failing, err)
+	m.Handle(testEvent(testProviderA, 0, 0))
+	s.False(called)
+
+	_, err = m.Subscribe(Subscription{ProviderID: testProviderA})
+	s.Error(err, "Callback is required")
+}
+
+// TestRouting ensures events are delivered only to matching subscribers.
+func (s *multiplexerSuite) TestRouting() {
+	m := newMultiplexer(s)
+	got := make(map[string]int)
+	subscribe := func(name string, sub Subscription) {
+		sub.Callback = func(*Event) { got[name]++ }
+		_, err := m.Subscribe(sub)
+		s.Require().NoError(err)
+	}
+
+	subscribe("errors", Subscription{ProviderID: testProviderA, Level: TRACE_LEVEL_ERROR})
+	subscribe("keywords", Subscription{ProviderID: testProviderA, MatchAnyKeyword: 0x6, MatchAllKeyword: 0x8})
+	subscribe("filtered", Subscription{ProviderID: testProviderA, Filter: func(e *Event) bool {
+		return e.Header.Keyword == 0xC
+	}})
+	subscribe("other", Subscription{ProviderID: testProviderB})
+
+	m.Handle(testEvent(testProviderA, uint8(TRACE_LEVEL_ERROR), 0x1))         // errors
+	m.Handle(testEvent(testProviderA, uint8(TRACE_LEVEL_VERBOSE), 0xC))       // keywords, filtered
+	m.Handle(testEvent(testProviderA, uint8(TRACE_LEVEL_VERBOSE), 0x4))       // none
+	m.Handle(testEvent(testProviderA, 0, 0))                                  // errors, keywords
+	m.Handle(testEvent(windows.GUID{Data1: 42}, uint8(TRACE_LEVEL_ERROR), 0)) // none
+
+	s.Equal(map[string]int{"errors": 2, "keywords": 2, "filtered": 1}, got)
+}
+
+// TestUnsubscribeFromCallback ensures callbacks could change subscriptions.
+func (s *multiplexerSuite) TestUnsubscribeFromCallback() {
+	m := newMultiplexer(s)
+	var id SubscriptionID
+	calls := 0
+	id, err := m.Subscribe(Subscription{ProviderID: testProviderA, Callback: func(*Event) {
+		calls++
+		s.NoError(m.Unsubscribe(id))
+	}})
+	s.Require().NoError(err)
+
+	m.Handle(testEvent(testProviderA, 0, 0))
+	m.Handle(testEvent(testProviderA, 0, 0))
+	s.Equal(1, calls)
+}
@@ -0,0 +1,145 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// PanicPolicy defines what happens if EventCallback panics. Panics can't
+// cross the cgo boundary gracefully, so without a recovery the process just
+// crashes leaving the session running.
+type PanicPolicy int
+
+const (
+	// PanicRepanic stops the session and panics again with PanicError. It's
+	// the default policy: the process still crashes, but doesn't leak the
+	// session.
+	PanicRepanic PanicPolicy = iota
+
+	// PanicContinue reports the panic and continues with the next event.
+	PanicContinue
+
+	// PanicStop reports the panic and stops the session. Events received
+	// after the panic are dropped and Trace.Process returns PanicError.
+	PanicStop
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicRepanic:
+		return "repanic"
+	case PanicContinue:
+		return "continue"
+	case PanicStop:
+		return "stop"
+	default:
+		return fmt.Sprintf("PanicPolicy(%d)", int(p))
+	}
+}
+
+// PanicOptions tells how to handle panics in EventCallback.
+type PanicOptions struct {
+	Policy PanicPolicy
+
+	// OnPanic is called with every recovered panic before the policy is
+	// applied. If not set, panics are written to the standard logger.
+	OnPanic func(*PanicError)
+}
+
+// Validate checks the policy is known.
+func (o PanicOptions) Validate() error {
+	if o.Policy < PanicRepanic || o.Policy > PanicStop {
+		return fmt.Errorf("unknown panic policy %s", o.Policy)
+	}
+	return nil
+}
+
+// PanicError is a panic recovered from EventCallback.
+type PanicError struct {
+	// Value is the value passed to panic().
+	Value interface{}
+
+	// Header is the header of the event being handled.
+	Header EventHeader
+
+	// Stack is the stack trace of the panicked goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("EventCallback panicked on event %d of provider %s: %v",
+		e.Header.ID, e.Header.ProviderID.String(), e.Value)
+}
+
+// Unwrap returns the panic value if it's an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// panicState tracks panics recovered during processing.
+type panicState struct {
+	stopped int32        // Accessed atomically; set by PanicStop.
+	err     atomic.Value // Of *PanicError, the first one stopping the trace.
+}
+
+// reset clears the state for the next processing.
+func (s *panicState) reset() {
+	atomic.StoreInt32(&s.stopped, 0)
+	s.err.Store((*PanicError)(nil))
+}
+
+// error returns the panic which stopped the processing if any.
+func (s *panicState) error() error {
+	if err, ok := s.err.Load().(*PanicError); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// dispatch passes @evt to the callback recovering from panics.
+func (trace *Trace) dispatch(evt *Event) {
+	if atomic.LoadInt32(&trace.panics.stopped) != 0 {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			trace.handlePanic(&PanicError{Value: r, Header: evt.Header, Stack: debug.Stack()})
+		}
+	}()
+	trace.callback(evt)
+}
+
+// handlePanic reports @err and applies the panic policy.
+func (trace *Trace) handlePanic(err *PanicError) {
+	options := trace.options.Panics
+	options.report(err)
+
+	switch options.Policy {
+	case PanicContinue:
+		return
+	case PanicStop:
+		if atomic.CompareAndSwapInt32(&trace.panics.stopped, 0, 1) {
+			trace.panics.err.Store(err)
+			_ = trace.Stop()
+		}
+	default:
+		_ = trace.Stop()
+		panic(err)
+	}
+}
+
+// report passes @err to OnPanic or writes it to the standard logger.
+func (o PanicOptions) report(err *PanicError) {
+	if o.OnPanic != nil {
+		o.OnPanic(err)
+	} else {
+		log.Printf("etw: %s\n%s", err, err.Stack)
+	}
+}
@@ -0,0 +1,90 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPanics(t *testing.T) {
+	suite.Run(t, new(panicsSuite))
+}
+
+type panicsSuite struct {
+	suite.Suite
+
+	calls    int
+	reported []*PanicError
+}
+
+func (s *panicsSuite) SetupTest() {
+	s.calls = 0
+	s.reported = nil
+}
+
+// newTrace makes a trace with a callback panicking on the first event only.
+func (s *panicsSuite) newTrace(policy PanicPolicy) *Trace {
+	callback := func(e *Event) {
+		s.calls++
+		if s.calls == 1 {
+			panic(errors.New("boom"))
+		}
+	}
+	options := TraceOptions{Panics: PanicOptions{
+		Policy:  policy,
+		OnPanic: func(err *PanicError) { s.reported = append(s.reported, err) },
+	}}
+	trace, err := newTrace("Test-ETW", callback, newFakeTraceImpl(), []TraceOptions{options})
+	s.Require().NoError(err)
+	return trace
+}
+
+func (s *panicsSuite) event(id uint16) *Event {
+	return &Event{Header: EventHeader{EventDescriptor: EventDescriptor{ID: id}}}
+}
+
+// TestContinue ensures the panic is reported with the event header and
+// processing goes on.
+func (s *panicsSuite) TestContinue() {
+	trace := s.newTrace(PanicContinue)
+	trace.dispatch(s.event(1))
+	trace.dispatch(s.event(2))
+
+	s.Equal(2, s.calls)
+	s.Require().Len(s.reported, 1)
+	s.Equal(uint16(1), s.reported[0].Header.ID)
+	s.NotEmpty(s.reported[0].Stack)
+	s.EqualError(errors.Unwrap(s.reported[0]), "boom")
+	s.NoError(trace.panics.error())
+}
+
+// TestStop ensures events after the panic are dropped and the panic is
+// returned as an error.
+func (s *panicsSuite) TestStop() {
+	trace := s.newTrace(PanicStop)
+	trace.dispatch(s.event(1))
+	trace.dispatch(s.event(2))
+
+	s.Equal(1, s.calls)
+	s.Require().Len(s.reported, 1)
+	var panicErr *PanicError
+	s.Require().True(errors.As(trace.panics.error(), &panicErr))
+	s.Equal(uint16(1), panicErr.Header.ID)
+
+	// Reopening the trace starts from scratch.
+	trace.panics.reset()
+	trace.dispatch(s.event(3))
+	s.Equal(2, s.calls)
+	s.NoError(trace.panics.error())
+}
+
+// TestRepanic ensures the panic is raised again after reporting.
+func (s *panicsSuite) TestRepanic() {
+	trace := s.newTrace(PanicRepanic)
+	s.Panics(func() { trace.dispatch(s.event(1)) })
+	s.Len(s.reported, 1)
+}
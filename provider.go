@@ -17,6 +17,15 @@ type Provider struct {
 	// KernelTrace Providers
 	EnableFlags uint64
 
+	// GroupMasks are extended kernel flags (PERF_*) which can't be set with
+	// EnableFlags. Setting them requires Windows 8 or newer.
+	GroupMasks []PerfGroupMask
+
+	// StackTracing is a list of opcodes of ProviderId events the kernel should
+	// collect call stacks for, e.g. 1 (Start) of KERNEL_PROCESS_GUID. Stacks
+	// are delivered as separate StackWalk events.
+	StackTracing []uint8
+
 	// UserTrace Providers
 
 	// Level represents provider-defined value that specifies the level of
@@ -57,6 +66,16 @@ type Provider struct {
 	// original API reference:
 	// https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ns-evntrace-enable_trace_parameters
 	EnableProperties []EnableProperty
+
+	// Filters are applied by the provider before events are written to the
+	// session. At most one filter of each type could be set. Check
+	// EventFilter docs for more info. Filters are ignored by kernel traces.
+	Filters []EventFilter
+
+	// CaptureState asks the provider to write its current state right after
+	// it's enabled by Trace.Open or Trace.Enable. Check Trace.CaptureState
+	// for details.
+	CaptureState bool
 }
 
 // TraceLevel represents provider-defined value that specifies the level of
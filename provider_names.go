@@ -0,0 +1,236 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"crypto/sha1" //nolint:gosec // Required by the EventSource naming scheme, not for security.
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// TdhEnumerateProviders is missing in MinGW.
+//
+//nolint:gochecknoglobals
+var tdhEnumerateProviders = tdh.NewProc("TdhEnumerateProviders")
+
+// eventSourceNamespace is a namespace GUID used by EventSource and TraceLogging
+// to derive provider GUIDs from names. Stored in the network byte order.
+//
+//nolint:gochecknoglobals
+var eventSourceNamespace = [16]byte{
+	0x48, 0x2C, 0x2D, 0xB2, 0xC3, 0x90, 0x47, 0xC8,
+	0x87, 0xF8, 0x1A, 0x15, 0xBF, 0xC1, 0x30, 0xFB,
+}
+
+// wellKnownProviders resolves names of common manifest providers without
+// querying the system, e.g. when parsing configs for another machine.
+//
+//nolint:gochecknoglobals
+var wellKnownProviders = []struct {
+	name string
+	id   windows.GUID
+}{
+	{"Microsoft-Antimalware-Scan-Interface", windows.GUID{Data1: 0x2a576b87, Data2: 0x09a7, Data3: 0x520e, Data4: [8]byte{0xc2, 0x1a, 0x49, 0x42, 0xf0, 0x27, 0x1d, 0x67}}},
+	{"Microsoft-Windows-DNS-Client", windows.GUID{Data1: 0x1c95126e, Data2: 0x7eea, Data3: 0x49a9, Data4: [8]byte{0xa3, 0xfe, 0xa3, 0x78, 0xb0, 0x3d, 0xdb, 0x4d}}},
+	{"Microsoft-Windows-DotNETRuntime", windows.GUID{Data1: 0xe13c0d23, Data2: 0xccbc, Data3: 0x4e12, Data4: [8]byte{0x93, 0x1b, 0xd9, 0xcc, 0x2e, 0xee, 0x27, 0xe4}}},
+	{"Microsoft-Windows-Kernel-Audit-API-Calls", windows.GUID{Data1: 0xe02a841c, Data2: 0x75a3, Data3: 0x4fa7, Data4: [8]byte{0xaf, 0xc8, 0xae, 0x09, 0xcf, 0x9b, 0x7f, 0x23}}},
+	{"Microsoft-Windows-Kernel-EventTracing", windows.GUID{Data1: 0xb675ec37, Data2: 0xbdb6, Data3: 0x4648, Data4: [8]byte{0xbc, 0x92, 0xf3, 0xfd, 0xc7, 0x4d, 0x3c, 0xa2}}},
+	{"Microsoft-Windows-Kernel-File", windows.GUID{Data1: 0xedd08927, Data2: 0x9cc4, Data3: 0x4e65, Data4: [8]byte{0xb9, 0x70, 0xc2, 0x56, 0x0f, 0xb5, 0xc2, 0x89}}},
+	{"Microsoft-Windows-Kernel-Memory", windows.GUID{Data1: 0xd1d93ef7, Data2: 0xe1f2, Data3: 0x4f45, Data4: [8]byte{0x99, 0x43, 0x03, 0xd2, 0x45, 0xfe, 0x6c, 0x00}}},
+	{"Microsoft-Windows-Kernel-Network", windows.GUID{Data1: 0x7dd42a49, Data2: 0x5329, Data3: 0x4832, Data4: [8]byte{0x8d, 0xfd, 0x43, 0xd9, 0x79, 0x15, 0x3a, 0x88}}},
+	{"Microsoft-Windows-Kernel-Process", windows.GUID{Data1: 0x22fb2cd6, Data2: 0x0e7b, Data3: 0x422b, Data4: [8]byte{0xa0, 0xc7, 0x2f, 0xad, 0x1f, 0xd0, 0xe7, 0x16}}},
+	{"Microsoft-Windows-Kernel-Registry", windows.GUID{Data1: 0x70eb4f03, Data2: 0xc1de, Data3: 0x4f73, Data4: [8]byte{0xa0, 0x51, 0x33, 0xd1, 0x3d, 0x54, 0x13, 0xbd}}},
+	{"Microsoft-Windows-PowerShell", windows.GUID{Data1: 0xa0c1853b, Data2: 0x5c40, Data3: 0x4b15, Data4: [8]byte{0x87, 0x66, 0x3c, 0xf1, 0xc5, 0x8f, 0x98, 0x5a}}},
+	{"Microsoft-Windows-RPC", windows.GUID{Data1: 0x6ad52b32, Data2: 0xd609, Data3: 0x4be9, Data4: [8]byte{0xae, 0x07, 0xce, 0x8d, 0xae, 0x93, 0x7e, 0x39}}},
+	{"Microsoft-Windows-Security-Auditing", windows.GUID{Data1: 0x54849625, Data2: 0x5478, Data3: 0x4994, Data4: [8]byte{0xa5, 0xba, 0x3e, 0x3b, 0x03, 0x28, 0xc3, 0x0d}}},
+	{"Microsoft-Windows-Services", windows.GUID{Data1: 0x0063715b, Data2: 0xeeda, Data3: 0x4007, Data4: [8]byte{0x94, 0x29, 0xad, 0x52, 0x6f, 0x62, 0x69, 0x6e}}},
+	{"Microsoft-Windows-SMBClient", windows.GUID{Data1: 0x988c59c5, Data2: 0x0a1c, Data3: 0x45b6, Data4: [8]byte{0xa5, 0x55, 0x0c, 0x62, 0x27, 0x6e, 0x32, 0x7d}}},
+	{"Microsoft-Windows-Sysmon", windows.GUID{Data1: 0x5770385f, Data2: 0xc22a, Data3: 0x43e0, Data4: [8]byte{0xbf, 0x4c, 0x06, 0xf5, 0x69, 0x8f, 0xfb, 0xd9}}},
+	{"Microsoft-Windows-TaskScheduler", windows.GUID{Data1: 0xde7b24ea, Data2: 0x73c8, Data3: 0x4a09, Data4: [8]byte{0x98, 0x5d, 0x5b, 0xda, 0xdc, 0xfa, 0x90, 0x17}}},
+	{"Microsoft-Windows-TCPIP", windows.GUID{Data1: 0x2f07e2ee, Data2: 0x15db, Data3: 0x40f1, Data4: [8]byte{0x90, 0xef, 0x9d, 0x7b, 0xa2, 0x82, 0x18, 0x8a}}},
+	{"Microsoft-Windows-Threat-Intelligence", windows.GUID{Data1: 0xf4e1897c, Data2: 0xbb5d, Data3: 0x5668, Data4: [8]byte{0xf1, 0xd8, 0x04, 0x0f, 0x4d, 0x8d, 0xd3, 0x44}}},
+	{"Microsoft-Windows-WinINet", windows.GUID{Data1: 0x43d1a55c, Data2: 0x76d6, Data3: 0x4f7e, Data4: [8]byte{0x99, 0x5c, 0x64, 0xc7, 0x11, 0xe5, 0xca, 0xfe}}},
+	{"Microsoft-Windows-Winlogon", windows.GUID{Data1: 0xdbe9b383, Data2: 0x7cf3, Data3: 0x4331, Data4: [8]byte{0x91, 0xcc, 0xa3, 0xcb, 0x16, 0xa3, 0xb5, 0x38}}},
+	{"Microsoft-Windows-WMI-Activity", windows.GUID{Data1: 0x1418ef04, Data2: 0xb0b4, Data3: 0x4623, Data4: [8]byte{0xbf, 0x7e, 0xd7, 0x4a, 0xb4, 0x7b, 0xbd, 0xaa}}},
+}
+
+// NewProviderByName is like NewProvider but takes a provider name.
+//
+// The name is resolved in the following order:
+//  1. the table of well-known manifest providers;
+//  2. manifest and MOF providers registered in the system;
+//  3. EventSource and TraceLogging naming scheme (see ProviderGUIDFromName).
+//
+// A name matching none of the registered providers always resolves to a GUID
+// by the last rule, so a typo in a manifest provider name results in a session
+// receiving no events rather than in an error.
+func NewProviderByName(name string) (*Provider, error) {
+	id, err := LookupProvider(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewProvider(id), nil
+}
+
+// LookupProvider resolves a provider @name into its GUID. Check
+// NewProviderByName for the resolution order.
+func LookupProvider(name string) (windows.GUID, error) {
+	if name == "" {
+		return windows.GUID{}, fmt.Errorf("empty provider name")
+	}
+	if id, ok := wellKnownProvider(name); ok {
+		return id, nil
+	}
+
+	id, ok, err := registeredProvider(name)
+	if err != nil {
+		return windows.GUID{}, fmt.Errorf("failed to lookup provider %q; %w", name, err)
+	}
+	if ok {
+		return id, nil
+	}
+	return ProviderGUIDFromName(name), nil
+}
+
+// ProviderGUIDFromName computes a provider GUID from its @name the same way
+// EventSource and TraceLogging providers do: it's a SHA-1 name-based GUID of
+// the upper-cased name in UTF-16BE with a fixed namespace.
+//
+// Ref: https://docs.microsoft.com/en-us/dotnet/api/system.diagnostics.tracing.eventsource.getguid
+func ProviderGUIDFromName(name string) windows.GUID {
+	h := sha1.New() //nolint:gosec // Not used for security.
+	h.Write(eventSourceNamespace[:])
+	for _, c := range utf16.Encode([]rune(strings.ToUpper(name))) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	sum := h.Sum(nil)
+
+	// Set the version 5 (name-based SHA-1) like RFC 4122 does, but in a byte
+	// which is read as little endian.
+	sum[7] = sum[7]&0x0F | 0x50
+
+	// The bytes are read as in .NET Guid(byte[]) constructor.
+	id := windows.GUID{
+		Data1: binary.LittleEndian.Uint32(sum[0:4]),
+		Data2: binary.LittleEndian.Uint16(sum[4:6]),
+		Data3: binary.LittleEndian.Uint16(sum[6:8]),
+	}
+	copy(id.Data4[:], sum[8:16])
+	return id
+}
+
+// wellKnownProvider looks for the @name in the table of well-known providers.
+// Provider names are case insensitive.
+func wellKnownProvider(name string) (windows.GUID, bool) {
+	for _, p := range wellKnownProviders {
+		if strings.EqualFold(p.name, name) {
+			return p.id, true
+		}
+	}
+	return windows.GUID{}, false
+}
+
+// registeredProvider looks for the @name in providers registered in the
+// system using TdhEnumerateProviders.
+func registeredProvider(name string) (windows.GUID, bool, error) {
+	// TDHSTATUS TdhEnumerateProviders(
+	//  PPROVIDER_ENUMERATION_INFO pBuffer,
+	//  ULONG                      *pBufferSize
+	// );
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/tdh/nf-tdh-tdhenumerateproviders
+	var size uint32
+	var buffer []byte
+	for {
+		var ptr uintptr
+		if len(buffer) > 0 {
+			ptr = uintptr(unsafe.Pointer(&buffer[0]))
+		}
+		r0, _, _ := tdhEnumerateProviders.Call(ptr, uintptr(unsafe.Pointer(&size)))
+		status := windows.Errno(r0)
+		if status == windows.ERROR_INSUFFICIENT_BUFFER {
+			// The list could grow between calls, so repeat.
+			buffer = make([]byte, size)
+			continue
+		}
+		if status != windows.ERROR_SUCCESS {
+			return windows.GUID{}, false, fmt.Errorf("TdhEnumerateProviders failed; %w", status)
+		}
+		break
+	}
+
+	if len(buffer) == 0 {
+		return windows.GUID{}, false, nil
+	}
+	return findProviderInfo(buffer[:size], name)
+}
+
+// findProviderInfo looks for the provider @name in the PROVIDER_ENUMERATION_INFO
+// @buffer:
+//
+//	typedef struct _PROVIDER_ENUMERATION_INFO {
+//	  ULONG               NumberOfProviders;
+//	  ULONG               Reserved;
+//	  TRACE_PROVIDER_INFO TraceProviderInfoArray[ANYSIZE_ARRAY];
+//	} PROVIDER_ENUMERATION_INFO;
+//
+//	typedef struct _TRACE_PROVIDER_INFO {
+//	  GUID  ProviderGuid;
+//	  ULONG SchemaSource;
+//	  ULONG ProviderNameOffset;
+//	} TRACE_PROVIDER_INFO;
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/tdh/ns-tdh-provider_enumeration_info
+func findProviderInfo(buffer []byte, name string) (windows.GUID, bool, error) {
+	const (
+		headerSize = 8
+		infoSize   = 24
+	)
+	if len(buffer) < headerSize {
+		return windows.GUID{}, false, errors.New("provider enumeration buffer is too short")
+	}
+	count := int(binary.LittleEndian.Uint32(buffer))
+	if headerSize+count*infoSize > len(buffer) {
+		return windows.GUID{}, false, fmt.Errorf("provider enumeration buffer is too short for %d providers", count)
+	}
+
+	for i := 0; i < count; i++ {
+		info := buffer[headerSize+i*infoSize:]
+		nameOffset := int(binary.LittleEndian.Uint32(info[20:]))
+		if nameOffset <= 0 || nameOffset >= len(buffer) {
+			continue
+		}
+		if !strings.EqualFold(utf16StringAt(buffer[nameOffset:]), name) {
+			continue
+		}
+
+		id := windows.GUID{
+			Data1: binary.LittleEndian.Uint32(info[0:]),
+			Data2: binary.LittleEndian.Uint16(info[4:]),
+			Data3: binary.LittleEndian.Uint16(info[6:]),
+		}
+		copy(id.Data4[:], info[8:16])
+		return id, true, nil
+	}
+	return windows.GUID{}, false, nil
+}
+
+// utf16StringAt decodes a null-terminated UTF-16LE string from @data.
+func utf16StringAt(data []byte) string {
+	var s []uint16
+	for ; len(data) >= 2; data = data[2:] {
+		c := binary.LittleEndian.Uint16(data)
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	return string(utf16.Decode(s))
+}
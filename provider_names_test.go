@@ -0,0 +1,100 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestProviderNames(t *testing.T) {
+	suite.Run(t, new(providerNamesSuite))
+}
+
+type providerNamesSuite struct {
+	suite.Suite
+}
+
+// TestGUIDFromName checks hashing against GUIDs of known TraceLogging
+// providers.
+func (s *providerNamesSuite) TestGUIDFromName() {
+	known := map[string]windows.GUID{
+		"wincni": {Data1: 0xc822b598, Data2: 0xf4cc, Data3: 0x5a72,
+			Data4: [8]byte{0x79, 0x33, 0xce, 0x2a, 0x81, 0x6d, 0x03, 0x3f}},
+		"Moby": {Data1: 0x6996f090, Data2: 0xc5de, Data3: 0x5082,
+			Data4: [8]byte{0xa8, 0x1e, 0x58, 0x41, 0xac, 0xc3, 0xa6, 0x35}},
+		"ContainerD": {Data1: 0x2acb92c0, Data2: 0xeb9b, Data3: 0x571a,
+			Data4: [8]byte{0x69, 0xcf, 0x8f, 0x34, 0x10, 0xf3, 0x83, 0xad}},
+		"Microsoft.Virtualization.RunHCS": {Data1: 0x0b52781f, Data2: 0xb24d, Data3: 0x5685,
+			Data4: [8]byte{0xdd, 0xf6, 0x69, 0x83, 0x0e, 0xd4, 0x0e, 0xc3}},
+	}
+	for name, id := range known {
+		s.Equal(id, ProviderGUIDFromName(name), name)
+	}
+	s.Equal(ProviderGUIDFromName("moby"), ProviderGUIDFromName("MOBY"), "Names are case insensitive")
+}
+
+// TestWellKnown ensures the table is looked up case insensitively and has no
+// duplicates.
+func (s *providerNamesSuite) TestWellKnown() {
+	id, ok := wellKnownProvider("microsoft-windows-kernel-process")
+	s.True(ok)
+	s.Equal(uint32(0x22fb2cd6), id.Data1)
+
+	_, ok = wellKnownProvider("Unknown-Provider")
+	s.False(ok)
+
+	names := make(map[string]bool)
+	ids := make(map[windows.GUID]bool)
+	for _, p := range wellKnownProviders {
+		s.False(names[p.name], "Duplicate name %s", p.name)
+		s.False(ids[p.id], "Duplicate GUID of %s", p.name)
+		names[p.name], ids[p.id] = true, true
+	}
+}
+
+// TestFindProviderInfo ensures PROVIDER_ENUMERATION_INFO is parsed.
+func (s *providerNamesSuite) TestFindProviderInfo() {
+	providers := []struct {
+		name string
+		id   windows.GUID
+	}{
+		{"First", windows.GUID{Data1: 1, Data2: 2, Data3: 3, Data4: [8]byte{4, 5, 6, 7, 8, 9, 10, 11}}},
+		{"Second", windows.GUID{Data1: 0x01020304}},
+	}
+
+	buffer := make([]byte, 8+24*len(providers))
+	binary.LittleEndian.PutUint32(buffer, uint32(len(providers)))
+	for i, p := range providers {
+		info := buffer[8+24*i:]
+		binary.LittleEndian.PutUint32(info[0:], p.id.Data1)
+		binary.LittleEndian.PutUint16(info[4:], p.id.Data2)
+		binary.LittleEndian.PutUint16(info[6:], p.id.Data3)
+		copy(info[8:16], p.id.Data4[:])
+		binary.LittleEndian.PutUint32(info[20:], uint32(len(buffer)))
+		for _, c := range utf16.Encode([]rune(p.name + "\x00")) {
+			buffer = append(buffer, byte(c), byte(c>>8))
+		}
+	}
+
+	for _, p := range providers {
+		id, ok, err := findProviderInfo(buffer, p.name)
+		s.Require().NoError(err)
+		s.True(ok, p.name)
+		s.Equal(p.id, id)
+	}
+	_, ok, err := findProviderInfo(buffer, "SECOND")
+	s.NoError(err)
+	s.True(ok, "Names are case insensitive")
+	_, ok, err = findProviderInfo(buffer, "Third")
+	s.NoError(err)
+	s.False(ok)
+
+	_, _, err = findProviderInfo(buffer[:20], "First")
+	s.Error(err, "Truncated buffer")
+}
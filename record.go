@@ -0,0 +1,143 @@
+//go:build windows
+// +build windows
+
+package etw
+
+/*
+	#include "etw.h"
+*/
+import "C"
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Record is a copy of an Event detached from ETW buffers, so unlike Event it
+// could be used outside of EventCallback. Making a Record parses all the
+// event data, so use it only if the event should outlive the callback.
+type Record struct {
+	Header       EventHeader
+	ProviderName string
+	Properties   map[string]interface{}
+	Extended     ExtendedEventInfo
+}
+
+// Record copies the event to a Record. Properties parsing errors are returned
+// along with the Record having Header and Extended fields set.
+func (e *Event) Record() (*Record, error) {
+	if e.eventRecord == nil {
+		return nil, fmt.Errorf("usage of Event is invalid outside of EventCallback")
+	}
+
+	r := &Record{
+		Header:       e.Header,
+		ProviderName: e.ProviderName(),
+		Extended:     e.ExtendedInfo(),
+	}
+	props, err := e.EventProperties()
+	if err != nil {
+		return r, err
+	}
+	r.Properties = props
+	return r, nil
+}
+
+// userData returns a copy of the raw event payload.
+func (e *Event) userData() []byte {
+	if e.eventRecord == nil || e.eventRecord.UserDataLength == 0 {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(e.eventRecord.UserData), C.int(e.eventRecord.UserDataLength))
+}
+
+// rawTimeStamp returns the timestamp of EVENT_HEADER as is, before it's
+// converted to time.Time. StackWalk events refer to events by it.
+func (e *Event) rawTimeStamp() uint64 {
+	if e.eventRecord == nil {
+		return 0
+	}
+	return uint64(C.GetTimeStamp(e.eventRecord.EventHeader))
+}
+
+// ProviderName returns the provider name from the event schema. It's empty if
+// the schema is not available.
+func (e *Event) ProviderName() string {
+	if e.eventRecord == nil {
+		return ""
+	}
+	p, err := newPropertyParser(e.eventRecord)
+	if err != nil {
+		return ""
+	}
+	defer p.free()
+	return p.getProviderName()
+}
+
+// getProviderName returns a provider name from the event information.
+func (p *propertyParser) getProviderName() string {
+	if p.info.ProviderNameOffset == 0 {
+		return ""
+	}
+	name := uintptr(unsafe.Pointer(p.info)) + uintptr(p.info.ProviderNameOffset)
+	length := C.wcslen((C.PWCHAR)(unsafe.Pointer(name)))
+	return createUTF16String(name, int(length))
+}
+
+// Schema converts the record to the platform independent model used by
+// encoders. Properties are sorted by name as the original order is lost.
+func (r *Record) Schema() *schema.Event {
+	h := r.Header
+	ev := &schema.Event{
+		Header: schema.Header{
+			Descriptor:    schema.Descriptor(h.EventDescriptor),
+			ThreadID:      h.ThreadID,
+			ProcessID:     h.ProcessID,
+			TimeStamp:     h.TimeStamp,
+			ProviderID:    schema.GUID(h.ProviderID),
+			ActivityID:    schema.GUID(h.ActivityID),
+			Flags:         h.Flags,
+			KernelTime:    h.KernelTime,
+			UserTime:      h.UserTime,
+			ProcessorTime: h.ProcessorTime,
+
+			Rundown:            h.Rundown,
+			DuringCaptureState: h.DuringCaptureState,
+		},
+		ProviderName: r.ProviderName,
+		Properties:   make([]schema.Property, 0, len(r.Properties)),
+	}
+	for name, value := range r.Properties {
+		ev.Properties = append(ev.Properties, schema.Property{Name: name, Value: value})
+	}
+	sort.Slice(ev.Properties, func(i, j int) bool { return ev.Properties[i].Name < ev.Properties[j].Name })
+
+	x := r.Extended
+	ev.Extended.SessionID = x.SessionID
+	if x.ActivityID != nil {
+		id := schema.GUID(*x.ActivityID)
+		ev.Extended.ActivityID = &id
+	}
+	if x.UserSID != nil {
+		ev.Extended.UserSID = x.UserSID.String()
+	}
+	if x.InstanceInfo != nil {
+		ev.Extended.InstanceInfo = &schema.InstanceInfo{
+			InstanceID:       x.InstanceInfo.InstanceID,
+			ParentInstanceID: x.InstanceInfo.ParentInstanceID,
+			ParentGUID:       schema.GUID(x.InstanceInfo.ParentGUID),
+		}
+	}
+	if x.StackTrace != nil {
+		ev.Extended.StackTrace = &schema.StackTrace{
+			MatchedID:      x.StackTrace.MatchedID,
+			Addresses:      x.StackTrace.Addresses,
+			KernelFrames:   x.StackTrace.KernelFrames,
+			KernelStackKey: x.StackTrace.KernelStackKey,
+			UserStackKey:   x.StackTrace.UserStackKey,
+		}
+	}
+	return ev
+}
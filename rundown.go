@@ -0,0 +1,155 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Opcodes reserved by the manifest schema for rundown events: win:DC_Start
+// and win:DC_Stop. Kernel and CLR rundown events use them as well.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/wes/eventmanifestschema-opcodetype-complextype
+const (
+	opcodeDCStart = 3
+	opcodeDCStop  = 4
+)
+
+// captureStateTimeout limits the time CaptureState waits for the provider to
+// write its state.
+const captureStateTimeout = 10 * time.Second
+
+// errNotRegistered is returned for operations that require an open session.
+//
+//nolint:gochecknoglobals
+var errNotRegistered = errors.New("session is not open")
+
+// CaptureState asks enabled @providers to write events describing their
+// current state (existing processes, loaded modules, etc.), also known as
+// rundown. The trace should be open.
+//
+// Rundown events are marked with EventHeader.Rundown if providers use the
+// DC_Start/DC_Stop opcodes for them and with EventHeader.DuringCaptureState
+// otherwise. To request the state right after a provider is enabled use
+// Provider.CaptureState.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-enabletraceex2
+func (trace *Trace) CaptureState(providers ...*Provider) error {
+	trace.providersMu.Lock()
+	var errs ProviderErrors
+	var captures []*Provider
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		enabled, ok := trace.providers[keyOf(provider)]
+		switch {
+		case !ok:
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: ErrProviderNotEnabled})
+		case !trace.isRegistered():
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: errNotRegistered})
+		default:
+			copied := *enabled
+			captures = append(captures, &copied)
+		}
+	}
+	handle := trace.registrationHandle
+	trace.providersMu.Unlock()
+
+	return append(errs, trace.captureStates(handle, captures)...).errorOrNil()
+}
+
+// captureStates requests the rundown of enabled @providers one by one. It
+// waits for providers to write their state, so it should be called without
+// providersMu held not to block provider control meanwhile.
+func (trace *Trace) captureStates(handle traceHandle, providers []*Provider) ProviderErrors {
+	var errs ProviderErrors
+	for _, provider := range providers {
+		if err := trace.captureState(handle, provider); err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+		}
+	}
+	return errs
+}
+
+// captureState requests the rundown of the enabled @provider from the
+// session @handle tracking the time the provider was writing it.
+func (trace *Trace) captureState(handle traceHandle, provider *Provider) error {
+	// Providers write the state synchronously inside their enable callback
+	// and the request waits for callbacks to complete, so events of the
+	// provider with timestamps inside the window are likely the rundown ones.
+	trace.rundowns.begin(provider.ProviderId, time.Now())
+	err := trace.impl.captureState(handle, provider)
+	trace.rundowns.end(provider.ProviderId, time.Now())
+	return err
+}
+
+// rundownWindow is a time range the provider was writing its rundown. Zero
+// end means the rundown is in progress.
+type rundownWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// rundownTracker marks events written during capture state requests.
+// Windows are read on every event, so they are kept in an immutable map
+// replaced on every change.
+type rundownTracker struct {
+	mu      sync.Mutex   // Serializes writers.
+	windows atomic.Value // map[windows.GUID]rundownWindow
+}
+
+// begin opens a rundown window of the provider @id at @now.
+func (t *rundownTracker) begin(id windows.GUID, now time.Time) {
+	t.update(id, rundownWindow{start: now})
+}
+
+// end closes the window of the provider @id at @now.
+func (t *rundownTracker) end(id windows.GUID, now time.Time) {
+	w, ok := t.load()[id]
+	if !ok {
+		return
+	}
+	w.end = now
+	t.update(id, w)
+}
+
+func (t *rundownTracker) update(id windows.GUID, w rundownWindow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := t.load()
+	updated := make(map[windows.GUID]rundownWindow, len(current)+1)
+	for k, v := range current {
+		updated[k] = v
+	}
+	updated[id] = w
+	t.windows.Store(updated)
+}
+
+func (t *rundownTracker) load() map[windows.GUID]rundownWindow {
+	m, _ := t.windows.Load().(map[windows.GUID]rundownWindow)
+	return m
+}
+
+// isRundown tells if the event with a given @header is a rundown one by its
+// opcode.
+func isRundown(header *EventHeader) bool {
+	return header.OpCode == opcodeDCStart || header.OpCode == opcodeDCStop
+}
+
+// duringCaptureState tells if the event with a given @header was written by
+// the provider during the last capture state request.
+func (t *rundownTracker) duringCaptureState(header *EventHeader) bool {
+	w, ok := t.load()[header.ProviderID]
+	if !ok || header.TimeStamp.Before(w.start) {
+		return false
+	}
+	return w.end.IsZero() || !header.TimeStamp.After(w.end)
+}
@@ -0,0 +1,126 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRundown(t *testing.T) {
+	suite.Run(t, new(rundownSuite))
+}
+
+type rundownSuite struct {
+	suite.Suite
+}
+
+// TestTracker ensures rundown events are marked by opcode only and events
+// during capture state requests by their window.
+func (s *rundownSuite) TestTracker() {
+	var tracker rundownTracker
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	event := func(opcode uint8, ts time.Time) *EventHeader {
+		h := &EventHeader{ProviderID: testProviderA, TimeStamp: ts}
+		h.OpCode = opcode
+		return h
+	}
+
+	s.False(isRundown(event(1, start)))
+	s.True(isRundown(event(opcodeDCStart, start)))
+	s.True(isRundown(event(opcodeDCStop, start)))
+	s.False(tracker.duringCaptureState(event(1, start)), "Empty tracker marked an event")
+
+	tracker.begin(testProviderA, start)
+	s.True(tracker.duringCaptureState(event(0, start.Add(time.Hour))), "Window in progress is unbounded")
+	s.False(tracker.duringCaptureState(event(0, start.Add(-time.Millisecond))))
+	s.False(isRundown(event(0, start.Add(time.Hour))), "Live event marked as rundown")
+
+	tracker.end(testProviderA, start.Add(time.Second))
+	s.True(tracker.duringCaptureState(event(0, start.Add(time.Second))))
+	s.False(tracker.duringCaptureState(event(0, start.Add(2*time.Second))))
+
+	other := event(0, start.Add(time.Millisecond))
+	other.ProviderID = testProviderB
+	s.False(tracker.duringCaptureState(other), "Other provider events marked")
+}
+
+// TestCaptureState ensures capture state is requested for enabled providers
+// only and automatically when requested by the provider settings.
+func (s *rundownSuite) TestCaptureState() {
+	impl := newFakeTraceImpl()
+	trace, err := newTrace("Test-ETW", func(*Event) {}, impl, nil)
+	s.Require().NoError(err)
+
+	s.Require().NoError(trace.Enable(NewProvider(testProviderA)))
+	errs := ProviderErrors{}
+	s.Require().True(errors.As(trace.CaptureState(NewProvider(testProviderA)), &errs))
+	s.True(errors.Is(errs[0], errNotRegistered))
+
+	trace.registrationHandle = 1 // Pretend the session is started.
+	s.Require().NoError(trace.CaptureState(NewProvider(testProviderA)))
+	s.Equal(1, impl.captures)
+	w, ok := trace.rundowns.load()[testProviderA]
+	s.Require().True(ok, "Rundown window is not tracked")
+	s.False(w.end.IsZero(), "Rundown window is not closed")
+
+	s.Require().True(errors.As(trace.CaptureState(NewProvider(testProviderB)), &errs))
+	s.True(errors.Is(errs[0], ErrProviderNotEnabled))
+
+	// Automatic rundown; failure leaves provider enabled.
+	impl.captureErr = errors.New("timeout")
+	provider := NewProvider(testProviderB)
+	provider.CaptureState = true
+	s.Error(trace.Enable(provider))
+	s.Equal(2, impl.captures)
+	_, ok = impl.get(testProviderB)
+	s.True(ok, "Provider is not enabled after failed capture state")
+	s.Len(trace.providers, 2)
+
+	impl.captureErr = nil
+	s.Require().NoError(trace.Enable(provider))
+	s.Equal(3, impl.captures)
+}
+
+// blockingCapture blocks capture state requests until released.
+type blockingCapture struct {
+	*fakeTraceImpl
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingCapture) captureState(handle traceHandle, provider *Provider) error {
+	close(b.started)
+	<-b.release
+	return b.fakeTraceImpl.captureState(handle, provider)
+}
+
+// TestCaptureStateUnlocked ensures providers could be controlled while
+// capture state waits for the provider.
+func (s *rundownSuite) TestCaptureStateUnlocked() {
+	impl := &blockingCapture{
+		fakeTraceImpl: newFakeTraceImpl(),
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	trace, err := newTrace("Test-ETW", func(*Event) {}, impl, nil)
+	s.Require().NoError(err)
+	s.Require().NoError(trace.Enable(NewProvider(testProviderA)))
+	trace.registrationHandle = 1 // Pretend the session is started.
+
+	done := make(chan error, 1)
+	go func() {
+		done <- trace.CaptureState(NewProvider(testProviderA))
+	}()
+	<-impl.started
+
+	s.Require().NoError(trace.Enable(NewProvider(testProviderB)), "Provider control is blocked")
+	close(impl.release)
+	s.Require().NoError(<-done)
+	s.Equal(1, impl.captures)
+}
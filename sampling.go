@@ -0,0 +1,533 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default SamplingOptions.
+const (
+	defaultSamplingMaxKeys = 10000
+	defaultSummaryInterval = time.Minute
+	defaultReservoirWindow = time.Minute
+)
+
+// samplingKeySeparator separates parts of combined keys.
+const samplingKeySeparator = "/"
+
+// SamplingOtherKey is the key of events exceeding SamplingOptions.MaxKeys.
+const SamplingOtherKey = "other"
+
+// Sampling policies reported in SamplingSummary.
+const (
+	PolicyRateLimit   = "rate_limit"
+	PolicyNth         = "nth"
+	PolicyProbability = "probability"
+	PolicyReservoir   = "reservoir"
+)
+
+// Middleware wraps an EventCallback, e.g. Sampler.Wrap, Metrics.Wrap or
+// VerbosityController.Wrap.
+type Middleware func(callback EventCallback) EventCallback
+
+// Chain wraps @callback into @middleware, so events pass the middleware in
+// the given order before reaching @callback.
+func Chain(callback EventCallback, middleware ...Middleware) EventCallback {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		callback = middleware[i](callback)
+	}
+	return callback
+}
+
+// SampleKey returns the key events are limited and sampled by, so every key
+// has its own budget.
+type SampleKey func(e *Event) string
+
+// KeyProvider keys events by the provider GUID.
+func KeyProvider(e *Event) string {
+	return e.Header.ProviderID.String()
+}
+
+// KeyEventID keys events by the event ID.
+func KeyEventID(e *Event) string {
+	return strconv.FormatUint(uint64(e.Header.ID), 10)
+}
+
+// KeyProcessID keys events by the ID of the process which emitted the event.
+func KeyProcessID(e *Event) string {
+	return strconv.FormatUint(uint64(e.Header.ProcessID), 10)
+}
+
+// KeyProperties keys events by values of top level properties @names.
+// Missing properties and events failed to parse have empty values.
+//
+// Keying by properties parses every event, which is much slower than keying
+// by header fields.
+func KeyProperties(names ...string) SampleKey {
+	return func(e *Event) string {
+		values := make([]string, len(names))
+		props, err := e.EventProperties()
+		if err == nil {
+			for i, name := range names {
+				if v, ok := props[name]; ok {
+					values[i] = fmt.Sprint(v)
+				}
+			}
+		}
+		return strings.Join(values, samplingKeySeparator)
+	}
+}
+
+// Keys combines @keys, e.g. Keys(KeyProvider, KeyEventID).
+func Keys(keys ...SampleKey) SampleKey {
+	return func(e *Event) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key(e)
+		}
+		return strings.Join(parts, samplingKeySeparator)
+	}
+}
+
+// SamplingOptions configure samplers. Zero values stand for defaults.
+type SamplingOptions struct {
+	// Key splits events into groups sampled independently. All events share
+	// a single group if nil.
+	Key SampleKey
+
+	// MaxKeys bounds the memory used for keys: events of new keys share
+	// SamplingOtherKey once the limit is reached. Keys without events for a
+	// whole summary interval are forgotten. Defaults to 10000.
+	MaxKeys int
+
+	// SummaryInterval is the period summaries are reported for. Reservoir
+	// reports summaries for every window instead. Defaults to 1m.
+	SummaryInterval time.Duration
+
+	// OnSummary is called with summaries of keys which had events suppressed
+	// during the interval. It's called synchronously from the callback.
+	OnSummary func(SamplingSummary)
+
+	// Now returns the current time. Defaults to time.Now. Set it along with
+	// Rand to make sampling deterministic in tests.
+	Now func() time.Time
+
+	// Rand is the source of randomness. Defaults to a source seeded with the
+	// current time.
+	Rand rand.Source
+}
+
+// withDefaults validates options and fills defaults.
+func (o SamplingOptions) withDefaults() (SamplingOptions, error) {
+	if o.MaxKeys < 0 {
+		return o, fmt.Errorf("invalid MaxKeys %d", o.MaxKeys)
+	}
+	if o.SummaryInterval < 0 {
+		return o, fmt.Errorf("invalid SummaryInterval %v", o.SummaryInterval)
+	}
+	if o.Key == nil {
+		o.Key = func(*Event) string { return "" }
+	}
+	if o.MaxKeys == 0 {
+		o.MaxKeys = defaultSamplingMaxKeys
+	}
+	if o.SummaryInterval == 0 {
+		o.SummaryInterval = defaultSummaryInterval
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	if o.Rand == nil {
+		o.Rand = rand.NewSource(time.Now().UnixNano())
+	}
+	return o, nil
+}
+
+// SamplingSummary tells how many events of a key were suppressed during an
+// interval.
+type SamplingSummary struct {
+	Policy string // One of Policy* constants.
+	Key    string
+	Start  time.Time
+	End    time.Time
+
+	Passed     uint64
+	Suppressed uint64
+}
+
+// Sampler passes a part of events to the callback deciding on every event
+// independently by a policy: a token bucket rate limit, 1-in-N or
+// probabilistic sampling. Samplers are composable, e.g. with Chain.
+type Sampler struct {
+	mu sync.Mutex
+
+	policy  string
+	options SamplingOptions
+	rand    *rand.Rand
+	allow   func(s *Sampler, state *samplerState, now time.Time) bool
+
+	keys          map[string]*samplerState
+	intervalStart time.Time
+}
+
+// samplerState is the state of a single key.
+type samplerState struct {
+	passed     uint64
+	suppressed uint64
+
+	// Token bucket.
+	tokens float64
+	last   time.Time
+
+	// 1-in-N.
+	seen uint64
+}
+
+// NewRateLimiter creates a Sampler passing at most @rate events per second
+// of every key with bursts of up to @burst events. Zero @burst defaults to
+// a second worth of events.
+func NewRateLimiter(rate float64, burst int, options SamplingOptions) (*Sampler, error) {
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, fmt.Errorf("invalid rate %v", rate)
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("invalid burst %d", burst)
+	}
+	capacity := float64(burst)
+	if burst == 0 {
+		capacity = math.Max(1, math.Ceil(rate))
+	}
+	return newSampler(PolicyRateLimit, options, func(s *Sampler, state *samplerState, now time.Time) bool {
+		if state.last.IsZero() {
+			state.tokens = capacity
+		} else if elapsed := now.Sub(state.last); elapsed > 0 {
+			state.tokens = math.Min(capacity, state.tokens+elapsed.Seconds()*rate)
+		}
+		state.last = now
+		if state.tokens < 1 {
+			return false
+		}
+		state.tokens--
+		return true
+	})
+}
+
+// NewNthSampler creates a Sampler passing every @n-th event of every key
+// starting from the first one.
+func NewNthSampler(n uint64, options SamplingOptions) (*Sampler, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("invalid n %d", n)
+	}
+	return newSampler(PolicyNth, options, func(s *Sampler, state *samplerState, now time.Time) bool {
+		state.seen++
+		return (state.seen-1)%n == 0
+	})
+}
+
+// NewProbabilitySampler creates a Sampler passing every event with
+// probability @p.
+func NewProbabilitySampler(p float64, options SamplingOptions) (*Sampler, error) {
+	if !(p > 0 && p <= 1) {
+		return nil, fmt.Errorf("invalid probability %v", p)
+	}
+	return newSampler(PolicyProbability, options, func(s *Sampler, state *samplerState, now time.Time) bool {
+		return s.rand.Float64() < p
+	})
+}
+
+func newSampler(policy string, options SamplingOptions, allow func(*Sampler, *samplerState, time.Time) bool) (*Sampler, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &Sampler{
+		policy:  policy,
+		options: options,
+		rand:    rand.New(options.Rand), //nolint:gosec // Sampling needs no secure source.
+		allow:   allow,
+		keys:    make(map[string]*samplerState),
+	}, nil
+}
+
+// Wrap returns an EventCallback passing sampled events to @callback.
+func (s *Sampler) Wrap(callback EventCallback) EventCallback {
+	return func(e *Event) {
+		if s.Allow(e) {
+			callback(e)
+		}
+	}
+}
+
+// Allow returns true if @e should be passed on.
+func (s *Sampler) Allow(e *Event) bool {
+	key := s.options.Key(e)
+
+	s.mu.Lock()
+	now := s.options.Now()
+	summaries := s.advance(now)
+	state, ok := s.keys[key]
+	if !ok {
+		if len(s.keys) >= s.options.MaxKeys {
+			key = SamplingOtherKey
+			state = s.keys[key]
+		}
+		if state == nil {
+			state = &samplerState{}
+			s.keys[key] = state
+		}
+	}
+	allowed := s.allow(s, state, now)
+	if allowed {
+		state.passed++
+	} else {
+		state.suppressed++
+	}
+	s.mu.Unlock()
+
+	s.report(summaries)
+	return allowed
+}
+
+// Flush reports summaries of the current interval and starts a new one.
+func (s *Sampler) Flush() {
+	s.mu.Lock()
+	now := s.options.Now()
+	summaries := s.summarize(now)
+	s.intervalStart = now
+	s.mu.Unlock()
+
+	s.report(summaries)
+}
+
+// advance closes the summary interval if @now is past it. Should be called
+// with mu held.
+func (s *Sampler) advance(now time.Time) []SamplingSummary {
+	if s.intervalStart.IsZero() {
+		s.intervalStart = now
+		return nil
+	}
+	elapsed := now.Sub(s.intervalStart)
+	if elapsed < s.options.SummaryInterval {
+		return nil
+	}
+	end := s.intervalStart.Add(s.options.SummaryInterval)
+	summaries := s.summarize(end)
+	// Keep intervals aligned even if there were no events for a while.
+	s.intervalStart = s.intervalStart.Add(elapsed / s.options.SummaryInterval * s.options.SummaryInterval)
+	return summaries
+}
+
+// summarize returns summaries of the interval ending at @end sorted by key,
+// resets counters and forgets idle keys. Should be called with mu held.
+func (s *Sampler) summarize(end time.Time) []SamplingSummary {
+	var summaries []SamplingSummary
+	for key, state := range s.keys {
+		if state.passed == 0 && state.suppressed == 0 {
+			delete(s.keys, key)
+			continue
+		}
+		if state.suppressed != 0 {
+			summaries = append(summaries, SamplingSummary{
+				Policy:     s.policy,
+				Key:        key,
+				Start:      s.intervalStart,
+				End:        end,
+				Passed:     state.passed,
+				Suppressed: state.suppressed,
+			})
+		}
+		state.passed, state.suppressed = 0, 0
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+	return summaries
+}
+
+func (s *Sampler) report(summaries []SamplingSummary) {
+	if s.options.OnSummary == nil {
+		return
+	}
+	for _, summary := range summaries {
+		s.options.OnSummary(summary)
+	}
+}
+
+// ReservoirSample is a uniform random sample of events of a key collected
+// during a window.
+type ReservoirSample struct {
+	Key   string
+	Start time.Time
+	End   time.Time
+
+	// Seen is the number of events of the key in the window.
+	Seen    uint64
+	Records []*Record
+}
+
+// Reservoir keeps a uniform random sample of up to a fixed number of events
+// of every key per window. Samples are known only once the window is over,
+// so events are copied to Records and reported by OnSample instead of being
+// passed to a callback.
+//
+// Windows are closed by the next event after the window end or by Flush.
+type Reservoir struct {
+	mu sync.Mutex
+
+	size     int
+	window   time.Duration
+	onSample func(ReservoirSample)
+	options  SamplingOptions
+	rand     *rand.Rand
+	record   func(e *Event) (*Record, error)
+
+	keys        map[string]*reservoirState
+	windowStart time.Time
+}
+
+// reservoirState is a sample of a single key.
+type reservoirState struct {
+	seen    uint64
+	records []*Record
+}
+
+// NewReservoir creates a Reservoir keeping @size events of every key per
+// @window and reporting them to @onSample. Zero @window defaults to 1m.
+// Options.SummaryInterval is ignored: summaries are reported per window.
+func NewReservoir(size int, window time.Duration, onSample func(ReservoirSample), options SamplingOptions) (*Reservoir, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("invalid window %v", window)
+	}
+	if onSample == nil {
+		return nil, fmt.Errorf("onSample is not set")
+	}
+	if window == 0 {
+		window = defaultReservoirWindow
+	}
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &Reservoir{
+		size:     size,
+		window:   window,
+		onSample: onSample,
+		options:  options,
+		rand:     rand.New(options.Rand), //nolint:gosec // Sampling needs no secure source.
+		record:   (*Event).Record,
+		keys:     make(map[string]*reservoirState),
+	}, nil
+}
+
+// Handle adds the event to the sample of its key. It's an EventCallback.
+func (r *Reservoir) Handle(e *Event) {
+	key := r.options.Key(e)
+
+	r.mu.Lock()
+	now := r.options.Now()
+	samples := r.advance(now)
+	state, ok := r.keys[key]
+	if !ok {
+		if len(r.keys) >= r.options.MaxKeys {
+			key = SamplingOtherKey
+			state = r.keys[key]
+		}
+		if state == nil {
+			state = &reservoirState{}
+			r.keys[key] = state
+		}
+	}
+
+	// Algorithm R: the n-th event replaces a random sample with probability
+	// size/n, so records are copied only for kept events.
+	state.seen++
+	slot := len(state.records)
+	if slot >= r.size {
+		slot = int(r.rand.Int63n(int64(state.seen)))
+	}
+	if slot < r.size {
+		// Records with properties failed to parse still have the header.
+		if record, _ := r.record(e); record != nil {
+			if slot == len(state.records) {
+				state.records = append(state.records, record)
+			} else {
+				state.records[slot] = record
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	r.report(samples)
+}
+
+// Flush reports samples of the current window and starts a new one.
+func (r *Reservoir) Flush() {
+	r.mu.Lock()
+	now := r.options.Now()
+	samples := r.collect(now)
+	r.windowStart = now
+	r.mu.Unlock()
+
+	r.report(samples)
+}
+
+// advance closes the window if @now is past it. Should be called with mu
+// held.
+func (r *Reservoir) advance(now time.Time) []ReservoirSample {
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+		return nil
+	}
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < r.window {
+		return nil
+	}
+	samples := r.collect(r.windowStart.Add(r.window))
+	r.windowStart = r.windowStart.Add(elapsed / r.window * r.window)
+	return samples
+}
+
+// collect returns samples of the window ending at @end sorted by key and
+// resets them. Should be called with mu held.
+func (r *Reservoir) collect(end time.Time) []ReservoirSample {
+	samples := make([]ReservoirSample, 0, len(r.keys))
+	for key, state := range r.keys {
+		samples = append(samples, ReservoirSample{
+			Key:     key,
+			Start:   r.windowStart,
+			End:     end,
+			Seen:    state.seen,
+			Records: state.records,
+		})
+	}
+	r.keys = make(map[string]*reservoirState)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Key < samples[j].Key })
+	return samples
+}
+
+func (r *Reservoir) report(samples []ReservoirSample) {
+	for _, sample := range samples {
+		r.onSample(sample)
+		kept := uint64(len(sample.Records))
+		if r.options.OnSummary != nil && sample.Seen > kept {
+			r.options.OnSummary(SamplingSummary{
+				Policy:     PolicyReservoir,
+				Key:        sample.Key,
+				Start:      sample.Start,
+				End:        sample.End,
+				Passed:     kept,
+				Suppressed: sample.Seen - kept,
+			})
+		}
+	}
+}
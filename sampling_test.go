@@ -0,0 +1,293 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestSampling(t *testing.T) {
+	suite.Run(t, new(samplingSuite))
+}
+
+type samplingSuite struct {
+	suite.Suite
+
+	now       time.Time
+	summaries []SamplingSummary
+}
+
+func (s *samplingSuite) SetupTest() {
+	s.now = time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.summaries = nil
+}
+
+// options returns options with the fake clock and a fixed random seed.
+func (s *samplingSuite) options(key SampleKey) SamplingOptions {
+	return SamplingOptions{
+		Key:             key,
+		SummaryInterval: 10 * time.Second,
+		OnSummary:       func(summary SamplingSummary) { s.summaries = append(s.summaries, summary) },
+		Now:             func() time.Time { return s.now },
+		Rand:            rand.NewSource(1),
+	}
+}
+
+func samplingEvent(provider windows.GUID, id uint16, pid uint32) *Event {
+	e := &Event{Header: EventHeader{ProviderID: provider, ProcessID: pid}}
+	e.Header.ID = id
+	return e
+}
+
+// pass returns IDs of events passed by @sampler.
+func pass(sampler *Sampler, events ...*Event) []uint16 {
+	var ids []uint16
+	cb := sampler.Wrap(func(e *Event) { ids = append(ids, e.Header.ID) })
+	for _, e := range events {
+		cb(e)
+	}
+	return ids
+}
+
+// TestRateLimiter ensures token buckets are refilled by the clock and keys
+// are limited independently.
+func (s *samplingSuite) TestRateLimiter() {
+	limiter, err := NewRateLimiter(2, 3, s.options(KeyProcessID))
+	s.Require().NoError(err)
+
+	burst := []*Event{
+		samplingEvent(testProviderA, 1, 10),
+		samplingEvent(testProviderA, 2, 10),
+		samplingEvent(testProviderA, 3, 10),
+		samplingEvent(testProviderA, 4, 10),
+		samplingEvent(testProviderA, 5, 20),
+	}
+	s.Equal([]uint16{1, 2, 3, 5}, pass(limiter, burst...))
+
+	s.now = s.now.Add(500 * time.Millisecond)
+	s.Equal([]uint16{6}, pass(limiter,
+		samplingEvent(testProviderA, 6, 10),
+		samplingEvent(testProviderA, 7, 10)))
+
+	s.now = s.now.Add(time.Hour)
+	s.Equal([]uint16{8, 9, 10}, pass(limiter,
+		samplingEvent(testProviderA, 8, 10),
+		samplingEvent(testProviderA, 9, 10),
+		samplingEvent(testProviderA, 10, 10),
+		samplingEvent(testProviderA, 11, 10)))
+
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.Equal([]SamplingSummary{{
+		Policy:     PolicyRateLimit,
+		Key:        "10",
+		Start:      start,
+		End:        start.Add(10 * time.Second),
+		Passed:     4,
+		Suppressed: 2,
+	}}, s.summaries, "Keys without suppressed events are not reported")
+
+	limiter.Flush()
+	s.Equal(SamplingSummary{
+		Policy:     PolicyRateLimit,
+		Key:        "10",
+		Start:      start.Add(time.Hour),
+		End:        s.now,
+		Passed:     3,
+		Suppressed: 1,
+	}, s.summaries[1], "Intervals are aligned")
+	s.Len(limiter.keys, 1, "Idle keys are forgotten")
+
+	limiter, err = NewRateLimiter(2.5, 0, s.options(nil))
+	s.Require().NoError(err)
+	s.Equal([]uint16{1, 2, 3}, pass(limiter,
+		samplingEvent(testProviderA, 1, 10),
+		samplingEvent(testProviderB, 2, 20),
+		samplingEvent(testProviderA, 3, 30),
+		samplingEvent(testProviderA, 4, 40)), "A second worth of events by default")
+}
+
+// TestNth ensures every n-th event of a key passes.
+func (s *samplingSuite) TestNth() {
+	sampler, err := NewNthSampler(3, s.options(Keys(KeyProvider, KeyEventID)))
+	s.Require().NoError(err)
+
+	var events []*Event
+	for i := 0; i < 7; i++ {
+		events = append(events, samplingEvent(testProviderA, 1, uint32(i)))
+	}
+	events = append(events, samplingEvent(testProviderB, 1, 100), samplingEvent(testProviderA, 2, 200))
+
+	var pids []uint32
+	cb := sampler.Wrap(func(e *Event) { pids = append(pids, e.Header.ProcessID) })
+	for _, e := range events {
+		cb(e)
+	}
+	s.Equal([]uint32{0, 3, 6, 100, 200}, pids)
+
+	sampler.Flush()
+	s.Require().Len(s.summaries, 1)
+	s.Equal(testProviderA.String()+"/1", s.summaries[0].Key)
+	s.Equal(uint64(3), s.summaries[0].Passed)
+	s.Equal(uint64(4), s.summaries[0].Suppressed)
+	s.Equal(PolicyNth, s.summaries[0].Policy)
+}
+
+// TestProbability ensures sampling is random but deterministic for a seed.
+func (s *samplingSuite) TestProbability() {
+	run := func() []uint16 {
+		sampler, err := NewProbabilitySampler(0.25, s.options(nil))
+		s.Require().NoError(err)
+		var events []*Event
+		for id := uint16(0); id < 1000; id++ {
+			events = append(events, samplingEvent(testProviderA, id, 1))
+		}
+		return pass(sampler, events...)
+	}
+	ids := run()
+	s.InDelta(250, len(ids), 50)
+	s.Equal(ids, run())
+
+	sampler, err := NewProbabilitySampler(1, s.options(nil))
+	s.Require().NoError(err)
+	s.Len(pass(sampler, samplingEvent(testProviderA, 1, 1), samplingEvent(testProviderA, 2, 1)), 2)
+}
+
+// TestReservoir ensures samples are bounded, uniform and reported per window.
+func (s *samplingSuite) TestReservoir() {
+	var samples []ReservoirSample
+	r, err := NewReservoir(2, time.Second, func(sample ReservoirSample) {
+		samples = append(samples, sample)
+	}, s.options(KeyProvider))
+	s.Require().NoError(err)
+	// Outside of a trace events can't be copied, so copy headers only.
+	copies := 0
+	r.record = func(e *Event) (*Record, error) {
+		copies++
+		return &Record{Header: e.Header}, nil
+	}
+
+	for id := uint16(0); id < 100; id++ {
+		r.Handle(samplingEvent(testProviderA, id, 1))
+	}
+	r.Handle(samplingEvent(testProviderB, 1000, 1))
+	s.Empty(samples, "Window is not over yet")
+	s.Less(copies, 20, "Only kept events are copied")
+
+	s.now = s.now.Add(1500 * time.Millisecond)
+	r.Handle(samplingEvent(testProviderA, 2000, 1))
+	s.Require().Len(samples, 2)
+
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	a, b := samples[0], samples[1]
+	if a.Key != testProviderA.String() {
+		a, b = b, a
+	}
+	s.Equal(uint64(100), a.Seen)
+	s.Equal(start, a.Start)
+	s.Equal(start.Add(time.Second), a.End)
+	s.Len(a.Records, 2)
+	s.NotEqual(a.Records[0].Header.ID, a.Records[1].Header.ID)
+	s.Equal(uint64(1), b.Seen)
+	s.Equal(uint16(1000), b.Records[0].Header.ID)
+
+	s.Equal([]SamplingSummary{{
+		Policy:     PolicyReservoir,
+		Key:        testProviderA.String(),
+		Start:      start,
+		End:        start.Add(time.Second),
+		Passed:     2,
+		Suppressed: 98,
+	}}, s.summaries)
+
+	r.Flush()
+	s.Require().Len(samples, 3)
+	s.Equal(start.Add(time.Second), samples[2].Start)
+	s.Equal(s.now, samples[2].End)
+	s.Equal(uint16(2000), samples[2].Records[0].Header.ID)
+
+	// The sample is uniform: every event is kept with the same probability.
+	kept := make(map[uint16]int)
+	for i := 0; i < 2000; i++ {
+		for id := uint16(0); id < 4; id++ {
+			r.Handle(samplingEvent(testProviderA, id, 1))
+		}
+		r.Flush()
+		for _, record := range samples[len(samples)-1].Records {
+			kept[record.Header.ID]++
+		}
+	}
+	for id := uint16(0); id < 4; id++ {
+		s.InDelta(1000, kept[id], 150, "Event %d", id)
+	}
+}
+
+// TestMaxKeys ensures new keys share the other key once the limit is hit.
+func (s *samplingSuite) TestMaxKeys() {
+	options := s.options(KeyEventID)
+	options.MaxKeys = 2
+	sampler, err := NewNthSampler(2, options)
+	s.Require().NoError(err)
+
+	var events []*Event
+	for id := uint16(1); id <= 6; id++ {
+		events = append(events, samplingEvent(testProviderA, id, 1))
+	}
+	s.Equal([]uint16{1, 2, 3, 5}, pass(sampler, events...))
+	sampler.Flush()
+	s.Require().Len(s.summaries, 1)
+	s.Equal(SamplingOtherKey, s.summaries[0].Key)
+	s.Equal(uint64(2), s.summaries[0].Suppressed)
+}
+
+// TestChain ensures middleware is applied in order and keys are combined.
+func (s *samplingSuite) TestChain() {
+	nth, err := NewNthSampler(2, s.options(nil))
+	s.Require().NoError(err)
+	limiter, err := NewRateLimiter(1, 2, s.options(nil))
+	s.Require().NoError(err)
+
+	var ids []uint16
+	cb := Chain(func(e *Event) { ids = append(ids, e.Header.ID) }, nth.Wrap, limiter.Wrap)
+	for id := uint16(1); id <= 8; id++ {
+		cb(samplingEvent(testProviderA, id, 1))
+	}
+	s.Equal([]uint16{1, 3}, ids)
+
+	e := samplingEvent(testProviderA, 7, 42)
+	key := Keys(KeyProvider, KeyEventID, KeyProcessID, KeyProperties("A", "B"))
+	s.Equal(testProviderA.String()+"/7/42//", key(e), "Properties can't be parsed outside of a trace")
+}
+
+// TestOptions ensures invalid settings are rejected.
+func (s *samplingSuite) TestOptions() {
+	var err error
+	_, err = NewRateLimiter(0, 1, SamplingOptions{})
+	s.Error(err)
+	_, err = NewRateLimiter(1, -1, SamplingOptions{})
+	s.Error(err)
+	_, err = NewNthSampler(0, SamplingOptions{})
+	s.Error(err)
+	_, err = NewProbabilitySampler(0, SamplingOptions{})
+	s.Error(err)
+	_, err = NewProbabilitySampler(1.5, SamplingOptions{})
+	s.Error(err)
+	_, err = NewReservoir(0, time.Second, func(ReservoirSample) {}, SamplingOptions{})
+	s.Error(err)
+	_, err = NewReservoir(1, time.Second, nil, SamplingOptions{})
+	s.Error(err)
+	_, err = NewNthSampler(1, SamplingOptions{MaxKeys: -1})
+	s.Error(err)
+	_, err = NewNthSampler(1, SamplingOptions{SummaryInterval: -time.Second})
+	s.Error(err)
+
+	r, err := NewReservoir(1, 0, func(ReservoirSample) {}, SamplingOptions{})
+	s.Require().NoError(err)
+	s.Equal(defaultReservoirWindow, r.window)
+	s.Equal(defaultSamplingMaxKeys, r.options.MaxKeys)
+}
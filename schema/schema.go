@@ -0,0 +1,202 @@
+// Package schema defines a platform independent model of ETW events. It's
+// shared by encoders and readers of event formats, so they could be used and
+// tested on any platform.
+//
+// On Windows etw.Record.Schema converts received events to this model.
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GUID has the same layout as windows.GUID, so they are convertible to each
+// other.
+type GUID struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+// String formats the GUID in the registry format as windows.GUID does:
+// {XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX}.
+func (g GUID) String() string {
+	return fmt.Sprintf("{%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X}",
+		g.Data1, g.Data2, g.Data3,
+		g.Data4[0], g.Data4[1], g.Data4[2], g.Data4[3],
+		g.Data4[4], g.Data4[5], g.Data4[6], g.Data4[7])
+}
+
+// IsZero tells if the GUID is not set.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// ParseGUID parses a GUID in the registry format with or without braces.
+func ParseGUID(s string) (GUID, error) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	var g GUID
+	var d4 [8]uint8
+	n, err := fmt.Sscanf(trimmed, "%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		&g.Data1, &g.Data2, &g.Data3,
+		&d4[0], &d4[1], &d4[2], &d4[3], &d4[4], &d4[5], &d4[6], &d4[7])
+	if err != nil || n != 11 || len(trimmed) != 36 {
+		return GUID{}, fmt.Errorf("invalid GUID %q", s)
+	}
+	g.Data4 = d4
+	// Sscanf ignores trailing garbage, so make sure the whole string is used.
+	if !strings.EqualFold(g.String()[1:37], trimmed) {
+		return GUID{}, fmt.Errorf("invalid GUID %q", s)
+	}
+	return g, nil
+}
+
+// Event is a decoded event.
+type Event struct {
+	Header Header
+
+	// ProviderName is the name of the provider if known.
+	ProviderName string
+
+	// Properties are decoded event data in the order of the event schema if
+	// it's known or sorted by name otherwise.
+	Properties []Property
+
+	Extended Extended
+}
+
+// Property is a single named value of the event data. Value is one of:
+//   - string or a Go number, bool, time.Time for scalar values;
+//   - []interface{} or []string for arrays;
+//   - []Property or map[string]interface{} for structures.
+type Property struct {
+	Name  string
+	Value interface{}
+}
+
+// Property returns a value of the top level property @name.
+func (e *Event) Property(name string) (interface{}, bool) {
+	for _, p := range e.Properties {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Title is a short human readable description of the event: the provider
+// name, or the GUID if it's unknown, and the event ID.
+func (e *Event) Title() string {
+	name := e.ProviderName
+	if name == "" {
+		name = e.Header.ProviderID.String()
+	}
+	return fmt.Sprintf("%s event %d", name, e.Header.ID)
+}
+
+// Descriptor mirrors etw.EventDescriptor.
+type Descriptor struct {
+	ID      uint16
+	Version uint8
+	Channel uint8
+	Level   uint8
+	OpCode  uint8
+	Task    uint16
+	Keyword uint64
+}
+
+// Header mirrors etw.EventHeader.
+type Header struct {
+	Descriptor
+
+	ThreadID  uint32
+	ProcessID uint32
+	TimeStamp time.Time
+
+	ProviderID GUID
+	ActivityID GUID
+
+	Flags         uint16
+	KernelTime    uint32
+	UserTime      uint32
+	ProcessorTime uint64
+
+	// Rundown and DuringCaptureState mirror etw.EventHeader: the event
+	// describes the provider state (DC_Start/DC_Stop opcodes) or was written
+	// while the state was requested.
+	Rundown            bool
+	DuringCaptureState bool
+}
+
+// Extended mirrors etw.ExtendedEventInfo. All fields are optional.
+type Extended struct {
+	SessionID    *uint32
+	ActivityID   *GUID
+	UserSID      string // In the S-1-5-... form.
+	InstanceInfo *InstanceInfo
+	StackTrace   *StackTrace
+}
+
+// InstanceInfo mirrors etw.EventInstanceInfo.
+type InstanceInfo struct {
+	InstanceID       uint32
+	ParentInstanceID uint32
+	ParentGUID       GUID
+}
+
+// StackTrace mirrors etw.EventStackTrace.
+type StackTrace struct {
+	MatchedID      uint64
+	Addresses      []uint64
+	KernelFrames   int
+	KernelStackKey uint64
+	UserStackKey   uint64
+}
+
+// Standard event levels.
+const (
+	LevelLogAlways   = 0
+	LevelCritical    = 1
+	LevelError       = 2
+	LevelWarning     = 3
+	LevelInformation = 4
+	LevelVerbose     = 5
+)
+
+// LevelName returns the standard name of the @level as Event Viewer shows it
+// or the number for custom levels.
+func LevelName(level uint8) string {
+	switch level {
+	case LevelLogAlways:
+		return "LogAlways"
+	case LevelCritical:
+		return "Critical"
+	case LevelError:
+		return "Error"
+	case LevelWarning:
+		return "Warning"
+	case LevelInformation:
+		return "Information"
+	case LevelVerbose:
+		return "Verbose"
+	default:
+		return fmt.Sprintf("%d", level)
+	}
+}
+
+// FILETIME is a number of 100-nanosecond intervals since January 1, 1601
+// (UTC). fileTimeEpochDelta is the number of such intervals before the Unix
+// epoch.
+const fileTimeEpochDelta = 116444736000000000
+
+// ToFileTime converts @t to FILETIME.
+func ToFileTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100 + fileTimeEpochDelta)
+}
+
+// FromFileTime converts FILETIME @ft to time.Time.
+func FromFileTime(ft uint64) time.Time {
+	return time.Unix(0, (int64(ft)-fileTimeEpochDelta)*100).UTC()
+}
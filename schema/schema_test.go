@@ -0,0 +1,67 @@
+package schema
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSchema(t *testing.T) {
+	suite.Run(t, new(schemaSuite))
+}
+
+type schemaSuite struct {
+	suite.Suite
+}
+
+// TestGUID ensures GUIDs are formatted and parsed in the registry format.
+func (s *schemaSuite) TestGUID() {
+	g := GUID{
+		Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+		Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+	}
+	s.Equal("{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}", g.String())
+
+	for _, str := range []string{
+		"{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716}",
+		"22fb2cd6-0e7b-422b-a0c7-2fad1fd0e716",
+	} {
+		parsed, err := ParseGUID(str)
+		s.Require().NoError(err, str)
+		s.Equal(g, parsed, str)
+	}
+
+	for _, str := range []string{"", "{22FB2CD6-0E7B-422B-A0C7}", "22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E71Z"} {
+		_, err := ParseGUID(str)
+		s.Error(err, str)
+	}
+	s.True(GUID{}.IsZero())
+	s.False(g.IsZero())
+}
+
+// TestFileTime ensures FILETIME conversion keeps 100ns precision.
+func (s *schemaSuite) TestFileTime() {
+	t := time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC)
+	s.Equal(uint64(132593079671234567), ToFileTime(t))
+	s.Equal(t, FromFileTime(ToFileTime(t)))
+	s.Equal(time.Unix(0, 0).UTC(), FromFileTime(fileTimeEpochDelta))
+}
+
+// TestTitle ensures events are named by the provider GUID if the name is
+// unknown.
+func (s *schemaSuite) TestTitle() {
+	e := &Event{
+		Header: Header{
+			Descriptor: Descriptor{ID: 1},
+			ProviderID: GUID{
+				Data1: 0x22FB2CD6, Data2: 0x0E7B, Data3: 0x422B,
+				Data4: [8]byte{0xA0, 0xC7, 0x2F, 0xAD, 0x1F, 0xD0, 0xE7, 0x16},
+			},
+		},
+		ProviderName: "Microsoft-Windows-Kernel-Process",
+	}
+	s.Equal("Microsoft-Windows-Kernel-Process event 1", e.Title())
+	e.ProviderName = ""
+	s.Equal("{22FB2CD6-0E7B-422B-A0C7-2FAD1FD0E716} event 1", e.Title())
+}
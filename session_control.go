@@ -0,0 +1,216 @@
+//go:build windows
+// +build windows
+
+package etw
+
+/*
+	#include "etw.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Session and log file names are limited to 1024 characters.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ns-evntrace-event_trace_properties#remarks
+const (
+	maxSessionNameLength = 1024
+	maxLogFileNameLength = 1024
+
+	// MAXLOGGERS is the limit on the array size of QueryAllTracesW, larger
+	// arrays are not accepted.
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-queryalltracesw
+	maxLoggers = 64
+)
+
+// etwSessionControl is a sessionControl implemented with the ETW API.
+type etwSessionControl struct{}
+
+func (etwSessionControl) query(name string) (SessionInfo, error) {
+	pProperties := newQueryProperties()
+	if err := controlTraceByName(name, pProperties, C.EVENT_TRACE_CONTROL_QUERY); err != nil {
+		return SessionInfo{}, err
+	}
+	return sessionInfoFromProperties(pProperties), nil
+}
+
+// queryAll returns ERROR_MORE_DATA if there are more than maxLoggers sessions
+// as QueryAllTracesW can't list them.
+func (etwSessionControl) queryAll() ([]SessionInfo, error) {
+	return queryAllTraces(maxLoggers)
+}
+
+func (etwSessionControl) update(name string, info SessionInfo) error {
+	props := info.updateProperties()
+
+	pProperties := newQueryProperties()
+	pProperties.BufferSize = C.ulong(props.BufferSize)
+	pProperties.MinimumBuffers = C.ulong(props.MinimumBuffers)
+	pProperties.MaximumBuffers = C.ulong(props.MaximumBuffers)
+	pProperties.FlushTimer = C.ulong(props.FlushTimer)
+	pProperties.LogFileMode = C.ulong(props.LogFileMode)
+	// Kernel sessions treat missing flags as a request to disable providers.
+	pProperties.EnableFlags = C.ulong(info.EnableFlags)
+
+	return controlTraceByName(name, pProperties, C.EVENT_TRACE_CONTROL_UPDATE)
+}
+
+func (etwSessionControl) flush(name string) error {
+	return controlTraceByName(name, newQueryProperties(), C.EVENT_TRACE_CONTROL_FLUSH)
+}
+
+func (etwSessionControl) stop(name string) error {
+	err := controlTraceByName(name, newQueryProperties(), C.EVENT_TRACE_CONTROL_STOP)
+
+	// If you receive ERROR_MORE_DATA when stopping the session, ETW will have
+	// already stopped the session before generating this error.
+	// https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-controltracew
+	if err == windows.ERROR_MORE_DATA {
+		return nil
+	}
+	return err
+}
+
+// controlTraceByName issues ControlTraceW with a given @controlCode for the
+// session named @name. Properties returned by the OS are written to
+// @pProperties. Returned error is a raw windows.Errno.
+func controlTraceByName(name string, pProperties C.PEVENT_TRACE_PROPERTIES, controlCode C.ULONG) error {
+	utf16Name, err := windows.UTF16FromString(name)
+	if err != nil {
+		return fmt.Errorf("incorrect session name; %w", err)
+	}
+
+	// ULONG WMIAPI ControlTraceW(
+	//  TRACEHANDLE             TraceHandle,
+	//  LPCWSTR                 InstanceName,
+	//  PEVENT_TRACE_PROPERTIES Properties,
+	//  ULONG                   ControlCode
+	// );
+	ret := C.ControlTraceW(
+		0,
+		(*C.ushort)(unsafe.Pointer(&utf16Name[0])),
+		pProperties,
+		controlCode)
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
+		return status
+	}
+	return nil
+}
+
+// queryAllTraces wraps QueryAllTracesW expecting no more than @count
+// sessions. Returns ERROR_MORE_DATA if there are more.
+func queryAllTraces(count int) ([]SessionInfo, error) {
+	propertiesSize := queryPropertiesSize()
+
+	// QueryAllTracesW expects an array of pointers to properties buffers.
+	// Keep the whole thing in C memory not to violate cgo pointer rules.
+	buf := C.calloc(C.size_t(count), C.size_t(propertiesSize))
+	if buf == nil {
+		return nil, fmt.Errorf("calloc(%d, %d) failed", count, propertiesSize)
+	}
+	defer C.free(buf)
+
+	arrayBuf := C.calloc(C.size_t(count), C.size_t(unsafe.Sizeof(C.PEVENT_TRACE_PROPERTIES(nil))))
+	if arrayBuf == nil {
+		return nil, fmt.Errorf("calloc(%d) failed", count)
+	}
+	defer C.free(arrayBuf)
+
+	array := (*[1 << 20]C.PEVENT_TRACE_PROPERTIES)(arrayBuf)[:count:count]
+	for i := range array {
+		array[i] = (C.PEVENT_TRACE_PROPERTIES)(unsafe.Pointer(uintptr(buf) + uintptr(i*propertiesSize)))
+		initQueryProperties(array[i], propertiesSize)
+	}
+
+	// ULONG WMIAPI QueryAllTracesW(
+	//  PEVENT_TRACE_PROPERTIES *PropertyArray,
+	//  ULONG                   PropertyArrayCount,
+	//  PULONG                  LoggerCount
+	// );
+	var loggerCount C.ULONG
+	ret := C.QueryAllTracesW(&array[0], C.ULONG(count), &loggerCount)
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
+		return nil, status
+	}
+
+	sessions := make([]SessionInfo, int(loggerCount))
+	for i := range sessions {
+		sessions[i] = sessionInfoFromProperties(array[i])
+	}
+	return sessions, nil
+}
+
+// queryPropertiesSize returns a size of EVENT_TRACE_PROPERTIES buffer large
+// enough to receive session and log file names of any session.
+func queryPropertiesSize() int {
+	const wcharSize = int(unsafe.Sizeof(uint16(0)))
+	return int(unsafe.Sizeof(C.EVENT_TRACE_PROPERTIES{})) +
+		(maxSessionNameLength+maxLogFileNameLength)*wcharSize
+}
+
+// newQueryProperties allocates EVENT_TRACE_PROPERTIES ready to be filled by
+// the OS with any session info.
+func newQueryProperties() C.PEVENT_TRACE_PROPERTIES {
+	bufSize := queryPropertiesSize()
+	propertiesBuf := make([]byte, bufSize)
+	pProperties := (C.PEVENT_TRACE_PROPERTIES)(unsafe.Pointer(&propertiesBuf[0]))
+	initQueryProperties(pProperties, bufSize)
+	return pProperties
+}
+
+// initQueryProperties prepares zeroed properties buffer of @bufSize to be
+// filled by the OS.
+func initQueryProperties(p C.PEVENT_TRACE_PROPERTIES, bufSize int) {
+	const wcharSize = int(unsafe.Sizeof(uint16(0)))
+	propertiesSize := int(unsafe.Sizeof(C.EVENT_TRACE_PROPERTIES{}))
+
+	p.Wnode.BufferSize = C.ulong(bufSize)
+	p.LoggerNameOffset = C.ulong(propertiesSize)
+	p.LogFileNameOffset = C.ulong(propertiesSize + maxSessionNameLength*wcharSize)
+}
+
+// sessionInfoFromProperties translates properties filled by the OS to Go.
+func sessionInfoFromProperties(p C.PEVENT_TRACE_PROPERTIES) SessionInfo {
+	props := sessionProperties{
+		BufferSize:     uint32(p.BufferSize),
+		MinimumBuffers: uint32(p.MinimumBuffers),
+		MaximumBuffers: uint32(p.MaximumBuffers),
+		FlushTimer:     uint32(p.FlushTimer),
+		LogFileMode:    uint32(p.LogFileMode),
+	}
+	stats := TraceStats{
+		EventsLost:          uint32(p.EventsLost),
+		BuffersWritten:      uint32(p.BuffersWritten),
+		LogBuffersLost:      uint32(p.LogBuffersLost),
+		RealTimeBuffersLost: uint32(p.RealTimeBuffersLost),
+		NumberOfBuffers:     uint32(p.NumberOfBuffers),
+		FreeBuffers:         uint32(p.FreeBuffers),
+	}
+	if stats.NumberOfBuffers > stats.FreeBuffers {
+		stats.BuffersInUse = stats.NumberOfBuffers - stats.FreeBuffers
+	}
+
+	return SessionInfo{
+		Name:        propertiesString(p, p.LoggerNameOffset),
+		LogFileName: propertiesString(p, p.LogFileNameOffset),
+		Options:     props.traceOptions(),
+		LogFileMode: props.LogFileMode,
+		EnableFlags: uint32(p.EnableFlags),
+		Stats:       stats,
+	}
+}
+
+// propertiesString extracts a string placed at @offset of properties buffer.
+func propertiesString(p C.PEVENT_TRACE_PROPERTIES, offset C.ulong) string {
+	if offset == 0 {
+		return ""
+	}
+	ptr := uintptr(unsafe.Pointer(p)) + uintptr(offset)
+	length := C.wcslen((C.PWCHAR)(unsafe.Pointer(ptr)))
+	return createUTF16String(ptr, int(length))
+}
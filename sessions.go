@@ -0,0 +1,192 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SessionInfo describes an ETW session running in the system. Sessions are
+// not necessary created by this package, so SessionInfo could be used to
+// find sessions leaked by crashed processes.
+type SessionInfo struct {
+	// Name is the session name (the one passed to NewUserTrace and others).
+	Name string
+
+	// LogFileName is a path of the log file if the session writes one.
+	LogFileName string
+
+	// Options holds current buffering settings of the session.
+	Options TraceOptions
+
+	// LogFileMode is a raw set of EVENT_TRACE_*_MODE flags of the session.
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/logging-mode-constants
+	LogFileMode uint32
+
+	// EnableFlags is a set of EVENT_TRACE_FLAG_* enabled for kernel sessions.
+	EnableFlags uint32
+
+	// Stats contains OS-level session counters. In-stream counters of
+	// TraceStats are always zero here.
+	Stats TraceStats
+}
+
+// IsKernel tells if the session is a kernel (system logger) session.
+func (s SessionInfo) IsKernel() bool {
+	return s.LogFileMode&eventTraceSystemLoggerMode != 0
+}
+
+// IsRealTime tells if the session delivers events in real time.
+func (s SessionInfo) IsRealTime() bool {
+	return s.LogFileMode&eventTraceRealTimeMode != 0
+}
+
+// sessionControl wraps ETW API controlling sessions by name. It's an
+// interface to be able to test the logic on top of it without an actual
+// session.
+type sessionControl interface {
+	query(name string) (SessionInfo, error)
+	queryAll() ([]SessionInfo, error)
+	update(name string, info SessionInfo) error
+	flush(name string) error
+	stop(name string) error
+}
+
+// QuerySessions returns all ETW sessions running in the system. It fails with
+// windows.ERROR_MORE_DATA if there are more than 64 of them, the most
+// QueryAllTracesW could list.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-queryalltracesw
+func QuerySessions() ([]SessionInfo, error) {
+	return querySessions(etwSessionControl{})
+}
+
+// QuerySession returns info about the running session with a given @name.
+func QuerySession(name string) (SessionInfo, error) {
+	return querySession(etwSessionControl{}, name)
+}
+
+// FlushSession forces the session with a given @name to deliver its
+// non-empty buffers to consumers.
+func FlushSession(name string) error {
+	return flushSession(etwSessionControl{}, name)
+}
+
+// UpdateSession changes buffering settings of the running session with a
+// given @name. Zero fields of @options are left untouched.
+//
+// Only MaximumBuffers and FlushTimer could be changed on a live session, so
+// UpdateSession fails if BufferSize or MinimumBuffers differ from the
+// current ones.
+func UpdateSession(name string, options TraceOptions) error {
+	return updateSession(etwSessionControl{}, name, options)
+}
+
+// StopSession stops the session with a given @name. As well as Trace.Kill it
+// doesn't disable providers gracefully, so use it only for sessions you've
+// lost control over.
+func StopSession(name string) error {
+	return stopSession(etwSessionControl{}, name)
+}
+
+func querySessions(control sessionControl) ([]SessionInfo, error) {
+	sessions, err := control.queryAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions; %w", err)
+	}
+	return sessions, nil
+}
+
+func querySession(control sessionControl, name string) (SessionInfo, error) {
+	info, err := control.query(name)
+	if err != nil {
+		return SessionInfo{}, fmt.Errorf("failed to query session %q; %w", name, err)
+	}
+	return info, nil
+}
+
+func flushSession(control sessionControl, name string) error {
+	if err := control.flush(name); err != nil {
+		return fmt.Errorf("failed to flush session %q; %w", name, err)
+	}
+	return nil
+}
+
+func updateSession(control sessionControl, name string, options TraceOptions) error {
+	current, err := querySession(control, name)
+	if err != nil {
+		return err
+	}
+	updated, err := mergeSessionUpdate(current, options)
+	if err != nil {
+		return fmt.Errorf("can't update session %q; %w", name, err)
+	}
+	if err := control.update(name, updated); err != nil {
+		return fmt.Errorf("failed to update session %q; %w", name, err)
+	}
+	return nil
+}
+
+func stopSession(control sessionControl, name string) error {
+	if err := control.stop(name); err != nil {
+		return fmt.Errorf("failed to stop session %q; %w", name, err)
+	}
+	return nil
+}
+
+// mergeSessionUpdate applies non-zero @options to the @current session
+// settings checking that only tunable properties are changed.
+func mergeSessionUpdate(current SessionInfo, options TraceOptions) (SessionInfo, error) {
+	if err := options.Validate(); err != nil {
+		return SessionInfo{}, err
+	}
+	if options.BufferSize != 0 && options.BufferSize != current.Options.BufferSize {
+		return SessionInfo{}, errors.New("BufferSize can't be changed on a running session")
+	}
+	if options.MinimumBuffers != 0 && options.MinimumBuffers != current.Options.MinimumBuffers {
+		return SessionInfo{}, errors.New("MinimumBuffers can't be changed on a running session")
+	}
+
+	updated := current
+	if options.MaximumBuffers != 0 {
+		if options.MaximumBuffers < current.Options.MinimumBuffers {
+			return SessionInfo{}, fmt.Errorf("MaximumBuffers (%d) is less than MinimumBuffers (%d) of the session",
+				options.MaximumBuffers, current.Options.MinimumBuffers)
+		}
+		updated.Options.MaximumBuffers = options.MaximumBuffers
+	}
+	if options.FlushTimer != 0 {
+		updated.Options.FlushTimer = options.FlushTimer
+	}
+	return updated, nil
+}
+
+// traceOptions translates EVENT_TRACE_PROPERTIES values back to TraceOptions.
+func (p sessionProperties) traceOptions() TraceOptions {
+	flushUnit := time.Second
+	if p.LogFileMode&eventTraceUseMsFlushTimer != 0 {
+		flushUnit = time.Millisecond
+	}
+	return TraceOptions{
+		BufferSize:     p.BufferSize,
+		MinimumBuffers: p.MinimumBuffers,
+		MaximumBuffers: p.MaximumBuffers,
+		FlushTimer:     time.Duration(p.FlushTimer) * flushUnit,
+	}
+}
+
+// updateProperties returns EVENT_TRACE_PROPERTIES values to be passed with
+// EVENT_TRACE_CONTROL_UPDATE for the session @info.
+//
+// Current session values are not validated: sessions created by other tools
+// could be configured beyond TraceOptions limits.
+func (s SessionInfo) updateProperties() sessionProperties {
+	props := s.Options.properties()
+	// Keep the session mode, only flush timer units are controlled by options.
+	props.LogFileMode = s.LogFileMode&^eventTraceUseMsFlushTimer | props.LogFileMode&eventTraceUseMsFlushTimer
+	return props
+}
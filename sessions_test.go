@@ -0,0 +1,217 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestSessions(t *testing.T) {
+	suite.Run(t, new(sessionsSuite))
+}
+
+type sessionsSuite struct {
+	suite.Suite
+}
+
+// fakeSessionControl is an in-memory sessionControl simulating sessions
+// registered in the system. A missing session is reported the same way as
+// the OS does: with ERROR_WMI_INSTANCE_NOT_FOUND.
+type fakeSessionControl struct {
+	mu       sync.Mutex
+	sessions map[string]SessionInfo
+	flushes  map[string]int
+}
+
+func newFakeSessionControl(sessions ...SessionInfo) *fakeSessionControl {
+	f := &fakeSessionControl{
+		sessions: make(map[string]SessionInfo),
+		flushes:  make(map[string]int),
+	}
+	for _, s := range sessions {
+		f.sessions[s.Name] = s
+	}
+	return f
+}
+
+func (f *fakeSessionControl) query(name string) (SessionInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, ok := f.sessions[name]
+	if !ok {
+		return SessionInfo{}, windows.ERROR_WMI_INSTANCE_NOT_FOUND
+	}
+	return info, nil
+}
+
+func (f *fakeSessionControl) queryAll() ([]SessionInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(f.sessions))
+	for _, info := range f.sessions {
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return sessions, nil
+}
+
+func (f *fakeSessionControl) update(name string, info SessionInfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sessions[name]; !ok {
+		return windows.ERROR_WMI_INSTANCE_NOT_FOUND
+	}
+	f.sessions[name] = info
+	return nil
+}
+
+func (f *fakeSessionControl) flush(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sessions[name]; !ok {
+		return windows.ERROR_WMI_INSTANCE_NOT_FOUND
+	}
+	f.flushes[name]++
+	return nil
+}
+
+func (f *fakeSessionControl) stop(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sessions[name]; !ok {
+		return windows.ERROR_WMI_INSTANCE_NOT_FOUND
+	}
+	delete(f.sessions, name)
+	return nil
+}
+
+// set adds or replaces a session.
+func (f *fakeSessionControl) set(info SessionInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[info.Name] = info
+}
+
+func (f *fakeSessionControl) exists(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.sessions[name]
+	return ok
+}
+
+// TestQuery ensures sessions could be listed and found by name.
+func (s *sessionsSuite) TestQuery() {
+	leaked := SessionInfo{
+		Name:        "go-etw-leaked",
+		Options:     TraceOptions{BufferSize: 64, MinimumBuffers: 4, MaximumBuffers: 16, FlushTimer: time.Second},
+		LogFileMode: defaultLogFileMode,
+	}
+	kernel := SessionInfo{
+		Name:        "go-etw-kernel",
+		LogFileMode: defaultLogFileMode | eventTraceSystemLoggerMode,
+		EnableFlags: 0x1,
+	}
+	control := newFakeSessionControl(leaked, kernel)
+
+	sessions, err := querySessions(control)
+	s.Require().NoError(err)
+	s.Equal([]SessionInfo{kernel, leaked}, sessions)
+
+	info, err := querySession(control, "go-etw-leaked")
+	s.Require().NoError(err)
+	s.Equal(leaked, info)
+	s.True(info.IsRealTime())
+	s.False(info.IsKernel())
+
+	info, err = querySession(control, "go-etw-kernel")
+	s.Require().NoError(err)
+	s.True(info.IsKernel())
+
+	_, err = querySession(control, "go-etw-missing")
+	s.True(errors.Is(err, windows.ERROR_WMI_INSTANCE_NOT_FOUND), "Unexpected error: %s", err)
+}
+
+// TestFlushAndStop ensures flush and stop are routed to the proper session.
+func (s *sessionsSuite) TestFlushAndStop() {
+	control := newFakeSessionControl(SessionInfo{Name: "go-etw-leaked"})
+
+	s.Require().NoError(flushSession(control, "go-etw-leaked"))
+	s.Require().NoError(flushSession(control, "go-etw-leaked"))
+	s.Equal(2, control.flushes["go-etw-leaked"])
+	s.Error(flushSession(control, "go-etw-missing"))
+
+	s.Require().NoError(stopSession(control, "go-etw-leaked"))
+	s.False(control.exists("go-etw-leaked"))
+	s.Error(stopSession(control, "go-etw-leaked"))
+
+	// Kill should use the same session control.
+	control.set(SessionInfo{Name: "go-etw-leaked"})
+	trace, err := NewUserTrace("go-etw-leaked", nil)
+	s.Require().NoError(err)
+	trace.control = control
+	s.Require().NoError(trace.Kill())
+	s.False(control.exists("go-etw-leaked"))
+}
+
+// TestUpdate ensures only tunable properties could be changed and unchanged
+// ones are preserved.
+func (s *sessionsSuite) TestUpdate() {
+	original := SessionInfo{
+		Name:        "go-etw-kernel",
+		Options:     TraceOptions{BufferSize: 64, MinimumBuffers: 4, MaximumBuffers: 16, FlushTimer: time.Second},
+		LogFileMode: defaultLogFileMode | eventTraceSystemLoggerMode,
+		EnableFlags: 0x1,
+	}
+	control := newFakeSessionControl(original)
+
+	s.Require().NoError(updateSession(control, "go-etw-kernel", TraceOptions{
+		BufferSize:     64, // Same value is fine.
+		MaximumBuffers: 32,
+	}))
+	info, err := querySession(control, "go-etw-kernel")
+	s.Require().NoError(err)
+	expected := original
+	expected.Options.MaximumBuffers = 32
+	s.Equal(expected, info)
+
+	s.Require().NoError(updateSession(control, "go-etw-kernel", TraceOptions{FlushTimer: 250 * time.Millisecond}))
+	info, err = querySession(control, "go-etw-kernel")
+	s.Require().NoError(err)
+	expected.Options.FlushTimer = 250 * time.Millisecond
+	s.Equal(expected, info)
+
+	// Properties passed to the OS keep kernel flags and switch flush units.
+	props := info.updateProperties()
+	s.Equal(uint32(250), props.FlushTimer)
+	s.Equal(uint32(defaultLogFileMode|eventTraceSystemLoggerMode|eventTraceUseMsFlushTimer), props.LogFileMode)
+	s.Equal(expected.Options, props.traceOptions())
+
+	invalid := map[string]TraceOptions{
+		"buffer size":        {BufferSize: 128},
+		"min buffers":        {MinimumBuffers: 8},
+		"max less than min":  {MaximumBuffers: 2},
+		"negative flush":     {FlushTimer: -time.Second},
+		"out of range value": {BufferSize: 4096},
+	}
+	for name, options := range invalid {
+		s.Error(updateSession(control, "go-etw-kernel", options), name)
+	}
+	info, err = querySession(control, "go-etw-kernel")
+	s.Require().NoError(err)
+	s.Equal(expected, info, "Failed updates changed the session")
+
+	s.Error(updateSession(control, "go-etw-missing", TraceOptions{MaximumBuffers: 32}))
+}
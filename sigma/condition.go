@@ -0,0 +1,230 @@
+package sigma
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// condition is a compiled part of a detection: a search identifier or an
+// expression over them.
+type condition interface {
+	match(v *eventView) bool
+}
+
+type andCondition []condition
+
+func (c andCondition) match(v *eventView) bool {
+	for _, x := range c {
+		if !x.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+type orCondition []condition
+
+func (c orCondition) match(v *eventView) bool {
+	for _, x := range c {
+		if x.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type notCondition struct {
+	c condition
+}
+
+func (c notCondition) match(v *eventView) bool {
+	return !c.c.match(v)
+}
+
+// parseCondition compiles a condition expression referring @searches:
+//
+//	expr    = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | primary
+//	primary = "(" expr ")" | ( "1" | "all" ) "of" ( "them" | pattern ) | identifier
+func parseCondition(text string, searches map[string]condition) (condition, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens, searches: searches}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return c, nil
+}
+
+// tokenize splits a condition into parentheses and words.
+func tokenize(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		ch := rune(text[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '|':
+			return nil, fmt.Errorf("aggregations are not supported")
+		default:
+			start := i
+			for i < len(text) && !unicode.IsSpace(rune(text[i])) && text[i] != '(' && text[i] != ')' && text[i] != '|' {
+				i++
+			}
+			tokens = append(tokens, text[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens   []string
+	pos      int
+	searches map[string]condition
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// accept consumes the next token if it's the @keyword.
+func (p *conditionParser) accept(keyword string) bool {
+	if strings.EqualFold(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) or() (condition, error) {
+	var alternatives orCondition
+	for {
+		c, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, c)
+		if !p.accept("or") {
+			break
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return alternatives, nil
+}
+
+func (p *conditionParser) and() (condition, error) {
+	var all andCondition
+	for {
+		c, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, c)
+		if !p.accept("and") {
+			break
+		}
+	}
+	if len(all) == 1 {
+		return all[0], nil
+	}
+	return all, nil
+}
+
+func (p *conditionParser) not() (condition, error) {
+	if p.accept("not") {
+		c, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{c}, nil
+	}
+	return p.primary()
+}
+
+func (p *conditionParser) primary() (condition, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case p.accept("("):
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return c, nil
+	case token == "1" || strings.EqualFold(token, "all"):
+		p.pos++
+		if !p.accept("of") {
+			return nil, fmt.Errorf("expected \"of\" after %q", token)
+		}
+		matched, err := p.pattern()
+		if err != nil {
+			return nil, err
+		}
+		if token == "1" {
+			return orCondition(matched), nil
+		}
+		return andCondition(matched), nil
+	}
+
+	p.pos++
+	c, ok := p.searches[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown search identifier %q", token)
+	}
+	return c, nil
+}
+
+// pattern returns searches matching the next token: "them" stands for all
+// searches but ones starting with an underscore.
+func (p *conditionParser) pattern() ([]condition, error) {
+	token := p.peek()
+	if token == "" || token == "(" || token == ")" {
+		return nil, fmt.Errorf("expected search identifier pattern")
+	}
+	p.pos++
+
+	var names []string
+	for name := range p.searches {
+		if strings.EqualFold(token, "them") {
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+		} else if ok, err := path.Match(token, name); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q; %w", token, err)
+		} else if ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no search identifiers match %q", token)
+	}
+	sort.Strings(names)
+
+	matched := make([]condition, len(names))
+	for i, name := range names {
+		matched[i] = p.searches[name]
+	}
+	return matched, nil
+}
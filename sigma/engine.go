@@ -0,0 +1,146 @@
+package sigma
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// LogsourceMapping maps rules of a log source onto ETW events.
+type LogsourceMapping struct {
+	// Logsource selects rules: every attribute set here should be equal to
+	// the attribute of the rule (case-insensitively), the rest of the rule
+	// attributes are not checked. At least one attribute should be set.
+	Logsource Logsource
+
+	// Providers are providers of the log source events.
+	Providers []schema.GUID
+
+	// EventIDs limits the log source to the listed events. Any event of
+	// Providers is evaluated if empty.
+	EventIDs []uint16
+
+	// Fields maps Sigma field names to property names, e.g. "Image" to
+	// "ImageName". Fields missing here are looked up as is.
+	Fields map[string]string
+}
+
+// covers returns true if @rule belongs to the log source.
+func (m *LogsourceMapping) covers(rule Logsource) bool {
+	equal := func(mapped, actual string) bool {
+		return mapped == "" || strings.EqualFold(mapped, actual)
+	}
+	return equal(m.Logsource.Category, rule.Category) &&
+		equal(m.Logsource.Product, rule.Product) &&
+		equal(m.Logsource.Service, rule.Service)
+}
+
+// Options configure Engine.
+type Options struct {
+	// Logsources map rules onto events. A rule is evaluated for events of
+	// every log source covering it.
+	Logsources []LogsourceMapping
+}
+
+// Alert is a match of a rule.
+type Alert struct {
+	Rule  *Rule
+	Event *schema.Event
+
+	// Fields are values of Rule.Fields present in the event.
+	Fields []schema.Property
+}
+
+// Engine evaluates rules over events of mapped log sources.
+type Engine struct {
+	bindings map[schema.GUID][]binding
+	unmapped []*Rule
+}
+
+// binding is a rule applied to events of a provider.
+type binding struct {
+	rule     *Rule
+	eventIDs map[uint16]bool // nil means any event.
+	fields   map[string]string
+}
+
+// NewEngine binds @rules to log sources of @options. Rules not covered by any
+// log source are never matched, they are listed by Unmapped.
+func NewEngine(rules []*Rule, options Options) (*Engine, error) {
+	for i, m := range options.Logsources {
+		l := m.Logsource
+		if l.Category == "" && l.Product == "" && l.Service == "" {
+			return nil, fmt.Errorf("log source %d: no attributes set", i)
+		}
+		if len(m.Providers) == 0 {
+			return nil, fmt.Errorf("log source %d: no providers set", i)
+		}
+	}
+
+	e := &Engine{bindings: make(map[schema.GUID][]binding)}
+	for _, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("nil rule")
+		}
+		mapped := false
+		for i := range options.Logsources {
+			m := &options.Logsources[i]
+			if !m.covers(rule.Logsource) {
+				continue
+			}
+			mapped = true
+			b := binding{rule: rule, fields: m.Fields}
+			if len(m.EventIDs) != 0 {
+				b.eventIDs = make(map[uint16]bool, len(m.EventIDs))
+				for _, id := range m.EventIDs {
+					b.eventIDs[id] = true
+				}
+			}
+			for _, provider := range m.Providers {
+				e.bindings[provider] = append(e.bindings[provider], b)
+			}
+		}
+		if !mapped {
+			e.unmapped = append(e.unmapped, rule)
+		}
+	}
+	return e, nil
+}
+
+// Unmapped returns rules not covered by any log source.
+func (e *Engine) Unmapped() []*Rule {
+	return e.unmapped
+}
+
+// Match evaluates rules bound to the @event provider and returns alerts of
+// matched rules in the order of rules. A rule matches once even if it's
+// bound to the event by several log sources.
+func (e *Engine) Match(event *schema.Event) []Alert {
+	var alerts []Alert
+	var matched map[*Rule]bool
+	for _, b := range e.bindings[event.Header.ProviderID] {
+		if b.eventIDs != nil && !b.eventIDs[event.Header.ID] {
+			continue
+		}
+		if matched[b.rule] {
+			continue
+		}
+		v := &eventView{event: event, fields: b.fields}
+		if !b.rule.detection.condition.match(v) {
+			continue
+		}
+		if matched == nil {
+			matched = make(map[*Rule]bool)
+		}
+		matched[b.rule] = true
+		alerts = append(alerts, Alert{Rule: b.rule, Event: event, Fields: v.properties(b.rule.Fields)})
+	}
+	return alerts
+}
+
+// Match evaluates the rule detection over @event regardless of log sources.
+// Field names are looked up as is.
+func (r *Rule) Match(event *schema.Event) bool {
+	return r.detection.condition.match(&eventView{event: event})
+}
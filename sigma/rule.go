@@ -0,0 +1,205 @@
+// Package sigma evaluates Sigma detection rules over events.
+//
+// Rules are parsed from YAML with ParseRules or LoadDir and evaluated by an
+// Engine, which maps rule log sources onto ETW providers and event IDs:
+//
+//	engine, err := sigma.NewEngine(rules, sigma.Options{
+//		Logsources: []sigma.LogsourceMapping{{
+//			Logsource: sigma.Logsource{Product: "windows", Category: "process_creation"},
+//			Providers: []schema.GUID{sysmonGUID},
+//			EventIDs:  []uint16{1},
+//		}},
+//	})
+//	for _, alert := range engine.Match(event) {
+//		log.Printf("%s: %s", alert.Rule.Level, alert.Rule.Title)
+//	}
+//
+// Supported are search maps and lists of them, keyword lists, null values,
+// modifiers contains, startswith, endswith, re, all, cidr, base64 and
+// base64offset and conditions with and, or, not, parentheses, "1 of" and
+// "all of". Aggregations (count() etc.) are not supported.
+//
+// Ref: https://github.com/SigmaHQ/sigma-specification
+package sigma
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule levels.
+const (
+	LevelInformational = "informational"
+	LevelLow           = "low"
+	LevelMedium        = "medium"
+	LevelHigh          = "high"
+	LevelCritical      = "critical"
+)
+
+// Logsource describes events a rule applies to.
+type Logsource struct {
+	Category   string `yaml:"category"`
+	Product    string `yaml:"product"`
+	Service    string `yaml:"service"`
+	Definition string `yaml:"definition"`
+}
+
+// Rule is a parsed Sigma rule. Fields hold the rule metadata which is passed
+// to alerts as is.
+type Rule struct {
+	Title          string    `yaml:"title"`
+	ID             string    `yaml:"id"`
+	Status         string    `yaml:"status"`
+	Description    string    `yaml:"description"`
+	Author         string    `yaml:"author"`
+	Date           string    `yaml:"date"`
+	Modified       string    `yaml:"modified"`
+	References     []string  `yaml:"references"`
+	Tags           []string  `yaml:"tags"`
+	Logsource      Logsource `yaml:"logsource"`
+	FalsePositives []string  `yaml:"falsepositives"`
+	Level          string    `yaml:"level"`
+
+	// Fields are names of event fields worth to be shown with an alert.
+	Fields []string `yaml:"fields"`
+
+	detection detection
+}
+
+// ParseRule parses a single rule.
+func ParseRule(data []byte) (*Rule, error) {
+	rules, err := ParseRules(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) != 1 {
+		return nil, fmt.Errorf("expected a single rule, got %d", len(rules))
+	}
+	return rules[0], nil
+}
+
+// ParseRules parses rules of a YAML stream with one rule per document.
+//
+// Rule collections (action: global) are not supported.
+func ParseRules(data []byte) ([]*Rule, error) {
+	var rules []*Rule
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		var doc struct {
+			Rule      `yaml:",inline"`
+			Action    string    `yaml:"action"`
+			Detection yaml.Node `yaml:"detection"`
+		}
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse document %d; %w", i, err)
+		}
+		if doc.Action != "" {
+			return nil, fmt.Errorf("document %d: rule collections are not supported", i)
+		}
+
+		rule := doc.Rule
+		if rule.Title == "" {
+			return nil, fmt.Errorf("document %d: title is not set", i)
+		}
+		if rule.detection, err = parseDetection(&doc.Detection); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Title, err)
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, nil
+}
+
+// LoadDir parses rules of all .yml and .yaml files under @dir.
+func LoadDir(dir string) ([]*Rule, error) {
+	var rules []*Rule
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if info.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		parsed, err := ParseRules(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		rules = append(rules, parsed...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// detection is a compiled detection section.
+type detection struct {
+	searches  map[string]condition
+	condition condition
+}
+
+// parseDetection compiles search identifiers and the condition.
+func parseDetection(node *yaml.Node) (detection, error) {
+	if node.Kind != yaml.MappingNode {
+		return detection{}, fmt.Errorf("detection is not set")
+	}
+	d := detection{searches: make(map[string]condition)}
+	var conditions []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i].Value, node.Content[i+1]
+		if name == "condition" {
+			if err := value.Decode(&conditions); err != nil {
+				var single string
+				if err := value.Decode(&single); err != nil {
+					return detection{}, fmt.Errorf("invalid condition; %w", err)
+				}
+				conditions = []string{single}
+			}
+			continue
+		}
+		if name == "timeframe" {
+			return detection{}, fmt.Errorf("timeframe is not supported")
+		}
+		s, err := parseSearch(value)
+		if err != nil {
+			return detection{}, fmt.Errorf("search %q: %w", name, err)
+		}
+		d.searches[name] = s
+	}
+	if len(conditions) == 0 {
+		return detection{}, fmt.Errorf("condition is not set")
+	}
+
+	// A list of conditions is an alternative of them.
+	var alternatives []condition
+	for _, text := range conditions {
+		c, err := parseCondition(text, d.searches)
+		if err != nil {
+			return detection{}, fmt.Errorf("condition %q: %w", text, err)
+		}
+		alternatives = append(alternatives, c)
+	}
+	if len(alternatives) == 1 {
+		d.condition = alternatives[0]
+	} else {
+		d.condition = orCondition(alternatives)
+	}
+	return d, nil
+}
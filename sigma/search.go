@@ -0,0 +1,485 @@
+package sigma
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+// Value modifiers.
+const (
+	modifierContains     = "contains"
+	modifierStartsWith   = "startswith"
+	modifierEndsWith     = "endswith"
+	modifierRe           = "re"
+	modifierAll          = "all"
+	modifierCIDR         = "cidr"
+	modifierBase64       = "base64"
+	modifierBase64Offset = "base64offset"
+)
+
+// parseSearch compiles a search identifier: a map of fields, a list of maps
+// or a list of keywords.
+func parseSearch(node *yaml.Node) (condition, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return parseFields(node)
+	case yaml.ScalarNode:
+		return parseKeywords([]*yaml.Node{node})
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			return nil, fmt.Errorf("empty list")
+		}
+		if node.Content[0].Kind == yaml.ScalarNode {
+			return parseKeywords(node.Content)
+		}
+		var alternatives orCondition
+		for _, item := range node.Content {
+			if item.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("lists should have either maps or keywords")
+			}
+			c, err := parseFields(item)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, c)
+		}
+		return alternatives, nil
+	}
+	return nil, fmt.Errorf("unexpected YAML node")
+}
+
+// fieldSearch matches if all fields match.
+type fieldSearch []fieldMatcher
+
+func (s fieldSearch) match(v *eventView) bool {
+	for i := range s {
+		if !s[i].match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldMatcher matches field values with any (or all) of values.
+type fieldMatcher struct {
+	field  string
+	values []valueMatcher
+	all    bool
+}
+
+func (m *fieldMatcher) match(v *eventView) bool {
+	values, _ := v.values(m.field)
+	for _, matcher := range m.values {
+		if matcher.match(values) != m.all {
+			return !m.all
+		}
+	}
+	return m.all
+}
+
+func parseFields(node *yaml.Node) (fieldSearch, error) {
+	var s fieldSearch
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		parts := strings.Split(key, "|")
+		if parts[0] == "" {
+			return nil, fmt.Errorf("empty field name of %q", key)
+		}
+		m := fieldMatcher{field: parts[0]}
+		modifiers := parts[1:]
+		for i, modifier := range modifiers {
+			if modifier == modifierAll {
+				m.all = true
+				modifiers = append(modifiers[:i:i], modifiers[i+1:]...)
+				break
+			}
+		}
+
+		items := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			items = value.Content
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("no values of %q", key)
+		}
+		for _, item := range items {
+			matcher, err := newValueMatcher(item, modifiers, false)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", key, err)
+			}
+			m.values = append(m.values, matcher)
+		}
+		s = append(s, m)
+	}
+	return s, nil
+}
+
+// keywordSearch matches if any of keywords is found in any property.
+type keywordSearch []valueMatcher
+
+func (s keywordSearch) match(v *eventView) bool {
+	values := v.keywords()
+	for _, m := range s {
+		if m.match(values) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseKeywords(items []*yaml.Node) (keywordSearch, error) {
+	var s keywordSearch
+	for _, item := range items {
+		if item.Kind != yaml.ScalarNode || item.Tag == "!!null" {
+			return nil, fmt.Errorf("lists should have either maps or keywords")
+		}
+		m, err := newValueMatcher(item, nil, true)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, m)
+	}
+	return s, nil
+}
+
+// valueMatcher matches a value of a search with field values.
+type valueMatcher interface {
+	// match returns true if any of @values matches.
+	match(values []string) bool
+}
+
+// nullMatcher matches missing and empty fields.
+type nullMatcher struct{}
+
+func (nullMatcher) match(values []string) bool {
+	for _, v := range values {
+		if v != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// stringMatcher compares values case-insensitively unless caseSensitive is
+// set, any of patterns should match. Patterns are literals (lowercase for
+// case-insensitive matching) or regular expressions.
+type stringMatcher struct {
+	kind          string // "" for the equality, contains, startswith or endswith.
+	caseSensitive bool
+	literals      []string
+	patterns      []*regexp.Regexp
+}
+
+func (m *stringMatcher) match(values []string) bool {
+	for _, v := range values {
+		for _, re := range m.patterns {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		if len(m.literals) == 0 {
+			continue
+		}
+		text := v
+		if !m.caseSensitive {
+			text = strings.ToLower(v)
+		}
+		for _, l := range m.literals {
+			var ok bool
+			switch m.kind {
+			case modifierContains:
+				ok = strings.Contains(text, l)
+			case modifierStartsWith:
+				ok = strings.HasPrefix(text, l)
+			case modifierEndsWith:
+				ok = strings.HasSuffix(text, l)
+			default:
+				ok = text == l
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cidrMatcher matches IP addresses of a network.
+type cidrMatcher struct {
+	network *net.IPNet
+}
+
+func (m cidrMatcher) match(values []string) bool {
+	for _, v := range values {
+		if ip := net.ParseIP(v); ip != nil && m.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newValueMatcher compiles a scalar @node with @modifiers. Keywords are
+// matched as substrings.
+func newValueMatcher(node *yaml.Node, modifiers []string, keyword bool) (valueMatcher, error) {
+	if node.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("values should be scalars")
+	}
+	if node.Tag == "!!null" {
+		if len(modifiers) != 0 {
+			return nil, fmt.Errorf("null can't have modifiers")
+		}
+		return nullMatcher{}, nil
+	}
+	value := node.Value
+
+	kind := ""
+	if keyword {
+		kind = modifierContains
+	}
+	var encodings []string
+	for _, modifier := range modifiers {
+		switch modifier {
+		case modifierContains, modifierStartsWith, modifierEndsWith, modifierRe, modifierCIDR:
+			if kind != "" {
+				return nil, fmt.Errorf("modifiers %q and %q can't be combined", kind, modifier)
+			}
+			kind = modifier
+		case modifierBase64, modifierBase64Offset:
+			encodings = append(encodings, modifier)
+		case modifierAll:
+			return nil, fmt.Errorf("modifier %q applies to lists of values", modifier)
+		default:
+			return nil, fmt.Errorf("unsupported modifier %q", modifier)
+		}
+	}
+
+	switch kind {
+	case modifierRe:
+		if len(encodings) != 0 {
+			return nil, fmt.Errorf("regular expressions can't be encoded")
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return &stringMatcher{patterns: []*regexp.Regexp{re}}, nil
+	case modifierCIDR:
+		if len(encodings) != 0 {
+			return nil, fmt.Errorf("networks can't be encoded")
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return cidrMatcher{network}, nil
+	}
+
+	m := &stringMatcher{kind: kind}
+	if len(encodings) != 0 {
+		// Encoded values are case-sensitive literals.
+		m.caseSensitive = true
+		m.literals = []string{value}
+		for _, encoding := range encodings {
+			m.literals = encode(m.literals, encoding)
+		}
+		return m, nil
+	}
+
+	literal, wildcards := unescape(value)
+	if !wildcards {
+		m.literals = []string{strings.ToLower(literal)}
+		return m, nil
+	}
+	re, err := regexp.Compile(wildcardPattern(value, kind))
+	if err != nil {
+		return nil, err
+	}
+	m.patterns = []*regexp.Regexp{re}
+	return m, nil
+}
+
+// encode applies a base64 modifier to @values.
+func encode(values []string, encoding string) []string {
+	var encoded []string
+	for _, v := range values {
+		if encoding == modifierBase64 {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString([]byte(v)))
+			continue
+		}
+		// Every offset in the encoded data gives its own encoding of the
+		// value, strip characters depending on the surrounding data.
+		for offset := 0; offset < 3; offset++ {
+			s := base64.StdEncoding.EncodeToString(append(make([]byte, offset), v...))
+			start := []int{0, 2, 3}[offset]
+			end := len(s) - []int{0, 3, 2}[(len(v)+offset)%3]
+			if start < end {
+				encoded = append(encoded, s[start:end])
+			}
+		}
+	}
+	return encoded
+}
+
+// unescape removes escaping of wildcards: "\*", "\?" and "\\" are literal
+// characters, other backslashes are kept as is. It reports if @value has
+// unescaped wildcards.
+func unescape(value string) (string, bool) {
+	var b strings.Builder
+	wildcards := false
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case ch == '\\' && i+1 < len(value) && strings.IndexByte(`*?\`, value[i+1]) >= 0:
+			i++
+			b.WriteByte(value[i])
+		case ch == '*' || ch == '?':
+			wildcards = true
+			b.WriteByte(ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String(), wildcards
+}
+
+// wildcardPattern converts @value with wildcards to a case-insensitive
+// regular expression anchored according to @kind.
+func wildcardPattern(value, kind string) string {
+	var b strings.Builder
+	b.WriteString("(?is)")
+	if kind == "" || kind == modifierStartsWith {
+		b.WriteByte('^')
+	}
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case ch == '\\' && i+1 < len(value) && strings.IndexByte(`*?\`, value[i+1]) >= 0:
+			i++
+			b.WriteString(regexp.QuoteMeta(value[i : i+1]))
+		case ch == '*':
+			b.WriteString(".*")
+		case ch == '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(value[i : i+1]))
+		}
+	}
+	if kind == "" || kind == modifierEndsWith {
+		b.WriteByte('$')
+	}
+	return b.String()
+}
+
+// eventView resolves field names of an event.
+type eventView struct {
+	event  *schema.Event
+	fields map[string]string // Sigma field names to property names.
+
+	keywordValues []string // Values of all properties, built on demand.
+}
+
+// value returns the @field value. Properties of structures are referred as
+// "<name>.<field>".
+//
+// EventID and Provider_Name refer the event header unless the event has
+// such properties.
+func (v *eventView) value(field string) (interface{}, bool) {
+	if name, ok := v.fields[field]; ok {
+		field = name
+	}
+	if value, ok := lookup(v.event.Properties, field); ok {
+		return value, true
+	}
+	switch field {
+	case "EventID":
+		return v.event.Header.ID, true
+	case "Provider_Name":
+		return v.event.ProviderName, true
+	}
+	return nil, false
+}
+
+// values returns texts of the @field value. Arrays give a text per item.
+func (v *eventView) values(field string) ([]string, bool) {
+	value, ok := v.value(field)
+	if !ok {
+		return nil, false
+	}
+	return texts(nil, value), true
+}
+
+// properties returns values of @fields present in the event.
+func (v *eventView) properties(fields []string) []schema.Property {
+	var properties []schema.Property
+	for _, field := range fields {
+		if value, ok := v.value(field); ok {
+			properties = append(properties, schema.Property{Name: field, Value: value})
+		}
+	}
+	return properties
+}
+
+// keywords returns texts of all property values.
+func (v *eventView) keywords() []string {
+	if v.keywordValues == nil {
+		v.keywordValues = []string{}
+		for _, p := range v.event.Properties {
+			v.keywordValues = texts(v.keywordValues, p.Value)
+		}
+	}
+	return v.keywordValues
+}
+
+// lookup finds a property by name or by a path of nested structures.
+func lookup(properties []schema.Property, name string) (interface{}, bool) {
+	for _, p := range properties {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if value, ok := lookup(properties, name[:i]); ok {
+			if nested, ok := value.([]schema.Property); ok {
+				if value, ok := lookup(nested, name[i+1:]); ok {
+					return value, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// texts appends texts of @value to @dst. Structures are skipped.
+func texts(dst []string, value interface{}) []string {
+	switch v := value.(type) {
+	case nil, []schema.Property:
+		return dst
+	case string:
+		return append(dst, v)
+	case []byte:
+		return append(dst, strings.ToUpper(fmt.Sprintf("%x", v)))
+	case time.Time:
+		return append(dst, v.UTC().Format(time.RFC3339Nano))
+	case schema.GUID:
+		return append(dst, v.String())
+	}
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		for i := 0; i < rv.Len(); i++ {
+			dst = texts(dst, rv.Index(i).Interface())
+		}
+		return dst
+	}
+	return append(dst, fmt.Sprint(value))
+}
@@ -0,0 +1,318 @@
+package sigma
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gaelmuller/etw/v2/schema"
+)
+
+func TestSigma(t *testing.T) {
+	suite.Run(t, new(sigmaSuite))
+}
+
+type sigmaSuite struct {
+	suite.Suite
+}
+
+//nolint:gochecknoglobals
+var (
+	sysmonGUID   = schema.GUID{Data1: 0x5770385F, Data2: 0xC22A, Data3: 0x43E0, Data4: [8]byte{0xBF, 0x4C, 0x06, 0xF5, 0x69, 0x8F, 0xFB, 0xD9}}
+	securityGUID = schema.GUID{Data1: 0x54849625, Data2: 0x5478, Data3: 0x4994, Data4: [8]byte{0xA5, 0xBA, 0x3E, 0x3B, 0x03, 0x28, 0xC3, 0x0D}}
+)
+
+const processCreation = `
+title: Suspicious PowerShell
+id: 6e8e0b34-8c3e-4b8a-9d1c-000000000001
+status: experimental
+description: Encoded PowerShell command line.
+author: Test
+tags: [attack.execution, attack.t1059.001]
+level: high
+logsource:
+  product: windows
+  category: process_creation
+fields: [CommandLine, ParentImage, Missing]
+detection:
+  selection:
+    Image|endswith: '\powershell.exe'
+    CommandLine|contains:
+      - ' -enc '
+      - ' -EncodedCommand '
+  filter:
+    ParentImage: 'C:\Windows\System32\services.exe'
+  condition: selection and not filter
+`
+
+func processEvent(id uint16, image, commandLine, parent string) *schema.Event {
+	return &schema.Event{
+		Header: schema.Header{
+			Descriptor: schema.Descriptor{ID: id},
+			ProviderID: sysmonGUID,
+		},
+		ProviderName: "Microsoft-Windows-Sysmon",
+		Properties: []schema.Property{
+			{Name: "Image", Value: image},
+			{Name: "CommandLine", Value: commandLine},
+			{Name: "ParentImage", Value: parent},
+		},
+	}
+}
+
+// event returns an event with @properties given as name and value pairs.
+func event(properties ...interface{}) *schema.Event {
+	e := &schema.Event{Header: schema.Header{ProviderID: sysmonGUID}}
+	for i := 0; i+1 < len(properties); i += 2 {
+		e.Properties = append(e.Properties, schema.Property{Name: properties[i].(string), Value: properties[i+1]})
+	}
+	return e
+}
+
+// rule parses a rule with @detection.
+func (s *sigmaSuite) rule(detection string) *Rule {
+	r, err := ParseRule([]byte("title: Test\nlogsource: {product: windows}\ndetection:\n" + detection))
+	s.Require().NoError(err)
+	return r
+}
+
+// TestParse ensures rule metadata is parsed.
+func (s *sigmaSuite) TestParse() {
+	r, err := ParseRule([]byte(processCreation))
+	s.Require().NoError(err)
+	s.Equal("Suspicious PowerShell", r.Title)
+	s.Equal("6e8e0b34-8c3e-4b8a-9d1c-000000000001", r.ID)
+	s.Equal(LevelHigh, r.Level)
+	s.Equal([]string{"attack.execution", "attack.t1059.001"}, r.Tags)
+	s.Equal(Logsource{Product: "windows", Category: "process_creation"}, r.Logsource)
+	s.Equal([]string{"CommandLine", "ParentImage", "Missing"}, r.Fields)
+
+	s.True(r.Match(processEvent(1, `C:\Windows\powershell.exe`, "powershell -enc AAAA", `C:\explorer.exe`)))
+	s.True(r.Match(processEvent(1, `C:\WINDOWS\PowerShell.EXE`, "powershell -encodedcommand AAAA", `C:\explorer.exe`)), "Case-insensitive")
+	s.False(r.Match(processEvent(1, `C:\Windows\powershell.exe`, "powershell -enc AAAA", `C:\Windows\System32\services.exe`)), "Filtered")
+	s.False(r.Match(processEvent(1, `C:\Windows\cmd.exe`, "cmd -enc AAAA", `C:\explorer.exe`)))
+
+	rules, err := ParseRules([]byte(processCreation + "---\n" + processCreation))
+	s.Require().NoError(err)
+	s.Len(rules, 2)
+}
+
+// TestModifiers ensures value modifiers.
+func (s *sigmaSuite) TestModifiers() {
+	for _, c := range []struct {
+		detection string
+		event     *schema.Event
+		matched   bool
+	}{
+		{"  s: {A: abc}\n  condition: s", event("A", "ABC"), true},
+		{"  s: {A: abc}\n  condition: s", event("A", "abcd"), false},
+		{"  s: {A: 'a*c?'}\n  condition: s", event("A", "aXXcY"), true},
+		{"  s: {A: 'a*c?'}\n  condition: s", event("A", "aXXc"), false},
+		{"  s: {A: 'a\\*'}\n  condition: s", event("A", "a*"), true},
+		{"  s: {A: 'a\\*'}\n  condition: s", event("A", "ab"), false},
+		{"  s: {A|startswith: ab}\n  condition: s", event("A", "ABC"), true},
+		{"  s: {A|endswith: bc}\n  condition: s", event("A", "ABC"), true},
+		{"  s: {A|endswith: ab}\n  condition: s", event("A", "ABC"), false},
+		{"  s: {A|contains: 'b*d'}\n  condition: s", event("A", "abcde"), true},
+		{"  s: {A|re: '^a.c$'}\n  condition: s", event("A", "abc"), true},
+		{"  s: {A|re: '^a.c$'}\n  condition: s", event("A", "ABC"), false},
+		{"  s: {A|contains|all: [a, c]}\n  condition: s", event("A", "abc"), true},
+		{"  s: {A|contains|all: [a, d]}\n  condition: s", event("A", "abc"), false},
+		{"  s: {A|contains: [a, d]}\n  condition: s", event("A", "abc"), true},
+		{"  s: {A|cidr: 10.0.0.0/8}\n  condition: s", event("A", "10.1.2.3"), true},
+		{"  s: {A|cidr: 10.0.0.0/8}\n  condition: s", event("A", "11.1.2.3"), false},
+		{"  s: {A|cidr: 'fe80::/10'}\n  condition: s", event("A", "fe80::1"), true},
+		{"  s: {A|base64: abc}\n  condition: s", event("A", "YWJj"), true},
+		{"  s: {A|base64: abc}\n  condition: s", event("A", "ywjj"), false},
+		{"  s: {A: 4624}\n  condition: s", event("A", uint16(4624)), true},
+		{"  s: {A: [1, 2]}\n  condition: s", event("A", []uint32{3, 2}), true},
+		{"  s: {A: null}\n  condition: s", event("B", "x"), true},
+		{"  s: {A: null}\n  condition: s", event("A", ""), true},
+		{"  s: {A: null}\n  condition: s", event("A", "x"), false},
+		{"  s: {A: ''}\n  condition: s", event("A", ""), true},
+		{"  s: {A: x}\n  condition: s", event("B", "x"), false},
+		{"  s: {A.B: x}\n  condition: s", event("A", []schema.Property{{Name: "B", Value: "x"}}), true},
+		{"  s: {EventID: 0}\n  condition: s", event(), true},
+	} {
+		s.Equal(c.matched, s.rule(c.detection).Match(c.event), "%s with %v", c.detection, c.event.Properties)
+	}
+}
+
+// TestBase64Offset ensures values are found at any offset of encoded data.
+func (s *sigmaSuite) TestBase64Offset() {
+	r := s.rule("  s: {A|base64offset|contains: '/bin/bash -i'}\n  condition: s")
+	for _, prefix := range []string{"", "x", "xy", "xyz"} {
+		for _, suffix := range []string{"", "1", "12"} {
+			encoded := base64.StdEncoding.EncodeToString([]byte(prefix + "/bin/bash -i" + suffix))
+			s.True(r.Match(event("A", encoded)), "%q", prefix+"/bin/bash -i"+suffix)
+		}
+	}
+	s.False(r.Match(event("A", base64.StdEncoding.EncodeToString([]byte("/bin/bash -x")))))
+}
+
+// TestKeywords ensures keyword lists search all properties.
+func (s *sigmaSuite) TestKeywords() {
+	r := s.rule("  keywords: [mimikatz, 'sekurlsa::*']\n  condition: keywords")
+	s.True(r.Match(event("A", "x", "B", "run MIMIKATZ.exe")))
+	s.True(r.Match(event("A", []string{"x", "sekurlsa::logonpasswords"})))
+	s.False(r.Match(event("A", "x")))
+
+	r = s.rule("  keywords: mimikatz\n  condition: keywords")
+	s.True(r.Match(event("A", "mimikatz")))
+}
+
+// TestConditions ensures the condition syntax and precedence.
+func (s *sigmaSuite) TestConditions() {
+	const searches = "  sel_a: {A: x}\n  sel_b: {B: x}\n  _c: {C: x}\n"
+	for _, c := range []struct {
+		condition string
+		event     *schema.Event
+		matched   bool
+	}{
+		{"sel_a or sel_b and _c", event("A", "x"), true},
+		{"(sel_a or sel_b) and _c", event("A", "x"), false},
+		{"not sel_a and sel_b", event("B", "x"), true},
+		{"not (sel_a or sel_b)", event("B", "x"), false},
+		{"NOT sel_a AND NOT sel_b", event(), true},
+		{"1 of sel_*", event("B", "x"), true},
+		{"all of sel_*", event("B", "x"), false},
+		{"all of sel_*", event("A", "x", "B", "x"), true},
+		{"1 of them", event("C", "x"), false},
+		{"all of them", event("A", "x", "B", "x"), true},
+		{"all of them and not _c", event("A", "x", "B", "x", "C", "x"), false},
+	} {
+		r := s.rule(searches + "  condition: " + c.condition)
+		s.Equal(c.matched, r.Match(c.event), "%s with %v", c.condition, c.event.Properties)
+	}
+
+	// A list of conditions is an alternative.
+	r := s.rule(searches + "  condition: [sel_a, sel_b]")
+	s.True(r.Match(event("B", "x")))
+
+	// A list of maps is an alternative too.
+	r = s.rule("  s:\n    - {A: x, B: y}\n    - {C: z}\n  condition: s")
+	s.True(r.Match(event("C", "z")))
+	s.True(r.Match(event("A", "x", "B", "y")))
+	s.False(r.Match(event("A", "x")))
+}
+
+// TestEngine ensures log sources, field mapping and alerts.
+func (s *sigmaSuite) TestEngine() {
+	process, err := ParseRule([]byte(processCreation))
+	s.Require().NoError(err)
+	logon := s.rule("  s: {LogonType: 10}\n  condition: s")
+	logon.Logsource = Logsource{Product: "windows", Service: "security"}
+	dns := s.rule("  s: {QueryName: x}\n  condition: s")
+	dns.Logsource = Logsource{Product: "windows", Category: "dns_query"}
+
+	engine, err := NewEngine([]*Rule{process, logon, dns}, Options{Logsources: []LogsourceMapping{
+		{
+			Logsource: Logsource{Product: "windows", Category: "process_creation"},
+			Providers: []schema.GUID{sysmonGUID},
+			EventIDs:  []uint16{1},
+		},
+		{
+			Logsource: Logsource{Product: "windows", Category: "process_creation"},
+			Providers: []schema.GUID{securityGUID},
+			EventIDs:  []uint16{4688},
+			Fields:    map[string]string{"Image": "NewProcessName", "ParentImage": "ParentProcessName"},
+		},
+		{
+			Logsource: Logsource{Service: "Security"},
+			Providers: []schema.GUID{securityGUID},
+			EventIDs:  []uint16{4624},
+		},
+	}})
+	s.Require().NoError(err)
+	s.Equal([]*Rule{dns}, engine.Unmapped())
+
+	e := processEvent(1, `C:\Windows\powershell.exe`, "powershell -enc AAAA", `C:\explorer.exe`)
+	alerts := engine.Match(e)
+	s.Require().Len(alerts, 1)
+	s.Equal(process, alerts[0].Rule)
+	s.Equal(e, alerts[0].Event)
+	s.Equal([]schema.Property{
+		{Name: "CommandLine", Value: "powershell -enc AAAA"},
+		{Name: "ParentImage", Value: `C:\explorer.exe`},
+	}, alerts[0].Fields)
+
+	s.Empty(engine.Match(processEvent(3, `C:\Windows\powershell.exe`, "powershell -enc AAAA", "")), "Other event")
+
+	security := &schema.Event{
+		Header: schema.Header{Descriptor: schema.Descriptor{ID: 4688}, ProviderID: securityGUID},
+		Properties: []schema.Property{
+			{Name: "NewProcessName", Value: `C:\Windows\powershell.exe`},
+			{Name: "CommandLine", Value: "powershell -enc AAAA"},
+			{Name: "ParentProcessName", Value: `C:\explorer.exe`},
+		},
+	}
+	alerts = engine.Match(security)
+	s.Require().Len(alerts, 1)
+	s.Equal(`C:\explorer.exe`, alerts[0].Fields[1].Value, "Mapped field")
+
+	security.Header.ID = 4624
+	security.Properties = []schema.Property{{Name: "LogonType", Value: uint32(10)}}
+	alerts = engine.Match(security)
+	s.Require().Len(alerts, 1)
+	s.Equal(logon, alerts[0].Rule)
+
+	_, err = NewEngine(nil, Options{Logsources: []LogsourceMapping{{Providers: []schema.GUID{sysmonGUID}}}})
+	s.Error(err, "No attributes")
+	_, err = NewEngine(nil, Options{Logsources: []LogsourceMapping{{Logsource: Logsource{Product: "windows"}}}})
+	s.Error(err, "No providers")
+}
+
+// TestErrors ensures invalid rules are rejected.
+func (s *sigmaSuite) TestErrors() {
+	for _, detection := range []string{
+		"  s: {A: x}\n",
+		"  s: {A: x}\n  condition: t",
+		"  s: {A: x}\n  condition: s and",
+		"  s: {A: x}\n  condition: (s",
+		"  s: {A: x}\n  condition: s)",
+		"  s: {A: x}\n  condition: 1 of t*",
+		"  s: {A: x}\n  condition: 2 of s",
+		"  s: {A: x}\n  condition: s | count() > 5",
+		"  s: {A|unknown: x}\n  condition: s",
+		"  s: {A|contains|startswith: x}\n  condition: s",
+		"  s: {A|re: '('}\n  condition: s",
+		"  s: {A|cidr: 10.0.0.0}\n  condition: s",
+		"  s: {A|contains: null}\n  condition: s",
+		"  s: {'|contains': x}\n  condition: s",
+		"  s: {A: []}\n  condition: s",
+		"  s: [{A: x}, y]\n  condition: s",
+		"  s: {A: x}\n  timeframe: 5m\n  condition: s",
+	} {
+		_, err := ParseRule([]byte("title: Test\ndetection:\n" + detection))
+		s.Error(err, detection)
+	}
+
+	_, err := ParseRule([]byte("detection:\n  s: {A: x}\n  condition: s"))
+	s.Error(err, "No title")
+	_, err = ParseRule([]byte("title: Test\naction: global\ndetection:\n  s: {A: x}\n  condition: s"))
+	s.Error(err, "Collection")
+}
+
+// TestLoadDir ensures rules are loaded from YAML files only.
+func (s *sigmaSuite) TestLoadDir() {
+	dir, err := ioutil.TempDir("", "sigma")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	s.Require().NoError(os.Mkdir(filepath.Join(dir, "windows"), 0o700))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "windows", "a.yml"), []byte(processCreation), 0o600))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte(processCreation), 0o600))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# Rules"), 0o600))
+
+	rules, err := LoadDir(dir)
+	s.Require().NoError(err)
+	s.Len(rules, 2)
+
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "c.yml"), []byte("title: [bad"), 0o600))
+	_, err = LoadDir(dir)
+	s.Error(err)
+}
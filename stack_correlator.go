@@ -0,0 +1,434 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Opcodes of KERNEL_STACK_WALK_GUID events.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/stackwalk
+const (
+	stackWalkOpcodeStack      = 32 // StackWalk_Event
+	stackWalkOpcodeKeyCreate  = 34 // StackWalk_KeyCreate
+	stackWalkOpcodeKeyDelete  = 35 // StackWalk_KeyCreate (delete)
+	stackWalkOpcodeKeyRundown = 36 // StackWalk_KeyCreate (rundown)
+	stackWalkOpcodeKeyKernel  = 37 // StackWalk_Key (kernel)
+	stackWalkOpcodeKeyUser    = 38 // StackWalk_Key (user)
+)
+
+// Pointer size flags of EVENT_HEADER.Flags.
+const (
+	eventHeaderFlag32BitHeader = 0x0020
+	eventHeaderFlag64BitHeader = 0x0040
+)
+
+// Default StackCorrelatorOptions.
+const (
+	defaultStackLatency     = time.Second
+	defaultMaxPendingStacks = 10000
+	defaultMaxCachedStacks  = 10000
+)
+
+// StackClass identifies a kernel event class which has stack tracing enabled
+// (see Provider.StackTracing).
+type StackClass struct {
+	ProviderID windows.GUID
+	OpCode     uint8
+}
+
+// StackCorrelatorOptions bound the latency and the memory used by
+// StackCorrelator. Zero values stand for defaults.
+type StackCorrelatorOptions struct {
+	// MaxLatency is how long an event waits for its stack. The time is
+	// measured by event timestamps, not by the wall clock. Defaults to 1s.
+	MaxLatency time.Duration
+
+	// MaxPending limits the number of events waiting for their stacks. The
+	// oldest event is delivered as is when the limit is reached. Defaults to
+	// 10000.
+	MaxPending int
+
+	// MaxCachedStacks limits the number of cached stacks remembered for stack
+	// keys. Defaults to 10000.
+	MaxCachedStacks int
+
+	// Classes are event classes which have stack tracing enabled. Events of
+	// other classes are delivered immediately, so they could overtake
+	// events waiting for stacks. If empty, all events wait for stacks.
+	Classes []StackClass
+}
+
+// StackCorrelator pairs kernel events with StackWalk events carrying their
+// call stacks. Stacks are attached to events as ExtendedEventInfo.StackTrace.
+//
+// The kernel writes StackWalk events right after the event they belong to,
+// but the user mode part of the stack could be written later, when the thread
+// returns to the user mode. StackWalk events refer to the original event by
+// the thread ID and the raw timestamp, so StackCorrelator buffers recent events
+// per thread and pairs StackWalk events with the waiting event of the thread
+// having the same raw timestamp. StackWalk events without such an event are
+// dropped.
+//
+// If stack caching is enabled, stacks arrive as stack keys and frames are
+// resolved from StackWalk key events if they are seen before the event is
+// delivered.
+//
+// Use StackCorrelator.Handle as an EventCallback of the kernel trace.
+type StackCorrelator struct {
+	mu sync.Mutex
+
+	options StackCorrelatorOptions
+	classes map[StackClass]bool
+	output  func(*Record)
+
+	pending   []*pendingStack            // In arrival order.
+	threads   map[uint32][]*pendingStack // Pending events by thread.
+	watermark time.Time                  // The latest timestamp seen.
+
+	cache      map[uint64]*list.Element // Stack key to element of cacheOrder.
+	cacheOrder *list.List               // Of cachedStack, the oldest first.
+}
+
+// pendingStack is an event waiting for its stack.
+type pendingStack struct {
+	record         *Record
+	threadID       uint32
+	eventTimeStamp uint64 // Raw timestamp of EVENT_HEADER.
+
+	matched   bool
+	kernel    []uint64
+	user      []uint64
+	kernelKey uint64
+	userKey   uint64
+	hasUser   bool
+}
+
+type cachedStack struct {
+	key    uint64
+	frames []uint64
+}
+
+// NewStackCorrelator creates a StackCorrelator which passes events with
+// attached stacks to @output. @output is called synchronously from Handle or
+// Flush.
+func NewStackCorrelator(options StackCorrelatorOptions, output func(*Record)) *StackCorrelator {
+	if options.MaxLatency <= 0 {
+		options.MaxLatency = defaultStackLatency
+	}
+	if options.MaxPending <= 0 {
+		options.MaxPending = defaultMaxPendingStacks
+	}
+	if options.MaxCachedStacks <= 0 {
+		options.MaxCachedStacks = defaultMaxCachedStacks
+	}
+
+	c := &StackCorrelator{
+		options:    options,
+		output:     output,
+		threads:    make(map[uint32][]*pendingStack),
+		cache:      make(map[uint64]*list.Element),
+		cacheOrder: list.New(),
+	}
+	if len(options.Classes) > 0 {
+		c.classes = make(map[StackClass]bool, len(options.Classes))
+		for _, class := range options.Classes {
+			c.classes[class] = true
+		}
+	}
+	return c
+}
+
+// Handle consumes a single event. StackWalk events are consumed silently,
+// other events are copied and delivered to the output once their stacks are
+// found or the latency limit is exceeded.
+func (c *StackCorrelator) Handle(e *Event) {
+	if e.Header.ProviderID == KERNEL_STACK_WALK_GUID {
+		walk, err := parseStackWalk(e.Header, e.userData())
+		if err == nil {
+			c.pushStack(walk)
+		}
+		return
+	}
+
+	// Properties errors are not fatal, deliver what we have.
+	record, _ := e.Record()
+	if record != nil {
+		c.pushRecord(record, e.rawTimeStamp())
+	}
+}
+
+// Flush delivers all waiting events. Call it when the trace is stopped.
+func (c *StackCorrelator) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.pending) > 0 {
+		c.releaseHead()
+	}
+}
+
+// CachedStack returns frames of the cached stack with a given @key if it's
+// known. It could be used to resolve stack keys of events delivered before
+// the stack was reported.
+func (c *StackCorrelator) CachedStack(key uint64) ([]uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(cachedStack).frames, true
+}
+
+// pushRecord queues @record with the raw @eventTimeStamp of its header.
+func (c *StackCorrelator) pushRecord(record *Record, eventTimeStamp uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	class := StackClass{ProviderID: record.Header.ProviderID, OpCode: record.Header.OpCode}
+	if c.classes != nil && !c.classes[class] {
+		c.output(record)
+		c.advance(record.Header.TimeStamp)
+		return
+	}
+
+	p := &pendingStack{record: record, threadID: record.Header.ThreadID, eventTimeStamp: eventTimeStamp}
+	c.pending = append(c.pending, p)
+	c.threads[p.threadID] = append(c.threads[p.threadID], p)
+	for len(c.pending) > c.options.MaxPending {
+		c.releaseHead()
+	}
+	c.advance(record.Header.TimeStamp)
+}
+
+func (c *StackCorrelator) pushStack(walk stackWalk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch walk.opcode {
+	case stackWalkOpcodeKeyCreate, stackWalkOpcodeKeyRundown:
+		c.cacheStack(walk.key, walk.frames)
+	case stackWalkOpcodeKeyDelete:
+		if el, ok := c.cache[walk.key]; ok {
+			c.cacheOrder.Remove(el)
+			delete(c.cache, walk.key)
+		}
+	case stackWalkOpcodeStack, stackWalkOpcodeKeyKernel, stackWalkOpcodeKeyUser:
+		if p := c.findPending(walk); p != nil {
+			p.attach(walk)
+		}
+	}
+	c.advance(walk.timestamp)
+}
+
+// findPending looks for the event @walk belongs to: the waiting event of the
+// thread with the same raw timestamp.
+func (c *StackCorrelator) findPending(walk stackWalk) *pendingStack {
+	thread := c.threads[walk.threadID]
+	for i := len(thread) - 1; i >= 0; i-- {
+		if thread[i].eventTimeStamp == walk.eventTimeStamp {
+			return thread[i]
+		}
+	}
+	return nil
+}
+
+// advance moves the watermark to @ts and delivers events which are complete
+// or waited for too long. Events are delivered in the arrival order.
+func (c *StackCorrelator) advance(ts time.Time) {
+	if ts.After(c.watermark) {
+		c.watermark = ts
+	}
+	for len(c.pending) > 0 {
+		head := c.pending[0]
+		expired := head.record.Header.TimeStamp.Add(c.options.MaxLatency).Before(c.watermark)
+		if !head.hasUser && !expired {
+			return
+		}
+		c.releaseHead()
+	}
+}
+
+// releaseHead delivers the oldest waiting event.
+func (c *StackCorrelator) releaseHead() {
+	p := c.pending[0]
+	c.pending[0] = nil
+	c.pending = c.pending[1:]
+
+	// Events are queued per thread in the same order, so it's the first one.
+	thread := c.threads[p.threadID]
+	if len(thread) <= 1 {
+		delete(c.threads, p.threadID)
+	} else {
+		thread[0] = nil
+		c.threads[p.threadID] = thread[1:]
+	}
+
+	if p.matched {
+		p.record.Extended.StackTrace = c.buildStack(p)
+	}
+	c.output(p.record)
+}
+
+func (c *StackCorrelator) buildStack(p *pendingStack) *EventStackTrace {
+	var kernelCached, userCached []uint64
+	if el, ok := c.cache[p.kernelKey]; ok && p.kernelKey != 0 {
+		kernelCached = el.Value.(cachedStack).frames
+	}
+	if el, ok := c.cache[p.userKey]; ok && p.userKey != 0 {
+		userCached = el.Value.(cachedStack).frames
+	}
+
+	// Cached frames are shared, so copy everything into a new slice.
+	kernelFrames := len(kernelCached) + len(p.kernel)
+	addresses := make([]uint64, 0, kernelFrames+len(p.user)+len(userCached))
+	addresses = append(addresses, kernelCached...)
+	addresses = append(addresses, p.kernel...)
+	addresses = append(addresses, p.user...)
+	addresses = append(addresses, userCached...)
+	return &EventStackTrace{
+		Addresses:      addresses,
+		KernelFrames:   kernelFrames,
+		KernelStackKey: p.kernelKey,
+		UserStackKey:   p.userKey,
+	}
+}
+
+func (c *StackCorrelator) cacheStack(key uint64, frames []uint64) {
+	if el, ok := c.cache[key]; ok {
+		c.cacheOrder.Remove(el)
+	}
+	c.cache[key] = c.cacheOrder.PushBack(cachedStack{key: key, frames: frames})
+
+	for c.cacheOrder.Len() > c.options.MaxCachedStacks {
+		oldest := c.cacheOrder.Front()
+		c.cacheOrder.Remove(oldest)
+		delete(c.cache, oldest.Value.(cachedStack).key)
+	}
+}
+
+// attach adds a part of the stack described by @walk.
+func (p *pendingStack) attach(walk stackWalk) {
+	p.matched = true
+
+	switch walk.opcode {
+	case stackWalkOpcodeStack:
+		for _, frame := range walk.frames {
+			if isKernelAddress(frame, walk.pointerSize) {
+				p.kernel = append(p.kernel, frame)
+			} else {
+				p.user = append(p.user, frame)
+				p.hasUser = true
+			}
+		}
+	case stackWalkOpcodeKeyKernel:
+		p.kernelKey = walk.key
+	case stackWalkOpcodeKeyUser:
+		p.userKey = walk.key
+		p.hasUser = true
+	}
+}
+
+// stackWalk is a parsed StackWalk event.
+type stackWalk struct {
+	opcode      uint8
+	timestamp   time.Time // Of the StackWalk event itself.
+	pointerSize int
+
+	// StackWalk_Event and StackWalk_Key.
+	eventTimeStamp uint64 // Raw timestamp of the original event.
+	processID      uint32
+	threadID       uint32
+
+	// StackWalk_Key and StackWalk_KeyCreate.
+	key uint64
+
+	// StackWalk_Event and StackWalk_KeyCreate.
+	frames []uint64
+}
+
+// parseStackWalk decodes the payload of StackWalk events:
+//
+//	StackWalk_Event     { UInt64 EventTimeStamp; UInt32 StackProcess; UInt32 StackThread; Pointer Stack[]; }
+//	StackWalk_Key       { UInt64 EventTimeStamp; UInt32 StackProcess; UInt32 StackThread; UInt64 StackKey; }
+//	StackWalk_KeyCreate { UInt64 StackKey; Pointer StackFrames[]; }
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/stackwalk-event
+func parseStackWalk(header EventHeader, data []byte) (stackWalk, error) {
+	walk := stackWalk{
+		opcode:      header.OpCode,
+		timestamp:   header.TimeStamp,
+		pointerSize: pointerSize(header.Flags),
+	}
+
+	switch walk.opcode {
+	case stackWalkOpcodeStack, stackWalkOpcodeKeyKernel, stackWalkOpcodeKeyUser:
+		if len(data) < 16 {
+			return stackWalk{}, fmt.Errorf("StackWalk event is too short: %d bytes", len(data))
+		}
+		walk.eventTimeStamp = binary.LittleEndian.Uint64(data)
+		walk.processID = binary.LittleEndian.Uint32(data[8:])
+		walk.threadID = binary.LittleEndian.Uint32(data[12:])
+		data = data[16:]
+
+		if walk.opcode != stackWalkOpcodeStack {
+			if len(data) < 8 {
+				return stackWalk{}, fmt.Errorf("StackWalk key event is too short")
+			}
+			walk.key = binary.LittleEndian.Uint64(data)
+			return walk, nil
+		}
+
+	case stackWalkOpcodeKeyCreate, stackWalkOpcodeKeyDelete, stackWalkOpcodeKeyRundown:
+		if len(data) < 8 {
+			return stackWalk{}, fmt.Errorf("StackWalk key create event is too short")
+		}
+		walk.key = binary.LittleEndian.Uint64(data)
+		data = data[8:]
+
+	default:
+		return stackWalk{}, fmt.Errorf("unknown StackWalk opcode %d", walk.opcode)
+	}
+
+	walk.frames = make([]uint64, 0, len(data)/walk.pointerSize)
+	for ; len(data) >= walk.pointerSize; data = data[walk.pointerSize:] {
+		if walk.pointerSize == 4 {
+			walk.frames = append(walk.frames, uint64(binary.LittleEndian.Uint32(data)))
+		} else {
+			walk.frames = append(walk.frames, binary.LittleEndian.Uint64(data))
+		}
+	}
+	return walk, nil
+}
+
+// pointerSize returns a size of pointers in the event payload by header
+// @flags. If flags are not set, the event was written by the same platform.
+func pointerSize(flags uint16) int {
+	switch {
+	case flags&eventHeaderFlag32BitHeader != 0:
+		return 4
+	case flags&eventHeaderFlag64BitHeader != 0:
+		return 8
+	default:
+		return int(unsafe.Sizeof(uintptr(0)))
+	}
+}
+
+// isKernelAddress tells if @addr belongs to the kernel address space.
+func isKernelAddress(addr uint64, pointerSize int) bool {
+	if pointerSize == 4 {
+		return addr >= 0x80000000
+	}
+	return addr >= 0xFFFF800000000000
+}
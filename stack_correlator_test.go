@@ -0,0 +1,233 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestStackCorrelator(t *testing.T) {
+	suite.Run(t, new(stackCorrelatorSuite))
+}
+
+type stackCorrelatorSuite struct {
+	suite.Suite
+
+	base   time.Time
+	output []*Record
+}
+
+//nolint:gochecknoglobals
+var testStackClass = StackClass{ProviderID: KERNEL_FILE_IO_GUID, OpCode: 64}
+
+const (
+	testKernelFrame = 0xFFFFF80000001000
+	testUserFrame   = 0x00007FF600001000
+)
+
+func (s *stackCorrelatorSuite) SetupTest() {
+	s.base = time.Unix(1600000000, 0)
+	s.output = nil
+}
+
+func (s *stackCorrelatorSuite) newCorrelator(options StackCorrelatorOptions) *StackCorrelator {
+	return NewStackCorrelator(options, func(r *Record) {
+		s.output = append(s.output, r)
+	})
+}
+
+// record makes an event of @class written by @tid at @ms after base.
+func (s *stackCorrelatorSuite) record(class StackClass, tid uint32, ms int) *Record {
+	return &Record{Header: EventHeader{
+		EventDescriptor: EventDescriptor{OpCode: class.OpCode},
+		ThreadID:        tid,
+		ProviderID:      class.ProviderID,
+		TimeStamp:       s.base.Add(time.Duration(ms) * time.Millisecond),
+	}}
+}
+
+// pushWalk pushes StackWalk_Event of the event at raw @ts.
+func (s *stackCorrelatorSuite) pushWalk(c *StackCorrelator, tid uint32, ms int, ts uint64, frames ...uint64) {
+	data := make([]byte, 16+8*len(frames))
+	binary.LittleEndian.PutUint64(data, ts)
+	binary.LittleEndian.PutUint32(data[8:], 1)
+	binary.LittleEndian.PutUint32(data[12:], tid)
+	for i, f := range frames {
+		binary.LittleEndian.PutUint64(data[16+8*i:], f)
+	}
+	s.push(c, s.stackHeader(stackWalkOpcodeStack, ms), data)
+}
+
+func (s *stackCorrelatorSuite) stackHeader(opcode uint8, ms int) EventHeader {
+	return EventHeader{
+		EventDescriptor: EventDescriptor{OpCode: opcode},
+		Flags:           eventHeaderFlag64BitHeader,
+		ProviderID:      KERNEL_STACK_WALK_GUID,
+		TimeStamp:       s.base.Add(time.Duration(ms) * time.Millisecond),
+	}
+}
+
+func (s *stackCorrelatorSuite) push(c *StackCorrelator, header EventHeader, data []byte) {
+	walk, err := parseStackWalk(header, data)
+	s.Require().NoError(err)
+	c.pushStack(walk)
+}
+
+// TestKernelAndUserParts ensures both parts of the stack are attached to the
+// right event and the event is delivered once the user part arrives.
+func (s *stackCorrelatorSuite) TestKernelAndUserParts() {
+	c := s.newCorrelator(StackCorrelatorOptions{Classes: []StackClass{testStackClass}})
+
+	c.pushRecord(s.record(testStackClass, 10, 0), 100)
+	c.pushRecord(s.record(testStackClass, 20, 1), 101)
+	s.pushWalk(c, 10, 2, 100, testKernelFrame, testKernelFrame+1)
+	s.Empty(s.output, "Waiting for the user part")
+
+	// Stacks of unknown events are dropped.
+	s.pushWalk(c, 20, 2, 99, testKernelFrame)
+
+	// Events of other classes pass through.
+	other := s.record(StackClass{ProviderID: KERNEL_PROCESS_GUID, OpCode: 1}, 10, 3)
+	c.pushRecord(other, 103)
+	s.Equal([]*Record{other}, s.output)
+
+	s.pushWalk(c, 10, 4, 100, testUserFrame)
+	s.Require().Len(s.output, 2)
+	first := s.output[1]
+	s.Equal(uint32(10), first.Header.ThreadID)
+	s.Require().NotNil(first.Extended.StackTrace)
+	s.Equal([]uint64{testKernelFrame, testKernelFrame + 1, testUserFrame}, first.Extended.StackTrace.Addresses)
+	s.Equal(2, first.Extended.StackTrace.KernelFrames)
+
+	// The second event has no stack and is delivered on Flush.
+	c.Flush()
+	s.Require().Len(s.output, 3)
+	s.Nil(s.output[2].Extended.StackTrace)
+}
+
+// TestRawTimestamps ensures stacks are attached by the raw timestamp rather
+// than to the latest event of the thread.
+func (s *stackCorrelatorSuite) TestRawTimestamps() {
+	c := s.newCorrelator(StackCorrelatorOptions{})
+
+	c.pushRecord(s.record(testStackClass, 10, 0), 100)
+	c.pushRecord(s.record(testStackClass, 10, 1), 101)
+	s.pushWalk(c, 10, 2, 100, testKernelFrame, testUserFrame)
+	s.Require().Len(s.output, 1)
+	s.Equal(s.base, s.output[0].Header.TimeStamp)
+	s.Require().NotNil(s.output[0].Extended.StackTrace)
+
+	c.Flush()
+	s.Require().Len(s.output, 2)
+	s.Nil(s.output[1].Extended.StackTrace)
+}
+
+// TestStackKeys ensures stack keys are resolved from the cache.
+func (s *stackCorrelatorSuite) TestStackKeys() {
+	c := s.newCorrelator(StackCorrelatorOptions{})
+
+	keyCreate := func(opcode uint8, key uint64, frames ...uint64) {
+		data := make([]byte, 8+8*len(frames))
+		binary.LittleEndian.PutUint64(data, key)
+		for i, f := range frames {
+			binary.LittleEndian.PutUint64(data[8+8*i:], f)
+		}
+		s.push(c, s.stackHeader(opcode, 0), data)
+	}
+	keyRef := func(opcode uint8, ms int, key uint64) {
+		data := make([]byte, 24)
+		binary.LittleEndian.PutUint64(data, 100)
+		binary.LittleEndian.PutUint32(data[12:], 10)
+		binary.LittleEndian.PutUint64(data[16:], key)
+		s.push(c, s.stackHeader(opcode, ms), data)
+	}
+
+	keyCreate(stackWalkOpcodeKeyRundown, 1, testKernelFrame)
+	keyCreate(stackWalkOpcodeKeyCreate, 2, testUserFrame, testUserFrame+1)
+	frames, ok := c.CachedStack(2)
+	s.True(ok)
+	s.Equal([]uint64{testUserFrame, testUserFrame + 1}, frames)
+
+	c.pushRecord(s.record(testStackClass, 10, 0), 100)
+	keyRef(stackWalkOpcodeKeyKernel, 1, 1)
+	s.Empty(s.output)
+	keyRef(stackWalkOpcodeKeyUser, 2, 2)
+	s.Require().Len(s.output, 1)
+
+	stack := s.output[0].Extended.StackTrace
+	s.Require().NotNil(stack)
+	s.Equal([]uint64{testKernelFrame, testUserFrame, testUserFrame + 1}, stack.Addresses)
+	s.Equal(1, stack.KernelFrames)
+	s.Equal(uint64(1), stack.KernelStackKey)
+	s.Equal(uint64(2), stack.UserStackKey)
+
+	keyCreate(stackWalkOpcodeKeyDelete, 2)
+	_, ok = c.CachedStack(2)
+	s.False(ok)
+}
+
+// TestBounds ensures events don't wait for stacks longer than allowed.
+func (s *stackCorrelatorSuite) TestBounds() {
+	c := s.newCorrelator(StackCorrelatorOptions{MaxLatency: 10 * time.Millisecond, MaxPending: 2})
+
+	c.pushRecord(s.record(testStackClass, 10, 0), 100)
+	s.pushWalk(c, 10, 1, 100, testKernelFrame)
+	c.pushRecord(s.record(testStackClass, 20, 5), 105)
+	s.Empty(s.output)
+
+	// Watermark passes the latency limit of the first event only.
+	c.pushRecord(s.record(testStackClass, 30, 11), 111)
+	s.Require().Len(s.output, 1)
+	s.Require().NotNil(s.output[0].Extended.StackTrace)
+	s.Equal(1, s.output[0].Extended.StackTrace.KernelFrames)
+
+	// Third pending event evicts the oldest one.
+	c.pushRecord(s.record(testStackClass, 40, 12), 112)
+	s.Require().Len(s.output, 2)
+	s.Equal(uint32(20), s.output[1].Header.ThreadID)
+
+	// Cache is bounded as well.
+	c = s.newCorrelator(StackCorrelatorOptions{MaxCachedStacks: 1})
+	for key := uint64(1); key <= 2; key++ {
+		data := make([]byte, 16)
+		binary.LittleEndian.PutUint64(data, key)
+		s.push(c, s.stackHeader(stackWalkOpcodeKeyCreate, 0), data)
+	}
+	_, ok := c.CachedStack(1)
+	s.False(ok)
+	_, ok = c.CachedStack(2)
+	s.True(ok)
+}
+
+// TestParse ensures 32-bit stacks are decoded and malformed ones rejected.
+func (s *stackCorrelatorSuite) TestParse() {
+	header := EventHeader{
+		EventDescriptor: EventDescriptor{OpCode: stackWalkOpcodeStack},
+		Flags:           eventHeaderFlag32BitHeader,
+	}
+	data := []byte{
+		1, 0, 0, 0, 0, 0, 0, 0, // EventTimeStamp
+		2, 0, 0, 0, // StackProcess
+		3, 0, 0, 0, // StackThread
+		0x00, 0x10, 0x00, 0x80, // Kernel frame
+		0x00, 0x10, 0x40, 0x00, // User frame
+	}
+	walk, err := parseStackWalk(header, data)
+	s.Require().NoError(err)
+	s.Equal(uint64(1), walk.eventTimeStamp)
+	s.Equal(uint32(3), walk.threadID)
+	s.Equal([]uint64{0x80001000, 0x00401000}, walk.frames)
+	s.True(isKernelAddress(walk.frames[0], walk.pointerSize))
+	s.False(isKernelAddress(walk.frames[1], walk.pointerSize))
+
+	_, err = parseStackWalk(header, data[:10])
+	s.Error(err)
+	header.OpCode = 1
+	_, err = parseStackWalk(header, data)
+	s.Error(err)
+}
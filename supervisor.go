@@ -0,0 +1,228 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default SupervisorOptions.
+const (
+	defaultSupervisorMinBackoff = time.Second
+	defaultSupervisorMaxBackoff = time.Minute
+)
+
+// ErrSessionTerminated is reported in Gap if the session stopped processing
+// without an error, e.g. it was stopped by `logman stop`.
+//
+//nolint:gochecknoglobals
+var ErrSessionTerminated = errors.New("session terminated")
+
+// SupervisorOptions configure Supervisor. Zero values stand for defaults.
+type SupervisorOptions struct {
+	// MinBackoff is a delay before the first restart attempt. It's doubled
+	// with every failed attempt up to MaxBackoff. Defaults to 1s and 1m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts limits consecutive failed restart attempts. Supervisor.Run
+	// returns the last error once it's exceeded. Zero means no limit.
+	MaxAttempts int
+
+	// OnGap is called every time the session is restarted with a period
+	// events could be missing for.
+	OnGap func(Gap)
+}
+
+// Gap marks a period the session was not running, so events of that period
+// are lost.
+type Gap struct {
+	// From is when the processing stopped and To is when it was restarted.
+	From time.Time
+	To   time.Time
+
+	// Attempts is a number of restart attempts made.
+	Attempts int
+
+	// Err is why the session stopped.
+	Err error
+}
+
+// SupervisorStats are counters of a Supervisor.
+type SupervisorStats struct {
+	// Restarts is a number of successful restarts.
+	Restarts int
+
+	// FailedAttempts is a total number of failed restart attempts.
+	FailedAttempts int
+
+	// LastError is the last reason of the session stop or restart failure.
+	LastError error
+}
+
+// supervisedTrace is a subset of Trace used by Supervisor.
+type supervisedTrace interface {
+	Open() error
+	Process() error
+	Stop() error
+}
+
+// Supervisor keeps a trace running. If the session is stopped by someone else
+// or processing fails, Supervisor opens the session again with all its
+// providers using exponential backoff and reports the gap.
+type Supervisor struct {
+	trace   supervisedTrace
+	options SupervisorOptions
+
+	// controlMu serializes opening and stopping the trace by Run with
+	// stopping it once the context is done. Trace.Stop is not safe for
+	// concurrent use.
+	controlMu sync.Mutex
+
+	statsMu sync.Mutex
+	stats   SupervisorStats
+}
+
+// NewSupervisor creates a Supervisor of @trace. The trace should not be
+// started, Supervisor.Run does it.
+func NewSupervisor(trace *Trace, options SupervisorOptions) *Supervisor {
+	return newSupervisor(trace, options)
+}
+
+func newSupervisor(trace supervisedTrace, options SupervisorOptions) *Supervisor {
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultSupervisorMinBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultSupervisorMaxBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	return &Supervisor{trace: trace, options: options}
+}
+
+// Stats returns restart counters.
+func (s *Supervisor) Stats() SupervisorStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// Run opens and processes the trace until @ctx is done restarting it if
+// needed. The trace is stopped on return.
+//
+// Run returns nil if stopped by @ctx. If the very first Open fails or
+// MaxAttempts are exceeded the last error is returned.
+func (s *Supervisor) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			s.stop()
+		case <-done:
+		}
+	}()
+
+	if err := s.open(ctx); err != nil {
+		return err
+	}
+
+	for {
+		err := s.trace.Process()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = ErrSessionTerminated
+		}
+		gap := Gap{From: time.Now(), Err: err}
+		s.setLastError(err)
+		s.stop()
+
+		if err := s.restart(ctx, &gap); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// open opens the trace unless @ctx is already done.
+func (s *Supervisor) open(ctx context.Context) error {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return s.trace.Open()
+}
+
+// stop stops the trace.
+func (s *Supervisor) stop() {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	_ = s.trace.Stop()
+}
+
+// restart opens the trace with backoff and reports the @gap once it's done.
+func (s *Supervisor) restart(ctx context.Context, gap *Gap) error {
+	backoff := s.options.MinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		gap.Attempts++
+		err := s.open(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			gap.To = time.Now()
+			s.statsMu.Lock()
+			s.stats.Restarts++
+			s.statsMu.Unlock()
+			if s.options.OnGap != nil {
+				s.options.OnGap(*gap)
+			}
+			return nil
+		}
+
+		s.statsMu.Lock()
+		s.stats.FailedAttempts++
+		s.stats.LastError = err
+		s.statsMu.Unlock()
+		if s.options.MaxAttempts > 0 && gap.Attempts >= s.options.MaxAttempts {
+			return fmt.Errorf("failed to restart session after %d attempts; %w", gap.Attempts, err)
+		}
+
+		backoff *= 2
+		if backoff > s.options.MaxBackoff {
+			backoff = s.options.MaxBackoff
+		}
+	}
+}
+
+func (s *Supervisor) setLastError(err error) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.LastError = err
+}
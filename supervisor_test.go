@@ -0,0 +1,187 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSupervisor(t *testing.T) {
+	suite.Run(t, new(supervisorSuite))
+}
+
+type supervisorSuite struct {
+	suite.Suite
+}
+
+// fakeSession simulates a session which could be killed from outside.
+type fakeSession struct {
+	mu        sync.Mutex
+	opens     int
+	failOpen  int // Number of Open calls to fail.
+	processed chan struct{}
+	running   chan error // Closed or fed with an error to end Process.
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{processed: make(chan struct{}, 16)}
+}
+
+func (f *fakeSession) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failOpen > 0 {
+		f.failOpen--
+		return errors.New("open failed")
+	}
+	f.opens++
+	f.running = make(chan error, 1)
+	return nil
+}
+
+func (f *fakeSession) Process() error {
+	f.mu.Lock()
+	running := f.running
+	f.mu.Unlock()
+
+	f.processed <- struct{}{}
+	return <-running
+}
+
+func (f *fakeSession) Stop() error {
+	f.kill(nil)
+	return nil
+}
+
+// kill ends Process with @err as if the session was stopped externally.
+func (f *fakeSession) kill(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case f.running <- err:
+	default:
+	}
+}
+
+func (s *supervisorSuite) waitProcessing(session *fakeSession) {
+	select {
+	case <-session.processed:
+	case <-time.After(5 * time.Second):
+		s.FailNow("Session is not processing")
+	}
+}
+
+// TestRestart ensures killed sessions are restarted and gaps are reported.
+func (s *supervisorSuite) TestRestart() {
+	session := newFakeSession()
+	gaps := make(chan Gap, 2)
+	supervisor := newSupervisor(session, SupervisorOptions{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		OnGap:      func(g Gap) { gaps <- g },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- supervisor.Run(ctx) }()
+	s.waitProcessing(session)
+
+	// Killed by someone else.
+	session.kill(nil)
+	s.waitProcessing(session)
+	gap := <-gaps
+	s.Equal(ErrSessionTerminated, gap.Err)
+	s.Equal(1, gap.Attempts)
+	s.False(gap.To.Before(gap.From))
+
+	// Processing failed and the first reopen fails as well.
+	processErr := errors.New("process failed")
+	session.mu.Lock()
+	session.failOpen = 2
+	session.mu.Unlock()
+	session.kill(processErr)
+	s.waitProcessing(session)
+	gap = <-gaps
+	s.Equal(processErr, gap.Err)
+	s.Equal(3, gap.Attempts)
+
+	stats := supervisor.Stats()
+	s.Equal(2, stats.Restarts)
+	s.Equal(2, stats.FailedAttempts)
+
+	cancel()
+	s.NoError(<-result)
+	s.Equal(3, session.opens)
+	s.Empty(gaps, "Stop is not a gap")
+}
+
+// TestGiveUp ensures Run fails if the session can't be opened.
+func (s *supervisorSuite) TestGiveUp() {
+	session := newFakeSession()
+	session.failOpen = 1
+	supervisor := newSupervisor(session, SupervisorOptions{MinBackoff: time.Millisecond, MaxAttempts: 2})
+	s.Error(supervisor.Run(context.Background()), "The first Open fails")
+
+	go func() {
+		<-session.processed
+		session.mu.Lock()
+		session.failOpen = 2
+		session.mu.Unlock()
+		session.kill(nil)
+	}()
+	err := supervisor.Run(context.Background())
+	s.Error(err)
+	s.Equal(2, supervisor.Stats().FailedAttempts)
+}
+
+// stoppingSession detects overlapping Stop calls, Trace.Stop is not safe for
+// concurrent use.
+type stoppingSession struct {
+	*fakeSession
+	onStop func()
+
+	mu         sync.Mutex
+	stopping   bool
+	overlapped bool
+}
+
+func (f *stoppingSession) Stop() error {
+	f.mu.Lock()
+	f.overlapped = f.overlapped || f.stopping
+	f.stopping = true
+	f.mu.Unlock()
+
+	f.onStop()
+	time.Sleep(10 * time.Millisecond)
+
+	f.mu.Lock()
+	f.stopping = false
+	f.mu.Unlock()
+	return f.fakeSession.Stop()
+}
+
+// TestStopOnCancel ensures the trace isn't stopped concurrently if @ctx is
+// canceled while Process is returning.
+func (s *supervisorSuite) TestStopOnCancel() {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &stoppingSession{fakeSession: newFakeSession(), onStop: cancel}
+	supervisor := newSupervisor(session, SupervisorOptions{MinBackoff: time.Millisecond})
+
+	result := make(chan error, 1)
+	go func() { result <- supervisor.Run(ctx) }()
+	s.waitProcessing(session.fakeSession)
+
+	// Run stops the failed session, which cancels ctx in the middle.
+	session.kill(errors.New("process failed"))
+	s.NoError(<-result)
+	s.False(session.overlapped)
+}
@@ -20,10 +20,18 @@ import (
 
 type traceImplementation interface {
 	setTraceProperties(trace *Trace)
-	enableProviders(trace *Trace) error
-	disableProviders(trace *Trace) error
+	// enableProvider applies @provider settings to the registered session.
+	enableProvider(trace *Trace, provider *Provider) error
+	// disableProvider stops @provider writing to the registered session.
+	disableProvider(trace *Trace, provider *Provider) error
+	// captureState asks enabled @provider to write its current state to the
+	// session @handle.
+	captureState(handle traceHandle, provider *Provider) error
 }
 
+// traceHandle is TRACEHANDLE usable in files without cgo, e.g. tests.
+type traceHandle = C.TRACEHANDLE
+
 // ExistsError is returned by trace.Open() if the session name is already taken.
 //
 // Having ExistsError you have an option to force kill the session.
@@ -44,42 +52,78 @@ func (e ExistsError) Error() string {
 // N.B. Event pointer @e is valid ONLY inside a callback. You CAN'T copy a
 // whole event, only EventHeader, EventProperties and ExtendedEventInfo
 // separately.
+//
+// Panics in EventCallback are recovered and handled according to
+// TraceOptions.Panics.
 type EventCallback func(e *Event)
 
 type Trace struct {
-	name      []uint16
-	providers map[windows.GUID]*Provider
+	// lostEvents is accessed atomically, so keep it first to guarantee 64-bit
+	// alignment on 32-bit platforms.
+	lostEvents lostEventCounters
+
+	// baseName is the name passed to the constructor, name is the one of
+	// the session which differs if it was renamed with CollisionRename.
+	baseName string
+	name     []uint16
+
+	// providersMu guards the provider table and serializes provider control
+	// calls as they could be made while the trace is processing.
+	providersMu sync.Mutex
+	providers   map[providerKey]*Provider
+	rundowns    rundownTracker
+	panics      panicState
 
 	registrationHandle C.TRACEHANDLE
 	sessionHandle      C.TRACEHANDLE
 
+	// clock converts raw event timestamps, it's set by OpenTrace.
+	clock traceClock
+
+	// attached is set if the session is owned by someone else (see
+	// CollisionAttach), so we only consume its events.
+	attached bool
+
 	properties C.PEVENT_TRACE_PROPERTIES
 
 	callback EventCallback
 	cgoKey   uintptr
 
-	impl traceImplementation
+	options TraceOptions
+	impl    traceImplementation
+	control sessionControl // nil means ETW API.
 }
 
-func newTrace(name string, callback EventCallback, impl traceImplementation) (*Trace, error) {
+func newTrace(name string, callback EventCallback, impl traceImplementation, options []TraceOptions) (*Trace, error) {
 	// Convert the name to UTF-16
 	utf16Name, err := windows.UTF16FromString(name)
 	if err != nil {
 		return nil, fmt.Errorf("incorrect session name; %w", err) // unlikely
 	}
 
+	opts, err := pickTraceOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	props, err := opts.sessionProperties()
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace options; %w", err)
+	}
+
 	return &Trace{
+		baseName:           name,
 		name:               utf16Name,
-		providers:          make(map[windows.GUID]*Provider),
+		providers:          make(map[providerKey]*Provider),
 		registrationHandle: C.INVALID_PROCESSTRACE_HANDLE,
 		sessionHandle:      C.INVALID_PROCESSTRACE_HANDLE,
-		properties:         newTraceProperties(utf16Name),
+		properties:         newTraceProperties(utf16Name, props),
 		callback:           callback,
+		options:            opts,
 		impl:               impl,
 	}, nil
 }
 
-func newTraceProperties(name []uint16) C.PEVENT_TRACE_PROPERTIES {
+func newTraceProperties(name []uint16, props sessionProperties) C.PEVENT_TRACE_PROPERTIES {
 	// We need to allocate a sequential buffer for a structure and a session name
 	// which will be placed there by an API call (for the future calls).
 	//
@@ -91,8 +135,8 @@ func newTraceProperties(name []uint16) C.PEVENT_TRACE_PROPERTIES {
 	propertiesBuf := make([]byte, bufSize)
 
 	// We will use Query Performance Counter for timestamp cos it gives us higher
-	// time resolution. Event timestamps however would be converted to the common
-	// FileTime due to absence of PROCESS_TRACE_MODE_RAW_TIMESTAMP in LogFileMode.
+	// time resolution. Traces are opened with PROCESS_TRACE_MODE_RAW_TIMESTAMP,
+	// so event timestamps are converted to time by traceClock.
 	//
 	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ns-evntrace-event_trace_properties
 	pProperties := (C.PEVENT_TRACE_PROPERTIES)(unsafe.Pointer(&propertiesBuf[0]))
@@ -101,17 +145,17 @@ func newTraceProperties(name []uint16) C.PEVENT_TRACE_PROPERTIES {
 	pProperties.Wnode.Flags = C.WNODE_FLAG_TRACED_GUID
 
 	// Mark that we are going to process events in real time using a callback.
-	pProperties.LogFileMode = C.EVENT_TRACE_REAL_TIME_MODE | C.EVENT_TRACE_NO_PER_PROCESSOR_BUFFERING
+	// Mode flags are already resolved by TraceOptions along with the buffers
+	// settings (zero values stand for OS defaults).
+	pProperties.LogFileMode = C.ulong(props.LogFileMode)
+	pProperties.BufferSize = C.ulong(props.BufferSize)
+	pProperties.MinimumBuffers = C.ulong(props.MinimumBuffers)
+	pProperties.MaximumBuffers = C.ulong(props.MaximumBuffers)
+	pProperties.FlushTimer = C.ulong(props.FlushTimer)
 
 	return pProperties
 }
 
-func (trace *Trace) Enable(provider *Provider) {
-	if provider != nil {
-		trace.providers[provider.ProviderId] = provider
-	}
-}
-
 func (trace *Trace) Start() error {
 	if trace.sessionHandle == C.INVALID_PROCESSTRACE_HANDLE {
 		if err := trace.Open(); err != nil {
@@ -131,27 +175,90 @@ func (trace *Trace) OpenTrace() error {
 	trace.cgoKey = newCallbackKey(trace)
 
 	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-opentracew
+	var clock C.TraceClock
 	trace.sessionHandle = C.OpenTraceHelper(
 		(C.LPWSTR)(unsafe.Pointer(&trace.name[0])),
 		(C.PVOID)(trace.cgoKey),
+		&clock,
 	)
 	if trace.sessionHandle == C.INVALID_PROCESSTRACE_HANDLE {
 		return fmt.Errorf("OpenTraceW failed; %w", windows.GetLastError())
 	}
+	trace.clock = traceClock{
+		kind:        uint32(clock.Type),
+		frequency:   int64(clock.Frequency),
+		syncCounter: int64(clock.SyncCounter),
+		syncTime:    int64(clock.SyncTime),
+	}
 
 	return nil
 }
 
 func (trace *Trace) Open() error {
-	if err := trace.registerTrace(); err != nil {
+	if err := trace.register(); err != nil {
 		return err
 	}
 
-	trace.impl.enableProviders(trace)
-
 	return trace.OpenTrace()
 }
 
+// register starts the session and enables all the providers. The session is
+// stopped if any provider fails, so the caller isn't left with a session
+// missing some of requested events.
+func (trace *Trace) register() error {
+	trace.providersMu.Lock()
+	captures, err := trace.registerLocked()
+	handle := trace.registrationHandle
+	trace.providersMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if errs := trace.captureStates(handle, captures); len(errs) != 0 {
+		_ = trace.stopTrace()
+		return errs
+	}
+	return nil
+}
+
+// registerLocked starts the session and enables all the providers returning
+// the ones to capture the state of. Should be called with providersMu held.
+func (trace *Trace) registerLocked() ([]*Provider, error) {
+	trace.panics.reset()
+	// Renames are derived from the base name, so reopening a renamed trace
+	// doesn't stack suffixes.
+	_, attached, err := trace.options.Collision.startSession(
+		trace.baseName,
+		trace.registerTraceAs,
+		trace.sessionControl().stop,
+	)
+	if err != nil {
+		return nil, err
+	}
+	trace.attached = attached
+	if attached {
+		return nil, nil
+	}
+	captures, err := trace.enableAllProviders()
+	if err != nil {
+		_ = trace.stopRegistered()
+		return nil, err
+	}
+	return captures, nil
+}
+
+// isRegistered tells if the session is started, so providers could be
+// enabled or disabled right away.
+func (trace *Trace) isRegistered() bool {
+	return trace.registrationHandle != C.INVALID_PROCESSTRACE_HANDLE
+}
+
+// Name returns the session name. It differs from the one passed to the
+// constructor if the session was renamed with CollisionRename.
+func (trace *Trace) Name() string {
+	return windows.UTF16ToString(trace.name)
+}
+
 func (trace *Trace) Process() error {
 	return trace.processTrace()
 }
@@ -163,37 +270,25 @@ func (trace *Trace) Process() error {
 // Use Kill only to destroy session you've lost control over. If you
 // have a session handle always prefer `.Stop`.
 func (trace *Trace) Kill() error {
-	sessionNameLength := len(trace.name) * int(unsafe.Sizeof(trace.name[0]))
-
 	// We don't know if this session was opened with the log file or not
-	// (session could be opened without our library) so allocate memory for LogFile name too.
-	const maxLengthLogfileName = 1024
-	bufSize := int(unsafe.Sizeof(C.EVENT_TRACE_PROPERTIES{})) + sessionNameLength + maxLengthLogfileName
-	propertiesBuf := make([]byte, bufSize)
-	pProperties := (C.PEVENT_TRACE_PROPERTIES)(unsafe.Pointer(&propertiesBuf[0]))
-	pProperties.Wnode.BufferSize = C.ulong(bufSize)
+	// (session could be opened without our library) so the session control
+	// allocates memory for LogFile name too.
+	return trace.sessionControl().stop(trace.Name())
+}
 
-	// ULONG WMIAPI ControlTraceW(
-	//  TRACEHANDLE             TraceHandle,
-	//  LPCWSTR                 InstanceName,
-	//  PEVENT_TRACE_PROPERTIES Properties,
-	//  ULONG                   ControlCode
-	// );
-	ret := C.ControlTraceW(
-		0,
-		(*C.ushort)(unsafe.Pointer(&trace.name[0])),
-		pProperties,
-		C.EVENT_TRACE_CONTROL_STOP)
-
-	// If you receive ERROR_MORE_DATA when stopping the session, ETW will have
-	// already stopped the session before generating this error.
-	// https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-controltracew
-	switch status := windows.Errno(ret); status {
-	case windows.ERROR_MORE_DATA, windows.ERROR_SUCCESS:
-		return nil
-	default:
-		return status
+// registerTraceAs registers the trace with a given @name renaming it if
+// it differs from the current session name. The base name is kept.
+func (trace *Trace) registerTraceAs(name string) error {
+	if name != trace.Name() {
+		utf16Name, err := windows.UTF16FromString(name)
+		if err != nil {
+			return fmt.Errorf("incorrect session name; %w", err)
+		}
+		// Properties have room for the name, so allocate them again.
+		trace.name = utf16Name
+		trace.properties = newTraceProperties(utf16Name, trace.options.properties())
 	}
+	return trace.registerTrace()
 }
 
 func (trace *Trace) registerTrace() error {
@@ -238,6 +333,9 @@ func (trace *Trace) processTrace() error {
 		nil, // Do not want to limit StartTime (default is from now).
 		nil, // Do not want to limit EndTime.
 	)
+	if err := trace.panics.error(); err != nil {
+		return err // Stopped by PanicStop.
+	}
 	switch status := windows.Errno(ret); status {
 	case windows.ERROR_SUCCESS, windows.ERROR_CANCELLED:
 		return nil // Cancelled is obviously ok when we block until closing.
@@ -247,8 +345,17 @@ func (trace *Trace) processTrace() error {
 }
 
 func (trace *Trace) stopTrace() error {
-	if trace.registrationHandle != C.INVALID_PROCESSTRACE_HANDLE {
-		trace.impl.disableProviders(trace)
+	trace.providersMu.Lock()
+	defer trace.providersMu.Unlock()
+
+	return trace.stopRegistered()
+}
+
+// stopRegistered stops the registered session. Should be called with
+// providersMu held.
+func (trace *Trace) stopRegistered() error {
+	if trace.isRegistered() {
+		_ = trace.disableAllProviders()
 
 		// ULONG WMIAPI ControlTraceW(
 		//  TRACEHANDLE             TraceHandle,
@@ -265,8 +372,13 @@ func (trace *Trace) stopTrace() error {
 		// If you receive ERROR_MORE_DATA when stopping the session, ETW will have
 		// already stopped the session before generating this error.
 		// https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-controltracew
+		//
+		// ERROR_WMI_INSTANCE_NOT_FOUND means the session was stopped by
+		// someone else, so it's gone as well.
 		switch status := windows.Errno(ret); status {
-		case windows.ERROR_MORE_DATA, windows.ERROR_SUCCESS:
+		case windows.ERROR_MORE_DATA, windows.ERROR_SUCCESS, windows.ERROR_WMI_INSTANCE_NOT_FOUND:
+			// Providers enabled after that point wait for the next Open.
+			trace.registrationHandle = C.INVALID_PROCESSTRACE_HANDLE
 			return nil
 		default:
 			return status
@@ -284,6 +396,9 @@ func (trace *Trace) closeTrace() error {
 		ret := C.CloseTrace(trace.sessionHandle)
 		switch status := windows.Errno(ret); status {
 		case windows.ERROR_SUCCESS, windows.ERROR_CTX_CLOSE_PENDING:
+			// The handle is not valid anymore, so Stop could be called again
+			// (e.g. after PanicStop) and Start opens the trace anew.
+			trace.sessionHandle = C.INVALID_PROCESSTRACE_HANDLE
 			return nil
 		default:
 			return fmt.Errorf("CloseTrace failed: %w", status)
@@ -329,20 +444,25 @@ func handleEvent(eventRecord C.PEVENT_RECORD) {
 		return
 	}
 
+	trace := targetTrace.(*Trace)
 	evt := &Event{
-		Header:      eventHeaderToGo(eventRecord.EventHeader),
+		Header:      eventHeaderToGo(eventRecord.EventHeader, trace.clock),
 		eventRecord: eventRecord,
 	}
-	targetTrace.(*Trace).callback(evt)
+	evt.Header.Rundown = isRundown(&evt.Header)
+	evt.Header.DuringCaptureState = trace.rundowns.duringCaptureState(&evt.Header)
+	trace.lostEvents.observe(&evt.Header)
+	trace.dispatch(evt)
 	evt.eventRecord = nil
 }
 
-func eventHeaderToGo(header C.EVENT_HEADER) EventHeader {
+// eventHeaderToGo converts @header with the raw timestamp in the @clock.
+func eventHeaderToGo(header C.EVENT_HEADER, clock traceClock) EventHeader {
 	return EventHeader{
 		EventDescriptor: eventDescriptorToGo(header.EventDescriptor),
 		ThreadID:        uint32(header.ThreadId),
 		ProcessID:       uint32(header.ProcessId),
-		TimeStamp:       stampToTime(C.GetTimeStamp(header)),
+		TimeStamp:       clock.time(int64(C.GetTimeStamp(header))),
 		ProviderID:      windowsGUIDToGo(header.ProviderId),
 		ActivityID:      windowsGUIDToGo(header.ActivityId),
 
@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Clock types of raw event timestamps.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/wnode-header#members
+const (
+	clockQPC        = 1
+	clockSystemTime = 2
+	clockCPUCycles  = 3
+)
+
+// traceClock converts raw event timestamps to time. Traces are opened with
+// PROCESS_TRACE_MODE_RAW_TIMESTAMP, so timestamps are kept in the session
+// clock as StackWalk events refer to events by them.
+type traceClock struct {
+	kind        uint32
+	frequency   int64 // Ticks per second.
+	syncCounter int64 // Counter value taken at syncTime.
+	syncTime    int64 // FILETIME.
+}
+
+// time converts the @raw timestamp. System time clocks and clocks which
+// can't be converted (unknown frequency) are treated as FILETIME.
+func (c traceClock) time(raw int64) time.Time {
+	if c.kind == clockSystemTime || c.frequency <= 0 {
+		return stampToTime(raw)
+	}
+
+	// Split ticks to keep the multiplication in range.
+	ticks := raw - c.syncCounter
+	sec, rem := ticks/c.frequency, ticks%c.frequency
+	offset := time.Duration(sec)*time.Second + time.Duration(rem*int64(time.Second)/c.frequency)
+	return stampToTime(c.syncTime).Add(offset)
+}
+
+// stampToTime translates FileTime to a golang time. Same as in standard packages.
+func stampToTime(quadPart int64) time.Time {
+	ft := windows.Filetime{
+		HighDateTime: uint32(quadPart >> 32),
+		LowDateTime:  uint32(quadPart & math.MaxUint32),
+	}
+	return time.Unix(0, ft.Nanoseconds())
+}
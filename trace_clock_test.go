@@ -0,0 +1,78 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestTraceClock(t *testing.T) {
+	suite.Run(t, new(traceClockSuite))
+}
+
+type traceClockSuite struct {
+	suite.Suite
+}
+
+// TestConversion ensures raw timestamps are converted relative to the sync
+// point of the clock.
+func (s *traceClockSuite) TestConversion() {
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ft := windows.NsecToFiletime(base.UnixNano())
+	syncTime := int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+
+	qpc := traceClock{kind: clockQPC, frequency: 10000000, syncCounter: 5000, syncTime: syncTime}
+	cycles := traceClock{kind: clockCPUCycles, frequency: 3000000000, syncTime: syncTime}
+
+	tests := []struct {
+		name     string
+		clock    traceClock
+		raw      int64
+		expected time.Time
+	}{
+		{
+			name:     "sync point",
+			clock:    qpc,
+			raw:      5000,
+			expected: base,
+		},
+		{
+			name:     "after sync",
+			clock:    qpc,
+			raw:      5000 + 15000001,
+			expected: base.Add(1500000100 * time.Nanosecond),
+		},
+		{
+			name:     "before sync",
+			clock:    qpc,
+			raw:      5000 - 2500000,
+			expected: base.Add(-250 * time.Millisecond),
+		},
+		{
+			name:     "high frequency",
+			clock:    cycles,
+			raw:      2*3000000000 + 2999999999,
+			expected: base.Add(2999999999 * time.Nanosecond),
+		},
+		{
+			name:     "system time",
+			clock:    traceClock{kind: clockSystemTime},
+			raw:      syncTime,
+			expected: base,
+		},
+		{
+			name:     "unknown frequency",
+			clock:    traceClock{kind: clockCPUCycles, syncTime: syncTime},
+			raw:      syncTime,
+			expected: base,
+		},
+	}
+	for _, tt := range tests {
+		s.Equal(tt.expected.UnixNano(), tt.clock.time(tt.raw).UnixNano(), tt.name)
+	}
+}
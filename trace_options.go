@@ -0,0 +1,181 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TraceOptions tunes buffering of an ETW session. Every zero field leaves the
+// corresponding parameter to the OS defaults, so zero TraceOptions{} is the
+// same as not passing options at all.
+//
+// If a session loses events under load you most likely need bigger or more
+// buffers; if you need events faster -- smaller buffers and a shorter
+// FlushTimer. Check LowLatencyOptions and HighThroughputOptions for sane
+// starting points.
+//
+// For more info about the fields refer to the EVENT_TRACE_PROPERTIES docs:
+// https://docs.microsoft.com/en-us/windows/win32/api/evntrace/ns-evntrace-event_trace_properties
+type TraceOptions struct {
+	// BufferSize is a size of every session buffer in kilobytes. Should be in
+	// range [1, 1024].
+	BufferSize uint32
+
+	// MinimumBuffers is a number of buffers allocated for the session at
+	// start. Should be at least 2 if set.
+	MinimumBuffers uint32
+
+	// MaximumBuffers is a maximal number of buffers the session could grow
+	// to. Should be at least 2 and not less than MinimumBuffers if set.
+	MaximumBuffers uint32
+
+	// FlushTimer specifies how often non-empty buffers are flushed to the
+	// consumer. Without a FlushTimer buffers are flushed only being full,
+	// which could take a while for low-traffic sessions.
+	//
+	// It should be a whole number of milliseconds, at most math.MaxUint32 of
+	// them (about 49 days). Sub-second values require Windows 8+.
+	FlushTimer time.Duration
+
+	// Collision tells Trace.Open what to do if the session name is already
+	// taken. By default ExistsError is returned. It's not a session property,
+	// so it's ignored by UpdateSession and not reported by QuerySession.
+	Collision CollisionOptions
+
+	// Panics tells what to do if EventCallback panics. By default the
+	// session is stopped and the panic is raised again. Like Collision, it's
+	// not a session property.
+	Panics PanicOptions
+}
+
+// LowLatencyOptions returns TraceOptions for sessions that should deliver
+// events as soon as possible: small buffers flushed several times a second.
+func LowLatencyOptions() TraceOptions {
+	return TraceOptions{
+		BufferSize:     16,
+		MinimumBuffers: 4,
+		MaximumBuffers: 64,
+		FlushTimer:     100 * time.Millisecond,
+	}
+}
+
+// HighThroughputOptions returns TraceOptions for high-volume sessions (e.g.
+// kernel file or network IO) where losing events is worse than a delay.
+func HighThroughputOptions() TraceOptions {
+	return TraceOptions{
+		BufferSize:     256,
+		MinimumBuffers: 64,
+		MaximumBuffers: 256,
+		FlushTimer:     time.Second,
+	}
+}
+
+// Limits and flags used by TraceOptions.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/logging-mode-constants
+const (
+	maxBufferSizeKB = 1024
+	minBuffersCount = 2
+
+	eventTraceRealTimeMode            = 0x00000100 // EVENT_TRACE_REAL_TIME_MODE
+	eventTraceUseMsFlushTimer         = 0x00000010 // EVENT_TRACE_USE_MS_FLUSH_TIMER
+	eventTraceNoPerProcessorBuffering = 0x10000000 // EVENT_TRACE_NO_PER_PROCESSOR_BUFFERING
+	eventTraceSystemLoggerMode        = 0x02000000 // EVENT_TRACE_SYSTEM_LOGGER_MODE
+	defaultLogFileMode                = eventTraceRealTimeMode | eventTraceNoPerProcessorBuffering
+)
+
+// sessionProperties is a subset of EVENT_TRACE_PROPERTIES fields that is
+// controlled by TraceOptions. It's kept in pure Go to be testable without
+// an actual session.
+type sessionProperties struct {
+	BufferSize     uint32
+	MinimumBuffers uint32
+	MaximumBuffers uint32
+	FlushTimer     uint32
+	LogFileMode    uint32
+}
+
+// Validate checks that TraceOptions fields are in allowed ranges and don't
+// contradict each other.
+func (o TraceOptions) Validate() error {
+	if o.BufferSize > maxBufferSizeKB {
+		return fmt.Errorf("BufferSize %dKB exceeds maximum of %dKB", o.BufferSize, maxBufferSizeKB)
+	}
+	if o.MinimumBuffers != 0 && o.MinimumBuffers < minBuffersCount {
+		return fmt.Errorf("MinimumBuffers should be at least %d; got %d", minBuffersCount, o.MinimumBuffers)
+	}
+	if o.MaximumBuffers != 0 && o.MaximumBuffers < minBuffersCount {
+		return fmt.Errorf("MaximumBuffers should be at least %d; got %d", minBuffersCount, o.MaximumBuffers)
+	}
+	if o.MaximumBuffers != 0 && o.MaximumBuffers < o.MinimumBuffers {
+		return fmt.Errorf("MaximumBuffers (%d) is less than MinimumBuffers (%d)",
+			o.MaximumBuffers, o.MinimumBuffers)
+	}
+	if o.FlushTimer < 0 {
+		return errors.New("FlushTimer can't be negative")
+	}
+	if o.FlushTimer != 0 && o.FlushTimer < time.Millisecond {
+		return fmt.Errorf("FlushTimer %s is less than a millisecond", o.FlushTimer)
+	}
+	if o.FlushTimer%time.Millisecond != 0 {
+		return fmt.Errorf("FlushTimer %s is not a whole number of milliseconds", o.FlushTimer)
+	}
+	if o.FlushTimer/time.Millisecond > math.MaxUint32 {
+		return fmt.Errorf("FlushTimer %s exceeds maximum of %d milliseconds", o.FlushTimer, uint32(math.MaxUint32))
+	}
+	if err := o.Collision.Validate(); err != nil {
+		return fmt.Errorf("invalid Collision; %w", err)
+	}
+	if err := o.Panics.Validate(); err != nil {
+		return fmt.Errorf("invalid Panics; %w", err)
+	}
+	return nil
+}
+
+// sessionProperties validates options and translates them to the values
+// expected by EVENT_TRACE_PROPERTIES.
+func (o TraceOptions) sessionProperties() (sessionProperties, error) {
+	if err := o.Validate(); err != nil {
+		return sessionProperties{}, err
+	}
+	return o.properties(), nil
+}
+
+// properties translates options to EVENT_TRACE_PROPERTIES values as is.
+func (o TraceOptions) properties() sessionProperties {
+	props := sessionProperties{
+		BufferSize:     o.BufferSize,
+		MinimumBuffers: o.MinimumBuffers,
+		MaximumBuffers: o.MaximumBuffers,
+		LogFileMode:    defaultLogFileMode,
+	}
+
+	// FlushTimer is measured in seconds unless EVENT_TRACE_USE_MS_FLUSH_TIMER
+	// is set, so switch to milliseconds only if we really need them.
+	if o.FlushTimer%time.Second == 0 {
+		props.FlushTimer = uint32(o.FlushTimer / time.Second)
+	} else {
+		props.FlushTimer = uint32(o.FlushTimer / time.Millisecond)
+		props.LogFileMode |= eventTraceUseMsFlushTimer
+	}
+
+	return props
+}
+
+// pickTraceOptions returns the only TraceOptions passed to trace
+// constructors or the zero value if none.
+func pickTraceOptions(options []TraceOptions) (TraceOptions, error) {
+	switch len(options) {
+	case 0:
+		return TraceOptions{}, nil
+	case 1:
+		return options[0], nil
+	default:
+		return TraceOptions{}, errors.New("only one TraceOptions is accepted")
+	}
+}
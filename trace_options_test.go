@@ -0,0 +1,127 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestTraceOptions(t *testing.T) {
+	suite.Run(t, new(traceOptionsSuite))
+}
+
+type traceOptionsSuite struct {
+	suite.Suite
+}
+
+// TestDefaults ensures that zero options leave everything to the OS.
+func (s *traceOptionsSuite) TestDefaults() {
+	props, err := TraceOptions{}.sessionProperties()
+	s.Require().NoError(err)
+	s.Equal(sessionProperties{LogFileMode: defaultLogFileMode}, props)
+}
+
+// TestProperties ensures options are translated to EVENT_TRACE_PROPERTIES
+// values including flush timer units.
+func (s *traceOptionsSuite) TestProperties() {
+	tests := []struct {
+		name     string
+		options  TraceOptions
+		expected sessionProperties
+	}{
+		{
+			name: "seconds flush timer",
+			options: TraceOptions{
+				BufferSize:     64,
+				MinimumBuffers: 8,
+				MaximumBuffers: 32,
+				FlushTimer:     3 * time.Second,
+			},
+			expected: sessionProperties{
+				BufferSize:     64,
+				MinimumBuffers: 8,
+				MaximumBuffers: 32,
+				FlushTimer:     3,
+				LogFileMode:    defaultLogFileMode,
+			},
+		},
+		{
+			name:    "milliseconds flush timer",
+			options: TraceOptions{FlushTimer: 1500 * time.Millisecond},
+			expected: sessionProperties{
+				FlushTimer:  1500,
+				LogFileMode: defaultLogFileMode | eventTraceUseMsFlushTimer,
+			},
+		},
+		{
+			name:    "only maximum buffers",
+			options: TraceOptions{MaximumBuffers: 16},
+			expected: sessionProperties{
+				MaximumBuffers: 16,
+				LogFileMode:    defaultLogFileMode,
+			},
+		},
+	}
+	for _, tt := range tests {
+		props, err := tt.options.sessionProperties()
+		s.Require().NoError(err, tt.name)
+		s.Equal(tt.expected, props, tt.name)
+	}
+}
+
+// TestValidation ensures that out of range values and contradicting
+// combinations are rejected.
+func (s *traceOptionsSuite) TestValidation() {
+	invalid := map[string]TraceOptions{
+		"huge buffer":          {BufferSize: 2048},
+		"single min buffer":    {MinimumBuffers: 1},
+		"single max buffer":    {MaximumBuffers: 1},
+		"max less than min":    {MinimumBuffers: 16, MaximumBuffers: 8},
+		"negative flush timer": {FlushTimer: -time.Second},
+		"sub-ms flush timer":   {FlushTimer: time.Microsecond},
+		"fractional ms timer":  {FlushTimer: 1500 * time.Microsecond},
+		"huge flush timer":     {FlushTimer: (math.MaxUint32 + 1) * time.Millisecond},
+		"unknown collision":    {Collision: CollisionOptions{Policy: CollisionRename + 1}},
+		"negative attempts":    {Collision: CollisionOptions{MaxAttempts: -1}},
+		"unknown panic policy": {Panics: PanicOptions{Policy: PanicStop + 1}},
+	}
+	for name, options := range invalid {
+		s.Error(options.Validate(), name)
+
+		_, err := options.sessionProperties()
+		s.Error(err, name)
+	}
+
+	s.NoError(TraceOptions{BufferSize: 1024, MinimumBuffers: 2, MaximumBuffers: 2}.Validate())
+	s.NoError(TraceOptions{FlushTimer: math.MaxUint32 * time.Millisecond}.Validate())
+}
+
+// TestPresets ensures that presets are valid and really differ.
+func (s *traceOptionsSuite) TestPresets() {
+	lowLatency, highThroughput := LowLatencyOptions(), HighThroughputOptions()
+	s.NoError(lowLatency.Validate())
+	s.NoError(highThroughput.Validate())
+
+	s.Less(lowLatency.FlushTimer, highThroughput.FlushTimer)
+	s.Less(lowLatency.BufferSize, highThroughput.BufferSize)
+	s.Less(lowLatency.MaximumBuffers, highThroughput.MaximumBuffers)
+}
+
+// TestPickOptions ensures constructors accept at most one TraceOptions.
+func (s *traceOptionsSuite) TestPickOptions() {
+	opts, err := pickTraceOptions(nil)
+	s.Require().NoError(err)
+	s.Zero(opts)
+
+	opts, err = pickTraceOptions([]TraceOptions{LowLatencyOptions()})
+	s.Require().NoError(err)
+	s.Equal(LowLatencyOptions(), opts)
+
+	_, err = pickTraceOptions([]TraceOptions{LowLatencyOptions(), HighThroughputOptions()})
+	s.Error(err)
+}
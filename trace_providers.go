@@ -0,0 +1,248 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// ErrProviderNotEnabled is reported by Trace.Update and Trace.Disable for
+// providers that are not enabled in the trace.
+//
+//nolint:gochecknoglobals
+var ErrProviderNotEnabled = errors.New("provider is not enabled")
+
+// ProviderError describes a failure to change the state of a single provider.
+type ProviderError struct {
+	ProviderID windows.GUID
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("provider %s: %s", e.ProviderID.String(), e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ProviderErrors is returned by Trace.Enable, Trace.Disable, Trace.Update and
+// Trace.Open if some of the providers failed. Providers not mentioned in the
+// list were processed successfully.
+type ProviderErrors []*ProviderError
+
+func (e ProviderErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// errorOrNil converts an empty list to nil error.
+func (e ProviderErrors) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// providerKey identifies a provider in the trace. Kernel providers share
+// GUIDs and differ by flags only, so flags are a part of the key.
+type providerKey struct {
+	id     windows.GUID
+	flags  uint64
+	groups perfGroupMasks
+}
+
+func keyOf(provider *Provider) providerKey {
+	return providerKey{
+		id:     provider.ProviderId,
+		flags:  provider.EnableFlags,
+		groups: groupMasksOf(provider),
+	}
+}
+
+// Enable adds @providers to the trace. If the session is already open
+// providers are enabled immediately, otherwise they are enabled by Open.
+// If capture state is requested but fails, the provider stays enabled.
+//
+// Enabling an already enabled provider replaces its settings. Providers are
+// copied, so changing them after the call has no effect; use Update instead.
+func (trace *Trace) Enable(providers ...*Provider) error {
+	trace.providersMu.Lock()
+	var errs ProviderErrors
+	var captures []*Provider
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		if err := trace.setProvider(provider); err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+			continue
+		}
+		if provider.CaptureState && trace.isRegistered() {
+			copied := *trace.providers[keyOf(provider)]
+			captures = append(captures, &copied)
+		}
+	}
+	handle := trace.registrationHandle
+	trace.providersMu.Unlock()
+
+	return append(errs, trace.captureStates(handle, captures)...).errorOrNil()
+}
+
+// Update changes settings (level, keywords, etc.) of already enabled
+// @providers. On open sessions new settings are applied immediately without
+// restarting the session.
+//
+// Update fails with ErrProviderNotEnabled for providers which are not enabled.
+func (trace *Trace) Update(providers ...*Provider) error {
+	trace.providersMu.Lock()
+	defer trace.providersMu.Unlock()
+
+	var errs ProviderErrors
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		err := ErrProviderNotEnabled
+		if _, ok := trace.providers[keyOf(provider)]; ok {
+			err = trace.setProvider(provider)
+		}
+		if err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// replaceProvider swaps the enabled provider @old for @next with a single
+// update of the session. Flags of kernel providers are a part of their key,
+// so Update can't change them.
+//
+// It fails with ErrProviderNotEnabled if @old is not enabled.
+func (trace *Trace) replaceProvider(old, next *Provider) error {
+	trace.providersMu.Lock()
+	defer trace.providersMu.Unlock()
+
+	key := keyOf(old)
+	prev, ok := trace.providers[key]
+	if !ok {
+		return ErrProviderNotEnabled
+	}
+	if keyOf(next) == key {
+		return trace.setProvider(next)
+	}
+
+	delete(trace.providers, key)
+	if err := trace.setProvider(next); err != nil {
+		trace.providers[key] = prev
+		return err
+	}
+	return nil
+}
+
+// Disable removes @providers from the trace. On open sessions providers stop
+// writing events immediately, however, events already buffered by the
+// session are still delivered.
+//
+// Disable fails with ErrProviderNotEnabled for providers which are not enabled.
+func (trace *Trace) Disable(providers ...*Provider) error {
+	trace.providersMu.Lock()
+	defer trace.providersMu.Unlock()
+
+	var errs ProviderErrors
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		if err := trace.removeProvider(provider); err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// setProvider stores a copy of @provider in the provider table and applies it
+// to the registered session. The previous state is restored on failure.
+// Should be called with providersMu held.
+func (trace *Trace) setProvider(provider *Provider) error {
+	key := keyOf(provider)
+	prev, existed := trace.providers[key]
+
+	copied := *provider
+	trace.providers[key] = &copied
+	if !trace.isRegistered() {
+		return nil
+	}
+
+	if err := trace.impl.enableProvider(trace, &copied); err != nil {
+		if existed {
+			trace.providers[key] = prev
+		} else {
+			delete(trace.providers, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeProvider deletes @provider from the provider table and disables it in
+// the registered session. The provider is kept on failure.
+// Should be called with providersMu held.
+func (trace *Trace) removeProvider(provider *Provider) error {
+	key := keyOf(provider)
+	prev, ok := trace.providers[key]
+	if !ok {
+		return ErrProviderNotEnabled
+	}
+
+	delete(trace.providers, key)
+	if !trace.isRegistered() {
+		return nil
+	}
+
+	if err := trace.impl.disableProvider(trace, prev); err != nil {
+		trace.providers[key] = prev
+		return err
+	}
+	return nil
+}
+
+// enableAllProviders applies the whole provider table to the just registered
+// session returning copies of providers to capture the state of. Should be
+// called with providersMu held.
+func (trace *Trace) enableAllProviders() ([]*Provider, error) {
+	var errs ProviderErrors
+	var captures []*Provider
+	for _, provider := range trace.providers {
+		if err := trace.impl.enableProvider(trace, provider); err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+			continue
+		}
+		if provider.CaptureState {
+			copied := *provider
+			captures = append(captures, &copied)
+		}
+	}
+	return captures, errs.errorOrNil()
+}
+
+// disableAllProviders disables every provider in the table without removing
+// them, so the trace could be reopened with the same set. Should be called
+// with providersMu held.
+func (trace *Trace) disableAllProviders() error {
+	var errs ProviderErrors
+	for _, provider := range trace.providers {
+		if err := trace.impl.disableProvider(trace, provider); err != nil {
+			errs = append(errs, &ProviderError{ProviderID: provider.ProviderId, Err: err})
+		}
+	}
+	return errs.errorOrNil()
+}
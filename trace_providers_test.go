@@ -0,0 +1,246 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestTraceProviders(t *testing.T) {
+	suite.Run(t, new(traceProvidersSuite))
+}
+
+type traceProvidersSuite struct {
+	suite.Suite
+}
+
+// fakeTraceImpl records provider control calls instead of calling ETW.
+// Providers listed in @failing fail to change their state, @captureErr is
+// returned by capture state requests.
+type fakeTraceImpl struct {
+	mu         sync.Mutex
+	enabled    map[windows.GUID]Provider
+	failing    map[windows.GUID]error
+	captureErr error
+	enables    int
+	disables   int
+	captures   int
+}
+
+func newFakeTraceImpl() *fakeTraceImpl {
+	return &fakeTraceImpl{
+		enabled: make(map[windows.GUID]Provider),
+		failing: make(map[windows.GUID]error),
+	}
+}
+
+func (f *fakeTraceImpl) setTraceProperties(trace *Trace) {}
+
+func (f *fakeTraceImpl) enableProvider(trace *Trace, provider *Provider) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.enables++
+	if err := f.failing[provider.ProviderId]; err != nil {
+		return err
+	}
+	f.enabled[provider.ProviderId] = *provider
+	return nil
+}
+
+func (f *fakeTraceImpl) disableProvider(trace *Trace, provider *Provider) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.disables++
+	if err := f.failing[provider.ProviderId]; err != nil {
+		return err
+	}
+	delete(f.enabled, provider.ProviderId)
+	return nil
+}
+
+func (f *fakeTraceImpl) captureState(handle traceHandle, provider *Provider) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.captures++
+	return f.captureErr
+}
+
+func (f *fakeTraceImpl) get(id windows.GUID) (Provider, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.enabled[id]
+	return p, ok
+}
+
+// newTrace returns a trace backed by @impl. If @registered is set the trace
+// pretends the session is already started.
+func (s *traceProvidersSuite) newTrace(impl traceImplementation, registered bool) *Trace {
+	trace, err := newTrace("Test-ETW", func(*Event) {}, impl, nil)
+	s.Require().NoError(err)
+	if registered {
+		trace.registrationHandle = 1
+	}
+	return trace
+}
+
+//nolint:gochecknoglobals
+var (
+	testProviderA = windows.GUID{Data1: 0xa}
+	testProviderB = windows.GUID{Data1: 0xb}
+)
+
+// TestNotRegistered ensures providers are only recorded before Open.
+func (s *traceProvidersSuite) TestNotRegistered() {
+	impl := newFakeTraceImpl()
+	trace := s.newTrace(impl, false)
+
+	s.Require().NoError(trace.Enable(NewProvider(testProviderA), nil))
+	s.Require().NoError(trace.Update(&Provider{ProviderId: testProviderA, Level: TRACE_LEVEL_ERROR}))
+	s.Len(trace.providers, 1)
+	s.Equal(0, impl.enables, "Providers were enabled before Open")
+
+	s.Require().NoError(trace.Disable(NewProvider(testProviderA)))
+	s.Empty(trace.providers)
+	s.Equal(0, impl.disables)
+}
+
+// TestLive ensures changes are applied to the registered session immediately.
+func (s *traceProvidersSuite) TestLive() {
+	impl := newFakeTraceImpl()
+	trace := s.newTrace(impl, true)
+
+	provider := NewProvider(testProviderA)
+	s.Require().NoError(trace.Enable(provider))
+	enabled, ok := impl.get(testProviderA)
+	s.Require().True(ok)
+	s.Equal(TRACE_LEVEL_VERBOSE, enabled.Level)
+
+	// Provider is copied, so only Update changes the settings.
+	provider.Level = TRACE_LEVEL_ERROR
+	provider.MatchAnyKeyword = 0x10
+	s.Equal(TRACE_LEVEL_VERBOSE, trace.providers[keyOf(provider)].Level)
+	s.Require().NoError(trace.Update(provider))
+	enabled, _ = impl.get(testProviderA)
+	s.Equal(TRACE_LEVEL_ERROR, enabled.Level)
+	s.Equal(uint64(0x10), enabled.MatchAnyKeyword)
+
+	s.Require().NoError(trace.Disable(provider))
+	_, ok = impl.get(testProviderA)
+	s.False(ok)
+	s.Empty(trace.providers)
+}
+
+// TestErrors ensures failures are reported per provider and the provider
+// table is left consistent with the session.
+func (s *traceProvidersSuite) TestErrors() {
+	impl := newFakeTraceImpl()
+	trace := s.newTrace(impl, true)
+	failure := errors.New("access denied")
+
+	s.Require().NoError(trace.Enable(NewProvider(testProviderB)))
+	impl.failing[testProviderB] = failure
+
+	// Enabling: A succeeds, B keeps its previous settings.
+	err := trace.Enable(NewProvider(testProviderA), &Provider{ProviderId: testProviderB, Level: TRACE_LEVEL_ERROR})
+	errs := s.providerErrors(err)
+	s.Require().Len(errs, 1)
+	s.Equal(testProviderB, errs[0].ProviderID)
+	s.True(errors.Is(errs[0], failure))
+	s.Len(trace.providers, 2)
+	s.Equal(TRACE_LEVEL_VERBOSE, trace.providers[keyOf(NewProvider(testProviderB))].Level)
+
+	// Failed new provider is not recorded.
+	delete(impl.failing, testProviderB)
+	s.Require().NoError(trace.Disable(NewProvider(testProviderA)))
+	impl.failing[testProviderA] = failure
+	s.Error(trace.Enable(NewProvider(testProviderA)))
+	s.Len(trace.providers, 1)
+
+	// Update and Disable require provider to be enabled.
+	errs = s.providerErrors(trace.Update(NewProvider(testProviderA)))
+	s.Require().Len(errs, 1)
+	s.True(errors.Is(errs[0], ErrProviderNotEnabled))
+	errs = s.providerErrors(trace.Disable(NewProvider(testProviderA)))
+	s.Require().Len(errs, 1)
+	s.True(errors.Is(errs[0], ErrProviderNotEnabled))
+
+	// Failed disable keeps provider in the table.
+	impl.failing[testProviderB] = failure
+	s.Error(trace.Disable(NewProvider(testProviderB)))
+	s.Len(trace.providers, 1)
+}
+
+// TestKernelFlags ensures kernel providers sharing a GUID are kept separately.
+func (s *traceProvidersSuite) TestKernelFlags() {
+	trace := s.newTrace(newFakeTraceImpl(), false)
+
+	s.Require().NoError(trace.Enable(KERNEL_DISK_IO_PROVIDER, KERNEL_DISK_INIT_IO_PROVIDER))
+	masks := trace.kernelGroupMasks()
+	s.Equal(uint32(KERNEL_DISK_IO_PROVIDER.EnableFlags|KERNEL_DISK_INIT_IO_PROVIDER.EnableFlags), masks[0])
+
+	s.Require().NoError(trace.Disable(KERNEL_DISK_IO_PROVIDER))
+	masks = trace.kernelGroupMasks()
+	s.Equal(uint32(KERNEL_DISK_INIT_IO_PROVIDER.EnableFlags), masks[0])
+}
+
+// TestReplace ensures kernel flags are swapped with a single session update
+// and kept on failure.
+func (s *traceProvidersSuite) TestReplace() {
+	impl := newFakeTraceImpl()
+	trace := s.newTrace(impl, true)
+	full := NewKernelProvider(testProviderA, 0x10)
+	s.Require().NoError(trace.Enable(full))
+
+	compact := *full
+	compact.EnableFlags, compact.GroupMasks = 0, []PerfGroupMask{PERF_COMPACT_CSWITCH}
+	s.Require().NoError(trace.replaceProvider(full, &compact))
+	s.Equal(2, impl.enables)
+	s.Equal(0, impl.disables)
+	s.Equal([]PerfGroupMask{PERF_COMPACT_CSWITCH}, trace.providers[keyOf(&compact)].GroupMasks)
+	s.Len(trace.providers, 1)
+
+	impl.failing[testProviderA] = errors.New("access denied")
+	s.Error(trace.replaceProvider(&compact, full))
+	s.Contains(trace.providers, keyOf(&compact))
+	s.Len(trace.providers, 1)
+
+	s.Equal(ErrProviderNotEnabled, trace.replaceProvider(full, &compact))
+}
+
+// TestConcurrent ensures the provider table could be changed from several
+// goroutines (run with -race).
+func (s *traceProvidersSuite) TestConcurrent() {
+	impl := newFakeTraceImpl()
+	trace := s.newTrace(impl, true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			provider := NewProvider(windows.GUID{Data1: uint32(i)})
+			for j := 0; j < 100; j++ {
+				s.NoError(trace.Enable(provider))
+				s.NoError(trace.Update(provider))
+				s.NoError(trace.Disable(provider))
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Empty(trace.providers)
+}
+
+func (s *traceProvidersSuite) providerErrors(err error) ProviderErrors {
+	var errs ProviderErrors
+	s.Require().True(errors.As(err, &errs), "Unexpected error: %v", err)
+	return errs
+}
@@ -0,0 +1,150 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// TraceStats describes the health of an ETW session. The first part of the
+// fields is reported by the OS for the whole session, the rest is counted by
+// the Trace itself while processing the event stream.
+//
+// All counters are cumulative since the session (or the Trace for in-stream
+// counters) start.
+type TraceStats struct {
+	// EventsLost is a number of events that were not recorded by the session.
+	EventsLost uint32
+	// BuffersWritten is a number of buffers flushed by the session.
+	BuffersWritten uint32
+	// LogBuffersLost is a number of buffers that could not be written to
+	// the log file.
+	LogBuffersLost uint32
+	// RealTimeBuffersLost is a number of buffers that could not be delivered
+	// in real time to the consumer.
+	RealTimeBuffersLost uint32
+	// NumberOfBuffers is a number of buffers currently allocated.
+	NumberOfBuffers uint32
+	// FreeBuffers is a number of allocated buffers that are not in use.
+	FreeBuffers uint32
+	// BuffersInUse is a number of allocated buffers holding events.
+	BuffersInUse uint32
+
+	// LostEventNotifications counts RTLostEvent notifications received in
+	// the event stream: events were lost before being written to a buffer.
+	LostEventNotifications uint64
+	// LostBufferNotifications counts RTLostBuffer notifications: whole
+	// buffers were lost before delivery.
+	LostBufferNotifications uint64
+	// LostFileNotifications counts RTLostFile notifications: the backing
+	// file of the real time session was lost.
+	LostFileNotifications uint64
+}
+
+// Opcodes of the RT_LostEvent class of KERNEL_LOST_EVENT_GUID.
+//
+// Ref: https://docs.microsoft.com/en-us/windows/win32/etw/rt-lostevent
+const (
+	lostEventOpcodeEvent  = 32 // RTLostEvent
+	lostEventOpcodeBuffer = 33 // RTLostBuffer
+	lostEventOpcodeFile   = 34 // RTLostFile
+)
+
+// lostEventCounters accumulates in-stream lost-event notifications. It's
+// updated from the event callback and read concurrently by Stats.
+type lostEventCounters struct {
+	events  uint64
+	buffers uint64
+	files   uint64
+}
+
+// observe counts @header if it's a lost-event notification.
+func (c *lostEventCounters) observe(header *EventHeader) {
+	if header.ProviderID != KERNEL_LOST_EVENT_GUID {
+		return
+	}
+	switch header.OpCode {
+	case lostEventOpcodeEvent:
+		atomic.AddUint64(&c.events, 1)
+	case lostEventOpcodeBuffer:
+		atomic.AddUint64(&c.buffers, 1)
+	case lostEventOpcodeFile:
+		atomic.AddUint64(&c.files, 1)
+	}
+}
+
+// fill copies collected counters to @stats.
+func (c *lostEventCounters) fill(stats *TraceStats) {
+	stats.LostEventNotifications = atomic.LoadUint64(&c.events)
+	stats.LostBufferNotifications = atomic.LoadUint64(&c.buffers)
+	stats.LostFileNotifications = atomic.LoadUint64(&c.files)
+}
+
+// Stats returns current statistics of the session. OS-level counters are
+// queried with ControlTraceW (EVENT_TRACE_CONTROL_QUERY), so the session
+// should be running, while in-stream counters are collected during
+// processing.
+func (trace *Trace) Stats() (TraceStats, error) {
+	info, err := trace.sessionControl().query(trace.Name())
+	if err != nil {
+		return TraceStats{}, fmt.Errorf("failed to query session stats; %w", err)
+	}
+	stats := info.Stats
+	trace.lostEvents.fill(&stats)
+	return stats, nil
+}
+
+// MonitorStats calls @cb with session statistics every @interval until @ctx
+// is done. Query errors are passed to @cb as well, so it's up to the caller
+// whether to stop monitoring or not.
+//
+// MonitorStats blocks, so it's expected to be run in a separate goroutine.
+func (trace *Trace) MonitorStats(ctx context.Context, interval time.Duration, cb func(TraceStats, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cb(trace.Stats())
+		}
+	}
+}
+
+// StatsChan is a channel flavour of MonitorStats: it returns a channel which
+// receives statistics every @interval and is closed when @ctx is done. Query
+// errors are skipped.
+//
+// Statistics are dropped if the receiver is not ready, so the channel always
+// holds the latest known values.
+func (trace *Trace) StatsChan(ctx context.Context, interval time.Duration) <-chan TraceStats {
+	ch := make(chan TraceStats, 1)
+	go func() {
+		defer close(ch)
+		trace.MonitorStats(ctx, interval, func(stats TraceStats, err error) {
+			if err != nil {
+				return
+			}
+			// Replace stale stats if nobody read them yet.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- stats
+		})
+	}()
+	return ch
+}
+
+func (trace *Trace) sessionControl() sessionControl {
+	if trace.control != nil {
+		return trace.control
+	}
+	return etwSessionControl{}
+}
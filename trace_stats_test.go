@@ -0,0 +1,167 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/windows"
+)
+
+func TestTraceStats(t *testing.T) {
+	suite.Run(t, new(traceStatsSuite))
+}
+
+type traceStatsSuite struct {
+	suite.Suite
+}
+
+func (s *traceStatsSuite) newTrace(name string, control sessionControl) *Trace {
+	trace, err := NewUserTrace(name, func(*Event) {})
+	s.Require().NoError(err)
+	trace.control = control
+	return trace
+}
+
+// TestAggregation ensures OS counters and in-stream notifications are merged.
+func (s *traceStatsSuite) TestAggregation() {
+	control := newFakeSessionControl(SessionInfo{
+		Name: "Test-ETW",
+		Stats: TraceStats{
+			EventsLost:          3,
+			BuffersWritten:      100,
+			RealTimeBuffersLost: 2,
+			NumberOfBuffers:     10,
+			FreeBuffers:         4,
+			BuffersInUse:        6,
+		},
+	})
+	trace := s.newTrace("Test-ETW", control)
+
+	lost := func(opcode uint8) *EventHeader {
+		h := &EventHeader{ProviderID: KERNEL_LOST_EVENT_GUID}
+		h.OpCode = opcode
+		return h
+	}
+	trace.lostEvents.observe(lost(lostEventOpcodeEvent))
+	trace.lostEvents.observe(lost(lostEventOpcodeEvent))
+	trace.lostEvents.observe(lost(lostEventOpcodeBuffer))
+	trace.lostEvents.observe(lost(lostEventOpcodeFile))
+	trace.lostEvents.observe(lost(1))                                       // Unknown opcode.
+	trace.lostEvents.observe(&EventHeader{ProviderID: KERNEL_PROCESS_GUID}) // Not a notification.
+
+	stats, err := trace.Stats()
+	s.Require().NoError(err)
+	s.Equal(TraceStats{
+		EventsLost:              3,
+		BuffersWritten:          100,
+		RealTimeBuffersLost:     2,
+		NumberOfBuffers:         10,
+		FreeBuffers:             4,
+		BuffersInUse:            6,
+		LostEventNotifications:  2,
+		LostBufferNotifications: 1,
+		LostFileNotifications:   1,
+	}, stats)
+}
+
+// TestQueryError ensures backend errors are propagated.
+func (s *traceStatsSuite) TestQueryError() {
+	trace := s.newTrace("Test-ETW", newFakeSessionControl())
+
+	_, err := trace.Stats()
+	s.Require().Error(err)
+	s.True(errors.Is(err, windows.ERROR_WMI_INSTANCE_NOT_FOUND))
+}
+
+// TestMonitor ensures periodic stats are delivered until context is done.
+func (s *traceStatsSuite) TestMonitor() {
+	const deadline = 5 * time.Second
+
+	control := newFakeSessionControl()
+	trace := s.newTrace("Test-ETW", control)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Errors should reach the callback, stats too after the session appears.
+	var (
+		gotError = make(chan struct{}, 1)
+		gotStats = make(chan TraceStats, 1)
+	)
+	done := make(chan struct{})
+	go func() {
+		trace.MonitorStats(ctx, time.Millisecond, func(stats TraceStats, err error) {
+			if err != nil {
+				trySignal(gotError)
+				return
+			}
+			select {
+			case gotStats <- stats:
+			default:
+			}
+		})
+		close(done)
+	}()
+
+	s.waitForSignal(gotError, deadline, "Failed to get query error")
+	control.set(SessionInfo{Name: "Test-ETW", Stats: TraceStats{EventsLost: 42}})
+
+	select {
+	case stats := <-gotStats:
+		s.Equal(uint32(42), stats.EventsLost)
+	case <-time.After(deadline):
+		s.Fail("Failed to get stats")
+	}
+
+	cancel()
+	s.waitForSignal(done, deadline, "MonitorStats didn't stop on context cancel")
+}
+
+// TestChan ensures stats channel delivers values and is closed on cancel.
+func (s *traceStatsSuite) TestChan() {
+	const deadline = 5 * time.Second
+
+	control := newFakeSessionControl(SessionInfo{Name: "Test-ETW", Stats: TraceStats{BuffersWritten: 7}})
+	trace := s.newTrace("Test-ETW", control)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := trace.StatsChan(ctx, time.Millisecond)
+
+	select {
+	case stats := <-ch:
+		s.Equal(uint32(7), stats.BuffersWritten)
+	case <-time.After(deadline):
+		s.Fail("Failed to get stats from channel")
+	}
+
+	cancel()
+	timeout := time.After(deadline)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			s.Fail("Stats channel wasn't closed on context cancel")
+			return
+		}
+	}
+}
+
+// waitForSignal waits for anything on @done no longer than @deadline.
+// Fails test run if deadline exceeds.
+func (s traceStatsSuite) waitForSignal(done <-chan struct{}, deadline time.Duration, failMsg string) {
+	select {
+	case <-done:
+		// pass.
+	case <-time.After(deadline):
+		s.Fail(failMsg, "deadline %s exceeded", deadline)
+	}
+}
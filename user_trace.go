@@ -11,6 +11,7 @@ package etw
 import "C"
 import (
 	"fmt"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -18,8 +19,10 @@ import (
 
 type UserTrace struct{}
 
-func NewUserTrace(name string, callback EventCallback) (*Trace, error) {
-	return newTrace(name, callback, &UserTrace{})
+// NewUserTrace creates a trace session for user-mode providers. Optional
+// TraceOptions tune session buffers; at most one could be passed.
+func NewUserTrace(name string, callback EventCallback, options ...TraceOptions) (*Trace, error) {
+	return newTrace(name, callback, &UserTrace{}, options)
 }
 
 // For User traces, no additional property is needed
@@ -27,75 +30,94 @@ func (u *UserTrace) setTraceProperties(trace *Trace) {
 	return
 }
 
-func (u *UserTrace) enableProviders(trace *Trace) error {
-	for _, provider := range trace.providers {
-		// https://docs.microsoft.com/en-us/windows/win32/etw/configuring-and-starting-an-event-tracing-session
-		params := C.ENABLE_TRACE_PARAMETERS{
-			Version: 2, // ENABLE_TRACE_PARAMETERS_VERSION_2
-		}
-		for _, p := range provider.EnableProperties {
-			params.EnableProperty |= C.ULONG(p)
-		}
-
-		// ULONG WMIAPI EnableTraceEx2(
-		//	TRACEHANDLE              TraceHandle,
-		//	LPCGUID                  ProviderId,
-		//	ULONG                    ControlCode,
-		//	UCHAR                    Level,
-		//	ULONGLONG                MatchAnyKeyword,
-		//	ULONGLONG                MatchAllKeyword,
-		//	ULONG                    Timeout,
-		//	PENABLE_TRACE_PARAMETERS EnableParameters
-		// );
-		//
-		// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-enabletraceex2
-		ret := C.EnableTraceEx2(
-			trace.registrationHandle,
-			(*C.GUID)(unsafe.Pointer(&provider.ProviderId)),
-			C.EVENT_CONTROL_CODE_ENABLE_PROVIDER,
-			C.UCHAR(provider.Level),
-			C.ULONGLONG(provider.MatchAnyKeyword),
-			C.ULONGLONG(provider.MatchAllKeyword),
-			0,       // Timeout set to zero to enable the trace asynchronously
-			&params, //nolint:gocritic // TODO: dupSubExpr?? gocritic bug?
-		)
+func (u *UserTrace) enableProvider(trace *Trace, provider *Provider) error {
+	// https://docs.microsoft.com/en-us/windows/win32/etw/configuring-and-starting-an-event-tracing-session
+	params := C.ENABLE_TRACE_PARAMETERS{
+		Version: 2, // ENABLE_TRACE_PARAMETERS_VERSION_2
+	}
+	for _, p := range provider.EnableProperties {
+		params.EnableProperty |= C.ULONG(p)
+	}
 
-		if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
-			return fmt.Errorf("EVENT_CONTROL_CODE_ENABLE_PROVIDER failed; %w", status)
-		}
+	// Filter descriptors live in C memory as they are referenced from params.
+	filters, err := newFilterDescriptors(provider)
+	if err != nil {
+		return err
 	}
+	defer filters.free()
+	params.EnableFilterDesc = filters.array
+	params.FilterDescCount = C.ULONG(filters.count)
 
+	// ULONG WMIAPI EnableTraceEx2(
+	//	TRACEHANDLE              TraceHandle,
+	//	LPCGUID                  ProviderId,
+	//	ULONG                    ControlCode,
+	//	UCHAR                    Level,
+	//	ULONGLONG                MatchAnyKeyword,
+	//	ULONGLONG                MatchAllKeyword,
+	//	ULONG                    Timeout,
+	//	PENABLE_TRACE_PARAMETERS EnableParameters
+	// );
+	//
+	// Ref: https://docs.microsoft.com/en-us/windows/win32/api/evntrace/nf-evntrace-enabletraceex2
+	ret := C.EnableTraceEx2(
+		trace.registrationHandle,
+		(*C.GUID)(unsafe.Pointer(&provider.ProviderId)),
+		C.EVENT_CONTROL_CODE_ENABLE_PROVIDER,
+		C.UCHAR(provider.Level),
+		C.ULONGLONG(provider.MatchAnyKeyword),
+		C.ULONGLONG(provider.MatchAllKeyword),
+		0,       // Timeout set to zero to enable the trace asynchronously
+		&params, //nolint:gocritic // TODO: dupSubExpr?? gocritic bug?
+	)
+
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
+		return fmt.Errorf("EVENT_CONTROL_CODE_ENABLE_PROVIDER failed; %w", status)
+	}
 	return nil
 }
 
-func (u *UserTrace) disableProviders(trace *Trace) error {
-	var err error
-
-	for _, provider := range trace.providers {
-		// ULONG WMIAPI EnableTraceEx2(
-		//	TRACEHANDLE              TraceHandle,
-		//	LPCGUID                  ProviderId,
-		//	ULONG                    ControlCode,
-		//	UCHAR                    Level,
-		//	ULONGLONG                MatchAnyKeyword,
-		//	ULONGLONG                MatchAllKeyword,
-		//	ULONG                    Timeout,
-		//	PENABLE_TRACE_PARAMETERS EnableParameters
-		// );
-		ret := C.EnableTraceEx2(
-			trace.registrationHandle,
-			(*C.GUID)(unsafe.Pointer(&provider.ProviderId)),
-			C.EVENT_CONTROL_CODE_DISABLE_PROVIDER,
-			0,
-			0,
-			0,
-			0,
-			nil)
+func (u *UserTrace) captureState(handle traceHandle, provider *Provider) error {
+	// Wait for the provider to write the state to be able to mark it.
+	ret := C.EnableTraceEx2(
+		handle,
+		(*C.GUID)(unsafe.Pointer(&provider.ProviderId)),
+		C.EVENT_CONTROL_CODE_CAPTURE_STATE,
+		C.UCHAR(provider.Level),
+		C.ULONGLONG(provider.MatchAnyKeyword),
+		C.ULONGLONG(provider.MatchAllKeyword),
+		C.ULONG(captureStateTimeout/time.Millisecond),
+		nil)
 
-		if status := windows.Errno(ret); status != windows.ERROR_SUCCESS && status != windows.ERROR_NOT_FOUND {
-			err = status
-		}
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS {
+		return fmt.Errorf("EVENT_CONTROL_CODE_CAPTURE_STATE failed; %w", status)
 	}
+	return nil
+}
+
+func (u *UserTrace) disableProvider(trace *Trace, provider *Provider) error {
+	// ULONG WMIAPI EnableTraceEx2(
+	//	TRACEHANDLE              TraceHandle,
+	//	LPCGUID                  ProviderId,
+	//	ULONG                    ControlCode,
+	//	UCHAR                    Level,
+	//	ULONGLONG                MatchAnyKeyword,
+	//	ULONGLONG                MatchAllKeyword,
+	//	ULONG                    Timeout,
+	//	PENABLE_TRACE_PARAMETERS EnableParameters
+	// );
+	ret := C.EnableTraceEx2(
+		trace.registrationHandle,
+		(*C.GUID)(unsafe.Pointer(&provider.ProviderId)),
+		C.EVENT_CONTROL_CODE_DISABLE_PROVIDER,
+		0,
+		0,
+		0,
+		0,
+		nil)
 
-	return err
+	if status := windows.Errno(ret); status != windows.ERROR_SUCCESS && status != windows.ERROR_NOT_FOUND {
+		return fmt.Errorf("EVENT_CONTROL_CODE_DISABLE_PROVIDER failed; %w", status)
+	}
+	return nil
 }
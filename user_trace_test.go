@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -303,6 +304,193 @@ func (s *userTraceSuite) TestStopExisting() {
 	s.Require().NoError(trace.Stop(), "Failed to close session properly")
 }
 
+// TestPanicStop ensures the session stopped by PanicStop could be stopped
+// again by the owner.
+func (s *userTraceSuite) TestPanicStop() {
+	const deadline = 10 * time.Second
+
+	go s.generateEvents(s.ctx, s.provider, []msetw.Level{msetw.LevelInfo})
+
+	cb := func(_ *Event) {
+		panic("boom")
+	}
+	trace, err := NewUserTrace("Test-ETW", cb, TraceOptions{
+		Panics: PanicOptions{Policy: PanicStop, OnPanic: func(*PanicError) {}},
+	})
+	s.Require().NoError(err, "Failed to create trace")
+	trace.Enable(NewProvider(s.guid))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- trace.Start()
+	}()
+
+	select {
+	case err := <-done:
+		var panicErr *PanicError
+		s.Require().True(errors.As(err, &panicErr), "Unexpected processing error %v", err)
+	case <-time.After(deadline):
+		s.Fail("Failed to stop event processing on panic")
+	}
+
+	s.Require().NoError(trace.Stop(), "Failed to stop stopped session")
+	s.Require().NoError(trace.Stop(), "Stop is not idempotent")
+}
+
+// TestCollisionPolicy ensures name collisions are resolved by the policy
+// passed with TraceOptions.
+func (s *userTraceSuite) TestCollisionPolicy() {
+	sessionName := fmt.Sprintf("go-etw-collision-%d", time.Now().UnixNano())
+
+	existing, _ := NewUserTrace(sessionName, nil)
+	s.Require().NoError(existing.Open(), "Failed to create session with name %s", sessionName)
+	defer func() { _ = existing.Kill() }()
+
+	var decisions []CollisionDecision
+	onDecision := func(d CollisionDecision) { decisions = append(decisions, d) }
+
+	renamed, err := NewUserTrace(sessionName, nil, TraceOptions{
+		Collision: CollisionOptions{Policy: CollisionRename, OnDecision: onDecision},
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(renamed.Open(), "Failed to create session with a suffixed name")
+	s.Equal(sessionName+"-1", renamed.Name())
+	s.Require().NoError(renamed.Stop())
+
+	// Renames are derived from the original name on every Open.
+	s.Require().NoError(renamed.Open(), "Failed to reopen renamed session")
+	s.Equal(sessionName+"-1", renamed.Name())
+	s.Require().NoError(renamed.Stop())
+
+	killer, err := NewUserTrace(sessionName, nil, TraceOptions{
+		Collision: CollisionOptions{Policy: CollisionKill, OnDecision: onDecision},
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(killer.Open(), "Failed to create session after a kill")
+	s.Equal(sessionName, killer.Name())
+	s.Require().NoError(killer.Stop())
+
+	s.Require().Len(decisions, 3)
+	s.Equal(CollisionRename, decisions[0].Action)
+	s.Equal(CollisionDecision{Name: sessionName, Attempt: 1, Action: CollisionRename, NewName: sessionName + "-1"}, decisions[1])
+	s.Equal(CollisionKill, decisions[2].Action)
+	s.NoError(decisions[2].Err)
+}
+
+// TestSessionManagement ensures we could find a session leaked by its creator
+// in the list of system sessions and control it by name only.
+func (s *userTraceSuite) TestSessionManagement() {
+	sessionName := fmt.Sprintf("go-etw-leaked-%d", time.Now().UnixNano())
+
+	trace, err := NewUserTrace(sessionName, nil, TraceOptions{MinimumBuffers: 4, MaximumBuffers: 64})
+	s.Require().NoError(err)
+	s.Require().NoError(trace.Open(), "Failed to create session with name %s", sessionName)
+
+	sessions, err := QuerySessions()
+	s.Require().NoError(err, "Failed to query sessions")
+	var found bool
+	for _, info := range sessions {
+		found = found || info.Name == sessionName
+	}
+	s.True(found, "Session %s not found in %d sessions", sessionName, len(sessions))
+
+	info, err := QuerySession(sessionName)
+	s.Require().NoError(err, "Failed to query session")
+	s.Equal(sessionName, info.Name)
+	s.True(info.IsRealTime())
+	// The OS is free to adjust buffers count, but not to shrink it.
+	s.GreaterOrEqual(info.Options.MaximumBuffers, uint32(64))
+
+	s.Require().NoError(FlushSession(sessionName), "Failed to flush session")
+	s.Require().NoError(UpdateSession(sessionName, TraceOptions{MaximumBuffers: 128}), "Failed to update session")
+
+	info, err = QuerySession(sessionName)
+	s.Require().NoError(err, "Failed to query session")
+	s.GreaterOrEqual(info.Options.MaximumBuffers, uint32(128))
+
+	s.Require().NoError(StopSession(sessionName), "Failed to stop session")
+	_, err = QuerySession(sessionName)
+	s.Error(err, "Session still exists after stop")
+}
+
+// TestLiveProviders ensures providers could be enabled, updated and disabled
+// on a running session.
+func (s *userTraceSuite) TestLiveProviders() {
+	const deadline = 10 * time.Second
+
+	go s.generateEvents(s.ctx, s.provider, []msetw.Level{msetw.LevelInfo, msetw.LevelError})
+
+	var (
+		gotError = make(chan struct{}, 1)
+		gotInfo  = make(chan struct{}, 1)
+	)
+	cb := func(e *Event) {
+		switch e.Header.Level {
+		case uint8(msetw.LevelError):
+			trySignal(gotError)
+		case uint8(msetw.LevelInfo):
+			trySignal(gotInfo)
+		}
+	}
+
+	trace, err := NewUserTrace("Test-ETW", cb)
+	s.Require().NoError(err, "Failed to create trace")
+
+	done := make(chan struct{})
+	go func() {
+		s.Require().NoError(trace.Start(), "Error processing events")
+		close(done)
+	}()
+
+	// Wait a bit for the session to start, Enable before that is fine too.
+	time.Sleep(100 * time.Millisecond)
+	provider := &Provider{ProviderId: s.guid, Level: TRACE_LEVEL_ERROR}
+	s.Require().NoError(trace.Enable(provider), "Failed to enable provider")
+	s.waitForSignal(gotError, deadline, "Failed to receive event from enabled provider")
+
+	provider.Level = TRACE_LEVEL_VERBOSE
+	s.Require().NoError(trace.Update(provider), "Failed to update provider")
+	s.waitForSignal(gotInfo, deadline, "Failed to receive event after level update")
+
+	s.Require().NoError(trace.Disable(provider), "Failed to disable provider")
+
+	s.Require().NoError(trace.Stop(), "Failed to close session properly")
+	s.waitForSignal(done, deadline, "Failed to stop event processing")
+}
+
+// TestProviderFilters ensures provider accepts filters and passes events
+// matching them.
+func (s *userTraceSuite) TestProviderFilters() {
+	const deadline = 10 * time.Second
+
+	go s.generateEvents(s.ctx, s.provider, []msetw.Level{msetw.LevelInfo})
+
+	gotEvent := make(chan struct{}, 1)
+	trace, err := NewUserTrace("Test-ETW", func(e *Event) {
+		if e.Header.ProcessID == uint32(os.Getpid()) {
+			trySignal(gotEvent)
+		}
+	})
+	s.Require().NoError(err, "Failed to create trace")
+
+	provider := NewProvider(s.guid)
+	provider.Filters = []EventFilter{
+		PIDFilter{PIDs: []uint32{uint32(os.Getpid())}},
+		ExecutableNameFilter{Names: []string{filepath.Base(os.Args[0])}},
+	}
+	s.Require().NoError(trace.Enable(provider))
+
+	done := make(chan struct{})
+	go func() {
+		s.Require().NoError(trace.Start(), "Error processing events")
+		close(done)
+	}()
+
+	s.waitForSignal(gotEvent, deadline, "Failed to receive event passing filters")
+	s.Require().NoError(trace.Stop(), "Failed to close session properly")
+	s.waitForSignal(done, deadline, "Failed to stop event processing")
+}
+
 // trySignal tries to send a signal to @done if it's ready to receive.
 // @done expected to be a buffered channel.
 func trySignal(done chan<- struct{}) {
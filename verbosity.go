@@ -0,0 +1,409 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Default VerbosityOptions.
+const (
+	defaultVerbosityWindow   = time.Second
+	defaultVerbosityCooldown = 5 * time.Second
+	defaultRestoreRatio      = 0.5
+)
+
+// VerbosityBudget limits the event rate of a single provider.
+//
+// User providers are stepped down by Level and MatchAnyKeyword. Kernel
+// providers ignore both, so they are stepped down by KernelSteps instead.
+type VerbosityBudget struct {
+	// Provider holds the full settings restored once the rate drops. It
+	// should be enabled in the trace.
+	Provider *Provider
+
+	// OpCodes attribute events to the provider by their class if several
+	// kernel providers share its GUID, e.g. 36 (CSwitch) of
+	// KERNEL_CONTEXT_SWITCH_PROVIDER and 1-4 (thread start and end) of
+	// KERNEL_THREAD_PROVIDER. They are required for budgets of such providers.
+	// All the events of the provider GUID are counted if empty.
+	OpCodes []uint8
+
+	// MaxRate is the allowed number of events per second.
+	MaxRate float64
+
+	// MinLevel is the lowest level the provider is lowered to. Defaults to
+	// TRACE_LEVEL_ERROR.
+	MinLevel TraceLevel
+
+	// KeywordSteps are MatchAnyKeyword masks applied one by one after the
+	// level reaches MinLevel, e.g. masks with less and less keywords.
+	KeywordSteps []uint64
+
+	// KernelSteps are flags of a kernel provider applied one by one, e.g.
+	// PERF_COMPACT_CSWITCH instead of EVENT_TRACE_FLAG_CSWITCH or no flags
+	// at all to pause the provider. They are required for kernel providers.
+	KernelSteps []KernelFlags
+}
+
+// KernelFlags are settings of a kernel provider applied by a verbosity step.
+type KernelFlags struct {
+	EnableFlags uint64
+	GroupMasks  []PerfGroupMask
+}
+
+// VerbosityOptions configure VerbosityController. Zero values stand for
+// defaults.
+type VerbosityOptions struct {
+	// Window is the period event rates are measured for. Defaults to 1s.
+	Window time.Duration
+
+	// Cooldown is the minimal time between adjustments of a provider, so it
+	// has time to take effect. Defaults to 5s.
+	Cooldown time.Duration
+
+	// RestoreRatio is the part of MaxRate the rate should drop below to
+	// restore the previous settings. Defaults to 0.5.
+	RestoreRatio float64
+
+	// OnAdjust is called with every adjustment made.
+	OnAdjust func(VerbosityAdjustment)
+}
+
+// VerbosityAdjustment describes a change of provider settings made by
+// VerbosityController.
+type VerbosityAdjustment struct {
+	ProviderID windows.GUID
+	Time       time.Time
+
+	// Provider is the budget provider, it tells apart kernel providers
+	// sharing ProviderID.
+	Provider *Provider
+
+	// Rate is the measured events per second which caused the adjustment.
+	Rate float64
+
+	// Step is the new step: 0 stands for the full settings and every next
+	// step is more restrictive. Restored is set if the step is decreased.
+	Step     int
+	Restored bool
+
+	// Level and MatchAnyKeyword are the applied settings of user providers,
+	// EnableFlags and GroupMasks of kernel ones.
+	Level           TraceLevel
+	MatchAnyKeyword uint64
+	EnableFlags     uint64
+	GroupMasks      []PerfGroupMask
+
+	// Err is an error of applying the settings. The step is not changed in
+	// this case.
+	Err error
+}
+
+// providerUpdater is a subset of Trace used by VerbosityController.
+type providerUpdater interface {
+	replaceProvider(old, next *Provider) error
+}
+
+// VerbosityController lowers the verbosity of providers flooding the trace
+// and restores it once the flood is over.
+//
+// The controller should observe every event of the trace with Observe or
+// Wrap, which only count them. Rates are measured and providers adjusted by
+// Run every Window, so windows without events are measured as well and the
+// session is never updated from the event callback.
+type VerbosityController struct {
+	// advanceMu serializes measurements and adjustments. Providers are
+	// adjusted without holding mu, so Observe doesn't wait for the session.
+	advanceMu sync.Mutex
+
+	mu sync.Mutex
+
+	trace   providerUpdater
+	options VerbosityOptions
+	states  map[providerKey]*verbosityState
+
+	// byClass and byProvider find the state to count an event in: by the
+	// class for budgets with OpCodes, by the provider GUID otherwise.
+	byClass    map[eventClass]*verbosityState
+	byProvider map[windows.GUID]*verbosityState
+
+	windowStart time.Time
+}
+
+// eventClass is a kernel event class: events of a provider with an opcode.
+type eventClass struct {
+	id     windows.GUID
+	opcode uint8
+}
+
+// verbosityState is a budget of a single provider.
+type verbosityState struct {
+	budget     VerbosityBudget
+	steps      []Provider // The full settings first.
+	step       int
+	count      uint64
+	lastAdjust time.Time
+}
+
+// verbosityChange is a step decided by advance and not applied yet.
+type verbosityChange struct {
+	state *verbosityState
+	from  int
+	rate  float64
+	to    int
+}
+
+// NewVerbosityController creates a controller updating providers of @trace
+// according to @budgets.
+func NewVerbosityController(trace *Trace, options VerbosityOptions, budgets ...VerbosityBudget) (*VerbosityController, error) {
+	return newVerbosityController(trace, options, budgets)
+}
+
+func newVerbosityController(trace providerUpdater, options VerbosityOptions, budgets []VerbosityBudget) (*VerbosityController, error) {
+	if options.Window <= 0 {
+		options.Window = defaultVerbosityWindow
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = defaultVerbosityCooldown
+	}
+	if options.RestoreRatio <= 0 || options.RestoreRatio >= 1 {
+		options.RestoreRatio = defaultRestoreRatio
+	}
+
+	c := &VerbosityController{
+		trace:      trace,
+		options:    options,
+		states:     make(map[providerKey]*verbosityState, len(budgets)),
+		byClass:    make(map[eventClass]*verbosityState),
+		byProvider: make(map[windows.GUID]*verbosityState),
+	}
+	shared := make(map[windows.GUID]int, len(budgets))
+	for _, budget := range budgets {
+		if budget.Provider != nil {
+			shared[budget.Provider.ProviderId]++
+		}
+	}
+	for _, budget := range budgets {
+		if budget.Provider == nil {
+			return nil, fmt.Errorf("budget provider is not set")
+		}
+		id := budget.Provider.ProviderId
+		if budget.MaxRate <= 0 {
+			return nil, fmt.Errorf("invalid MaxRate %v of provider %s", budget.MaxRate, id.String())
+		}
+		key := keyOf(budget.Provider)
+		if _, ok := c.states[key]; ok {
+			return nil, fmt.Errorf("duplicate budget of provider %s", id.String())
+		}
+		if shared[id] > 1 && len(budget.OpCodes) == 0 {
+			return nil, fmt.Errorf("budgets sharing provider %s require OpCodes", id.String())
+		}
+		kernel := isKernelProvider(budget.Provider)
+		if kernel && len(budget.KernelSteps) == 0 {
+			return nil, fmt.Errorf("kernel provider %s requires KernelSteps", budget.Provider.ProviderId.String())
+		}
+		if !kernel && len(budget.KernelSteps) != 0 {
+			return nil, fmt.Errorf("KernelSteps of user provider %s", budget.Provider.ProviderId.String())
+		}
+		if budget.MinLevel == 0 {
+			budget.MinLevel = TRACE_LEVEL_ERROR
+		}
+		state := &verbosityState{
+			budget: budget,
+			steps:  verbositySteps(budget),
+		}
+		c.states[key] = state
+		if len(budget.OpCodes) == 0 {
+			c.byProvider[id] = state
+		}
+		for _, opcode := range budget.OpCodes {
+			class := eventClass{id: id, opcode: opcode}
+			if _, ok := c.byClass[class]; ok {
+				return nil, fmt.Errorf("opcode %d of provider %s is in several budgets", opcode, id.String())
+			}
+			c.byClass[class] = state
+		}
+	}
+	return c, nil
+}
+
+// isKernelProvider tells if @provider is a kernel one, i.e. it's controlled by
+// flags.
+func isKernelProvider(provider *Provider) bool {
+	return provider.EnableFlags != 0 || len(provider.GroupMasks) != 0
+}
+
+// verbositySteps builds the ladder of settings from the full ones: the level
+// is lowered by one down to MinLevel and then keywords are narrowed. Kernel
+// providers take KernelSteps instead.
+func verbositySteps(budget VerbosityBudget) []Provider {
+	full := *budget.Provider
+	steps := []Provider{full}
+	if isKernelProvider(&full) {
+		for _, flags := range budget.KernelSteps {
+			step := full
+			step.EnableFlags = flags.EnableFlags
+			step.GroupMasks = flags.GroupMasks
+			steps = append(steps, step)
+		}
+		return steps
+	}
+	for level := full.Level - 1; level >= budget.MinLevel && level < full.Level; level-- {
+		step := full
+		step.Level = level
+		steps = append(steps, step)
+	}
+	for _, keywords := range budget.KeywordSteps {
+		step := steps[len(steps)-1]
+		step.MatchAnyKeyword = keywords
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// Wrap returns an EventCallback observing events before passing them to
+// @callback.
+func (c *VerbosityController) Wrap(callback EventCallback) EventCallback {
+	return func(e *Event) {
+		c.Observe(&e.Header)
+		callback(e)
+	}
+}
+
+// Observe counts the event.
+func (c *VerbosityController) Observe(header *EventHeader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.byClass[eventClass{id: header.ProviderID, opcode: header.OpCode}]
+	if !ok {
+		state, ok = c.byProvider[header.ProviderID]
+	}
+	if ok {
+		state.count++
+	}
+}
+
+// Step returns the current step of the budget @provider.
+func (c *VerbosityController) Step(provider *Provider) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state, ok := c.states[keyOf(provider)]; ok {
+		return state.step
+	}
+	return 0
+}
+
+// Run measures rates and adjusts providers every Window until @ctx is done.
+//
+// Run blocks, so it's expected to be run in a separate goroutine.
+func (c *VerbosityController) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.options.Window)
+	defer ticker.Stop()
+
+	c.Advance(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.Advance(now)
+		}
+	}
+}
+
+// Advance closes the measurement window if @now is past it and adjusts
+// providers out of their budgets. The first call starts the window. Run
+// calls it by the clock.
+func (c *VerbosityController) Advance(now time.Time) {
+	c.advanceMu.Lock()
+	defer c.advanceMu.Unlock()
+
+	c.mu.Lock()
+	changes := c.advance(now)
+	c.mu.Unlock()
+
+	for _, change := range changes {
+		c.apply(change, now)
+	}
+}
+
+// advance measures rates of the window ended by @now and decides on steps.
+// Should be called with mu held.
+func (c *VerbosityController) advance(now time.Time) []verbosityChange {
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+		return nil
+	}
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.options.Window {
+		return nil
+	}
+
+	var changes []verbosityChange
+	for _, state := range c.states {
+		rate := float64(state.count) / elapsed.Seconds()
+		state.count = 0
+		if next, ok := c.evaluate(state, rate, now); ok {
+			state.lastAdjust = now
+			changes = append(changes, verbosityChange{state: state, from: state.step, rate: rate, to: next})
+		}
+	}
+	c.windowStart = now
+	return changes
+}
+
+// evaluate returns the step one up or down the ladder if @rate is out of the
+// budget.
+func (c *VerbosityController) evaluate(state *verbosityState, rate float64, now time.Time) (int, bool) {
+	if !state.lastAdjust.IsZero() && now.Sub(state.lastAdjust) < c.options.Cooldown {
+		return 0, false
+	}
+	switch {
+	case rate > state.budget.MaxRate && state.step < len(state.steps)-1:
+		return state.step + 1, true
+	case rate < state.budget.MaxRate*c.options.RestoreRatio && state.step > 0:
+		return state.step - 1, true
+	default:
+		return 0, false
+	}
+}
+
+// apply updates the provider with the settings of the new step. Steps are
+// changed by Advance only, so the step @change is made from is still
+// current.
+func (c *VerbosityController) apply(change verbosityChange, now time.Time) {
+	state := change.state
+	settings := state.steps[change.to]
+	adjustment := VerbosityAdjustment{
+		ProviderID:      settings.ProviderId,
+		Time:            now,
+		Provider:        state.budget.Provider,
+		Rate:            change.rate,
+		Step:            change.to,
+		Restored:        change.to < change.from,
+		Level:           settings.Level,
+		MatchAnyKeyword: settings.MatchAnyKeyword,
+		EnableFlags:     settings.EnableFlags,
+		GroupMasks:      settings.GroupMasks,
+	}
+	if err := c.trace.replaceProvider(&state.steps[change.from], &settings); err != nil {
+		adjustment.Err = err
+	} else {
+		c.mu.Lock()
+		state.step = change.to
+		c.mu.Unlock()
+	}
+
+	if c.options.OnAdjust != nil {
+		c.options.OnAdjust(adjustment)
+	}
+}
@@ -0,0 +1,267 @@
+//go:build windows
+// +build windows
+
+package etw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestVerbosity(t *testing.T) {
+	suite.Run(t, new(verbositySuite))
+}
+
+type verbositySuite struct {
+	suite.Suite
+
+	base        time.Time
+	updates     []Provider
+	updateErr   error
+	adjustments []VerbosityAdjustment
+}
+
+func (s *verbositySuite) SetupTest() {
+	s.base = time.Unix(1600000000, 0)
+	s.updates, s.updateErr, s.adjustments = nil, nil, nil
+}
+
+func (s *verbositySuite) replaceProvider(old, next *Provider) error {
+	if s.updateErr != nil {
+		return s.updateErr
+	}
+	s.updates = append(s.updates, *next)
+	return nil
+}
+
+func (s *verbositySuite) newController(budgets ...VerbosityBudget) *VerbosityController {
+	c, err := newVerbosityController(s, VerbosityOptions{
+		Window:   time.Second,
+		Cooldown: 2 * time.Second,
+		OnAdjust: func(a VerbosityAdjustment) { s.adjustments = append(s.adjustments, a) },
+	}, budgets)
+	s.Require().NoError(err)
+	c.Advance(s.base)
+	return c
+}
+
+// emit feeds @rate events per second of testProviderA for @seconds starting
+// at @from seconds after base and advances the clock every second. Returns
+// the next second.
+func (s *verbositySuite) emit(c *VerbosityController, from, seconds, rate int) int {
+	return s.emitEvents(c, EventHeader{ProviderID: testProviderA}, from, seconds, rate)
+}
+
+func (s *verbositySuite) emitEvents(c *VerbosityController, header EventHeader, from, seconds, rate int) int {
+	for sec := from; sec < from+seconds; sec++ {
+		for i := 0; i < rate; i++ {
+			c.Observe(&header)
+		}
+		// Events of other providers are not counted.
+		c.Observe(&EventHeader{ProviderID: testProviderB})
+		c.Advance(s.base.Add(time.Duration(sec+1) * time.Second))
+	}
+	return from + seconds
+}
+
+// TestStorm ensures the level is lowered step by step while the rate is over
+// the budget and restored after the storm.
+func (s *verbositySuite) TestStorm() {
+	provider := NewProvider(testProviderA)
+	provider.MatchAnyKeyword = 0xFF
+	c := s.newController(VerbosityBudget{
+		Provider:     provider,
+		MaxRate:      100,
+		MinLevel:     TRACE_LEVEL_WARNING,
+		KeywordSteps: []uint64{0x0F},
+	})
+
+	// Within the budget.
+	next := s.emit(c, 0, 5, 50)
+	s.Empty(s.adjustments)
+
+	// Storm: steps are taken no faster than the cooldown allows.
+	next = s.emit(c, next, 10, 500)
+	s.Require().Len(s.adjustments, 3)
+	s.Equal(TRACE_LEVEL_INFORMATION, s.adjustments[0].Level)
+	s.Equal(TRACE_LEVEL_WARNING, s.adjustments[1].Level)
+	s.Equal(uint64(0x0F), s.adjustments[2].MatchAnyKeyword)
+	s.Equal(3, c.Step(provider))
+	for _, a := range s.adjustments {
+		s.False(a.Restored)
+		s.Greater(a.Rate, 100.0)
+	}
+	s.True(s.adjustments[1].Time.Sub(s.adjustments[0].Time) >= 2*time.Second)
+
+	// The rest of the storm can't go further.
+	next = s.emit(c, next, 5, 500)
+	s.Len(s.adjustments, 3)
+
+	// Rate between RestoreRatio and MaxRate keeps settings.
+	next = s.emit(c, next, 5, 80)
+	s.Len(s.adjustments, 3)
+
+	// Calm: everything is restored.
+	s.emit(c, next, 10, 10)
+	s.Require().Len(s.adjustments, 6)
+	s.True(s.adjustments[5].Restored)
+	s.Equal(0, c.Step(provider))
+	s.Equal(*provider, s.updates[len(s.updates)-1])
+}
+
+// TestKernel ensures kernel providers are stepped by flags.
+func (s *verbositySuite) TestKernel() {
+	provider := NewKernelProvider(testProviderA, KERNEL_CONTEXT_SWITCH_PROVIDER.EnableFlags)
+	c := s.newController(VerbosityBudget{
+		Provider: provider,
+		MaxRate:  100,
+		KernelSteps: []KernelFlags{
+			{GroupMasks: []PerfGroupMask{PERF_COMPACT_CSWITCH}},
+			{},
+		},
+	})
+
+	next := s.emit(c, 0, 6, 500)
+	s.Require().Len(s.adjustments, 2)
+	s.Equal(KernelFlags{GroupMasks: []PerfGroupMask{PERF_COMPACT_CSWITCH}}, kernelFlagsOf(s.updates[0]))
+	s.Equal(KernelFlags{}, kernelFlagsOf(s.updates[1]))
+	s.Equal(uint64(0), s.adjustments[1].EnableFlags)
+	s.Equal(2, c.Step(provider))
+
+	s.emit(c, next, 6, 10)
+	s.Require().Len(s.adjustments, 4)
+	s.Equal(*provider, s.updates[len(s.updates)-1])
+}
+
+// TestPaused ensures a provider paused by a step without flags is restored
+// though it writes no events to measure.
+func (s *verbositySuite) TestPaused() {
+	provider := NewKernelProvider(testProviderA, KERNEL_CONTEXT_SWITCH_PROVIDER.EnableFlags)
+	c := s.newController(VerbosityBudget{Provider: provider, MaxRate: 100, KernelSteps: []KernelFlags{{}}})
+
+	s.emit(c, 0, 1, 500)
+	s.Require().Len(s.adjustments, 1)
+	s.Equal(1, c.Step(provider))
+
+	for sec := 2; sec <= 4; sec++ {
+		c.Advance(s.base.Add(time.Duration(sec) * time.Second))
+	}
+	s.Require().Len(s.adjustments, 2)
+	s.True(s.adjustments[1].Restored)
+	s.Zero(s.adjustments[1].Rate)
+	s.Equal(*provider, s.updates[1])
+}
+
+// TestSharedGUID ensures kernel providers sharing a GUID are measured by
+// their event classes.
+func (s *verbositySuite) TestSharedGUID() {
+	cswitch := NewKernelProvider(testProviderA, KERNEL_CONTEXT_SWITCH_PROVIDER.EnableFlags)
+	thread := NewKernelProvider(testProviderA, KERNEL_THREAD_PROVIDER.EnableFlags)
+	c := s.newController(
+		VerbosityBudget{Provider: cswitch, OpCodes: []uint8{36}, MaxRate: 100, KernelSteps: []KernelFlags{{}}},
+		VerbosityBudget{Provider: thread, OpCodes: []uint8{1, 2, 3, 4}, MaxRate: 100, KernelSteps: []KernelFlags{{}}},
+	)
+
+	header := EventHeader{ProviderID: testProviderA}
+	header.OpCode = 36
+	s.emitEvents(c, header, 0, 1, 500)
+	s.Require().Len(s.adjustments, 1)
+	s.Equal(cswitch, s.adjustments[0].Provider)
+	s.Equal(1, c.Step(cswitch))
+	s.Equal(0, c.Step(thread))
+}
+
+// TestRun ensures providers are adjusted by the clock.
+func (s *verbositySuite) TestRun() {
+	adjustments := make(chan VerbosityAdjustment, 16)
+	c, err := newVerbosityController(&fakeProviderUpdater{}, VerbosityOptions{
+		Window:   10 * time.Millisecond,
+		Cooldown: 10 * time.Millisecond,
+		OnAdjust: func(a VerbosityAdjustment) { adjustments <- a },
+	}, []VerbosityBudget{{Provider: NewProvider(testProviderA), MaxRate: 1}})
+	s.Require().NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 100; i++ {
+		c.Observe(&EventHeader{ProviderID: testProviderA})
+	}
+	select {
+	case a := <-adjustments:
+		s.False(a.Restored)
+	case <-time.After(5 * time.Second):
+		s.FailNow("Provider is not adjusted")
+	}
+	select {
+	case a := <-adjustments:
+		s.True(a.Restored, "Restored without events")
+	case <-time.After(5 * time.Second):
+		s.FailNow("Provider is not restored")
+	}
+}
+
+// fakeProviderUpdater accepts every update.
+type fakeProviderUpdater struct{}
+
+func (fakeProviderUpdater) replaceProvider(old, next *Provider) error {
+	return nil
+}
+
+func kernelFlagsOf(p Provider) KernelFlags {
+	return KernelFlags{EnableFlags: p.EnableFlags, GroupMasks: p.GroupMasks}
+}
+
+// TestUpdateError ensures failed updates are reported and don't change the
+// step.
+func (s *verbositySuite) TestUpdateError() {
+	provider := NewProvider(testProviderA)
+	c := s.newController(VerbosityBudget{Provider: provider, MaxRate: 10})
+	s.updateErr = errors.New("access denied")
+
+	s.emit(c, 0, 3, 100)
+	s.Require().NotEmpty(s.adjustments)
+	s.Equal(s.updateErr, s.adjustments[0].Err)
+	s.Equal(0, c.Step(provider))
+}
+
+// TestValidation ensures invalid budgets are rejected.
+func (s *verbositySuite) TestValidation() {
+	invalid := [][]VerbosityBudget{
+		{{MaxRate: 1}},
+		{{Provider: NewProvider(testProviderA)}},
+		{
+			{Provider: NewProvider(testProviderA), MaxRate: 1},
+			{Provider: NewProvider(testProviderA), MaxRate: 2},
+		},
+		{{Provider: KERNEL_CONTEXT_SWITCH_PROVIDER, MaxRate: 1}},
+		{{Provider: NewProvider(testProviderA), MaxRate: 1, KernelSteps: []KernelFlags{{}}}},
+		{
+			{Provider: KERNEL_CONTEXT_SWITCH_PROVIDER, MaxRate: 1, KernelSteps: []KernelFlags{{}}},
+			{Provider: KERNEL_THREAD_PROVIDER, MaxRate: 1, KernelSteps: []KernelFlags{{}}},
+		},
+		{
+			{Provider: KERNEL_CONTEXT_SWITCH_PROVIDER, OpCodes: []uint8{36}, MaxRate: 1, KernelSteps: []KernelFlags{{}}},
+			{Provider: KERNEL_THREAD_PROVIDER, OpCodes: []uint8{1, 36}, MaxRate: 1, KernelSteps: []KernelFlags{{}}},
+		},
+	}
+	for _, budgets := range invalid {
+		_, err := newVerbosityController(s, VerbosityOptions{}, budgets)
+		s.Error(err)
+	}
+
+	steps := verbositySteps(VerbosityBudget{Provider: NewProvider(testProviderA), MinLevel: TRACE_LEVEL_ERROR})
+	s.Len(steps, 4, "VERBOSE, INFORMATION, WARNING and ERROR")
+}